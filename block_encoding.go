@@ -0,0 +1,299 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/ed25519"
+)
+
+// The binary block encoding is a compact on-disk alternative to a block's JSON encoding.
+//
+// format: {magic}{version}{codec}{body}
+//
+// body: {header}{tx count}[{tx offset}...][{tx}...]
+//
+// The header is fixed length: previous, hash list root, target and chain work followed by the
+// time, nonce and height as big-endian int64s and the transaction count as a big-endian int32.
+// The tx count and offsets are big-endian uint32s. Each offset is where a transaction starts
+// relative to the first one so a single transaction can be read without decoding the block.
+// Transactions encode integers as varints and byte strings with a uvarint length prefix.
+//
+// If the codec is blockCodecZstd each transaction is a separate zstd frame. The header and offsets
+// aren't compressed so a single transaction is still read without decoding the others.
+
+const blockBinaryMagic = "CRUZBLK"
+
+// the current version of the binary block encoding
+const blockBinaryVersion = 1
+
+// body compression codecs
+const (
+	blockCodecNone = 0
+	blockCodecZstd = 1
+)
+
+// zstd encoders and decoders are safe for concurrent use with EncodeAll and DecodeAll
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// the codec newly stored binary blocks are compressed with
+func blockBinaryCodec(compress bool) byte {
+	if compress {
+		return blockCodecZstd
+	}
+	return blockCodecNone
+}
+
+const blockBinaryPrefixLength = len(blockBinaryMagic) + 2
+
+const blockBinaryHeaderLength = 4*len(BlockID{}) + 3*8 + 4
+
+// encodeBlockBinary returns the binary encoding of the block with its transactions compressed by codec.
+func encodeBlockBinary(block *Block, codec byte) ([]byte, error) {
+	if codec != blockCodecNone && codec != blockCodecZstd {
+		return nil, fmt.Errorf("Unsupported binary block codec %d", codec)
+	}
+
+	txs := new(bytes.Buffer)
+	offsets := make([]byte, 4*len(block.Transactions))
+	for i, tx := range block.Transactions {
+		binary.BigEndian.PutUint32(offsets[4*i:], uint32(txs.Len()))
+		if codec == blockCodecZstd {
+			encoded := new(bytes.Buffer)
+			encodeTransactionBinary(encoded, tx)
+			txs.Write(zstdEncoder.EncodeAll(encoded.Bytes(), nil))
+		} else {
+			encodeTransactionBinary(txs, tx)
+		}
+	}
+
+	body := new(bytes.Buffer)
+	header := block.Header
+	body.Write(header.Previous[:])
+	body.Write(header.HashListRoot[:])
+	body.Write(header.Target[:])
+	body.Write(header.ChainWork[:])
+	var fixed [3*8 + 4 + 4]byte
+	binary.BigEndian.PutUint64(fixed[0:], uint64(header.Time))
+	binary.BigEndian.PutUint64(fixed[8:], uint64(header.Nonce))
+	binary.BigEndian.PutUint64(fixed[16:], uint64(header.Height))
+	binary.BigEndian.PutUint32(fixed[24:], uint32(header.TransactionCount))
+	binary.BigEndian.PutUint32(fixed[28:], uint32(len(block.Transactions)))
+	body.Write(fixed[:])
+	body.Write(offsets)
+	body.Write(txs.Bytes())
+
+	out := new(bytes.Buffer)
+	out.WriteString(blockBinaryMagic)
+	out.WriteByte(blockBinaryVersion)
+	out.WriteByte(codec)
+	out.Write(body.Bytes())
+	return out.Bytes(), nil
+}
+
+// decodeBlockBinary decodes a block from its binary encoding.
+func decodeBlockBinary(encoded []byte) (*Block, error) {
+	body, codec, err := blockBinaryBody(bytes.NewReader(encoded), int64(len(encoded)))
+	if err != nil {
+		return nil, err
+	}
+	header, count, err := readBlockBinaryHeader(body)
+	if err != nil {
+		return nil, err
+	}
+	block := &Block{Header: header, Transactions: make([]*Transaction, count)}
+	for i := range block.Transactions {
+		tx, err := readBlockBinaryTransaction(body, codec, count, i)
+		if err != nil {
+			return nil, err
+		}
+		block.Transactions[i] = tx
+	}
+	return block, nil
+}
+
+// transactionFromBlockBinary reads the transaction at index and the header from a block's binary
+// encoding of the given size without decoding the other transactions.
+func transactionFromBlockBinary(r io.ReaderAt, size int64, index int) (*Transaction, *BlockHeader, error) {
+	body, codec, err := blockBinaryBody(r, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	header, count, err := readBlockBinaryHeader(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if index < 0 || index >= count {
+		return nil, nil, fmt.Errorf("Transaction index %d out of range, block has %d", index, count)
+	}
+	tx, err := readBlockBinaryTransaction(body, codec, count, index)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tx, header, nil
+}
+
+// check the prefix and return a reader of the body and the codec its transactions are compressed with
+func blockBinaryBody(r io.ReaderAt, size int64) (*io.SectionReader, byte, error) {
+	var prefix [blockBinaryPrefixLength]byte
+	if _, err := r.ReadAt(prefix[:], 0); err != nil {
+		return nil, 0, err
+	}
+	if string(prefix[:len(blockBinaryMagic)]) != blockBinaryMagic {
+		return nil, 0, fmt.Errorf("Not a binary encoded block")
+	}
+	if version := prefix[len(blockBinaryMagic)]; version != blockBinaryVersion {
+		return nil, 0, fmt.Errorf("Unsupported binary block version %d", version)
+	}
+	codec := prefix[len(blockBinaryMagic)+1]
+	if codec != blockCodecNone && codec != blockCodecZstd {
+		return nil, 0, fmt.Errorf("Unsupported binary block codec %d", codec)
+	}
+	return io.NewSectionReader(r, int64(len(prefix)), size-int64(len(prefix))), codec, nil
+}
+
+// read the block header and the number of transactions from the body
+func readBlockBinaryHeader(body *io.SectionReader) (*BlockHeader, int, error) {
+	var encoded [blockBinaryHeaderLength + 4]byte
+	if _, err := body.ReadAt(encoded[:], 0); err != nil {
+		return nil, 0, err
+	}
+	header := new(BlockHeader)
+	n := len(BlockID{})
+	copy(header.Previous[:], encoded[0:])
+	copy(header.HashListRoot[:], encoded[n:])
+	copy(header.Target[:], encoded[2*n:])
+	copy(header.ChainWork[:], encoded[3*n:])
+	fixed := encoded[4*n:]
+	header.Time = int64(binary.BigEndian.Uint64(fixed[0:]))
+	header.Nonce = int64(binary.BigEndian.Uint64(fixed[8:]))
+	header.Height = int64(binary.BigEndian.Uint64(fixed[16:]))
+	header.TransactionCount = int32(binary.BigEndian.Uint32(fixed[24:]))
+	count := int(binary.BigEndian.Uint32(fixed[28:]))
+
+	// sanity check the count against the space the offsets would need
+	if int64(count) > (body.Size()-int64(len(encoded)))/4 {
+		return nil, 0, fmt.Errorf("Invalid binary block transaction count %d", count)
+	}
+	return header, count, nil
+}
+
+// read the transaction at index from the body using the offset table
+func readBlockBinaryTransaction(body *io.SectionReader, codec byte, count, index int) (*Transaction, error) {
+	offsetsStart := int64(blockBinaryHeaderLength + 4)
+	txsStart := offsetsStart + 4*int64(count)
+
+	var offsets [8]byte
+	n := 8
+	if index == count-1 {
+		// the last one runs to the end
+		n = 4
+	}
+	if _, err := body.ReadAt(offsets[:n], offsetsStart+4*int64(index)); err != nil {
+		return nil, err
+	}
+	start := txsStart + int64(binary.BigEndian.Uint32(offsets[:4]))
+	end := body.Size()
+	if n == 8 {
+		end = txsStart + int64(binary.BigEndian.Uint32(offsets[4:]))
+	}
+	if start > end || end > body.Size() {
+		return nil, fmt.Errorf("Invalid binary block transaction offset")
+	}
+
+	encoded := make([]byte, end-start)
+	if _, err := body.ReadAt(encoded, start); err != nil {
+		return nil, err
+	}
+	if codec == blockCodecZstd {
+		// uncompress
+		var err error
+		if encoded, err = zstdDecoder.DecodeAll(encoded, nil); err != nil {
+			return nil, err
+		}
+	}
+	return decodeTransactionBinary(encoded)
+}
+
+func encodeTransactionBinary(buf *bytes.Buffer, tx *Transaction) {
+	var scratch [binary.MaxVarintLen64]byte
+	putVarint := func(v int64) {
+		buf.Write(scratch[:binary.PutVarint(scratch[:], v)])
+	}
+	putBytes := func(b []byte) {
+		buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(b)))])
+		buf.Write(b)
+	}
+	putVarint(tx.Time)
+	putVarint(int64(tx.Nonce))
+	putBytes(tx.From)
+	putBytes(tx.To)
+	putVarint(tx.Amount)
+	putVarint(tx.Fee)
+	putBytes([]byte(tx.Memo))
+	putVarint(tx.Matures)
+	putVarint(tx.Expires)
+	putVarint(tx.Series)
+	putBytes(tx.Signature)
+}
+
+func decodeTransactionBinary(encoded []byte) (*Transaction, error) {
+	r := bytes.NewReader(encoded)
+	var err error
+	getVarint := func() int64 {
+		if err != nil {
+			return 0
+		}
+		var v int64
+		v, err = binary.ReadVarint(r)
+		return v
+	}
+	getBytes := func() []byte {
+		if err != nil {
+			return nil
+		}
+		var n uint64
+		if n, err = binary.ReadUvarint(r); err != nil {
+			return nil
+		}
+		if n > uint64(r.Len()) {
+			err = io.ErrUnexpectedEOF
+			return nil
+		}
+		if n == 0 {
+			return nil
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		return b
+	}
+
+	tx := new(Transaction)
+	tx.Time = getVarint()
+	tx.Nonce = int32(getVarint())
+	tx.From = ed25519.PublicKey(getBytes())
+	tx.To = ed25519.PublicKey(getBytes())
+	tx.Amount = getVarint()
+	tx.Fee = getVarint()
+	tx.Memo = string(getBytes())
+	tx.Matures = getVarint()
+	tx.Expires = getVarint()
+	tx.Series = getVarint()
+	tx.Signature = Signature(getBytes())
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("Unexpected %d bytes after binary transaction", r.Len())
+	}
+	return tx, nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func makeTestEncodingBlock(t *testing.T) (*Block, BlockID) {
+	params := RegTestParams
+	genesis, genesisID, err := params.GenesisBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey2, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := NewTransaction(pubKey, pubKey2, 1234, 5, 0, 10, 1, "a memo")
+	if err := tx.Sign(privKey); err != nil {
+		t.Fatal(err)
+	}
+	tx2 := NewTransaction(pubKey, pubKey2, -1, 0, 2, 0, 1, "")
+	return mineTestBlock(t, genesis, genesisID, pubKey, tx, tx2)
+}
+
+func TestBlockBinaryEncoding(t *testing.T) {
+	block, id := makeTestEncodingBlock(t)
+	expect, err := json.Marshal(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, codec := range []byte{blockCodecNone, blockCodecZstd} {
+		encoded, err := encodeBlockBinary(block, codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(encoded) >= len(expect) {
+			t.Fatalf("Expected binary encoding to be smaller than JSON, %d >= %d", len(encoded), len(expect))
+		}
+
+		// round trip
+		decoded, err := decodeBlockBinary(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := json.Marshal(decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(found, expect) {
+			t.Fatalf("Decoded block doesn't match, codec: %d", codec)
+		}
+		decodedID, err := decoded.ID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decodedID != id {
+			t.Fatal("Decoded block ID doesn't match")
+		}
+
+		// single transactions
+		for i, tx := range block.Transactions {
+			found, header, err := transactionFromBlockBinary(bytes.NewReader(encoded), int64(len(encoded)), i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			txID, _ := tx.ID()
+			foundID, _ := found.ID()
+			if foundID != txID || *header != *block.Header {
+				t.Fatalf("Transaction %d doesn't match, codec: %d", i, codec)
+			}
+		}
+		if _, _, err := transactionFromBlockBinary(
+			bytes.NewReader(encoded), int64(len(encoded)), len(block.Transactions)); err == nil {
+			t.Fatal("Expected an error for an out of range transaction")
+		}
+	}
+
+	// compressed transactions are read without uncompressing the others
+	encoded, err := encodeBlockBinary(block, blockCodecZstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txsStart := blockBinaryPrefixLength + blockBinaryHeaderLength + 4 + 4*len(block.Transactions)
+	for i := 0; i < 8; i++ {
+		encoded[txsStart+i] ^= 0xff
+	}
+	if _, err := decodeBlockBinary(encoded); err == nil {
+		t.Fatal("Expected an error decoding a corrupt transaction")
+	}
+	found, _, err := transactionFromBlockBinary(bytes.NewReader(encoded), int64(len(encoded)), 1)
+	if err != nil || found.Memo != "a memo" {
+		t.Fatalf("Expected to read the intact transaction, found %v", err)
+	}
+
+	if _, err := decodeBlockBinary(expect); err == nil {
+		t.Fatal("Expected an error decoding JSON as binary")
+	}
+	if _, err := encodeBlockBinary(block, blockCodecZstd+1); err == nil {
+		t.Fatal("Expected an error for an unknown codec")
+	}
+}
+
+func TestBlockStorageDiskEncodings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encodings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// store a block with each encoding and read them all back with the last
+	blocksPath, dbPath := filepath.Join(dir, "blocks"), filepath.Join(dir, "headers.db")
+	var blocks []*Block
+	var ids []BlockID
+	for _, options := range [][2]bool{{false, false}, {true, false}, {false, true}, {true, true}} {
+		blockStore, err := NewBlockStorageDisk(blocksPath, dbPath, false, options[0], options[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, id := makeTestEncodingBlock(t)
+		if err := blockStore.Store(id, block, 0); err != nil {
+			t.Fatal(err)
+		}
+		blocks, ids = append(blocks, block), append(ids, id)
+		if err := blockStore.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blockStore, err := NewBlockStorageDisk(blocksPath, dbPath, false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockStore.Close()
+	for i, id := range ids {
+		expect, err := json.Marshal(blocks[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := blockStore.GetBlockBytes(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(found, expect) {
+			t.Fatalf("Block %d doesn't match", i)
+		}
+		block, err := blockStore.GetBlock(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *block.Header != *blocks[i].Header || len(block.Transactions) != 3 {
+			t.Fatalf("Block %d doesn't match", i)
+		}
+		tx, header, err := blockStore.GetTransaction(id, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tx.Memo != "a memo" || *header != *blocks[i].Header {
+			t.Fatalf("Transaction of block %d doesn't match", i)
+		}
+	}
+
+	// pruning removes any encoding
+	for i, id := range ids {
+		if err := blockStore.PruneBlock(id, int64(i)); err != nil {
+			t.Fatal(err)
+		}
+		if block, err := blockStore.GetBlockBytes(id); err != nil || block != nil {
+			t.Fatalf("Expected block %d to be pruned, found %v", i, err)
+		}
+	}
+	if infos, err := ioutil.ReadDir(blocksPath); err != nil || len(infos) != 0 {
+		t.Fatalf("Expected no block files, found %d %v", len(infos), err)
+	}
+}
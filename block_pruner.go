@@ -0,0 +1,154 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// log progress every this many pruned blocks
+const pruneProgressInterval = 1000
+
+// MinPruneDepth returns the fewest blocks below the tip whose bodies must be kept. The ledger reads
+// them when connecting and disconnecting blocks and when validating reorganizations of up to
+// maxReorgDepth blocks. Pruning requires a reorganization depth limit.
+func MinPruneDepth(params *ChainParams, maxReorgDepth int64) int64 {
+	return SnapshotWindow(params, maxReorgDepth)
+}
+
+// LowestAvailableHeight returns the lowest main chain height whose block body is available in
+// block storage. It's zero unless block bodies have been pruned.
+func LowestAvailableHeight(blockStore BlockStorage) (int64, error) {
+	prunable, ok := blockStore.(PrunableBlockStorage)
+	if !ok {
+		return 0, nil
+	}
+	prunedHeight, err := prunable.GetPrunedHeight()
+	if err != nil {
+		return 0, err
+	}
+	return prunedHeight + 1, nil
+}
+
+// BlockPruner deletes the bodies of main chain blocks more than a configured depth below the tip.
+// Block headers are kept. If an indexer is given blocks aren't pruned until the index state which
+// no longer needs them has been saved.
+type BlockPruner struct {
+	blockStore   PrunableBlockStorage
+	ledger       Ledger
+	processor    *Processor
+	indexer      *Indexer
+	depth        int64
+	shutdownChan chan struct{}
+	wg           sync.WaitGroup
+}
+
+// NewBlockPruner returns a new BlockPruner which keeps the bodies of the depth most recent main chain blocks.
+func NewBlockPruner(blockStore PrunableBlockStorage, ledger Ledger, processor *Processor, indexer *Indexer,
+	depth int64) *BlockPruner {
+	return &BlockPruner{
+		blockStore:   blockStore,
+		ledger:       ledger,
+		processor:    processor,
+		indexer:      indexer,
+		depth:        depth,
+		shutdownChan: make(chan struct{}),
+	}
+}
+
+// Run executes the pruner's main loop in its own goroutine.
+func (p *BlockPruner) Run() {
+	p.wg.Add(1)
+	go p.run()
+}
+
+func (p *BlockPruner) run() {
+	defer p.wg.Done()
+
+	// register for tip changes
+	tipChangeChan := make(chan TipChange, 1)
+	p.processor.RegisterForTipChange(tipChangeChan)
+	defer p.processor.UnregisterForTipChange(tipChangeChan)
+
+	if _, err := p.PruneBlocks(); err != nil {
+		log.Printf("Error pruning blocks: %s\n", err)
+	}
+
+	for {
+		select {
+		case tip := <-tipChangeChan:
+			if !tip.Connect || tip.More {
+				continue
+			}
+			if _, err := p.PruneBlocks(); err != nil {
+				log.Printf("Error pruning blocks: %s\n", err)
+			}
+		case _, ok := <-p.shutdownChan:
+			if !ok {
+				log.Printf("Block pruner shutting down...\n")
+				return
+			}
+		}
+	}
+}
+
+// PruneBlocks synchronously prunes the bodies of the main chain blocks which are now deep enough.
+// Returns the number of blocks pruned.
+func (p *BlockPruner) PruneBlocks() (int64, error) {
+	_, tipHeight, err := p.ledger.GetChainTip()
+	if err != nil {
+		return 0, err
+	}
+	maxHeight := tipHeight - p.depth
+	if p.indexer != nil {
+		if savedHeight := p.indexer.SavedHeight(); savedHeight < maxHeight {
+			maxHeight = savedHeight
+		}
+	}
+
+	prunedHeight, err := p.blockStore.GetPrunedHeight()
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	for height := prunedHeight + 1; height <= maxHeight; height++ {
+		select {
+		case <-p.shutdownChan:
+			return count, nil
+		default:
+		}
+
+		id, err := p.ledger.GetBlockIDForHeight(height)
+		if err != nil {
+			return count, err
+		}
+		if id == nil {
+			// a ledger started from a snapshot doesn't have the earlier blocks
+			continue
+		}
+		if err := p.blockStore.PruneBlock(*id, height); err != nil {
+			return count, fmt.Errorf("Error pruning block %s at height %d: %s", *id, height, err)
+		}
+		count++
+
+		if count%pruneProgressInterval == 0 {
+			log.Printf("Pruned %d blocks, height: %d\n", count, height)
+		}
+	}
+
+	if count != 0 {
+		log.Printf("Pruned %d block(s) through height %d\n", count, maxHeight)
+	}
+	return count, nil
+}
+
+// Shutdown stops the pruner synchronously.
+func (p *BlockPruner) Shutdown() {
+	close(p.shutdownChan)
+	p.wg.Wait()
+	log.Printf("Block pruner shutdown\n")
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestBlockPruner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pruner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	params := RegTestParams
+	genesis, genesisID, err := params.GenesisBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// register a name at height 2
+	blocks, ids := []*Block{genesis}, []BlockID{genesisID}
+	for height := int64(1); height <= 6; height++ {
+		var txs []*Transaction
+		if height == 2 {
+			tx := NewTransaction(pubKey, makeTestPathKey(t, "//alice//"), 1, MinFeeCruzbits, 0, 0, height, "")
+			if err := tx.Sign(privKey); err != nil {
+				t.Fatal(err)
+			}
+			txs = append(txs, tx)
+		}
+		block, id := mineTestBlock(t, blocks[height-1], ids[height-1], pubKey, txs...)
+		blocks, ids = append(blocks, block), append(ids, id)
+	}
+	node := newTestSnapshotNode(t, params, dir)
+	defer node.close()
+	node.connect(t, ids, blocks)
+
+	// nothing is pruned until the index state has been saved
+	stateDir := filepath.Join(dir, "index")
+	indexer := NewIndexer(params, node.blockStore, node.ledger, nil, genesisID, stateDir)
+	if err := indexer.AddModule(NewNameIndex()); err != nil {
+		t.Fatal(err)
+	}
+	pruner := NewBlockPruner(node.blockStore, node.ledger, nil, indexer, 2)
+	if count, err := pruner.PruneBlocks(); err != nil || count != 0 {
+		t.Fatalf("Expected nothing pruned, found %d %v", count, err)
+	}
+	if err := indexer.IndexChain(); err != nil {
+		t.Fatal(err)
+	}
+	if indexer.SavedHeight() != 6 {
+		t.Fatalf("Expected index state saved at height 6, found %d", indexer.SavedHeight())
+	}
+
+	// keep the 2 most recent blocks
+	if count, err := pruner.PruneBlocks(); err != nil || count != 5 {
+		t.Fatalf("Expected 5 blocks pruned, found %d %v", count, err)
+	}
+	if lowest, err := LowestAvailableHeight(node.blockStore); err != nil || lowest != 5 {
+		t.Fatalf("Expected lowest available height 5, found %d %v", lowest, err)
+	}
+	for i, id := range ids {
+		blockBytes, err := node.blockStore.GetBlockBytes(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, _, err := node.blockStore.GetBlockHeader(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header == nil || (blockBytes == nil) != (i < 5) {
+			t.Fatalf("Unexpected block %d, header: %v, pruned: %v", i, header != nil, blockBytes == nil)
+		}
+	}
+	var headers int
+	if err := node.blockStore.ForEachBlockHeader(func(BlockID, *BlockHeader, int64) error {
+		headers++
+		return nil
+	}); err != nil || headers != 7 {
+		t.Fatalf("Expected 7 headers, found %d %v", headers, err)
+	}
+
+	// the index resumes from its saved state
+	names := NewNameIndex()
+	resumed := NewIndexer(params, node.blockStore, node.ledger, nil, genesisID, stateDir)
+	if err := resumed.AddModule(names); err != nil {
+		t.Fatal(err)
+	}
+	if err := resumed.IndexChain(); err != nil {
+		t.Fatal(err)
+	}
+	checkTestName(t, names, "alice", pubKey)
+
+	// but can't be rebuilt without it
+	rebuilt := NewIndexer(params, node.blockStore, node.ledger, nil, genesisID, "")
+	if err := rebuilt.AddModule(NewNameIndex()); err != nil {
+		t.Fatal(err)
+	}
+	if err := rebuilt.IndexChain(); err == nil {
+		t.Fatal("Expected indexing pruned blocks to fail")
+	}
+	if err := Reindex(params, genesisID, node.blockStore, filepath.Join(dir, "reindex.db"), false); err == nil {
+		t.Fatal("Expected reindexing pruned blocks to fail")
+	}
+}
@@ -20,3 +20,16 @@ type BlockStorage interface {
 	// GetTransaction returns a transaction within a block and the block's header.
 	GetTransaction(id BlockID, index int) (*Transaction, *BlockHeader, error)
 }
+
+// PrunableBlockStorage is an interface for block storage which can delete block bodies to save space.
+// Headers of pruned blocks are kept.
+type PrunableBlockStorage interface {
+	BlockStorage
+
+	// PruneBlock deletes the referenced main chain block's body and records its height as the
+	// pruned height if it's the highest pruned so far.
+	PruneBlock(id BlockID, height int64) error
+
+	// GetPrunedHeight returns the height of the highest pruned main chain block or -1 if none have been.
+	GetPrunedHeight() (int64, error)
+}
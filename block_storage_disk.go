@@ -24,14 +24,23 @@ import (
 // BlockStorageDisk is an on-disk BlockStorage implementation using the filesystem for blocks
 // and LevelDB for block headers.
 type BlockStorageDisk struct {
-	db       *leveldb.DB
-	dirPath  string
-	readOnly bool
-	compress bool
+	db             *leveldb.DB
+	dirPath        string
+	readOnly       bool
+	compress       bool
+	binaryEncoding bool
 }
 
-// NewBlockStorageDisk returns a new instance of on-disk block storage.
-func NewBlockStorageDisk(dirPath, dbPath string, readOnly, compress bool) (*BlockStorageDisk, error) {
+// block file extensions
+const (
+	blockExtJson   = ".json"
+	blockExtLz4    = ".lz4"
+	blockExtBinary = ".bin"
+)
+
+// NewBlockStorageDisk returns a new instance of on-disk block storage. New blocks are stored in
+// the binary encoding if binaryEncoding is true. Blocks stored in any encoding can be read.
+func NewBlockStorageDisk(dirPath, dbPath string, readOnly, compress, binaryEncoding bool) (*BlockStorageDisk, error) {
 	// create the blocks path if it doesn't exist
 	if !readOnly {
 		if info, err := os.Stat(dirPath); os.IsNotExist(err) {
@@ -50,10 +59,11 @@ func NewBlockStorageDisk(dirPath, dbPath string, readOnly, compress bool) (*Bloc
 		return nil, err
 	}
 	return &BlockStorageDisk{
-		db:       db,
-		dirPath:  dirPath,
-		readOnly: readOnly,
-		compress: compress,
+		db:             db,
+		dirPath:        dirPath,
+		readOnly:       readOnly,
+		compress:       compress,
+		binaryEncoding: binaryEncoding,
 	}, nil
 }
 
@@ -64,13 +74,19 @@ func (b BlockStorageDisk) Store(id BlockID, block *Block, now int64) error {
 	}
 
 	// save the complete block to the filesystem
-	blockBytes, err := json.Marshal(block)
+	var blockBytes []byte
+	var err error
+	if b.binaryEncoding {
+		blockBytes, err = encodeBlockBinary(block, blockBinaryCodec(b.compress))
+	} else {
+		blockBytes, err = json.Marshal(block)
+	}
 	if err != nil {
 		return err
 	}
 
-	var ext string
-	if b.compress {
+	ext := b.ext()
+	if b.compress && !b.binaryEncoding {
 		// compress with lz4
 		in := bytes.NewReader(blockBytes)
 		zout := new(bytes.Buffer)
@@ -82,9 +98,6 @@ func (b BlockStorageDisk) Store(id BlockID, block *Block, now int64) error {
 			return err
 		}
 		blockBytes = zout.Bytes()
-		ext = ".lz4"
-	} else {
-		ext = ".json"
 	}
 
 	// write the block and sync
@@ -117,8 +130,52 @@ func (b BlockStorageDisk) Store(id BlockID, block *Block, now int64) error {
 	return b.db.Put(id[:], encodedBlockHeader, &wo)
 }
 
+// the extension of newly stored blocks
+func (b BlockStorageDisk) ext() string {
+	switch {
+	case b.binaryEncoding:
+		return blockExtBinary
+	case b.compress:
+		return blockExtLz4
+	default:
+		return blockExtJson
+	}
+}
+
+// find the referenced block's file. returns an empty path if it isn't found
+func (b BlockStorageDisk) findBlock(id BlockID) (string, string, error) {
+	// try the extension new blocks are stored with first
+	for _, ext := range []string{b.ext(), blockExtJson, blockExtLz4, blockExtBinary} {
+		blockPath := filepath.Join(b.dirPath, id.String()+ext)
+		_, err := os.Stat(blockPath)
+		if err == nil {
+			return blockPath, ext, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", "", err
+		}
+	}
+	return "", "", nil
+}
+
 // Get returns the referenced block.
 func (b BlockStorageDisk) GetBlock(id BlockID) (*Block, error) {
+	blockPath, ext, err := b.findBlock(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(blockPath) == 0 {
+		// not found
+		return nil, nil
+	}
+	if ext == blockExtBinary {
+		encoded, err := ioutil.ReadFile(blockPath)
+		if err != nil {
+			return nil, err
+		}
+		return decodeBlockBinary(encoded)
+	}
+
 	blockJson, err := b.GetBlockBytes(id)
 	if err != nil {
 		return nil, err
@@ -132,26 +189,15 @@ func (b BlockStorageDisk) GetBlock(id BlockID) (*Block, error) {
 	return block, nil
 }
 
-// GetBlockBytes returns the referenced block as a byte slice.
+// GetBlockBytes returns the referenced block's JSON encoding as a byte slice.
 func (b BlockStorageDisk) GetBlockBytes(id BlockID) ([]byte, error) {
-	var ext [2]string
-	if b.compress {
-		// order to try finding the block by extension
-		ext = [2]string{".lz4", ".json"}
-	} else {
-		ext = [2]string{".json", ".lz4"}
+	blockPath, ext, err := b.findBlock(id)
+	if err != nil {
+		return nil, err
 	}
-
-	var compressed bool = b.compress
-
-	blockPath := filepath.Join(b.dirPath, id.String()+ext[0])
-	if _, err := os.Stat(blockPath); os.IsNotExist(err) {
-		compressed = !compressed
-		blockPath = filepath.Join(b.dirPath, id.String()+ext[1])
-		if _, err := os.Stat(blockPath); os.IsNotExist(err) {
-			// not found
-			return nil, nil
-		}
+	if len(blockPath) == 0 {
+		// not found
+		return nil, nil
 	}
 
 	// read it off disk
@@ -160,7 +206,14 @@ func (b BlockStorageDisk) GetBlockBytes(id BlockID) ([]byte, error) {
 		return nil, err
 	}
 
-	if compressed {
+	switch ext {
+	case blockExtBinary:
+		block, err := decodeBlockBinary(blockBytes)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(block)
+	case blockExtLz4:
 		// uncompress
 		zin := bytes.NewBuffer(blockBytes)
 		out := new(bytes.Buffer)
@@ -192,11 +245,33 @@ func (b BlockStorageDisk) GetBlockHeader(id BlockID) (*BlockHeader, int64, error
 // GetTransaction returns a transaction within a block and the block's header.
 func (b BlockStorageDisk) GetTransaction(id BlockID, index int) (
 	*Transaction, *BlockHeader, error) {
+	blockPath, ext, err := b.findBlock(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ext == blockExtBinary {
+		// read only the transaction
+		f, err := os.Open(blockPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return nil, nil, err
+		}
+		return transactionFromBlockBinary(f, info.Size(), index)
+	}
+
 	blockJson, err := b.GetBlockBytes(id)
 	if err != nil {
 		return nil, nil, err
 	}
+	return transactionFromBlockJson(blockJson, index)
+}
 
+// pick out and unmarshal a transaction and the header from a block's JSON encoding
+func transactionFromBlockJson(blockJson []byte, index int) (*Transaction, *BlockHeader, error) {
 	// pick out and unmarshal the transaction at the index
 	idx := "[" + strconv.Itoa(index) + "]"
 	txJson, _, _, err := jsonparser.Get(blockJson, "transactions", idx)
@@ -220,12 +295,79 @@ func (b BlockStorageDisk) GetTransaction(id BlockID, index int) (
 	return tx, header, nil
 }
 
+// PruneBlock deletes the referenced main chain block's body and records its height as the
+// pruned height if it's the highest pruned so far. The header is kept.
+func (b BlockStorageDisk) PruneBlock(id BlockID, height int64) error {
+	if b.readOnly {
+		return fmt.Errorf("Block storage is in read-only mode")
+	}
+
+	for _, ext := range []string{blockExtJson, blockExtLz4, blockExtBinary} {
+		blockPath := filepath.Join(b.dirPath, id.String()+ext)
+		if err := os.Remove(blockPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	prunedHeight, err := b.GetPrunedHeight()
+	if err != nil {
+		return err
+	}
+	if height <= prunedHeight {
+		return nil
+	}
+	var encodedHeight [8]byte
+	binary.BigEndian.PutUint64(encodedHeight[:], uint64(height))
+	wo := opt.WriteOptions{Sync: true}
+	return b.db.Put([]byte(prunedHeightKey), encodedHeight[:], &wo)
+}
+
+// GetPrunedHeight returns the height of the highest pruned main chain block or -1 if none have been.
+func (b BlockStorageDisk) GetPrunedHeight() (int64, error) {
+	encodedHeight, err := b.db.Get([]byte(prunedHeightKey), nil)
+	if err == leveldb.ErrNotFound {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(encodedHeight)), nil
+}
+
+// ForEachBlockHeader calls fn with every stored block header in no particular order.
+// Iteration stops at the first error returned by fn.
+func (b BlockStorageDisk) ForEachBlockHeader(fn func(id BlockID, header *BlockHeader, when int64) error) error {
+	iter := b.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if len(iter.Key()) != len(BlockID{}) {
+			// not a header
+			continue
+		}
+		var id BlockID
+		copy(id[:], iter.Key())
+		header, when, err := decodeBlockHeader(iter.Value())
+		if err != nil {
+			return err
+		}
+		if err := fn(id, header, when); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
 // Close is called to close any underlying storage.
 func (b *BlockStorageDisk) Close() error {
 	return b.db.Close()
 }
 
-// leveldb schema: {bid} -> {timestamp}{gob encoded header}
+// leveldb schema
+
+// {bid}           -> {timestamp}{gob encoded header}
+// "pruned_height" -> {height} (of the highest main chain block whose body was pruned)
+
+const prunedHeightKey = "pruned_height"
 
 func encodeBlockHeader(header *BlockHeader, when int64) ([]byte, error) {
 	buf := new(bytes.Buffer)
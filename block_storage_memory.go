@@ -0,0 +1,142 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// BlockStorageMemory is an in-memory BlockStorage implementation. It's useful for tests and
+// simulations. Blocks are kept in their JSON encoding so callers can't modify stored blocks.
+type BlockStorageMemory struct {
+	lock         sync.RWMutex
+	blocks       map[BlockID][]byte
+	headers      map[BlockID]memoryBlockHeader
+	prunedHeight int64
+}
+
+type memoryBlockHeader struct {
+	header BlockHeader
+	when   int64
+}
+
+// NewBlockStorageMemory returns a new instance of in-memory block storage.
+func NewBlockStorageMemory() *BlockStorageMemory {
+	return &BlockStorageMemory{
+		blocks:       make(map[BlockID][]byte),
+		headers:      make(map[BlockID]memoryBlockHeader),
+		prunedHeight: -1,
+	}
+}
+
+// Store is called to store all of the block's information.
+func (b *BlockStorageMemory) Store(id BlockID, block *Block, now int64) error {
+	blockJson, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.blocks[id] = blockJson
+	b.headers[id] = memoryBlockHeader{header: *block.Header, when: now}
+	return nil
+}
+
+// GetBlock returns the referenced block.
+func (b *BlockStorageMemory) GetBlock(id BlockID) (*Block, error) {
+	blockJson, err := b.GetBlockBytes(id)
+	if err != nil {
+		return nil, err
+	}
+	if blockJson == nil {
+		// not found
+		return nil, nil
+	}
+
+	// unmarshal
+	block := new(Block)
+	if err := json.Unmarshal(blockJson, block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// GetBlockBytes returns the referenced block as a byte slice.
+func (b *BlockStorageMemory) GetBlockBytes(id BlockID) ([]byte, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	blockJson, ok := b.blocks[id]
+	if !ok {
+		// not found
+		return nil, nil
+	}
+	return append([]byte(nil), blockJson...), nil
+}
+
+// GetBlockHeader returns the referenced block's header and the timestamp of when it was stored.
+func (b *BlockStorageMemory) GetBlockHeader(id BlockID) (*BlockHeader, int64, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	stored, ok := b.headers[id]
+	if !ok {
+		return nil, 0, nil
+	}
+	header := stored.header
+	return &header, stored.when, nil
+}
+
+// GetTransaction returns a transaction within a block and the block's header.
+func (b *BlockStorageMemory) GetTransaction(id BlockID, index int) (
+	*Transaction, *BlockHeader, error) {
+	b.lock.RLock()
+	blockJson := b.blocks[id]
+	b.lock.RUnlock()
+	return transactionFromBlockJson(blockJson, index)
+}
+
+// ForEachBlockHeader calls fn with every stored block header in no particular order.
+// Iteration stops at the first error returned by fn.
+func (b *BlockStorageMemory) ForEachBlockHeader(fn func(id BlockID, header *BlockHeader, when int64) error) error {
+	// copy them so fn can use the storage
+	b.lock.RLock()
+	headers := make(map[BlockID]memoryBlockHeader, len(b.headers))
+	for id, stored := range b.headers {
+		headers[id] = stored
+	}
+	b.lock.RUnlock()
+
+	for id, stored := range headers {
+		header := stored.header
+		if err := fn(id, &header, stored.when); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneBlock deletes the referenced main chain block's body and records its height as the
+// pruned height if it's the highest pruned so far. The header is kept.
+func (b *BlockStorageMemory) PruneBlock(id BlockID, height int64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.blocks, id)
+	if height > b.prunedHeight {
+		b.prunedHeight = height
+	}
+	return nil
+}
+
+// GetPrunedHeight returns the height of the highest pruned main chain block or -1 if none have been.
+func (b *BlockStorageMemory) GetPrunedHeight() (int64, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.prunedHeight, nil
+}
+
+// Close is a no-op. It's here so memory storage can stand in for on-disk storage.
+func (b *BlockStorageMemory) Close() error {
+	return nil
+}
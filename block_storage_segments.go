@@ -0,0 +1,669 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pierrec/lz4"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// a new segment file is started once the current one would grow past this size
+var maxBlockSegmentSize int64 = 128 * 1024 * 1024
+
+const blockSegmentExt = ".seg"
+
+// BlockStorageSegments is an on-disk BlockStorage implementation which appends blocks to a
+// series of segment files instead of writing a file per block. Block headers and the location
+// of each block within the segments are kept in LevelDB.
+type BlockStorageSegments struct {
+	db             *leveldb.DB
+	dirPath        string
+	readOnly       bool
+	compress       bool
+	binaryEncoding bool
+
+	readLock    sync.RWMutex // held by readers while they use a segment so it isn't removed underneath them
+	lock        sync.Mutex
+	segment     uint32   // the segment being appended to
+	segmentFile *os.File // nil until the next append
+	segmentSize int64
+	readFiles   map[uint32]*os.File
+}
+
+// where a block is stored
+type blockLocation struct {
+	segment  uint32
+	offset   int64
+	length   uint32
+	encoding byte
+}
+
+// how a block is encoded within a segment
+const (
+	segmentBlockJson   = 0
+	segmentBlockLz4    = 1 // lz4 compressed JSON
+	segmentBlockBinary = 2
+)
+
+// NewBlockStorageSegments returns a new instance of segmented on-disk block storage. New blocks are
+// stored in the binary encoding if binaryEncoding is true. Blocks stored in any encoding can be read.
+func NewBlockStorageSegments(dirPath, dbPath string, readOnly, compress, binaryEncoding bool) (*BlockStorageSegments, error) {
+	// create the segments path if it doesn't exist
+	if !readOnly {
+		if info, err := os.Stat(dirPath); os.IsNotExist(err) {
+			if err := os.MkdirAll(dirPath, 0700); err != nil {
+				return nil, err
+			}
+		} else if !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", dirPath)
+		}
+	}
+
+	// open the database
+	opts := opt.Options{ReadOnly: readOnly}
+	db, err := leveldb.OpenFile(dbPath, &opts)
+	if err != nil {
+		return nil, err
+	}
+	b := &BlockStorageSegments{
+		db:             db,
+		dirPath:        dirPath,
+		readOnly:       readOnly,
+		compress:       compress,
+		binaryEncoding: binaryEncoding,
+		readFiles:      make(map[uint32]*os.File),
+	}
+
+	// continue appending to the latest segment
+	segments, err := b.listSegments()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if len(segments) != 0 {
+		b.segment = segments[len(segments)-1]
+	}
+	return b, nil
+}
+
+// Store is called to store all of the block's information.
+func (b *BlockStorageSegments) Store(id BlockID, block *Block, now int64) error {
+	if b.binaryEncoding {
+		encoded, err := encodeBlockBinary(block, blockBinaryCodec(b.compress))
+		if err != nil {
+			return err
+		}
+		return b.storeEncoded(id, encoded, segmentBlockBinary, block.Header, now)
+	}
+	blockBytes, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	return b.storeBlockBytes(id, blockBytes, block.Header, now)
+}
+
+// store the block given its JSON encoding. nil blockJson stores only the header
+func (b *BlockStorageSegments) storeBlockBytes(id BlockID, blockJson []byte, header *BlockHeader, now int64) error {
+	if blockJson == nil {
+		return b.storeEncoded(id, nil, segmentBlockJson, header, now)
+	}
+
+	if b.binaryEncoding {
+		block := new(Block)
+		if err := json.Unmarshal(blockJson, block); err != nil {
+			return err
+		}
+		encoded, err := encodeBlockBinary(block, blockBinaryCodec(b.compress))
+		if err != nil {
+			return err
+		}
+		return b.storeEncoded(id, encoded, segmentBlockBinary, header, now)
+	}
+
+	if !b.compress {
+		return b.storeEncoded(id, blockJson, segmentBlockJson, header, now)
+	}
+
+	// compress with lz4
+	in := bytes.NewReader(blockJson)
+	zout := new(bytes.Buffer)
+	zw := lz4.NewWriter(zout)
+	if _, err := io.Copy(zw, in); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return b.storeEncoded(id, zout.Bytes(), segmentBlockLz4, header, now)
+}
+
+// append the encoded block to the current segment and index its header and location.
+// nil encoded stores only the header
+func (b *BlockStorageSegments) storeEncoded(id BlockID, encoded []byte, encoding byte,
+	header *BlockHeader, now int64) error {
+	if b.readOnly {
+		return fmt.Errorf("Block storage is in read-only mode")
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	batch := new(leveldb.Batch)
+	location, err := b.getLocation(id)
+	if err != nil {
+		return err
+	}
+	if location == nil && encoded != nil {
+		// append and sync
+		location, err = b.append(encoded)
+		if err != nil {
+			return err
+		}
+		location.encoding = encoding
+		batch.Put(blockLocationKey(id), encodeBlockLocation(location))
+
+		count, err := b.getSegmentCount(location.segment)
+		if err != nil {
+			return err
+		}
+		batch.Put(segmentCountKey(location.segment), encodeSegmentCount(count+1))
+	}
+
+	// save the header
+	encodedBlockHeader, err := encodeBlockHeader(header, now)
+	if err != nil {
+		return err
+	}
+	batch.Put(id[:], encodedBlockHeader)
+
+	wo := opt.WriteOptions{Sync: true}
+	return b.db.Write(batch, &wo)
+}
+
+// append data to the current segment or start a new one if it's full. must be called with the lock held
+func (b *BlockStorageSegments) append(data []byte) (*blockLocation, error) {
+	if b.segmentFile != nil && b.segmentSize != 0 && b.segmentSize+int64(len(data)) > maxBlockSegmentSize {
+		if err := b.segmentFile.Close(); err != nil {
+			return nil, err
+		}
+		b.segmentFile = nil
+		b.segment++
+	}
+
+	if b.segmentFile == nil {
+		f, err := os.OpenFile(b.segmentPath(b.segment), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if info.Size() != 0 && info.Size()+int64(len(data)) > maxBlockSegmentSize {
+			// full from a previous run
+			f.Close()
+			b.segment++
+			return b.append(data)
+		}
+		b.segmentFile, b.segmentSize = f, info.Size()
+	}
+
+	location := &blockLocation{segment: b.segment, offset: b.segmentSize, length: uint32(len(data))}
+	n, err := b.segmentFile.Write(data)
+	if err == nil && n < len(data) {
+		err = io.ErrShortWrite
+	}
+	if err == nil {
+		err = b.segmentFile.Sync()
+	}
+	if err != nil {
+		// reopen and find the end of the segment again next time
+		b.segmentFile.Close()
+		b.segmentFile = nil
+		return nil, err
+	}
+	b.segmentSize += int64(n)
+	return location, nil
+}
+
+// GetBlock returns the referenced block.
+func (b *BlockStorageSegments) GetBlock(id BlockID) (*Block, error) {
+	location, encoded, err := b.readBlock(id)
+	if err != nil {
+		return nil, err
+	}
+	if location == nil {
+		// not found
+		return nil, nil
+	}
+	if location.encoding == segmentBlockBinary {
+		return decodeBlockBinary(encoded)
+	}
+
+	blockJson, err := blockJsonFromSegment(location, encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	// unmarshal
+	block := new(Block)
+	if err := json.Unmarshal(blockJson, block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// GetBlockBytes returns the referenced block's JSON encoding as a byte slice.
+func (b *BlockStorageSegments) GetBlockBytes(id BlockID) ([]byte, error) {
+	location, encoded, err := b.readBlock(id)
+	if err != nil {
+		return nil, err
+	}
+	if location == nil {
+		// not found
+		return nil, nil
+	}
+	return blockJsonFromSegment(location, encoded)
+}
+
+// read the referenced block's encoding from its segment. returns a nil location if it isn't found
+func (b *BlockStorageSegments) readBlock(id BlockID) (*blockLocation, []byte, error) {
+	b.readLock.RLock()
+	defer b.readLock.RUnlock()
+
+	location, err := b.getLocation(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if location == nil {
+		return nil, nil, nil
+	}
+
+	f, err := b.readFile(location.segment)
+	if err != nil {
+		return nil, nil, err
+	}
+	encoded := make([]byte, location.length)
+	if _, err := f.ReadAt(encoded, location.offset); err != nil {
+		return nil, nil, err
+	}
+	return location, encoded, nil
+}
+
+// convert a block read from a segment to its JSON encoding
+func blockJsonFromSegment(location *blockLocation, encoded []byte) ([]byte, error) {
+	switch location.encoding {
+	case segmentBlockJson:
+		return encoded, nil
+	case segmentBlockLz4:
+		// uncompress
+		zin := bytes.NewBuffer(encoded)
+		out := new(bytes.Buffer)
+		zr := lz4.NewReader(zin)
+		if _, err := io.Copy(out, zr); err != nil {
+			return nil, err
+		}
+		return out.Bytes(), nil
+	case segmentBlockBinary:
+		block, err := decodeBlockBinary(encoded)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(block)
+	default:
+		return nil, fmt.Errorf("Unknown block encoding %d", location.encoding)
+	}
+}
+
+// GetBlockHeader returns the referenced block's header and the timestamp of when it was stored.
+func (b *BlockStorageSegments) GetBlockHeader(id BlockID) (*BlockHeader, int64, error) {
+	// fetch it
+	encodedHeader, err := b.db.Get(id[:], nil)
+	if err == leveldb.ErrNotFound {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// decode it
+	return decodeBlockHeader(encodedHeader)
+}
+
+// GetTransaction returns a transaction within a block and the block's header.
+func (b *BlockStorageSegments) GetTransaction(id BlockID, index int) (
+	*Transaction, *BlockHeader, error) {
+	b.readLock.RLock()
+	location, err := b.getLocation(id)
+	if err != nil {
+		b.readLock.RUnlock()
+		return nil, nil, err
+	}
+	if location != nil && location.encoding == segmentBlockBinary {
+		// read only the transaction
+		defer b.readLock.RUnlock()
+		f, err := b.readFile(location.segment)
+		if err != nil {
+			return nil, nil, err
+		}
+		r := io.NewSectionReader(f, location.offset, int64(location.length))
+		return transactionFromBlockBinary(r, r.Size(), index)
+	}
+	b.readLock.RUnlock()
+
+	blockJson, err := b.GetBlockBytes(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return transactionFromBlockJson(blockJson, index)
+}
+
+// ForEachBlockHeader calls fn with every stored block header in no particular order.
+// Iteration stops at the first error returned by fn.
+func (b *BlockStorageSegments) ForEachBlockHeader(fn func(id BlockID, header *BlockHeader, when int64) error) error {
+	iter := b.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if len(iter.Key()) != len(BlockID{}) {
+			// not a header
+			continue
+		}
+		var id BlockID
+		copy(id[:], iter.Key())
+		header, when, err := decodeBlockHeader(iter.Value())
+		if err != nil {
+			return err
+		}
+		if err := fn(id, header, when); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// PruneBlock removes the referenced main chain block's body from the index and records its height
+// as the pruned height if it's the highest pruned so far. The header is kept. A segment file is
+// deleted once none of its blocks remain.
+func (b *BlockStorageSegments) PruneBlock(id BlockID, height int64) error {
+	if b.readOnly {
+		return fmt.Errorf("Block storage is in read-only mode")
+	}
+
+	// wait for any reads in progress since the block's segment may be removed
+	b.readLock.Lock()
+	defer b.readLock.Unlock()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	batch := new(leveldb.Batch)
+	location, err := b.getLocation(id)
+	if err != nil {
+		return err
+	}
+	var emptySegment bool
+	if location != nil {
+		batch.Delete(blockLocationKey(id))
+		count, err := b.getSegmentCount(location.segment)
+		if err != nil {
+			return err
+		}
+		if count <= 1 {
+			batch.Delete(segmentCountKey(location.segment))
+			emptySegment = location.segment != b.segment
+		} else {
+			batch.Put(segmentCountKey(location.segment), encodeSegmentCount(count-1))
+		}
+	}
+
+	prunedHeight, err := b.GetPrunedHeight()
+	if err != nil {
+		return err
+	}
+	if height > prunedHeight {
+		var encodedHeight [8]byte
+		binary.BigEndian.PutUint64(encodedHeight[:], uint64(height))
+		batch.Put([]byte(prunedHeightKey), encodedHeight[:])
+	}
+
+	wo := opt.WriteOptions{Sync: true}
+	if err := b.db.Write(batch, &wo); err != nil {
+		return err
+	}
+
+	if emptySegment {
+		if f, ok := b.readFiles[location.segment]; ok {
+			f.Close()
+			delete(b.readFiles, location.segment)
+		}
+		if err := os.Remove(b.segmentPath(location.segment)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		log.Printf("Removed empty block segment %d\n", location.segment)
+	}
+	return nil
+}
+
+// GetPrunedHeight returns the height of the highest pruned main chain block or -1 if none have been.
+func (b *BlockStorageSegments) GetPrunedHeight() (int64, error) {
+	encodedHeight, err := b.db.Get([]byte(prunedHeightKey), nil)
+	if err == leveldb.ErrNotFound {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(encodedHeight)), nil
+}
+
+// Close is called to close any underlying storage.
+func (b *BlockStorageSegments) Close() error {
+	b.readLock.Lock()
+	defer b.readLock.Unlock()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.segmentFile != nil {
+		b.segmentFile.Close()
+		b.segmentFile = nil
+	}
+	for segment, f := range b.readFiles {
+		f.Close()
+		delete(b.readFiles, segment)
+	}
+	return b.db.Close()
+}
+
+// MigrateBlockStorage copies every block and header from one block storage to segmented storage in
+// height order. Headers of pruned blocks are copied without a body. Blocks already in the destination
+// are skipped so an interrupted migration can be run again. Returns the number of blocks copied.
+func MigrateBlockStorage(from HeaderIterableBlockStorage, to *BlockStorageSegments) (int64, error) {
+	type storedHeader struct {
+		id     BlockID
+		header *BlockHeader
+		when   int64
+	}
+	var headers []storedHeader
+	if err := from.ForEachBlockHeader(func(id BlockID, header *BlockHeader, when int64) error {
+		headers = append(headers, storedHeader{id: id, header: header, when: when})
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	sort.Slice(headers, func(i, j int) bool {
+		return headers[i].header.Height < headers[j].header.Height
+	})
+
+	var count int64
+	for _, h := range headers {
+		existing, _, err := to.GetBlockHeader(h.id)
+		if err != nil {
+			return count, err
+		}
+		if existing != nil {
+			continue
+		}
+		blockJson, err := from.GetBlockBytes(h.id)
+		if err != nil {
+			return count, err
+		}
+		if err := to.storeBlockBytes(h.id, blockJson, h.header, h.when); err != nil {
+			return count, err
+		}
+		count++
+
+		if count%bootstrapProgressInterval == 0 {
+			log.Printf("Migrated %d blocks, height: %d\n", count, h.header.Height)
+		}
+	}
+
+	// carry over the pruned height
+	if prunable, ok := from.(PrunableBlockStorage); ok {
+		prunedHeight, err := prunable.GetPrunedHeight()
+		if err != nil {
+			return count, err
+		}
+		if prunedHeight >= 0 {
+			var encodedHeight [8]byte
+			binary.BigEndian.PutUint64(encodedHeight[:], uint64(prunedHeight))
+			wo := opt.WriteOptions{Sync: true}
+			if err := to.db.Put([]byte(prunedHeightKey), encodedHeight[:], &wo); err != nil {
+				return count, err
+			}
+		}
+	}
+	return count, nil
+}
+
+func (b *BlockStorageSegments) segmentPath(segment uint32) string {
+	return filepath.Join(b.dirPath, fmt.Sprintf("%08d%s", segment, blockSegmentExt))
+}
+
+// returns the numbers of the existing segment files in order
+func (b *BlockStorageSegments) listSegments() ([]uint32, error) {
+	infos, err := ioutil.ReadDir(b.dirPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var segments []uint32
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasSuffix(name, blockSegmentExt) {
+			continue
+		}
+		segment, err := strconv.ParseUint(strings.TrimSuffix(name, blockSegmentExt), 10, 32)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, uint32(segment))
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// returns an open read-only handle for the segment. handles are kept open until the storage is closed
+func (b *BlockStorageSegments) readFile(segment uint32) (*os.File, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if f, ok := b.readFiles[segment]; ok {
+		return f, nil
+	}
+	f, err := os.Open(b.segmentPath(segment))
+	if err != nil {
+		return nil, err
+	}
+	b.readFiles[segment] = f
+	return f, nil
+}
+
+func (b *BlockStorageSegments) getLocation(id BlockID) (*blockLocation, error) {
+	encodedLocation, err := b.db.Get(blockLocationKey(id), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeBlockLocation(encodedLocation)
+}
+
+func (b *BlockStorageSegments) getSegmentCount(segment uint32) (uint32, error) {
+	encodedCount, err := b.db.Get(segmentCountKey(segment), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(encodedCount), nil
+}
+
+// leveldb schema
+
+// {bid}           -> {timestamp}{gob encoded header}
+// l{bid}          -> {segment}{offset}{length}{encoding} (absent if the body was pruned)
+// c{segment}      -> {count} (of blocks in the segment which haven't been pruned)
+// "pruned_height" -> {height} (of the highest main chain block whose body was pruned)
+
+const blockLocationPrefix = 'l'
+
+const segmentCountPrefix = 'c'
+
+func blockLocationKey(id BlockID) []byte {
+	key := make([]byte, 1+len(id))
+	key[0] = blockLocationPrefix
+	copy(key[1:], id[:])
+	return key
+}
+
+func segmentCountKey(segment uint32) []byte {
+	key := make([]byte, 5)
+	key[0] = segmentCountPrefix
+	binary.BigEndian.PutUint32(key[1:], segment)
+	return key
+}
+
+func encodeBlockLocation(location *blockLocation) []byte {
+	encoded := make([]byte, 17)
+	binary.BigEndian.PutUint32(encoded[:4], location.segment)
+	binary.BigEndian.PutUint64(encoded[4:12], uint64(location.offset))
+	binary.BigEndian.PutUint32(encoded[12:16], location.length)
+	encoded[16] = location.encoding
+	return encoded
+}
+
+func decodeBlockLocation(encoded []byte) (*blockLocation, error) {
+	if len(encoded) != 17 {
+		return nil, fmt.Errorf("Invalid block location length %d", len(encoded))
+	}
+	return &blockLocation{
+		segment:  binary.BigEndian.Uint32(encoded[:4]),
+		offset:   int64(binary.BigEndian.Uint64(encoded[4:12])),
+		length:   binary.BigEndian.Uint32(encoded[12:16]),
+		encoding: encoded[16],
+	}, nil
+}
+
+func encodeSegmentCount(count uint32) []byte {
+	encoded := make([]byte, 4)
+	binary.BigEndian.PutUint32(encoded, count)
+	return encoded
+}
@@ -0,0 +1,247 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestBlockStorageSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a segment per block
+	defer func(size int64) { maxBlockSegmentSize = size }(maxBlockSegmentSize)
+	maxBlockSegmentSize = 1
+
+	params := RegTestParams
+	genesis, genesisID, err := params.GenesisBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, options := range [][2]bool{{false, false}, {true, false}, {false, true}, {true, true}} {
+		compress, binaryEncoding := options[0], options[1]
+		segmentsDir := filepath.Join(dir, "segments"+strconv.Itoa(i))
+		dbPath := segmentsDir + ".db"
+		blockStore, err := NewBlockStorageSegments(segmentsDir, dbPath, false, compress, binaryEncoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blockStore.Store(genesisID, genesis, 0); err != nil {
+			t.Fatal(err)
+		}
+		blocks, ids := []*Block{genesis}, []BlockID{genesisID}
+		for i := 0; i < 2; i++ {
+			block, id := storeTestBlock(t, blockStore, blocks[i], ids[i], int64(i+1), strconv.Itoa(i))
+			blocks, ids = append(blocks, block), append(ids, id)
+		}
+
+		// appending continues after reopening
+		if err := blockStore.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if blockStore, err = NewBlockStorageSegments(segmentsDir, dbPath, false, compress, binaryEncoding); err != nil {
+			t.Fatal(err)
+		}
+		block, id := storeTestBlock(t, blockStore, blocks[2], ids[2], 3, "reopened")
+		blocks, ids = append(blocks, block), append(ids, id)
+		if segments, err := blockStore.listSegments(); err != nil || len(segments) != 4 {
+			t.Fatalf("Expected 4 segments, found %v %v", segments, err)
+		}
+
+		for i, id := range ids {
+			expect, err := json.Marshal(blocks[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			found, err := blockStore.GetBlockBytes(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(found, expect) {
+				t.Fatalf("Block %d doesn't match, compress: %v, binary: %v", i, compress, binaryEncoding)
+			}
+			tx, header, err := blockStore.GetTransaction(id, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tx.Memo != blocks[i].Transactions[0].Memo || *header != *blocks[i].Header {
+				t.Fatalf("Transaction of block %d doesn't match", i)
+			}
+			header, when, err := blockStore.GetBlockHeader(id)
+			if err != nil || *header != *blocks[i].Header || when != int64(i) {
+				t.Fatalf("Header of block %d doesn't match: %v %d", i, err, when)
+			}
+		}
+		if block, err := blockStore.GetBlock(BlockID{}); err != nil || block != nil {
+			t.Fatalf("Expected missing block, found %v %v", block, err)
+		}
+
+		// pruning removes the emptied segment but keeps the header
+		if err := blockStore.PruneBlock(ids[1], 1); err != nil {
+			t.Fatal(err)
+		}
+		if segments, _ := blockStore.listSegments(); len(segments) != 3 {
+			t.Fatalf("Expected 3 segments after pruning, found %v", segments)
+		}
+		if blockJson, err := blockStore.GetBlockBytes(ids[1]); err != nil || blockJson != nil {
+			t.Fatalf("Expected pruned block, found %v", err)
+		}
+		if header, _, err := blockStore.GetBlockHeader(ids[1]); err != nil || header == nil {
+			t.Fatalf("Expected pruned block header, found %v", err)
+		}
+		if height, err := blockStore.GetPrunedHeight(); err != nil || height != 1 {
+			t.Fatalf("Expected pruned height 1, found %d %v", height, err)
+		}
+		if err := blockStore.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMigrateBlockStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	params := RegTestParams
+	genesis, genesisID, err := params.GenesisBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, err := NewBlockStorageDisk(filepath.Join(dir, "blocks"), filepath.Join(dir, "headers.db"), false, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer from.Close()
+	if err := from.Store(genesisID, genesis, 0); err != nil {
+		t.Fatal(err)
+	}
+	blocks, ids := []*Block{genesis}, []BlockID{genesisID}
+	for i := 0; i < 3; i++ {
+		block, id := storeTestBlock(t, from, blocks[i], ids[i], int64(i+1), strconv.Itoa(i))
+		blocks, ids = append(blocks, block), append(ids, id)
+	}
+	if err := from.PruneBlock(genesisID, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	to, err := NewBlockStorageSegments(filepath.Join(dir, "segments"), filepath.Join(dir, "segments.db"), false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer to.Close()
+	if count, err := MigrateBlockStorage(from, to); err != nil || count != 4 {
+		t.Fatalf("Expected 4 blocks migrated, found %d %v", count, err)
+	}
+	for i, id := range ids {
+		expect, err := from.GetBlockBytes(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := to.GetBlockBytes(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(found, expect) || (i == 0) != (found == nil) {
+			t.Fatalf("Block %d doesn't match", i)
+		}
+		header, when, err := to.GetBlockHeader(id)
+		if err != nil || header == nil || *header != *blocks[i].Header || when != int64(i) {
+			t.Fatalf("Header of block %d doesn't match: %v", i, err)
+		}
+	}
+	if height, err := to.GetPrunedHeight(); err != nil || height != 0 {
+		t.Fatalf("Expected pruned height 0, found %d %v", height, err)
+	}
+
+	// running it again has nothing to do
+	if count, err := MigrateBlockStorage(from, to); err != nil || count != 0 {
+		t.Fatalf("Expected nothing migrated, found %d %v", count, err)
+	}
+}
+
+func TestBlockStorageSegmentsPruneWhileReading(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a segment per block
+	defer func(size int64) { maxBlockSegmentSize = size }(maxBlockSegmentSize)
+	maxBlockSegmentSize = 1
+
+	blockStore, err := NewBlockStorageSegments(filepath.Join(dir, "segments"), filepath.Join(dir, "segments.db"),
+		false, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockStore.Close()
+
+	genesis, genesisID, err := RegTestParams.GenesisBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blockStore.Store(genesisID, genesis, 0); err != nil {
+		t.Fatal(err)
+	}
+	blocks, ids := []*Block{genesis}, []BlockID{genesisID}
+	for i := 0; i < 20; i++ {
+		block, id := storeTestBlock(t, blockStore, blocks[i], ids[i], int64(i+1), strconv.Itoa(i))
+		blocks, ids = append(blocks, block), append(ids, id)
+	}
+
+	// reads of blocks being pruned either find the block or find it missing
+	errChan := make(chan error, 2)
+	done := make(chan struct{})
+	for r := 0; r < 2; r++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					errChan <- nil
+					return
+				default:
+				}
+				for _, id := range ids {
+					if _, err := blockStore.GetBlockBytes(id); err != nil {
+						errChan <- err
+						return
+					}
+					if _, _, err := blockStore.GetTransaction(id, 0); err != nil {
+						// a missing block is an error for GetTransaction
+						if location, _ := blockStore.getLocation(id); location != nil {
+							errChan <- err
+							return
+						}
+					}
+				}
+			}
+		}()
+	}
+	for i, id := range ids[:len(ids)-1] {
+		if err := blockStore.PruneBlock(id, int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	for r := 0; r < 2; r++ {
+		if err := <-errChan; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
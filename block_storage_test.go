@@ -0,0 +1,163 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// every BlockStorage implementation must pass this
+func TestBlockStorageConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "block_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("disk", func(t *testing.T) {
+		blockStore, err := NewBlockStorageDisk(filepath.Join(dir, "blocks"), filepath.Join(dir, "headers.db"),
+			false, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer blockStore.Close()
+		testBlockStorage(t, blockStore)
+	})
+	t.Run("segments", func(t *testing.T) {
+		blockStore, err := NewBlockStorageSegments(filepath.Join(dir, "segments"), filepath.Join(dir, "segments.db"),
+			false, false, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer blockStore.Close()
+		testBlockStorage(t, blockStore)
+	})
+	t.Run("memory", func(t *testing.T) {
+		testBlockStorage(t, NewBlockStorageMemory())
+	})
+}
+
+func testBlockStorage(t *testing.T, blockStore BlockStorage) {
+	params := RegTestParams
+	genesis, genesisID, err := params.GenesisBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey2, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := NewTransaction(pubKey, pubKey2, 1, MinFeeCruzbits, 0, 0, 1, "memo")
+	if err := tx.Sign(privKey); err != nil {
+		t.Fatal(err)
+	}
+	block, id := mineTestBlock(t, genesis, genesisID, pubKey, tx)
+
+	if err := blockStore.Store(genesisID, genesis, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := blockStore.Store(id, block, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, whens := []BlockID{genesisID, id}, []int64{10, 20}
+	for i, stored := range []*Block{genesis, block} {
+		id, when := ids[i], whens[i]
+		expect, err := json.Marshal(stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := blockStore.GetBlockBytes(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(found, expect) {
+			t.Fatalf("Block %d bytes don't match", i)
+		}
+		foundBlock, err := blockStore.GetBlock(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if foundJson, _ := json.Marshal(foundBlock); !bytes.Equal(foundJson, expect) {
+			t.Fatalf("Block %d doesn't match", i)
+		}
+		header, foundWhen, err := blockStore.GetBlockHeader(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *header != *stored.Header || foundWhen != when {
+			t.Fatalf("Header of block %d doesn't match", i)
+		}
+		for j, expectTx := range stored.Transactions {
+			foundTx, header, err := blockStore.GetTransaction(id, j)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectID, _ := expectTx.ID()
+			foundID, _ := foundTx.ID()
+			if foundID != expectID || *header != *stored.Header {
+				t.Fatalf("Transaction %d of block %d doesn't match", j, i)
+			}
+		}
+		if _, _, err := blockStore.GetTransaction(id, len(stored.Transactions)); err == nil {
+			t.Fatalf("Expected an error for an out of range transaction in block %d", i)
+		}
+	}
+
+	// modifying a returned block doesn't change the stored one
+	foundBlock, err := blockStore.GetBlock(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foundBlock.Transactions[1].Memo = "changed"
+	if tx, _, err := blockStore.GetTransaction(id, 1); err != nil || tx.Memo != "memo" {
+		t.Fatalf("Expected the stored block to be unchanged, found %v", err)
+	}
+
+	// missing blocks
+	var missing BlockID
+	if block, err := blockStore.GetBlock(missing); err != nil || block != nil {
+		t.Fatalf("Expected no block, found %v %v", block, err)
+	}
+	if blockJson, err := blockStore.GetBlockBytes(missing); err != nil || blockJson != nil {
+		t.Fatalf("Expected no block bytes, found %v", err)
+	}
+	if header, _, err := blockStore.GetBlockHeader(missing); err != nil || header != nil {
+		t.Fatalf("Expected no header, found %v", err)
+	}
+
+	prunable, ok := blockStore.(PrunableBlockStorage)
+	if !ok {
+		return
+	}
+	if height, err := prunable.GetPrunedHeight(); err != nil || height != -1 {
+		t.Fatalf("Expected pruned height -1, found %d %v", height, err)
+	}
+	if err := prunable.PruneBlock(genesisID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if blockJson, err := prunable.GetBlockBytes(genesisID); err != nil || blockJson != nil {
+		t.Fatalf("Expected pruned block, found %v", err)
+	}
+	if header, _, err := prunable.GetBlockHeader(genesisID); err != nil || header == nil {
+		t.Fatalf("Expected pruned block header, found %v", err)
+	}
+	if height, err := prunable.GetPrunedHeight(); err != nil || height != 0 {
+		t.Fatalf("Expected pruned height 0, found %d %v", height, err)
+	}
+	if blockJson, err := prunable.GetBlockBytes(id); err != nil || blockJson == nil {
+		t.Fatalf("Expected unpruned block, found %v", err)
+	}
+}
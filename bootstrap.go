@@ -0,0 +1,219 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/pierrec/lz4"
+)
+
+// A bootstrap file is a portable stream of main chain blocks used to seed a node without a network.
+//
+// format: {magic}{version}{genesis id}[{length}{block json}...]
+//
+// The length is a big-endian uint32 and blocks appear in height order. The entire stream may
+// be wrapped in an lz4 frame.
+
+// BootstrapMagic begins every uncompressed bootstrap stream.
+const BootstrapMagic = "CRUZBOOT"
+
+// BootstrapVersion is the current version of the bootstrap format.
+const BootstrapVersion = 1
+
+// the lz4 frame magic number in the order it appears in a stream
+var lz4FrameMagic = []byte{0x04, 0x22, 0x4D, 0x18}
+
+// sanity limit on the length of a single block in a bootstrap stream
+const maxBootstrapBlockLength = 64 * 1024 * 1024
+
+// log progress every this many blocks
+const bootstrapProgressInterval = 1000
+
+// BootstrapWriter writes blocks to a bootstrap stream.
+type BootstrapWriter struct {
+	w  io.Writer
+	zw *lz4.Writer
+}
+
+// NewBootstrapWriter writes the bootstrap header for the given genesis block to w and returns
+// a BootstrapWriter. If compress is true the stream is compressed with lz4.
+func NewBootstrapWriter(w io.Writer, genesisID BlockID, compress bool) (*BootstrapWriter, error) {
+	b := &BootstrapWriter{w: w}
+	if compress {
+		b.zw = lz4.NewWriter(w)
+		b.w = b.zw
+	}
+	header := new(bytes.Buffer)
+	header.WriteString(BootstrapMagic)
+	header.WriteByte(BootstrapVersion)
+	header.Write(genesisID[:])
+	if _, err := b.w.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// WriteBlock writes the JSON encoding of a block to the stream.
+func (b *BootstrapWriter) WriteBlock(blockJson []byte) error {
+	if len(blockJson) > maxBootstrapBlockLength {
+		return fmt.Errorf("Block of %d bytes exceeds maximum length %d", len(blockJson), maxBootstrapBlockLength)
+	}
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(blockJson)))
+	if _, err := b.w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := b.w.Write(blockJson)
+	return err
+}
+
+// Close flushes any compressed data. It doesn't close the underlying writer.
+func (b *BootstrapWriter) Close() error {
+	if b.zw != nil {
+		return b.zw.Close()
+	}
+	return nil
+}
+
+// BootstrapReader reads blocks from a bootstrap stream.
+type BootstrapReader struct {
+	r         io.Reader
+	genesisID BlockID
+}
+
+// NewBootstrapReader reads the bootstrap header from r and returns a BootstrapReader.
+// Compressed streams are detected automatically.
+func NewBootstrapReader(r io.Reader) (*BootstrapReader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(lz4FrameMagic))
+	if err != nil {
+		return nil, err
+	}
+	b := &BootstrapReader{r: br}
+	if bytes.Equal(magic, lz4FrameMagic) {
+		b.r = lz4.NewReader(br)
+	}
+
+	header := make([]byte, len(BootstrapMagic)+1+len(b.genesisID))
+	if _, err := io.ReadFull(b.r, header); err != nil {
+		return nil, err
+	}
+	if string(header[:len(BootstrapMagic)]) != BootstrapMagic {
+		return nil, fmt.Errorf("Not a bootstrap file")
+	}
+	if version := header[len(BootstrapMagic)]; version != BootstrapVersion {
+		return nil, fmt.Errorf("Unsupported bootstrap version %d", version)
+	}
+	copy(b.genesisID[:], header[len(BootstrapMagic)+1:])
+	return b, nil
+}
+
+// GenesisID returns the ID of the genesis block of the chain in the stream.
+func (b *BootstrapReader) GenesisID() BlockID {
+	return b.genesisID
+}
+
+// ReadBlock returns the next block in the stream and its ID. It returns io.EOF at the end.
+func (b *BootstrapReader) ReadBlock() (*Block, BlockID, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(b.r, length[:]); err != nil {
+		return nil, BlockID{}, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > maxBootstrapBlockLength {
+		return nil, BlockID{}, fmt.Errorf("Block of %d bytes exceeds maximum length %d", n, maxBootstrapBlockLength)
+	}
+	blockJson := make([]byte, n)
+	if _, err := io.ReadFull(b.r, blockJson); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, BlockID{}, err
+	}
+	block := new(Block)
+	if err := json.Unmarshal(blockJson, block); err != nil {
+		return nil, BlockID{}, err
+	}
+	id, err := block.ID()
+	if err != nil {
+		return nil, BlockID{}, err
+	}
+	return block, id, nil
+}
+
+// ExportBlocks writes the main chain blocks from startHeight through endHeight to w as a bootstrap
+// stream. Returns the number of blocks written.
+func ExportBlocks(w io.Writer, genesisID BlockID, ledger Ledger, blockStore BlockStorage,
+	startHeight, endHeight int64, compress bool) (int64, error) {
+	bw, err := NewBootstrapWriter(w, genesisID, compress)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	for height := startHeight; height <= endHeight; height++ {
+		id, err := ledger.GetBlockIDForHeight(height)
+		if err != nil {
+			return count, err
+		}
+		if id == nil {
+			return count, fmt.Errorf("No block found at height %d", height)
+		}
+		blockJson, err := blockStore.GetBlockBytes(*id)
+		if err != nil {
+			return count, err
+		}
+		if blockJson == nil {
+			return count, fmt.Errorf("Block %s not found", *id)
+		}
+		if err := bw.WriteBlock(blockJson); err != nil {
+			return count, err
+		}
+		count++
+
+		if count%bootstrapProgressInterval == 0 {
+			log.Printf("Exported %d blocks, height: %d\n", count, height)
+		}
+	}
+
+	return count, bw.Close()
+}
+
+// ImportBlocks reads a bootstrap stream from r and processes each block in it with the processor.
+// Blocks receive the same validation as blocks from peers. Returns the number of blocks read.
+func ImportBlocks(r io.Reader, genesisID BlockID, processor *Processor) (int64, error) {
+	br, err := NewBootstrapReader(r)
+	if err != nil {
+		return 0, err
+	}
+	if br.GenesisID() != genesisID {
+		return 0, fmt.Errorf("Bootstrap file is for genesis block %s, expected %s", br.GenesisID(), genesisID)
+	}
+
+	var count int64
+	for {
+		block, id, err := br.ReadBlock()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		if err := processor.ProcessBlock(id, block, "import"); err != nil {
+			return count, fmt.Errorf("Error processing block %s at height %d: %s", id, block.Header.Height, err)
+		}
+		count++
+
+		if count%bootstrapProgressInterval == 0 {
+			log.Printf("Imported %d blocks, height: %d\n", count, block.Header.Height)
+		}
+	}
+}
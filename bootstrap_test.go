@@ -0,0 +1,209 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestBootstrapExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bootstrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	params := RegTestParams
+	genesis, genesisID, err := params.GenesisBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockStore, err := NewBlockStorageDisk(filepath.Join(dir, "blocks"), filepath.Join(dir, "headers.db"), false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockStore.Close()
+	ledger, err := NewLedgerDisk(params, filepath.Join(dir, "ledger.db"), false, false, blockStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ledger.Close()
+
+	if err := blockStore.Store(genesisID, genesis, 0); err != nil {
+		t.Fatal(err)
+	}
+	blocks, ids := []*Block{genesis}, []BlockID{genesisID}
+	for i := 0; i < 3; i++ {
+		block, id := storeTestBlock(t, blockStore, blocks[i], ids[i], 0, strconv.Itoa(i))
+		blocks, ids = append(blocks, block), append(ids, id)
+	}
+	for i := range blocks {
+		if _, err := ledger.ConnectBlock(ids[i], blocks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, compress := range []bool{false, true} {
+		buf := new(bytes.Buffer)
+		count, err := ExportBlocks(buf, genesisID, ledger, blockStore, 1, 3, compress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 3 {
+			t.Fatalf("Expected 3 blocks exported, found %d", count)
+		}
+
+		br, err := NewBootstrapReader(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if br.GenesisID() != genesisID {
+			t.Fatalf("Expected genesis %s, found %s", genesisID, br.GenesisID())
+		}
+		for i := 1; i <= 3; i++ {
+			block, id, err := br.ReadBlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != ids[i] || block.Header.Height != int64(i) {
+				t.Fatalf("Expected block %s at height %d, found %s at %d", ids[i], i, id, block.Header.Height)
+			}
+		}
+		if _, _, err := br.ReadBlock(); err != io.EOF {
+			t.Fatalf("Expected end of stream, found %v", err)
+		}
+	}
+
+	// blocks for another network aren't imported
+	buf := new(bytes.Buffer)
+	if _, err := ExportBlocks(buf, BlockID{}, ledger, blockStore, 0, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportBlocks(buf, genesisID, nil); err == nil {
+		t.Fatal("Expected mismatched genesis block to be rejected")
+	}
+
+	if _, err := NewBootstrapReader(bytes.NewReader([]byte("not a bootstrap file"))); err == nil {
+		t.Fatal("Expected invalid file to be rejected")
+	}
+}
+
+func TestBootstrapImport(t *testing.T) {
+	params := RegTestParams
+	genesis, genesisID, err := params.GenesisBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, ids := []*Block{genesis}, []BlockID{genesisID}
+	for i := 0; i < 3; i++ {
+		block, id := mineTestBlock(t, blocks[i], ids[i], pubKey)
+		blocks, ids = append(blocks, block), append(ids, id)
+	}
+
+	// import the stream into a fresh node and return its tip
+	importBlocks := func(stream []byte) (int64, BlockID, error) {
+		blockStore := NewBlockStorageMemory()
+		ledger := NewLedgerMemory(params, false, blockStore)
+		processor := NewProcessor(params, genesisID, blockStore, NewTransactionQueueMemory(ledger),
+			ledger, nil, ReorgPolicy{})
+		go processor.Run()
+		defer processor.Shutdown()
+		count, importErr := ImportBlocks(bytes.NewReader(stream), genesisID, processor)
+		tipID, _, err := ledger.GetChainTip()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tipID == nil {
+			return count, BlockID{}, importErr
+		}
+		return count, *tipID, importErr
+	}
+
+	// write the blocks to a stream
+	writeBlocks := func(blocks []*Block, compress bool) []byte {
+		buf := new(bytes.Buffer)
+		bw, err := NewBootstrapWriter(buf, genesisID, compress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, block := range blocks {
+			blockJson, err := json.Marshal(block)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := bw.WriteBlock(blockJson); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := bw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	// export from one node and import into another
+	blockStore := NewBlockStorageMemory()
+	ledger := NewLedgerMemory(params, false, blockStore)
+	processor := NewProcessor(params, genesisID, blockStore, NewTransactionQueueMemory(ledger),
+		ledger, nil, ReorgPolicy{})
+	for i, block := range blocks {
+		if err := processor.processBlock(ids[i], block, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, compress := range []bool{false, true} {
+		buf := new(bytes.Buffer)
+		if _, err := ExportBlocks(buf, genesisID, ledger, blockStore, 0, 3, compress); err != nil {
+			t.Fatal(err)
+		}
+		count, tipID, err := importBlocks(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 4 || tipID != ids[3] {
+			t.Fatalf("Expected 4 blocks imported with tip %s, found %d with tip %s", ids[3], count, tipID)
+		}
+	}
+
+	// a corrupted block is rejected and the blocks before it are kept
+	corrupt := *blocks[2]
+	header := *corrupt.Header
+	header.HashListRoot[0] ^= 0xff
+	corrupt.Header = &header
+	count, tipID, err := importBlocks(writeBlocks([]*Block{blocks[0], blocks[1], &corrupt, blocks[3]}, false))
+	if err == nil {
+		t.Fatal("Expected corrupted block to be rejected")
+	}
+	if count != 2 || tipID != ids[1] {
+		t.Fatalf("Expected 2 blocks imported with tip %s, found %d with tip %s", ids[1], count, tipID)
+	}
+
+	// a block before its parent is rejected
+	count, tipID, err = importBlocks(writeBlocks([]*Block{blocks[0], blocks[1], blocks[3], blocks[2]}, true))
+	if err == nil {
+		t.Fatal("Expected out of order block to be rejected")
+	}
+	if count != 2 || tipID != ids[1] {
+		t.Fatalf("Expected 2 blocks imported with tip %s, found %d with tip %s", ids[1], count, tipID)
+	}
+
+	// a truncated stream is rejected
+	stream := writeBlocks(blocks, false)
+	if _, _, err := importBlocks(stream[:len(stream)-10]); err == nil {
+		t.Fatal("Expected truncated stream to be rejected")
+	}
+}
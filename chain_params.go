@@ -0,0 +1,145 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// ChainParams defines the consensus rules and peering parameters which differ between networks.
+// The remaining consensus values in constants.go are shared by all networks.
+type ChainParams struct {
+	// Name identifies the network with the -network flag.
+	Name string
+
+	// GenesisBlockJson is the first block in the network's chain.
+	GenesisBlockJson string
+
+	// InitialTarget is the proof-of-work target of the genesis block and the maximum target.
+	InitialTarget string
+
+	// NoRetargeting keeps every block at the initial target.
+	NoRetargeting bool
+
+	RetargetInterval                   int64 // blocks
+	RetargetTime                       int64 // seconds
+	TargetSpacing                      int64 // seconds
+	RetargetSmaWindow                  int64 // blocks
+	BitcoinCashRetargetAlgorithmHeight int64
+
+	// CoinbaseMaturity is the number of blocks before a coinbase can be spent.
+	// If it's zero a coinbase can be spent in the block following the one it's in.
+	CoinbaseMaturity int64
+
+	// MaxTipAge is the age in seconds beyond which the tip is considered stale and the client
+	// assumes it's still syncing. If it's zero the tip is never considered stale.
+	MaxTipAge int64
+
+	// CheckpointsEnabled enables checking blocks against Checkpoints.
+	CheckpointsEnabled bool
+
+	// Checkpoints are known height and block ID pairs on the main chain.
+	Checkpoints map[int64]string
+
+	// LatestCheckpointHeight is used to determine if the client is synced.
+	LatestCheckpointHeight int64
+
+	// CheckpointKeys are base64-encoded public keys of developers allowed to sign checkpoints files.
+	// If there are none, checkpoints files don't need to be signed.
+	CheckpointKeys []string
+
+	// AssumeValid is the ID of a block whose ancestors' transaction signatures aren't verified
+	// during initial block download. If it's empty every signature is verified.
+	AssumeValid string
+
+	DefaultPort int
+	DNSSeeds    []string
+}
+
+// MainNetParams are the parameters of the main cruzbit network.
+var MainNetParams = &ChainParams{
+	Name:                               "mainnet",
+	GenesisBlockJson:                   GenesisBlockJson,
+	InitialTarget:                      InitialTarget,
+	RetargetInterval:                   RetargetInterval,
+	RetargetTime:                       RetargetTime,
+	TargetSpacing:                      TargetSpacing,
+	RetargetSmaWindow:                  RetargetSmaWindow,
+	BitcoinCashRetargetAlgorithmHeight: BitcoinCashRetargetAlgorithmHeight,
+	CoinbaseMaturity:                   CoinbaseMaturity,
+	MaxTipAge:                          MaxTipAge,
+	CheckpointsEnabled:                 true,
+	Checkpoints:                        Checkpoints,
+	LatestCheckpointHeight:             LatestCheckpointHeight,
+	AssumeValid:                        Checkpoints[LatestCheckpointHeight],
+	DefaultPort:                        DefaultCruzbitPort,
+	DNSSeeds:                           Seeders[:],
+}
+
+// TestNetParams are the parameters of the public test network. It follows the main network's rules
+// from a lower initial difficulty and its own genesis block.
+var TestNetParams = &ChainParams{
+	Name:                               "testnet",
+	GenesisBlockJson:                   TestNetGenesisBlockJson,
+	InitialTarget:                      "000000ffff000000000000000000000000000000000000000000000000000000",
+	RetargetInterval:                   RetargetInterval,
+	RetargetTime:                       RetargetTime,
+	TargetSpacing:                      TargetSpacing,
+	RetargetSmaWindow:                  RetargetSmaWindow,
+	BitcoinCashRetargetAlgorithmHeight: RetargetSmaWindow, // as soon as there are enough blocks
+	CoinbaseMaturity:                   CoinbaseMaturity,
+	MaxTipAge:                          MaxTipAge,
+	DefaultPort:                        DefaultCruzbitPort + 10000,
+}
+
+// RegTestParams are the parameters of a private network for local testing. Blocks can be mined
+// in moments on a CPU, the difficulty never changes and coinbases can be spent immediately.
+var RegTestParams = &ChainParams{
+	Name:             "regtest",
+	GenesisBlockJson: RegTestGenesisBlockJson,
+	InitialTarget:    "0000ffff00000000000000000000000000000000000000000000000000000000",
+	NoRetargeting:    true,
+	TargetSpacing:    TargetSpacing,
+	DefaultPort:      DefaultCruzbitPort + 10001,
+}
+
+var chainParamsByName = map[string]*ChainParams{
+	MainNetParams.Name: MainNetParams,
+	TestNetParams.Name: TestNetParams,
+	RegTestParams.Name: RegTestParams,
+}
+
+// ChainParamsForNetwork returns the parameters of the named network.
+func ChainParamsForNetwork(name string) (*ChainParams, error) {
+	params, ok := chainParamsByName[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown network: %s", name)
+	}
+	return params, nil
+}
+
+// NetworkNames returns the sorted names of the predefined networks.
+func NetworkNames() []string {
+	var names []string
+	for name := range chainParamsByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GenesisBlock returns the network's genesis block and its ID.
+func (c *ChainParams) GenesisBlock() (*Block, BlockID, error) {
+	block := new(Block)
+	if err := json.Unmarshal([]byte(c.GenesisBlockJson), block); err != nil {
+		return nil, BlockID{}, err
+	}
+	id, err := block.ID()
+	if err != nil {
+		return nil, BlockID{}, err
+	}
+	return block, id, nil
+}
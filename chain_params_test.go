@@ -0,0 +1,57 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestChainParamsGenesisBlocks(t *testing.T) {
+	seen := make(map[BlockID]string)
+	for _, name := range NetworkNames() {
+		params, err := ChainParamsForNetwork(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, id, err := params.GenesisBlock()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if other, ok := seen[id]; ok {
+			t.Fatalf("%s and %s share a genesis block", name, other)
+		}
+		seen[id] = name
+
+		if hex.EncodeToString(block.Header.Target[:]) != params.InitialTarget {
+			t.Fatalf("%s: genesis target %s doesn't match initial target %s",
+				name, block.Header.Target, params.InitialTarget)
+		}
+		if !block.CheckPOW(id) {
+			t.Fatalf("%s: genesis block %s fails proof-of-work", name, id)
+		}
+		if block.Header.Height != 0 || block.Header.Previous != (BlockID{}) {
+			t.Fatalf("%s: genesis block %s isn't the first block", name, id)
+		}
+	}
+
+	if _, err := ChainParamsForNetwork("nonet"); err == nil {
+		t.Fatal("Expected unknown network to be rejected")
+	}
+}
+
+func TestChainParamsNoRetargeting(t *testing.T) {
+	block, _, err := RegTestParams.GenesisBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the block store and ledger are never consulted without retargeting
+	target, err := computeTarget(RegTestParams, block.Header, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != block.Header.Target {
+		t.Fatalf("Expected target %s, found %s", block.Header.Target, target)
+	}
+}
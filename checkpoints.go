@@ -4,16 +4,22 @@
 package cruzbit
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
-)
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 
-// CheckpointsEnabled can be disabled for testing.
-const CheckpointsEnabled = true
+	"golang.org/x/crypto/ed25519"
+)
 
-// LatestCheckpointHeight is used to determine if the client is synced.
+// LatestCheckpointHeight is used to determine if the client is synced with the main network.
 const LatestCheckpointHeight = 145142
 
-// Checkpoints are known height and block ID pairs on the main chain.
+// Checkpoints are known height and block ID pairs on the main network's main chain.
 var Checkpoints map[int64]string = map[int64]string{
 	18144:  "000000000000b83e78ec29355d098256936389010d7450a288763ed4f191069e",
 	36288:  "00000000000052bd43e85cf60f2ecd1c5016083e6a560b3ee57427c7f2dd64e8",
@@ -27,11 +33,11 @@ var Checkpoints map[int64]string = map[int64]string{
 
 // CheckpointCheck returns an error if the passed height is a checkpoint and the
 // passed block ID does not match the given checkpoint block ID.
-func CheckpointCheck(id BlockID, height int64) error {
-	if !CheckpointsEnabled {
+func (c *ChainParams) CheckpointCheck(id BlockID, height int64) error {
+	if !c.CheckpointsEnabled {
 		return nil
 	}
-	checkpointID, ok := Checkpoints[height]
+	checkpointID, ok := c.Checkpoints[height]
 	if !ok {
 		return nil
 	}
@@ -41,3 +47,145 @@ func CheckpointCheck(id BlockID, height int64) error {
 	}
 	return nil
 }
+
+// CheckpointsFileName is the name of the file in the data directory containing additional checkpoints.
+const CheckpointsFileName = "checkpoints.json"
+
+// CheckpointsFile is the format of a file of checkpoints to add to the built-in set. Each signature
+// signs the JSON encoding of the checkpoints sorted by height.
+type CheckpointsFile struct {
+	Checkpoints []Checkpoint          `json:"checkpoints"`
+	Signatures  []CheckpointSignature `json:"signatures,omitempty"`
+}
+
+// Checkpoint is a known height and block ID pair on a network's main chain.
+type Checkpoint struct {
+	Height  int64   `json:"height"`
+	BlockID BlockID `json:"block_id"`
+}
+
+// CheckpointSignature is a signature of a checkpoints file.
+type CheckpointSignature struct {
+	PublicKey ed25519.PublicKey `json:"public_key"`
+	Signature Signature         `json:"signature"`
+}
+
+// the bytes each signature signs
+func (f CheckpointsFile) message() ([]byte, error) {
+	checkpoints := append([]Checkpoint(nil), f.Checkpoints...)
+	sort.Slice(checkpoints, func(i, j int) bool {
+		return checkpoints[i].Height < checkpoints[j].Height
+	})
+	return json.Marshal(checkpoints)
+}
+
+// Sign adds a signature of the checkpoints with the given private key.
+func (f *CheckpointsFile) Sign(privKey ed25519.PrivateKey) error {
+	message, err := f.message()
+	if err != nil {
+		return err
+	}
+	f.Signatures = append(f.Signatures, CheckpointSignature{
+		PublicKey: privKey.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(privKey, message),
+	})
+	return nil
+}
+
+// Verify returns true if the checkpoints are signed by any of the given public keys.
+func (f CheckpointsFile) Verify(pubKeys []ed25519.PublicKey) (bool, error) {
+	message, err := f.message()
+	if err != nil {
+		return false, err
+	}
+	for _, sig := range f.Signatures {
+		for _, pubKey := range pubKeys {
+			if bytes.Equal(sig.PublicKey, pubKey) && ed25519.Verify(pubKey, message, sig.Signature) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// LoadCheckpoints merges the checkpoints in the data directory's checkpoints file, if there is one,
+// with the network's built-in checkpoints. If the network or extraKeys specify any checkpoint public
+// keys, the file must be signed by one of them. Returns a copy of the parameters with the merged
+// checkpoints and the checkpoints which were added.
+func (c *ChainParams) LoadCheckpoints(dataDir string, extraKeys []string) (*ChainParams, []Checkpoint, error) {
+	path := filepath.Join(dataDir, CheckpointsFileName)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var file CheckpointsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, nil, fmt.Errorf("Invalid checkpoints file %s: %s", path, err)
+	}
+
+	var pubKeys []ed25519.PublicKey
+	for _, key := range append(append([]string(nil), c.CheckpointKeys...), extraKeys...) {
+		pubKeyBytes, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(pubKeyBytes) != ed25519.PublicKeySize {
+			return nil, nil, fmt.Errorf("Invalid checkpoint public key %s", key)
+		}
+		pubKeys = append(pubKeys, ed25519.PublicKey(pubKeyBytes))
+	}
+	if len(pubKeys) != 0 {
+		ok, err := file.Verify(pubKeys)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			return nil, nil, fmt.Errorf("Checkpoints file %s isn't signed by a checkpoint key", path)
+		}
+	}
+
+	params := *c
+	params.Checkpoints = make(map[int64]string)
+	for height, id := range c.Checkpoints {
+		params.Checkpoints[height] = id
+	}
+	var added []Checkpoint
+	for _, checkpoint := range file.Checkpoints {
+		if checkpoint.Height <= 0 {
+			return nil, nil, fmt.Errorf("Invalid checkpoint height %d", checkpoint.Height)
+		}
+		id, ok := params.Checkpoints[checkpoint.Height]
+		if ok {
+			if id != checkpoint.BlockID.String() {
+				return nil, nil, fmt.Errorf("Checkpoint %s at height %d conflicts with checkpoint %s",
+					checkpoint.BlockID, checkpoint.Height, id)
+			}
+			continue
+		}
+		params.Checkpoints[checkpoint.Height] = checkpoint.BlockID.String()
+		if checkpoint.Height > params.LatestCheckpointHeight {
+			params.LatestCheckpointHeight = checkpoint.Height
+		}
+		added = append(added, checkpoint)
+	}
+	if len(params.Checkpoints) != 0 {
+		params.CheckpointsEnabled = true
+	}
+	return &params, added, nil
+}
+
+// SortedCheckpoints returns the network's checkpoints sorted by height.
+func (c *ChainParams) SortedCheckpoints() []Checkpoint {
+	var checkpoints []Checkpoint
+	for height, id := range c.Checkpoints {
+		var blockID BlockID
+		if err := blockID.UnmarshalJSON([]byte(`"` + id + `"`)); err != nil {
+			continue
+		}
+		checkpoints = append(checkpoints, Checkpoint{Height: height, BlockID: blockID})
+	}
+	sort.Slice(checkpoints, func(i, j int) bool {
+		return checkpoints[i].Height < checkpoints[j].Height
+	})
+	return checkpoints
+}
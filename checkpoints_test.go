@@ -0,0 +1,99 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func writeTestCheckpointsFile(t *testing.T, dir string, file *CheckpointsFile) {
+	data, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, CheckpointsFileName), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadCheckpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// no file
+	params, added, err := RegTestParams.LoadCheckpoints(dir, nil)
+	if err != nil || params != RegTestParams || len(added) != 0 {
+		t.Fatalf("Expected unchanged parameters without a file, found %v %v", added, err)
+	}
+
+	var id BlockID
+	id[0] = 1
+	file := &CheckpointsFile{Checkpoints: []Checkpoint{{Height: 20, BlockID: id}, {Height: 10, BlockID: id}}}
+	writeTestCheckpointsFile(t, dir, file)
+
+	params, added, err = RegTestParams.LoadCheckpoints(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 2 || !params.CheckpointsEnabled || params.LatestCheckpointHeight != 20 {
+		t.Fatalf("Expected 2 checkpoints up to height 20, found %v %d", added, params.LatestCheckpointHeight)
+	}
+	if err := params.CheckpointCheck(BlockID{}, 10); err == nil {
+		t.Fatal("Expected mismatched block to fail the checkpoint")
+	}
+	if err := params.CheckpointCheck(id, 10); err != nil {
+		t.Fatal(err)
+	}
+	if RegTestParams.CheckpointsEnabled || len(RegTestParams.Checkpoints) != 0 {
+		t.Fatal("Expected the network's parameters to be unchanged")
+	}
+	if sorted := params.SortedCheckpoints(); len(sorted) != 2 || sorted[0].Height != 10 {
+		t.Fatalf("Expected checkpoints sorted by height, found %v", sorted)
+	}
+
+	// a key requires a signature
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{base64.StdEncoding.EncodeToString(pubKey)}
+	if _, _, err := RegTestParams.LoadCheckpoints(dir, keys); err == nil {
+		t.Fatal("Expected unsigned checkpoints to be rejected")
+	}
+	if err := file.Sign(otherKey); err != nil {
+		t.Fatal(err)
+	}
+	writeTestCheckpointsFile(t, dir, file)
+	if _, _, err := RegTestParams.LoadCheckpoints(dir, keys); err == nil {
+		t.Fatal("Expected checkpoints signed by another key to be rejected")
+	}
+	if err := file.Sign(privKey); err != nil {
+		t.Fatal(err)
+	}
+	writeTestCheckpointsFile(t, dir, file)
+	if _, added, err := RegTestParams.LoadCheckpoints(dir, keys); err != nil || len(added) != 2 {
+		t.Fatalf("Expected signed checkpoints to load, found %v %v", added, err)
+	}
+
+	// built-in checkpoints can't be contradicted
+	file = &CheckpointsFile{Checkpoints: []Checkpoint{{Height: LatestCheckpointHeight, BlockID: id}}}
+	writeTestCheckpointsFile(t, dir, file)
+	if _, _, err := MainNetParams.LoadCheckpoints(dir, nil); err == nil {
+		t.Fatal("Expected conflicting checkpoint to be rejected")
+	}
+}
@@ -6,7 +6,6 @@ package main
 import (
 	"bufio"
 	"encoding/base64"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -30,25 +29,106 @@ func main() {
 	pubKeyPtr := flag.String("pubkey", "", "A public key which receives newly mined block rewards")
 	dataDirPtr := flag.String("datadir", "", "Path to a directory to save block chain data")
 	memoPtr := flag.String("memo", "", "A memo to include in newly mined blocks")
-	portPtr := flag.Int("port", DefaultCruzbitPort, "Port to listen for incoming peer connections")
+	portPtr := flag.Int("port", 0, "Port to listen for incoming peer connections (defaults to the network's port)")
 	peerPtr := flag.String("peer", "", "Address of a peer to connect to")
 	upnpPtr := flag.Bool("upnp", false, "Attempt to forward the cruzbit port on your router with UPnP")
 	dnsSeedPtr := flag.Bool("dnsseed", false, "Run a DNS server to allow others to find peers")
-	compressPtr := flag.Bool("compress", false, "Compress blocks on disk with lz4")
+	compressPtr := flag.Bool("compress", false, "Compress blocks on disk with lz4 or zstd with -binaryblocks")
+	binaryBlocksPtr := flag.Bool("binaryblocks", false,
+		"Store blocks on disk in a compact binary encoding instead of JSON")
+	blockSegmentsPtr := flag.Bool("blocksegments", false,
+		"Store blocks in append-only segment files instead of a file per block")
 	numMinersPtr := flag.Int("numminers", 1, "Number of miners to run")
 	noIrcPtr := flag.Bool("noirc", true, "Disable use of IRC for peer discovery")
 	noAcceptPtr := flag.Bool("noaccept", false, "Disable inbound peer connections")
 	prunePtr := flag.Bool("prune", false, "Prune transaction and public key transaction indices")
+	pruneBlocksPtr := flag.Int64("pruneblocks", 0,
+		"Delete the bodies of main chain blocks more than this many blocks below the tip (0 to keep all blocks)")
 	keyFilePtr := flag.String("keyfile", "", "Path to a file containing public keys to use when mining")
 	tlsCertPtr := flag.String("tlscert", "", "Path to a file containing a PEM-encoded X.509 certificate to use with TLS")
 	tlsKeyPtr := flag.String("tlskey", "", "Path to a file containing a PEM-encoded private key to use with TLS")
 	inLimitPtr := flag.Int("inlimit", MaxInboundPeerConnections, "Limit for the number of inbound peer connections.")
 	banListPtr := flag.String("banlist", "", "Path to a file containing a list of banned host addresses")
+	indexesPtr := flag.String("indexes", "directory,names",
+		"Comma-separated list of index modules to enable (available: "+strings.Join(IndexModuleNames(), ", ")+")")
+	networkPtr := flag.String("network", MainNetParams.Name,
+		"Network to join (available: "+strings.Join(NetworkNames(), ", ")+")")
+	assumeValidPtr := flag.String("assumevalid", "",
+		"Skip verifying transaction signatures in this block and its ancestors while syncing (defaults to the network's block, 0 to disable)")
+	checkpointKeysPtr := flag.String("checkpointkeys", "",
+		"Comma-separated list of base64 encoded public keys allowed to sign the checkpoints file in addition to the network's")
+	maxReorgDepthPtr := flag.Int64("maxreorgdepth", DefaultMaxReorgDepth,
+		"Refuse reorganizations disconnecting more than this many blocks (0 for no limit)")
+	reorgWebhookPtr := flag.String("reorgwebhook", "", "URL to receive an HTTP POST alert for each refused reorganization")
+	reindexPtr := flag.Bool("reindex", false, "Rebuild the ledger from the blocks in block storage")
+	checkLedgerPtr := flag.Bool("checkledger", false,
+		"Check the whole chain against block storage at startup instead of only the most recent blocks")
+	importPtr := flag.String("import", "", "Path to a bootstrap file of blocks to process at startup")
+	snapshotPtr := flag.String("snapshot", "", "Path to a ledger snapshot to start a new node from")
+	snapshotHashPtr := flag.String("snapshothash", "", "Expected hash of the ledger snapshot")
+	unsafeSnapshotPtr := flag.Bool("unsafesnapshot", false,
+		"Trust a ledger snapshot without -snapshothash. Whoever provided it decides every balance")
+	backValidatePtr := flag.String("backvalidate", "",
+		"Path to a bootstrap file used to validate the history preceding the ledger snapshot in the background")
 	flag.Parse()
 
 	if len(*dataDirPtr) == 0 {
 		log.Fatal("-datadir argument required")
 	}
+	params, err := ChainParamsForNetwork(*networkPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if params != MainNetParams {
+		// keep other networks' block chain data apart
+		*dataDirPtr = filepath.Join(*dataDirPtr, params.Name)
+	}
+	if *portPtr == 0 {
+		*portPtr = params.DefaultPort
+	}
+
+	// load additional checkpoints
+	var checkpointKeys []string
+	for _, key := range strings.Split(*checkpointKeysPtr, ",") {
+		if key = strings.TrimSpace(key); len(key) != 0 {
+			checkpointKeys = append(checkpointKeys, key)
+		}
+	}
+	params, checkpoints, err := params.LoadCheckpoints(*dataDirPtr, checkpointKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(checkpoints) != 0 {
+		log.Printf("Loaded %d checkpoint(s), latest checkpoint height: %d\n",
+			len(checkpoints), params.LatestCheckpointHeight)
+	}
+	if len(*assumeValidPtr) == 0 {
+		*assumeValidPtr = params.AssumeValid
+	}
+	var assumeValid BlockID
+	if len(*assumeValidPtr) != 0 && *assumeValidPtr != "0" {
+		if err := assumeValid.UnmarshalJSON([]byte(strconv.Quote(*assumeValidPtr))); err != nil {
+			log.Fatalf("Invalid -assumevalid block ID: %s\n", err)
+		}
+	}
+	if len(*snapshotPtr) != 0 {
+		if len(*snapshotHashPtr) == 0 && !*unsafeSnapshotPtr {
+			log.Fatal("-snapshot requires -snapshothash")
+		}
+		if *maxReorgDepthPtr == 0 {
+			log.Fatal("-snapshot requires a -maxreorgdepth limit")
+		}
+	}
+	if *pruneBlocksPtr != 0 {
+		if *maxReorgDepthPtr == 0 {
+			log.Fatal("-pruneblocks requires a -maxreorgdepth limit")
+		}
+		if minDepth := MinPruneDepth(params, *maxReorgDepthPtr); *pruneBlocksPtr < minDepth {
+			log.Fatalf("-pruneblocks must be at least %d with -maxreorgdepth %d\n", minDepth, *maxReorgDepthPtr)
+		}
+		// indices of pruned transactions are of no use
+		*prunePtr = true
+	}
 	if len(*tlsCertPtr) != 0 && len(*tlsKeyPtr) == 0 {
 		log.Fatal("-tlskey argument missing")
 	}
@@ -59,7 +139,7 @@ func main() {
 	if len(*peerPtr) != 0 {
 		// add default port, if one was not supplied
 		if i := strings.LastIndex(*peerPtr, ":"); i < 0 {
-			*peerPtr = *peerPtr + ":" + strconv.Itoa(DefaultCruzbitPort)
+			*peerPtr = *peerPtr + ":" + strconv.Itoa(params.DefaultPort)
 		}
 	}
 
@@ -109,32 +189,36 @@ func main() {
 	}
 
 	// load genesis block
-	genesisBlock := new(Block)
-	if err := json.Unmarshal([]byte(GenesisBlockJson), genesisBlock); err != nil {
-		log.Fatal(err)
-	}
-
-	genesisID, err := genesisBlock.ID()
+	genesisBlock, genesisID, err := params.GenesisBlock()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Println("Starting up...")
+	log.Printf("Starting up on %s...\n", params.Name)
 	log.Printf("Genesis block ID: %s\n", genesisID)
 
 	// instantiate storage
-	blockStore, err := NewBlockStorageDisk(
-		filepath.Join(*dataDirPtr, "blocks"),
-		filepath.Join(*dataDirPtr, "headers.db"),
-		false, // not read-only
-		*compressPtr,
-	)
+	blockStore, err := openBlockStorage(*dataDirPtr, *blockSegmentsPtr, *compressPtr, *binaryBlocksPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// rebuild the ledger if asked to or if a previous attempt was interrupted
+	ledgerPath := filepath.Join(*dataDirPtr, "ledger.db")
+	reindexing, err := ReindexInProgress(ledgerPath)
 	if err != nil {
+		blockStore.Close()
 		log.Fatal(err)
 	}
+	if *reindexPtr || reindexing {
+		if err := Reindex(params, genesisID, blockStore, ledgerPath, *prunePtr); err != nil {
+			blockStore.Close()
+			log.Fatal(err)
+		}
+	}
 
 	// instantiate the ledger
-	ledger, err := NewLedgerDisk(filepath.Join(*dataDirPtr, "ledger.db"),
+	ledger, err := NewLedgerDisk(params, ledgerPath,
 		false, // not read-only
 		*prunePtr,
 		blockStore)
@@ -143,6 +227,46 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// start from a ledger snapshot
+	if len(*snapshotPtr) != 0 {
+		if err := loadSnapshot(*snapshotPtr, *snapshotHashPtr, *maxReorgDepthPtr,
+			params, genesisID, ledger); err != nil {
+			ledger.Close()
+			blockStore.Close()
+			log.Fatal(err)
+		}
+	}
+	snapshotInfo, err := ledger.GetSnapshotInfo()
+	if err != nil {
+		ledger.Close()
+		blockStore.Close()
+		log.Fatal(err)
+	}
+	baseID, baseHeight := genesisID, int64(0)
+	if snapshotInfo != nil {
+		baseID, baseHeight = snapshotInfo.BaseID, snapshotInfo.BaseHeight
+		log.Printf("Ledger started from snapshot %s at height %d, history validated: %v\n",
+			snapshotInfo.Hash, snapshotInfo.Height, snapshotInfo.Validated)
+		if *maxReorgDepthPtr == 0 {
+			// blocks before the snapshot can't be disconnected
+			ledger.Close()
+			blockStore.Close()
+			log.Fatal("A ledger started from a snapshot requires a -maxreorgdepth limit")
+		}
+	}
+
+	// make sure the ledger agrees with block storage
+	log.Println("Checking ledger consistency...")
+	checkDepth := int64(CheckLedgerDepth)
+	if *checkLedgerPtr {
+		checkDepth = 0
+	}
+	if err := CheckLedger(baseID, baseHeight, checkDepth, ledger, blockStore); err != nil {
+		ledger.Close()
+		blockStore.Close()
+		log.Fatalf("Ledger is inconsistent: %s, restart with -reindex to rebuild it\n", err)
+	}
+
 	// instantiate peer storage
 	peerStore, err := NewPeerStorageDisk(filepath.Join(*dataDirPtr, "peers.db"))
 	if err != nil {
@@ -151,20 +275,64 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// instantiate reorganization storage
+	reorgStore, err := NewReorgStorageDisk(filepath.Join(*dataDirPtr, "reorgs.db"), false)
+	if err != nil {
+		peerStore.Close()
+		ledger.Close()
+		blockStore.Close()
+		log.Fatal(err)
+	}
+
 	// instantiate the transaction queue
 	txQueue := NewTransactionQueueMemory(ledger)
 
+	// headers synced ahead of the ledger
+	headerChain := NewHeaderChain(params, assumeValid, blockStore, ledger)
+
 	// create and run the processor
-	processor := NewProcessor(genesisID, blockStore, txQueue, ledger)
+	reorgPolicy := ReorgPolicy{
+		MaxDepth:   *maxReorgDepthPtr,
+		Store:      reorgStore,
+		WebhookURL: *reorgWebhookPtr,
+	}
+	processor := NewProcessor(params, genesisID, blockStore, txQueue, ledger, headerChain, reorgPolicy)
 	processor.Run()
 
-	// process the genesis block
-	if err := processor.ProcessBlock(genesisID, genesisBlock, ""); err != nil {
-		processor.Shutdown()
-		peerStore.Close()
-		ledger.Close()
-		blockStore.Close()
-		log.Fatal(err)
+	// process the genesis block unless the ledger begins with a snapshot
+	if snapshotInfo == nil {
+		if err := processor.ProcessBlock(genesisID, genesisBlock, ""); err != nil {
+			processor.Shutdown()
+			reorgStore.Close()
+			peerStore.Close()
+			ledger.Close()
+			blockStore.Close()
+			log.Fatal(err)
+		}
+	}
+
+	// validate the history preceding the snapshot
+	if len(*backValidatePtr) != 0 {
+		if snapshotInfo == nil {
+			log.Println("Ledger wasn't started from a snapshot, ignoring -backvalidate")
+		} else if snapshotInfo.Validated {
+			log.Println("Snapshot history already validated, ignoring -backvalidate")
+		} else {
+			go backValidateSnapshot(*backValidatePtr, filepath.Join(*dataDirPtr, "backvalidate"),
+				params, snapshotInfo, ledger)
+		}
+	}
+
+	// import blocks from a bootstrap file
+	if len(*importPtr) != 0 {
+		if err := importBootstrapFile(*importPtr, genesisID, processor); err != nil {
+			processor.Shutdown()
+			reorgStore.Close()
+			peerStore.Close()
+			ledger.Close()
+			blockStore.Close()
+			log.Fatal(err)
+		}
 	}
 
 	var miners []*Miner
@@ -173,7 +341,7 @@ func main() {
 		hashUpdateChan := make(chan int64, *numMinersPtr)
 		// create and run miners
 		for i := 0; i < *numMinersPtr; i++ {
-			miner := NewMiner(pubKeys, *memoPtr, blockStore, txQueue, ledger, processor, hashUpdateChan, i)
+			miner := NewMiner(params, pubKeys, *memoPtr, blockStore, txQueue, ledger, processor, hashUpdateChan, i)
 			miners = append(miners, miner)
 			miner.Run()
 		}
@@ -187,7 +355,7 @@ func main() {
 	// start a dns server
 	var seeder *DNSSeeder
 	if *dnsSeedPtr {
-		seeder = NewDNSSeeder(peerStore, *portPtr)
+		seeder = NewDNSSeeder(params, peerStore, *portPtr)
 		seeder.Run()
 	}
 
@@ -204,11 +372,49 @@ func main() {
 		}
 	}
 
-	indexer := NewIndexer(blockStore, ledger, processor, genesisID)
+	// index modules save their state when blocks are pruned so they needn't replay the chain
+	var indexStateDir string
+	if *pruneBlocksPtr != 0 {
+		indexStateDir = filepath.Join(*dataDirPtr, "index")
+	}
+	indexer := NewIndexer(params, blockStore, ledger, processor, baseID, indexStateDir)
+	var indexing bool
+	for _, name := range strings.Split(*indexesPtr, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		if snapshotInfo != nil {
+			// modules need the chain's full history
+			log.Printf("Ledger started from a snapshot, not enabling index module: %s\n", name)
+			continue
+		}
+		module, err := NewIndexModule(name, blockStore, ledger)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := indexer.AddModule(module); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Enabled index module: %s\n", name)
+		indexing = true
+	}
 	indexer.Run()
 
+	// prune old block bodies
+	var pruner *BlockPruner
+	if *pruneBlocksPtr != 0 {
+		var pruneIndexer *Indexer
+		if indexing {
+			pruneIndexer = indexer
+		}
+		pruner = NewBlockPruner(blockStore, ledger, processor, pruneIndexer, *pruneBlocksPtr)
+		pruner.Run()
+		log.Printf("Pruning blocks more than %d blocks below the tip\n", *pruneBlocksPtr)
+	}
+
 	// manage peer connections
-	peerManager := NewPeerManager(genesisID, peerStore, blockStore, ledger, processor, indexer, txQueue,
+	peerManager := NewPeerManager(params, genesisID, peerStore, blockStore, ledger, processor, headerChain, indexer, txQueue,
 		*dataDirPtr, myExternalIP, *peerPtr, *tlsCertPtr, *tlsKeyPtr,
 		*portPtr, *inLimitPtr, !*noAcceptPtr, !*noIrcPtr, *dnsSeedPtr, banMap)
 	peerManager.Run()
@@ -236,6 +442,10 @@ func main() {
 
 		// shut everything down now
 		peerManager.Shutdown()
+		if pruner != nil {
+			pruner.Shutdown()
+		}
+		indexer.Shutdown()
 		if seeder != nil {
 			seeder.Shutdown()
 		}
@@ -248,6 +458,9 @@ func main() {
 		processor.Shutdown()
 
 		// close storage
+		if err := reorgStore.Close(); err != nil {
+			log.Println(err)
+		}
 		if err := peerStore.Close(); err != nil {
 			log.Println(err)
 		}
@@ -264,6 +477,46 @@ func main() {
 	log.Println("Exiting")
 }
 
+// diskBlockStorage is implemented by both on-disk block storage layouts
+type diskBlockStorage interface {
+	BlockStorage
+	ForEachBlockHeader(fn func(id BlockID, header *BlockHeader, when int64) error) error
+	PruneBlock(id BlockID, height int64) error
+	GetPrunedHeight() (int64, error)
+	Close() error
+}
+
+// open block storage with the chosen layout. a data directory can't switch layouts without migrating
+// but new blocks can be stored in a different encoding at any time
+func openBlockStorage(dataDir string, segments, compress, binaryEncoding bool) (diskBlockStorage, error) {
+	segmentsDbPath := filepath.Join(dataDir, "segments.db")
+	headersDbPath := filepath.Join(dataDir, "headers.db")
+	_, segmentsErr := os.Stat(segmentsDbPath)
+	_, headersErr := os.Stat(headersDbPath)
+	if segments {
+		if os.IsNotExist(segmentsErr) && headersErr == nil {
+			return nil, fmt.Errorf("Blocks are stored a file per block, run the inspector's migrate command first")
+		}
+		return NewBlockStorageSegments(
+			filepath.Join(dataDir, "segments"),
+			segmentsDbPath,
+			false, // not read-only
+			compress,
+			binaryEncoding,
+		)
+	}
+	if segmentsErr == nil {
+		return nil, fmt.Errorf("Blocks are stored in segment files, run with -blocksegments")
+	}
+	return NewBlockStorageDisk(
+		filepath.Join(dataDir, "blocks"),
+		headersDbPath,
+		false, // not read-only
+		compress,
+		binaryEncoding,
+	)
+}
+
 func loadPublicKeys(pubKeyEncoded, keyFile string) ([]ed25519.PublicKey, error) {
 	var pubKeysEncoded []string
 	var pubKeys []ed25519.PublicKey
@@ -317,3 +570,86 @@ func loadBanList(banListFile string) (map[string]bool, error) {
 	}
 	return banMap, nil
 }
+
+// process the blocks in a bootstrap file
+func importBootstrapFile(path string, genesisID BlockID, processor *Processor) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	log.Printf("Importing blocks from %s...\n", path)
+	count, err := ImportBlocks(file, genesisID, processor)
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported %d blocks\n", count)
+	return nil
+}
+
+// initialize an empty ledger from a snapshot file
+func loadSnapshot(path, expectHash string, maxReorgDepth int64,
+	params *ChainParams, genesisID BlockID, ledger *LedgerDisk) error {
+	tipID, _, err := ledger.GetChainTip()
+	if err != nil {
+		return err
+	}
+	if tipID != nil {
+		log.Println("Ledger already initialized, ignoring -snapshot")
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	log.Printf("Loading ledger snapshot from %s...\n", path)
+	snapshot, hash, err := ReadLedgerSnapshot(file)
+	if err != nil {
+		return err
+	}
+	if len(expectHash) != 0 {
+		var expect SnapshotHash
+		if err := expect.SetString(expectHash); err != nil {
+			return err
+		}
+		if hash != expect {
+			return fmt.Errorf("Snapshot hash %s doesn't match -snapshothash %s", hash, expect)
+		}
+	} else {
+		log.Printf("WARNING: -unsafesnapshot given, trusting snapshot %s without -snapshothash\n", hash)
+	}
+	if err := snapshot.Verify(params, genesisID, maxReorgDepth); err != nil {
+		return err
+	}
+	if err := ledger.ImportSnapshot(snapshot); err != nil {
+		return err
+	}
+	log.Printf("Loaded snapshot %s, tip: %s, height: %d, balances: %d\n",
+		hash, snapshot.TipID, snapshot.Height, len(snapshot.Balances))
+	return nil
+}
+
+// validate the history preceding the ledger's snapshot from a bootstrap file
+func backValidateSnapshot(path, dir string, params *ChainParams, info *SnapshotInfo, ledger *LedgerDisk) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("ALERT: snapshot back-validation failed: %s\n", err)
+		return
+	}
+	defer file.Close()
+
+	log.Printf("Back-validating snapshot history from %s...\n", path)
+	if err := BackValidateSnapshot(params, info, file, dir); err != nil {
+		log.Printf("ALERT: snapshot back-validation failed: %s\n", err)
+		return
+	}
+	if err := ledger.MarkSnapshotValidated(); err != nil {
+		log.Println(err)
+		return
+	}
+	log.Printf("Snapshot %s history validated\n", info.Hash)
+}
@@ -68,6 +68,16 @@ const MaxTipAge = 24 * 60 * 60 * 30
 
 const MaxProtocolMessageLength = 2 * 1024 * 1024 // doesn't apply to blocks
 
+const MaxGraphPageLength = 256 * 1024 // leaves room for JSON escaping within MaxProtocolMessageLength
+
+const MaxGraphCacheEntries = 256
+
+const MaxMergedGraphDirectories = 16
+
+// reorganizations aren't limited by default. refusing one is a local consensus choice
+// which can leave a node on a different chain than its peers so operators opt in
+const DefaultMaxReorgDepth = 0
+
 // the below values are mining policy and also do not affect ledger consensus
 
 // if you change this it needs to be less than the maximum at the current height
@@ -75,6 +85,9 @@ const MaxTransactionsToIncludePerBlock = InitialMaxTransactionsPerBlock
 
 const MaxTransactionQueueLength = MaxTransactionsToIncludePerBlock * 10
 
+// holds every queued transaction's signature with room for those in recently processed blocks
+const SignatureCacheSize = MaxTransactionQueueLength * 2
+
 const MinFeeCruzbits = 1000000 // 0.01 cruz
 
 const MinAmountCruzbits = 1000000 // 0.01 cruz
@@ -7,129 +7,121 @@ import (
 	"strings"
 )
 
+// the key of a directory's root node
+var rootNode = pad44("0")
+
 type node struct {
-	pubkey    string
-	ranking   float64
-	outbound  float64
+	pubkey   string
+	ranking  float64
+	outbound float64
+	out      []uint32 // indices of the edges from this node
+	in       []uint32 // indices of the edges to this node
+	dirty    bool     // outbound weights changed since the last rank
 }
 
 type edge struct {
+	source uint32
+	target uint32
 	weight float64
 	height int64
 	time   int64
 }
 
-// Graph holds node and edge data.
+// Graph holds node and edge data. Nodes and edges are stored in insertion order
+// and each node keeps the indices of its edges so they can be found without a scan.
 type Graph struct {
-	index map[string]uint32
-	nodes map[uint32]*node
-	edges map[uint32]map[uint32]*edge
+	index     map[string]uint32
+	nodes     []node
+	edges     []edge
+	edgeIndex map[uint64]uint32
+
+	// compact representation used for ranking. it's rebuilt when edges are added
+	// and updated in place when only the weights of existing edges have changed
+	compact    *compactGraph
+	dirty      []uint32 // nodes whose outbound weights changed since the last rank
+	structural bool     // edges were added since the last rank
+}
+
+// compactGraph holds a graph's normalized edge weights in compressed sparse row form.
+// The edges from node i are at positions offsets[i] through offsets[i+1]-1 in the
+// same order as the node's out list.
+type compactGraph struct {
+	offsets []uint32
+	targets []uint32
+	weights []float64
 }
 
 // NewGraph initializes and returns a new graph.
 func NewGraph() *Graph {
 	return &Graph{
-		edges: make(map[uint32](map[uint32]*edge)),
-		nodes: make(map[uint32]*node),
-		index: make(map[string]uint32),
+		index:     make(map[string]uint32),
+		edgeIndex: make(map[uint64]uint32),
 	}
 }
 
+func (graph *Graph) nodeIndex(pubkey string) uint32 {
+	if index, ok := graph.index[pubkey]; ok {
+		return index
+	}
+	index := uint32(len(graph.nodes))
+	graph.index[pubkey] = index
+	graph.nodes = append(graph.nodes, node{pubkey: pubkey})
+	return index
+}
+
 // Link creates a weighted edge between a source-target node pair.
 // If the edge already exists, the weight is incremented.
 func (graph *Graph) Link(src, tgt string, weight float64, height int64, time int64) float64 {
-	source := pad44(src)
-	target := pad44(tgt)
-
-	if _, ok := graph.index[source]; !ok {
-		index := uint32(len(graph.index))
-		graph.index[source] = index
-		graph.nodes[index] = &node{
-			ranking:  0,
-			outbound: 0,
-			pubkey:   source,
-		}
+	sIndex := graph.nodeIndex(pad44(src))
+	tIndex := graph.nodeIndex(pad44(tgt))
+
+	key := uint64(sIndex)<<32 | uint64(tIndex)
+	eIndex, ok := graph.edgeIndex[key]
+	if !ok {
+		eIndex = uint32(len(graph.edges))
+		graph.edgeIndex[key] = eIndex
+		graph.edges = append(graph.edges, edge{source: sIndex, target: tIndex})
+		graph.nodes[sIndex].out = append(graph.nodes[sIndex].out, eIndex)
+		graph.nodes[tIndex].in = append(graph.nodes[tIndex].in, eIndex)
+		graph.structural = true
 	}
 
-	if _, ok := graph.index[target]; !ok {
-		index := uint32(len(graph.index))
-		graph.index[target] = index
-		graph.nodes[index] = &node{
-			ranking:  0,
-			outbound: 0,
-			pubkey:   target,
-		}
-	}
-
-	sIndex := graph.index[source]
-	tIndex := graph.index[target]
-
-	if _, ok := graph.edges[sIndex]; !ok {
-		graph.edges[sIndex] = map[uint32]*edge{}
-	}
-
-	if _, ok := graph.edges[sIndex][tIndex]; !ok {
-		graph.edges[sIndex][tIndex] = &edge{}
-	}
-	graph.edges[sIndex][tIndex].weight += weight
-	graph.edges[sIndex][tIndex].height = height
-	graph.edges[sIndex][tIndex].time = time
+	e := &graph.edges[eIndex]
+	e.weight += weight
+	e.height = height
+	e.time = time
 
 	graph.nodes[sIndex].outbound += weight
+	if !graph.nodes[sIndex].dirty {
+		graph.nodes[sIndex].dirty = true
+		graph.dirty = append(graph.dirty, sIndex)
+	}
 
 	return weight
 }
 
 func (g *Graph) ToDOT(pubKey string, states map[string]*KeyState) string {
+	edges, includedNodes := g.neighborhood(pubKey)
+	return g.renderDOT(edges, includedNodes, states)
+}
 
-	pkIndex := g.index[pubKey] //defaults to zero- the directory root
-
+// Renders the given edges and nodes in DOT format.
+func (g *Graph) renderDOT(edges, includedNodes []uint32, states map[string]*KeyState) string {
 	var builder strings.Builder
 	builder.WriteString("digraph G {\n")
 
-	includedNodes := []uint32{}
-
-	for from, edge := range g.edges {
-		for to, e := range edge {
-			if (from == pkIndex || to == pkIndex) && e.weight > 0 {
-
-				builder.WriteString(fmt.Sprintf(
-					"  \"%d\" -> \"%d\" [weight=\"%f\", height=\"%d\", time=\"%d\"];\n",
-					from, to, e.weight, e.height, e.time,
-				))
-
-				if !containsInt(includedNodes, from) {
-					includedNodes = append(includedNodes, from)
-				}
-
-				if !containsInt(includedNodes, to) {
-					includedNodes = append(includedNodes, to)
-				}
-			}
-		}
+	for _, eIndex := range edges {
+		e := &g.edges[eIndex]
+		builder.WriteString(fmt.Sprintf(
+			"  \"%d\" -> \"%d\" [weight=\"%f\", height=\"%d\", time=\"%d\"];\n",
+			e.source, e.target, e.weight, e.height, e.time,
+		))
 	}
 
 	// Add nodes with ranks
 	for _, id := range includedNodes {
-		node := g.nodes[id]
-		label := fmt.Sprintf("%.*s", 15, strings.TrimRight(node.pubkey, "0="))
-		memo := ""
-
-		if st, ok := states[node.pubkey]; ok {
-			memo = st.memo
-
-			if st.label != "" {
-				label = st.label
-			}
-
-			if st.time != 0 {
-				label = label + "/v" + strconv.Itoa(int(st.revision)) + " (" + timeAgo(st.time) + ") "
-			}
-		}
-
-		if id == 0 {
-			label = "root"
-		}
+		node := &g.nodes[id]
+		label, memo := g.nodeLabel(id, states)
 
 		builder.WriteString(fmt.Sprintf(
 			"  \"%d\" [label=\"%s\", pubkey=\"%s\", memo=\"%s\", ranking=\"%f\"];\n",
@@ -141,13 +133,85 @@ func (g *Graph) ToDOT(pubKey string, states map[string]*KeyState) string {
 	return builder.String()
 }
 
-func containsInt(slice []uint32, value uint32) bool {
-	for _, v := range slice {
-		if v == value {
-			return true
+// Returns the positively weighted edges to and from a public key's node along with the nodes
+// they connect in the order they're first seen. Unknown keys default to the directory root.
+func (g *Graph) neighborhood(pubKey string) ([]uint32, []uint32) {
+	if len(g.nodes) == 0 {
+		return nil, nil
+	}
+
+	pkIndex := g.index[pubKey] //defaults to zero- the directory root
+	pkNode := &g.nodes[pkIndex]
+
+	candidates := make([]uint32, 0, len(pkNode.out)+len(pkNode.in))
+	candidates = append(candidates, pkNode.out...)
+	for _, eIndex := range pkNode.in {
+		// self-links are already included as outbound
+		if g.edges[eIndex].source != pkIndex {
+			candidates = append(candidates, eIndex)
 		}
 	}
-	return false
+
+	var edges, includedNodes []uint32
+	included := make(map[uint32]bool)
+	for _, eIndex := range candidates {
+		e := &g.edges[eIndex]
+		if e.weight <= 0 {
+			continue
+		}
+		edges = append(edges, eIndex)
+		for _, id := range []uint32{e.source, e.target} {
+			if !included[id] {
+				included[id] = true
+				includedNodes = append(includedNodes, id)
+			}
+		}
+	}
+	return edges, includedNodes
+}
+
+// Returns all of the positively weighted edges along with the nodes they connect.
+func (g *Graph) all() ([]uint32, []uint32) {
+	var edges, includedNodes []uint32
+	included := make([]bool, len(g.nodes))
+	for eIndex := range g.edges {
+		e := &g.edges[eIndex]
+		if e.weight <= 0 {
+			continue
+		}
+		edges = append(edges, uint32(eIndex))
+		for _, id := range []uint32{e.source, e.target} {
+			if !included[id] {
+				included[id] = true
+				includedNodes = append(includedNodes, id)
+			}
+		}
+	}
+	return edges, includedNodes
+}
+
+// Returns a node's display label and memo.
+func (g *Graph) nodeLabel(id uint32, states map[string]*KeyState) (string, string) {
+	node := &g.nodes[id]
+	label := fmt.Sprintf("%.*s", 15, strings.TrimRight(node.pubkey, "0="))
+	memo := ""
+
+	if st, ok := states[node.pubkey]; ok {
+		memo = st.memo
+
+		if st.label != "" {
+			label = st.label
+		}
+
+		if st.time != 0 {
+			label = label + "/v" + strconv.Itoa(int(st.revision)) + " (" + timeAgo(st.time) + ") "
+		}
+	}
+
+	if node.pubkey == rootNode {
+		label = "root"
+	}
+	return label, memo
 }
 
 // Checks for relationship to prevent cycles.
@@ -174,7 +238,8 @@ func (g *Graph) dfs(current, target uint32, visited map[uint32]bool) bool {
 
 	visited[current] = true
 
-	for edge := range g.edges[current] {
+	for _, eIndex := range g.nodes[current].out {
+		edge := g.edges[eIndex].target
 		if edge == 0 { // Skip the root node
 			continue
 		}
@@ -196,61 +261,162 @@ func (g *Graph) dfs(current, target uint32, visited map[uint32]bool) bool {
 //
 // This method will run as many iterations as needed, until the graph converges.
 func (graph *Graph) Rank(alpha, epsilon float64) {
+	if len(graph.nodes) == 0 {
+		return
+	}
 
-	normalizedWeights := make(map[uint32](map[uint32]float64))
+	compact := graph.compactWeights()
 
 	Δ := float64(1.0)
 	inverse := 1 / float64(len(graph.nodes))
 
-	// Normalize all the edge weights so that their sum amounts to 1.
-	for source := range graph.edges {
-		if graph.nodes[source].outbound > 0 {
-			normalizedWeights[source] = make(map[uint32]float64)
-			for target := range graph.edges[source] {
-				normalizedWeights[source][target] = graph.edges[source][target].weight / graph.nodes[source].outbound
-			}
-		}
-	}
-
-	for key := range graph.nodes {
-		graph.nodes[key].ranking = inverse
+	rankings := make([]float64, len(graph.nodes))
+	previous := make([]float64, len(graph.nodes))
+	for i := range rankings {
+		rankings[i] = inverse
 	}
 
 	for Δ > epsilon {
 		leak := float64(0)
-		nodes := map[uint32]float64{}
+		rankings, previous = previous, rankings
 
-		for key, value := range graph.nodes {
-			nodes[key] = value.ranking
-
-			if value.outbound == 0 {
-				leak += value.ranking
+		for i := range graph.nodes {
+			if graph.nodes[i].outbound == 0 {
+				leak += previous[i]
 			}
-
-			graph.nodes[key].ranking = 0
+			rankings[i] = 0
 		}
 
 		leak *= alpha
 
 		for source := range graph.nodes {
-			for target, weight := range normalizedWeights[source] {
-				graph.nodes[target].ranking += alpha * nodes[source] * weight
+			for e := compact.offsets[source]; e < compact.offsets[source+1]; e++ {
+				rankings[compact.targets[e]] += alpha * previous[source] * compact.weights[e]
 			}
 
-			graph.nodes[source].ranking += (1-alpha)*inverse + leak*inverse
+			rankings[source] += (1-alpha)*inverse + leak*inverse
 		}
 
 		Δ = 0
 
-		for key, value := range graph.nodes {
-			Δ += math.Abs(value.ranking - nodes[key])
+		for i := range rankings {
+			Δ += math.Abs(rankings[i] - previous[i])
+		}
+	}
+
+	for i := range graph.nodes {
+		graph.nodes[i].ranking = rankings[i]
+	}
+}
+
+// Returns the normalized edge weights in compact form. Rows of nodes whose outbound weight
+// has changed are renormalized in place unless edges were added, which requires a rebuild.
+func (graph *Graph) compactWeights() *compactGraph {
+	if graph.compact == nil || graph.structural {
+		compact := &compactGraph{
+			offsets: make([]uint32, len(graph.nodes)+1),
+			targets: make([]uint32, len(graph.edges)),
+			weights: make([]float64, len(graph.edges)),
+		}
+		var offset uint32
+		for i := range graph.nodes {
+			compact.offsets[i] = offset
+			for _, eIndex := range graph.nodes[i].out {
+				compact.targets[offset] = graph.edges[eIndex].target
+				offset++
+			}
+		}
+		compact.offsets[len(graph.nodes)] = offset
+		graph.compact = compact
+		for i := range graph.nodes {
+			graph.normalize(uint32(i))
+		}
+	} else {
+		for _, source := range graph.dirty {
+			graph.normalize(source)
+		}
+	}
+
+	for _, source := range graph.dirty {
+		graph.nodes[source].dirty = false
+	}
+	graph.structural = false
+	graph.dirty = graph.dirty[:0]
+	return graph.compact
+}
+
+// Normalize a node's edge weights so that their sum amounts to 1.
+// Nodes without a positive outbound weight don't contribute to their targets.
+func (graph *Graph) normalize(source uint32) {
+	n := &graph.nodes[source]
+	offset := graph.compact.offsets[source]
+	for i, eIndex := range n.out {
+		weight := float64(0)
+		if n.outbound > 0 {
+			weight = graph.edges[eIndex].weight / n.outbound
+		}
+		graph.compact.weights[offset+uint32(i)] = weight
+	}
+}
+
+// the saved form of a graph. edges are listed in insertion order
+type graphState struct {
+	Nodes []graphNodeState `json:"nodes"`
+	Edges []graphEdgeState `json:"edges"`
+}
+
+type graphNodeState struct {
+	PubKey   string  `json:"pubkey"`
+	Ranking  float64 `json:"ranking"`
+	Outbound float64 `json:"outbound"`
+}
+
+type graphEdgeState struct {
+	Source uint32  `json:"source"`
+	Target uint32  `json:"target"`
+	Weight float64 `json:"weight"`
+	Height int64   `json:"height"`
+	Time   int64   `json:"time"`
+}
+
+// Returns the graph's nodes and edges in a form which can be saved.
+func (graph *Graph) state() graphState {
+	var state graphState
+	for _, n := range graph.nodes {
+		state.Nodes = append(state.Nodes, graphNodeState{PubKey: n.pubkey, Ranking: n.ranking, Outbound: n.outbound})
+	}
+	for _, e := range graph.edges {
+		state.Edges = append(state.Edges, graphEdgeState{
+			Source: e.source, Target: e.target, Weight: e.weight, Height: e.height, Time: e.time,
+		})
+	}
+	return state
+}
+
+// Returns a graph restored from a saved state. The node edge lists are rebuilt in edge order.
+func graphFromState(state graphState) (*Graph, error) {
+	graph := NewGraph()
+	for _, n := range state.Nodes {
+		graph.index[n.PubKey] = uint32(len(graph.nodes))
+		graph.nodes = append(graph.nodes, node{pubkey: n.PubKey, ranking: n.Ranking, outbound: n.Outbound})
+	}
+	for _, e := range state.Edges {
+		if int(e.Source) >= len(graph.nodes) || int(e.Target) >= len(graph.nodes) {
+			return nil, fmt.Errorf("Graph edge references missing node")
 		}
+		eIndex := uint32(len(graph.edges))
+		graph.edgeIndex[uint64(e.Source)<<32|uint64(e.Target)] = eIndex
+		graph.edges = append(graph.edges, edge{
+			source: e.Source, target: e.Target, weight: e.Weight, height: e.Height, time: e.Time,
+		})
+		graph.nodes[e.Source].out = append(graph.nodes[e.Source].out, eIndex)
+		graph.nodes[e.Target].in = append(graph.nodes[e.Target].in, eIndex)
 	}
+	graph.structural = true
+	return graph, nil
 }
 
 // Reset clears all the current graph data.
 func (graph *Graph) Reset() {
-	graph.edges = make(map[uint32](map[uint32]*edge))
-	graph.nodes = make(map[uint32]*node)
-	graph.index = make(map[string]uint32)
+	*graph = *NewGraph()
 }
@@ -0,0 +1,206 @@
+package cruzbit
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"strings"
+)
+
+const (
+	svgSize          = 800.0
+	svgMargin        = 80.0
+	svgMinRadius     = 6.0
+	svgMaxRadius     = 30.0
+	svgMaxStroke     = 6.0
+	svgLayoutBudget  = 20000000 // limits the repulsion calculations for large subgraphs
+	svgLayoutMaxIter = 200
+)
+
+type point struct {
+	x, y float64
+}
+
+// ToSVG renders the same subgraph as ToDOT as a self-contained SVG document.
+// The subgraph is laid out with a force-directed layout. Nodes are sized by ranking
+// and edges are drawn with a thickness proportional to their weight.
+func (g *Graph) ToSVG(pubKey string, states map[string]*KeyState) string {
+	edges, includedNodes := g.neighborhood(pubKey)
+	return g.renderSVG(edges, includedNodes, pubKey, states)
+}
+
+// Renders the given edges and nodes as an SVG document. The public key's node is highlighted.
+func (g *Graph) renderSVG(edges, includedNodes []uint32, pubKey string, states map[string]*KeyState) string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf(
+		"<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%.0f\" height=\"%.0f\" viewBox=\"0 0 %.0f %.0f\">\n",
+		svgSize, svgSize, svgSize, svgSize,
+	))
+	builder.WriteString("<defs><marker id=\"arrow\" viewBox=\"0 0 10 10\" refX=\"10\" refY=\"5\" " +
+		"markerWidth=\"6\" markerHeight=\"6\" orient=\"auto\">" +
+		"<path d=\"M 0 0 L 10 5 L 0 10 z\" fill=\"#999\"/></marker></defs>\n")
+
+	if len(includedNodes) == 0 {
+		builder.WriteString("</svg>\n")
+		return builder.String()
+	}
+
+	positions := g.layout(edges, includedNodes)
+
+	var maxRanking, maxWeight float64
+	for _, id := range includedNodes {
+		maxRanking = math.Max(maxRanking, g.nodes[id].ranking)
+	}
+	for _, eIndex := range edges {
+		maxWeight = math.Max(maxWeight, g.edges[eIndex].weight)
+	}
+
+	radius := make(map[uint32]float64, len(includedNodes))
+	for _, id := range includedNodes {
+		radius[id] = svgMinRadius
+		if maxRanking > 0 {
+			radius[id] += (svgMaxRadius - svgMinRadius) * math.Sqrt(g.nodes[id].ranking/maxRanking)
+		}
+	}
+
+	builder.WriteString("<g stroke=\"#999\" fill=\"none\">\n")
+	for _, eIndex := range edges {
+		e := &g.edges[eIndex]
+		stroke := 1 + (svgMaxStroke-1)*e.weight/maxWeight
+		title := fmt.Sprintf("weight %f, height %d", e.weight, e.height)
+		source, target := positions[e.source], positions[e.target]
+
+		if e.source == e.target {
+			// draw self-links as a loop above the node
+			r := radius[e.source] / 2
+			builder.WriteString(fmt.Sprintf(
+				"<circle cx=\"%.1f\" cy=\"%.1f\" r=\"%.1f\" stroke-width=\"%.1f\"><title>%s</title></circle>\n",
+				source.x, source.y-radius[e.source]-r, r, stroke, title,
+			))
+			continue
+		}
+
+		// end the line at the edge of the target's circle so the arrow is visible
+		dx, dy := target.x-source.x, target.y-source.y
+		dist := math.Max(math.Hypot(dx, dy), 0.01)
+		x1, y1 := source.x+dx/dist*radius[e.source], source.y+dy/dist*radius[e.source]
+		x2, y2 := target.x-dx/dist*radius[e.target], target.y-dy/dist*radius[e.target]
+		builder.WriteString(fmt.Sprintf(
+			"<line x1=\"%.1f\" y1=\"%.1f\" x2=\"%.1f\" y2=\"%.1f\" stroke-width=\"%.1f\" "+
+				"marker-end=\"url(#arrow)\"><title>%s</title></line>\n",
+			x1, y1, x2, y2, stroke, title,
+		))
+	}
+	builder.WriteString("</g>\n")
+
+	pkIndex, focused := g.index[pubKey]
+	if !focused {
+		// unknown keys default to the directory root
+		pkIndex, focused = g.index[rootNode]
+	}
+	builder.WriteString("<g font-family=\"sans-serif\" font-size=\"12\" text-anchor=\"middle\">\n")
+	for _, id := range includedNodes {
+		node := &g.nodes[id]
+		label, memo := g.nodeLabel(id, states)
+		fill := "#1f77b4"
+		if focused && id == pkIndex {
+			fill = "#d62728"
+		}
+		p := positions[id]
+		builder.WriteString(fmt.Sprintf(
+			"<g><circle cx=\"%.1f\" cy=\"%.1f\" r=\"%.1f\" fill=\"%s\"><title>%s</title></circle>"+
+				"<text x=\"%.1f\" y=\"%.1f\">%s</text></g>\n",
+			p.x, p.y, radius[id], fill,
+			html.EscapeString(fmt.Sprintf("%s\n%s\nranking %f", node.pubkey, memo, node.ranking)),
+			p.x, p.y+radius[id]+14, html.EscapeString(label),
+		))
+	}
+	builder.WriteString("</g>\n</svg>\n")
+	return builder.String()
+}
+
+// Lays out the subgraph with the Fruchterman-Reingold algorithm and scales it to fit the document.
+// The initial positions are on a circle so the layout is deterministic.
+func (g *Graph) layout(edges, includedNodes []uint32) map[uint32]point {
+	n := len(includedNodes)
+	positions := make([]point, n)
+	slot := make(map[uint32]int, n)
+	for i, id := range includedNodes {
+		angle := 2 * math.Pi * float64(i) / float64(n)
+		positions[i] = point{x: math.Cos(angle) * svgSize / 2, y: math.Sin(angle) * svgSize / 2}
+		slot[id] = i
+	}
+
+	k := math.Sqrt(svgSize * svgSize / float64(n))
+	iterations := svgLayoutMaxIter
+	if n*n*iterations > svgLayoutBudget {
+		iterations = svgLayoutBudget / (n * n)
+		if iterations < 10 {
+			iterations = 10
+		}
+	}
+	temperature := svgSize / 10
+	cooling := temperature / float64(iterations+1)
+
+	displacement := make([]point, n)
+	for iter := 0; iter < iterations; iter++ {
+		for i := range displacement {
+			displacement[i] = point{}
+		}
+
+		// every pair of nodes repels
+		for i := 0; i < n; i++ {
+			for j := i + 1; j < n; j++ {
+				dx, dy := positions[i].x-positions[j].x, positions[i].y-positions[j].y
+				dist := math.Max(math.Hypot(dx, dy), 0.01)
+				force := k * k / dist
+				displacement[i].x += dx / dist * force
+				displacement[i].y += dy / dist * force
+				displacement[j].x -= dx / dist * force
+				displacement[j].y -= dy / dist * force
+			}
+		}
+
+		// linked nodes attract
+		for _, eIndex := range edges {
+			s, t := slot[g.edges[eIndex].source], slot[g.edges[eIndex].target]
+			if s == t {
+				continue
+			}
+			dx, dy := positions[s].x-positions[t].x, positions[s].y-positions[t].y
+			dist := math.Max(math.Hypot(dx, dy), 0.01)
+			force := dist * dist / k
+			displacement[s].x -= dx / dist * force
+			displacement[s].y -= dy / dist * force
+			displacement[t].x += dx / dist * force
+			displacement[t].y += dy / dist * force
+		}
+
+		// move no further than the current temperature
+		for i := range positions {
+			length := math.Max(math.Hypot(displacement[i].x, displacement[i].y), 0.01)
+			step := math.Min(length, temperature)
+			positions[i].x += displacement[i].x / length * step
+			positions[i].y += displacement[i].y / length * step
+		}
+		temperature -= cooling
+	}
+
+	// scale to fit within the margins
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, p := range positions {
+		minX, maxX = math.Min(minX, p.x), math.Max(maxX, p.x)
+		minY, maxY = math.Min(minY, p.y), math.Max(maxY, p.y)
+	}
+	scale := (svgSize - 2*svgMargin) / math.Max(math.Max(maxX-minX, maxY-minY), 1)
+
+	result := make(map[uint32]point, n)
+	for i, id := range includedNodes {
+		result[id] = point{
+			x: svgMargin + (positions[i].x-minX)*scale,
+			y: svgMargin + (positions[i].y-minY)*scale,
+		}
+	}
+	return result
+}
@@ -0,0 +1,260 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"encoding/xml"
+	"io"
+	"math"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// the map-based ranking the compact representation replaced
+func referenceRank(graph *Graph, alpha, epsilon float64) []float64 {
+	weights := make(map[uint32]map[uint32]float64)
+	for _, e := range graph.edges {
+		if outbound := graph.nodes[e.source].outbound; outbound > 0 {
+			if _, ok := weights[e.source]; !ok {
+				weights[e.source] = make(map[uint32]float64)
+			}
+			weights[e.source][e.target] = e.weight / outbound
+		}
+	}
+
+	inverse := 1 / float64(len(graph.nodes))
+	rankings := make([]float64, len(graph.nodes))
+	for i := range rankings {
+		rankings[i] = inverse
+	}
+
+	for Δ := float64(1.0); Δ > epsilon; {
+		previous := append([]float64(nil), rankings...)
+		leak := float64(0)
+		for i := range rankings {
+			if graph.nodes[i].outbound == 0 {
+				leak += previous[i]
+			}
+			rankings[i] = 0
+		}
+		leak *= alpha
+		for source := range rankings {
+			for target, weight := range weights[uint32(source)] {
+				rankings[target] += alpha * previous[source] * weight
+			}
+			rankings[source] += (1-alpha)*inverse + leak*inverse
+		}
+		Δ = 0
+		for i := range rankings {
+			Δ += math.Abs(rankings[i] - previous[i])
+		}
+	}
+	return rankings
+}
+
+func checkRankings(t *testing.T, graph *Graph, alpha float64) {
+	expected := referenceRank(graph, alpha, 1e-9)
+	graph.Rank(alpha, 1e-9)
+	for i, n := range graph.nodes {
+		if math.Abs(n.ranking-expected[i]) > 1e-9 {
+			t.Fatalf("Node %s expected ranking %f, found %f", n.pubkey, expected[i], n.ranking)
+		}
+	}
+}
+
+// build a random graph with the given number of nodes and edges
+func makeRandomGraph(nodes, edges int) *Graph {
+	r := rand.New(rand.NewSource(1))
+	graph := NewGraph()
+	for i := 0; i < edges; i++ {
+		src := strconv.Itoa(r.Intn(nodes))
+		tgt := strconv.Itoa(r.Intn(nodes))
+		graph.Link(src, tgt, float64(1+r.Intn(100)), int64(i), int64(i))
+	}
+	return graph
+}
+
+func TestGraphRank(t *testing.T) {
+	graph := makeRandomGraph(50, 200)
+	checkRankings(t, graph, 0.85)
+
+	// only weights change so the compact graph is updated in place
+	compact := graph.compact
+	for _, e := range graph.edges[:2] {
+		graph.Link(graph.nodes[e.source].pubkey, graph.nodes[e.target].pubkey, 500, 0, 0)
+	}
+	checkRankings(t, graph, 0.85)
+	if graph.compact != compact {
+		t.Fatal("Expected compact graph to be updated in place")
+	}
+
+	// new edges and nodes require a rebuild
+	graph.Link("1", "new", 10, 0, 0)
+	checkRankings(t, graph, 0.85)
+	if graph.compact == compact {
+		t.Fatal("Expected compact graph to be rebuilt")
+	}
+	if len(graph.compact.offsets) != len(graph.nodes)+1 || len(graph.compact.targets) != len(graph.edges) {
+		t.Fatal("Compact graph doesn't match the graph")
+	}
+
+	// a node whose outbound weight was withdrawn leaks like a node without edges
+	for _, eIndex := range graph.nodes[graph.index[pad44("1")]].out {
+		e := graph.edges[eIndex]
+		graph.Link("1", graph.nodes[e.target].pubkey, -e.weight, 0, 0)
+	}
+	checkRankings(t, graph, 0.85)
+
+	var total float64
+	for _, n := range graph.nodes {
+		total += n.ranking
+	}
+	if math.Abs(total-1) > 1e-6 {
+		t.Fatalf("Expected rankings to sum to 1, found %f", total)
+	}
+}
+
+func TestGraphToDOT(t *testing.T) {
+	graph := NewGraph()
+	graph.Link("0", "a", 1, 1, 1)
+	graph.Link("a", "b", 2, 2, 2)
+	graph.Link("b", "a", 3, 3, 3)
+	graph.Link("a", "a", 4, 4, 4)
+	graph.Link("b", "c", 5, 5, 5)
+	graph.Link("a", "c", 1, 6, 6)
+	graph.Link("a", "c", -1, 7, 7)
+	graph.Rank(0.85, 1e-6)
+
+	dot := graph.ToDOT(pad44("a"), nil)
+	for _, expected := range []string{
+		`"0" -> "1"`, `"1" -> "2"`, `"2" -> "1"`, `"1" -> "1"`,
+	} {
+		if strings.Count(dot, expected) != 1 {
+			t.Fatalf("Expected one edge %s in:\n%s", expected, dot)
+		}
+	}
+	if strings.Contains(dot, `"2" -> "3"`) || strings.Contains(dot, `"1" -> "3"`) {
+		t.Fatalf("Unexpected edge in:\n%s", dot)
+	}
+	if strings.Count(dot, "[label=") != 3 {
+		t.Fatalf("Expected 3 nodes in:\n%s", dot)
+	}
+
+	if dot := NewGraph().ToDOT(pad44("a"), nil); dot != "digraph G {\n}\n" {
+		t.Fatalf("Unexpected empty graph %s", dot)
+	}
+}
+
+func TestGraphToSVG(t *testing.T) {
+	graph := NewGraph()
+	graph.Link("0", "a", 1, 1, 1)
+	graph.Link("a", "b", 9, 2, 2)
+	graph.Link("a", "a", 4, 4, 4)
+	graph.Link("b", "c", 5, 5, 5)
+	graph.Rank(0.85, 1e-6)
+	states := map[string]*KeyState{pad44("b"): {label: "<b> & co", memo: "\"quoted\""}}
+
+	svg := graph.ToSVG(pad44("a"), states)
+	if svg != graph.ToSVG(pad44("a"), states) {
+		t.Fatal("Expected the layout to be deterministic")
+	}
+
+	// must be well-formed
+	decoder := xml.NewDecoder(strings.NewReader(svg))
+	var circles, lines int
+	var radii []float64
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Invalid SVG: %s\n%s", err, svg)
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			switch start.Name.Local {
+			case "circle":
+				circles++
+				for _, attr := range start.Attr {
+					if attr.Name.Local == "r" {
+						r, _ := strconv.ParseFloat(attr.Value, 64)
+						radii = append(radii, r)
+					}
+				}
+			case "line":
+				lines++
+			}
+		}
+	}
+	// 3 nodes plus a self-link loop and 2 lines
+	if circles != 4 || lines != 2 {
+		t.Fatalf("Expected 4 circles and 2 lines, found %d and %d", circles, lines)
+	}
+	if !strings.Contains(svg, "&lt;b&gt; &amp; co") {
+		t.Fatalf("Expected escaped label in:\n%s", svg)
+	}
+	// c isn't in a's neighborhood
+	if strings.Contains(svg, pad44("c")) {
+		t.Fatalf("Unexpected node in:\n%s", svg)
+	}
+	for _, r := range radii {
+		if r < svgMinRadius/2 || r > svgMaxRadius {
+			t.Fatalf("Unexpected radius %f", r)
+		}
+	}
+
+	if svg := NewGraph().ToSVG(pad44("a"), nil); !strings.HasSuffix(svg, "</svg>\n") {
+		t.Fatalf("Unexpected empty graph %s", svg)
+	}
+}
+
+func benchmarkGraphRank(b *testing.B, nodes, edges int) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	graph := makeRandomGraph(nodes, edges)
+	graph.Rank(0.85, 1e-6)
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// touch an existing edge so the compact graph is updated between ranks
+		graph.Link(graph.nodes[graph.edges[0].source].pubkey, graph.nodes[graph.edges[0].target].pubkey, 1, 0, 0)
+		graph.Rank(0.85, 1e-6)
+	}
+	b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc)), "graph-bytes")
+}
+
+func BenchmarkGraphRank10K(b *testing.B) {
+	benchmarkGraphRank(b, 10000, 50000)
+}
+
+func BenchmarkGraphRank100K(b *testing.B) {
+	benchmarkGraphRank(b, 100000, 500000)
+}
+
+func BenchmarkGraphLink(b *testing.B) {
+	graph := NewGraph()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		graph.Link(strconv.Itoa(i%100000), strconv.Itoa(i%99991), 1, int64(i), int64(i))
+	}
+}
+
+func BenchmarkGraphToDOT(b *testing.B) {
+	graph := makeRandomGraph(100000, 500000)
+	graph.Rank(0.85, 1e-6)
+	pubKey := graph.nodes[graph.edges[0].source].pubkey
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		graph.ToDOT(pubKey, nil)
+	}
+}
@@ -0,0 +1,1409 @@
+package cruzbit
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
+)
+
+type KeyState struct {
+	label      string
+	memo       string
+	revision   uint
+	time       int64
+	author     string // key which first wrote the entry
+	tombstoned bool   // retracted by its author
+	hidden     bool   // hidden by a directory moderator
+	labels     []KeyLabel
+}
+
+// Memos recognized by the indexer for retracting and moderating directory entries.
+// Moderation transactions are sent to the entry's path and don't consume directory balance.
+// Entries which are tombstoned or hidden remain in the graph but are excluded from listings.
+const (
+	// TombstoneMemo retracts an entry when sent by the entry's author.
+	// A later revision by the author restores it.
+	TombstoneMemo = "//tombstone//"
+
+	// HideMemo hides an entry when sent by the directory's owner or one of its moderators.
+	// Directories created by a coinbase without a public key memo have no owner or moderators
+	// so their entries can only be tombstoned.
+	HideMemo = "//hide//"
+
+	// UnhideMemo reverses HideMemo.
+	UnhideMemo = "//unhide//"
+
+	// ModeratorMemoPrefix followed by a directory ID delegates moderation of the directory
+	// to the recipient when sent by the directory's owner. The owner is the public key
+	// named in the memo of the coinbase which created the directory.
+	ModeratorMemoPrefix = "//moderator//"
+
+	// UnmoderatorMemoPrefix followed by a directory ID revokes a delegation.
+	UnmoderatorMemoPrefix = "//unmoderator//"
+)
+
+// DirectoryIndex is the index module for the directory system. It tracks directory balances,
+// labels and entries and ranks each directory's graph.
+type DirectoryIndex struct {
+	latestBlockID BlockID
+	latestHeight  int64
+	keyState      map[string]*KeyState
+	directories   map[string]string
+	dirBalances   map[string]map[string]int64
+	dirGraphs     map[string]*Graph
+	dirIssued     map[string]int64
+	dirOwners     map[string]string
+	dirModerators map[string]map[string]bool
+	labelHolders  map[string]map[string]bool
+	lock          sync.RWMutex
+
+	// write policies
+	dirPolicies    map[string]*DirectoryPolicy
+	writeHeights   map[string]map[string][]int64
+	rejectedWrites map[string][]RejectedWrite
+
+	// links from entries to other entries keyed by directory ID and path
+	entryLinks map[string]map[string]EntryLink
+
+	// label, moderation and policy changes made by recently connected blocks
+	undo      map[BlockID][]directoryUndo
+	undoOrder []BlockID
+
+	// rendered graphs are cached until the index is next updated
+	graphCache     map[graphCacheKey]string
+	graphVersion   int64
+	graphCacheLock sync.Mutex
+}
+
+// the number of connected blocks whose label, moderation and policy changes we can undo
+const directoryUndoDepth = 1000
+
+// the state of an entry, a moderator delegation, a policy, a key's recent writes or a key's label
+// before a block changed it, or a write the block rejected
+type directoryUndo struct {
+	Entry         string           `json:"entry,omitempty"`
+	Tombstoned    bool             `json:"tombstoned,omitempty"`
+	Hidden        bool             `json:"hidden,omitempty"`
+	DirectoryID   string           `json:"directory_id,omitempty"`
+	Moderator     string           `json:"moderator,omitempty"`
+	Delegated     bool             `json:"delegated,omitempty"`
+	PolicyChanged bool             `json:"policy_changed,omitempty"`
+	Policy        *DirectoryPolicy `json:"policy,omitempty"`
+	Writer        string           `json:"writer,omitempty"`
+	WriteHeights  []int64          `json:"write_heights,omitempty"`
+	LabelKey      string           `json:"label_key,omitempty"`
+	Label         string           `json:"label,omitempty"`
+	LabelMemo     string           `json:"label_memo,omitempty"`
+	LabelCount    int              `json:"label_count,omitempty"` // length of the label history
+	NewKey        bool             `json:"new_key,omitempty"`
+	RejectedID    *TransactionID   `json:"rejected_id,omitempty"`
+}
+
+type graphCacheKey struct {
+	directoryID string
+	pubKey      string
+	format      string
+	merged      bool
+}
+
+// NewDirectoryIndex returns a new, empty DirectoryIndex.
+func NewDirectoryIndex() *DirectoryIndex {
+	return &DirectoryIndex{
+		keyState:       make(map[string]*KeyState),
+		directories:    make(map[string]string),
+		dirBalances:    make(map[string]map[string]int64),
+		dirGraphs:      make(map[string]*Graph),
+		dirIssued:      make(map[string]int64),
+		dirOwners:      make(map[string]string),
+		dirModerators:  make(map[string]map[string]bool),
+		labelHolders:   make(map[string]map[string]bool),
+		graphCache:     make(map[graphCacheKey]string),
+		dirPolicies:    make(map[string]*DirectoryPolicy),
+		writeHeights:   make(map[string]map[string][]int64),
+		rejectedWrites: make(map[string][]RejectedWrite),
+		entryLinks:     make(map[string]map[string]EntryLink),
+		undo:           make(map[BlockID][]directoryUndo),
+		// versions aren't reused across restarts
+		graphVersion: time.Now().UnixNano(),
+	}
+}
+
+// Name implements IndexModule.
+func (idx *DirectoryIndex) Name() string {
+	return "directory"
+}
+
+// ConnectBlock implements IndexModule.
+func (idx *DirectoryIndex) ConnectBlock(id BlockID, block *Block) error {
+	idx.indexTransactions(block, id, true)
+	return nil
+}
+
+// DisconnectBlock implements IndexModule.
+func (idx *DirectoryIndex) DisconnectBlock(id BlockID, block *Block) error {
+	idx.indexTransactions(block, id, false) //Todo: Make sure no transaction is skipped.
+	return nil
+}
+
+// Persist implements IndexModule. The directory index is held in memory so this only ranks the graphs.
+func (idx *DirectoryIndex) Persist() error {
+	idx.rankGraph()
+	return nil
+}
+
+func inflateNodes(pubKey string) (bool, string, []string, uint) {
+	//omit the revision from the pubKey/instruction for validation
+	trimmed := strings.TrimRight(pubKey, "/+0=")
+	splitPK := strings.Split(trimmed, "/")
+
+	if len(splitPK) == 0 || splitPK[0] == "" {
+		return false, "", nil, 0
+	}
+
+	for i := 0; i < len(splitPK); i++ {
+		if splitPK[i] == "" {
+			return false, "", append([]string{}, pubKey), 0
+		}
+	}
+
+	//reset to include the revision
+	trimmed = strings.TrimRight(pubKey, "0=")
+	splitPK = strings.Split(trimmed, "/")
+
+	rootdir := splitPK[0]
+	nodes := splitPK
+	revision := 0
+
+	if last := nodes[len(nodes)-1]; strings.Trim(last, "+") == "" {
+		revision = len(last)
+		nodes = nodes[:len(nodes)-1] // remove the revision from the nodes
+	}
+
+	//append implicit revision (node/+++content/+++) to node identifier (node/+++)
+	for i := 0; i < len(nodes); i++ {
+		node := nodes[i]
+
+		if j := i + 1; j < len(nodes) {
+			next := nodes[j]
+			if strings.HasPrefix(next, "+") {
+				//get prefix
+				prefix := strings.Split(next, strings.Trim(next, "+"))[0]
+				node = node + "/" + prefix
+			}
+		}
+
+		nodes[i] = node
+	}
+
+	return true, rootdir, nodes, uint(revision)
+}
+
+func isLabelling(key string) (bool, string) {
+	if strings.HasPrefix(key, "//") {
+		re := regexp.MustCompile(`//([^/]+)//`)
+		trimmed := strings.TrimRight(key, "0=")
+		matches := re.FindStringSubmatch(trimmed)
+		if len(matches) > 1 {
+			return true, strings.ReplaceAll(strings.Trim(trimmed, "/"), "+", " ")
+		}
+	}
+
+	return false, ""
+}
+
+// returns the ID of the directory with the given root label. if more than one directory
+// has the label the lowest ID is returned
+func (idx *DirectoryIndex) directoryByLabel(label string) (string, bool) {
+	var directoryID string
+	for key, lbl := range idx.directories {
+		if lbl == label && (directoryID == "" || key < directoryID) {
+			//TODO: handle directorylabel collisions
+			directoryID = key
+		}
+	}
+	return directoryID, directoryID != ""
+}
+
+func (idx *DirectoryIndex) indexTransactions(block *Block, id BlockID, increment bool) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.invalidateGraphCache()
+
+	idx.latestBlockID = id
+	idx.latestHeight = block.Header.Height
+
+	var undo []directoryUndo
+	var rejected map[TransactionID]bool
+	if increment {
+		defer func() { idx.saveUndo(id, undo) }()
+	} else {
+		// writes rejected when the block was connected weren't indexed
+		rejected = idx.rejectedInBlock(id)
+		defer idx.applyUndo(id)
+	}
+
+	for t := 0; t < len(block.Transactions); t++ {
+		txn := block.Transactions[t]
+
+		txid, err := txn.ID()
+		if err != nil {
+			log.Printf("Error computing transaction ID: %v", err)
+			continue
+		}
+		if rejected[txid] {
+			continue
+		}
+
+		txnFrom := pubKeyToString(txn.From)
+		txnTo := pubKeyToString(txn.To)
+
+		/*
+			TODO: reversal, when Block disconnected
+			When Block disconnected; reverse all applicable transactions from the graph>>>>>>>>>>>>>>>>>>>
+		*/
+		incrementBy := int64(0)
+
+		if increment {
+			incrementBy = txn.Amount
+		}
+
+		if isLabl, label := isLabelling(txnTo); isLabl {
+
+			if txn.From == nil {
+				directoryID := txid.String()
+				idx.directories[directoryID] = label
+				idx.dirGraphs[directoryID] = NewGraph()
+				idx.dirBalances[directoryID] = make(map[string]int64)
+				idx.dirModerators[directoryID] = make(map[string]bool)
+				if owner, ok := parsePublicKeyMemo(txn.Memo); ok {
+					idx.dirOwners[directoryID] = owner
+				}
+			} else if increment {
+				//Capture label: "SenderKey" -> "//DirectoryLabel//0000000000000000000000000000="
+
+				if st, ok := idx.keyState[txnFrom]; ok {
+					undo = append(undo, directoryUndo{
+						LabelKey:   txnFrom,
+						Label:      st.label,
+						LabelMemo:  st.memo,
+						LabelCount: len(st.labels),
+					})
+				} else {
+					undo = append(undo, directoryUndo{LabelKey: txnFrom, NewKey: true})
+					idx.keyState[txnFrom] = &KeyState{}
+				}
+				idx.updateLabelHolders(txnFrom, idx.keyState[txnFrom].label, label)
+				idx.keyState[txnFrom].label = label
+				memo := strings.TrimSpace(txn.Memo)
+				idx.keyState[txnFrom].memo = memo
+				idx.keyState[txnFrom].recordLabel(label, memo, block.Header.Height, txn.Time)
+			}
+
+			continue
+		}
+
+		if ok, directoryID, add := parseModeratorMemo(txn.Memo); ok {
+			if increment {
+				if moderators, ok := idx.dirModerators[directoryID]; ok {
+					undo = append(undo, directoryUndo{
+						DirectoryID: directoryID,
+						Moderator:   txnTo,
+						Delegated:   moderators[txnTo],
+					})
+				}
+				idx.delegateModerator(directoryID, txnFrom, txnTo, add)
+			}
+			continue
+		}
+
+		trimmedSysMemo := strings.Trim(txn.Memo, "/")
+
+		if _, ok := idx.directories[trimmedSysMemo]; ok {
+
+			if balances, ok := idx.dirBalances[trimmedSysMemo]; ok {
+				if idx.dirGraphs[trimmedSysMemo].IsParentDescendant(txnTo, txnFrom) {
+					//prevent cycle
+					continue
+				}
+
+				balances[txnTo] += incrementBy
+			}
+
+			if idx.dirBalances[trimmedSysMemo][txnFrom] > 0 {
+				idx.dirGraphs[trimmedSysMemo].Link(txnFrom, txnTo, float64(incrementBy), block.Header.Height, txn.Time)
+				idx.dirBalances[trimmedSysMemo][txnFrom] -= incrementBy
+			} else {
+				idx.dirGraphs[trimmedSysMemo].Link(pad44("0"), txnTo, float64(incrementBy), block.Header.Height, txn.Time)
+				idx.dirIssued[trimmedSysMemo] += incrementBy
+			}
+
+		} else {
+
+			/*
+				Build directory graph.
+			*/
+			nodesOk, dirlbl, nodes, revision := inflateNodes(txnTo)
+			directoryID, _ := idx.directoryByLabel(dirlbl)
+			directoryGraph := idx.dirGraphs[directoryID]
+			dirBalances := idx.dirBalances[directoryID]
+
+			if nodesOk && directoryGraph != nil && isModerationMemo(txn.Memo) {
+				if increment {
+					undo = idx.appendEntryUndo(undo, pad44(txnTo))
+					idx.moderateEntry(directoryID, txnFrom, pad44(txnTo), txn.Memo)
+				}
+				continue
+			}
+
+			if nodesOk && directoryGraph != nil && strings.HasPrefix(txn.Memo, PolicyMemoPrefix) &&
+				idx.isOwner(directoryID, txnFrom) {
+				if increment {
+					previous, hadPolicy := idx.dirPolicies[directoryID]
+					if err := idx.setPolicy(directoryID, txn.Memo, block.Header.Height); err != nil {
+						undo = append(undo, idx.rejectWrite(directoryID, txid, txn, pad44(txnTo),
+							block.Header.Height, "invalid policy: "+err.Error()))
+					} else {
+						if !hadPolicy {
+							previous = nil
+						}
+						undo = append(undo, directoryUndo{DirectoryID: directoryID, PolicyChanged: true, Policy: previous})
+					}
+				}
+				continue
+			}
+
+			if nodesOk && directoryGraph != nil && increment {
+				if reason := idx.checkPolicy(directoryID, txnFrom, nodes, txn, block.Header.Height); reason != "" {
+					undo = append(undo, idx.rejectWrite(directoryID, txid, txn, pad44(txnTo),
+						block.Header.Height, reason))
+					continue
+				}
+			}
+
+			if dirBalances[txnFrom] < incrementBy {
+				//insufficient balance; skip transaction
+				if nodesOk && directoryGraph != nil {
+					undo = append(undo, idx.rejectWrite(directoryID, txid, txn, pad44(txnTo),
+						block.Header.Height, "insufficient directory balance"))
+				}
+				continue
+			}
+
+			if nodesOk && directoryGraph != nil {
+				directoryGraph.Link(txnFrom, txnTo, float64(incrementBy), block.Header.Height, txn.Time)
+				dirBalances[txnFrom] -= incrementBy
+				if increment {
+					undo = idx.appendWriteUndo(undo, directoryID, txnFrom)
+					idx.recordWrite(directoryID, txnFrom, block.Header.Height)
+				}
+
+				if _, ok := idx.keyState[pad44(txnTo)]; !ok {
+					idx.keyState[pad44(txnTo)] = &KeyState{}
+				}
+
+				idx.keyState[pad44(txnTo)].time = txn.Time
+				idx.keyState[pad44(txnTo)].revision = revision
+				idx.keyState[pad44(txnTo)].label = nodes[len(nodes)-1]
+				idx.keyState[pad44(txnTo)].memo = txn.Memo
+
+				if idx.keyState[pad44(txnTo)].author == "" {
+					idx.keyState[pad44(txnTo)].author = txnFrom
+				}
+				if increment && idx.keyState[pad44(txnTo)].author == txnFrom && idx.keyState[pad44(txnTo)].tombstoned {
+					undo = idx.appendEntryUndo(undo, pad44(txnTo))
+					idx.keyState[pad44(txnTo)].tombstoned = false
+				}
+				if increment {
+					idx.setLink(directoryID, pad44(txnTo), txn, block.Header.Height)
+				}
+
+				timestamp := time.Unix(txn.Time, 0)
+				YEAR := timestamp.UTC().Format("2006")
+				MONTH := timestamp.UTC().Format("2006+01")
+				DAY := timestamp.UTC().Format("2006+01+02")
+
+				DIMENSION_WEIGHT := float64(incrementBy / 4)
+
+				/*
+					1/4 temporal
+					(stagger timing: +20)
+				*/
+				directoryGraph.Link(txnTo, DAY, DIMENSION_WEIGHT, block.Header.Height, txn.Time+20)
+				directoryGraph.Link(DAY, MONTH, DIMENSION_WEIGHT, block.Header.Height, txn.Time+21)
+				directoryGraph.Link(MONTH, YEAR, DIMENSION_WEIGHT, block.Header.Height, txn.Time+22)
+				directoryGraph.Link(YEAR, "0", DIMENSION_WEIGHT, block.Header.Height, txn.Time+23)
+
+				/*
+					1/4 revision
+					(stagger timing: +30)
+				*/
+				revisionNode := "+" + strconv.Itoa(int(revision))
+				directoryGraph.Link(txnTo, revisionNode, DIMENSION_WEIGHT, block.Header.Height, txn.Time+30)
+				directoryGraph.Link(revisionNode, "0", DIMENSION_WEIGHT, block.Header.Height, txn.Time+31)
+
+				/*
+					1/4 spatial
+					(stagger timing: +40)
+				*/
+				reversedNodes := reverse(nodes)
+
+				//fractionalWeight := DIMENSION_WEIGHT / float64(len(reversedNodes))
+
+				for i := 0; i < len(reversedNodes); i++ {
+					node := reversedNodes[i]
+					additive := 40 + int64(i)
+
+					if i == 0 {
+						directoryGraph.Link(txnTo, node, DIMENSION_WEIGHT, block.Header.Height, txn.Time+additive)
+					}
+
+					if j := i + 1; j < len(reversedNodes) {
+						next := reversedNodes[j]
+						directoryGraph.Link(node, next, DIMENSION_WEIGHT, block.Header.Height, txn.Time+additive+int64(j)) // => accumulated
+					}
+
+					if i == len(reversedNodes)-1 { //last node => root
+						directoryGraph.Link(node, "0", DIMENSION_WEIGHT, block.Header.Height, txn.Time+additive+int64(i+1)) // => total spatial accumulation
+					}
+				}
+
+				/*
+					1/4 periodic
+					(stagger timing: +10)
+				*/
+				blockHeight := strconv.FormatInt(block.Header.Height, 10)
+				directoryGraph.Link(txnTo, blockHeight, DIMENSION_WEIGHT, block.Header.Height, txn.Time+10)
+
+				orders := DiminishingOrders(block.Header.Height)
+
+				for j := 1; j < len(orders); j++ {
+					i := j - 1
+
+					source := strconv.FormatInt(orders[i], 10)
+					target := strconv.FormatInt(orders[j], 10)
+
+					directoryGraph.Link(source, target, DIMENSION_WEIGHT, block.Header.Height, txn.Time+10+int64(j))
+				}
+			}
+		}
+	}
+}
+
+// labels are compared case-insensitively when checking for collisions
+func normalizeLabel(label string) string {
+	return strings.ToLower(strings.TrimSpace(label))
+}
+
+func (idx *DirectoryIndex) updateLabelHolders(pubKey, oldLabel, newLabel string) {
+	if oldLabel != "" {
+		delete(idx.labelHolders[normalizeLabel(oldLabel)], pubKey)
+	}
+	holders, ok := idx.labelHolders[normalizeLabel(newLabel)]
+	if !ok {
+		holders = make(map[string]bool)
+		idx.labelHolders[normalizeLabel(newLabel)] = holders
+	}
+	holders[pubKey] = true
+}
+
+// appends a label change to the key's history
+func (st *KeyState) recordLabel(label, memo string, height, time int64) {
+	record := KeyLabel{Label: label, Memo: memo, Height: height, Time: time}
+	if n := len(st.labels); n != 0 && st.labels[n-1] == record {
+		// unchanged
+		return
+	}
+	st.labels = append(st.labels, record)
+}
+
+// parses a memo naming a public key
+func parsePublicKeyMemo(memo string) (string, bool) {
+	pubKey, err := pubKeyFromString(strings.TrimSpace(memo))
+	if err != nil {
+		return "", false
+	}
+	return pubKeyToString(pubKey), true
+}
+
+// parses a moderator delegation memo. returns the directory ID and whether the
+// delegation is being added or revoked
+func parseModeratorMemo(memo string) (bool, string, bool) {
+	if strings.HasPrefix(memo, ModeratorMemoPrefix) {
+		return true, strings.TrimPrefix(memo, ModeratorMemoPrefix), true
+	}
+	if strings.HasPrefix(memo, UnmoderatorMemoPrefix) {
+		return true, strings.TrimPrefix(memo, UnmoderatorMemoPrefix), false
+	}
+	return false, "", false
+}
+
+func isModerationMemo(memo string) bool {
+	return memo == TombstoneMemo || memo == HideMemo || memo == UnhideMemo
+}
+
+// isListed returns false for entries which have been tombstoned or hidden
+func (st *KeyState) isListed() bool {
+	return !st.tombstoned && !st.hidden
+}
+
+func (idx *DirectoryIndex) isOwner(directoryID, pubKey string) bool {
+	owner, ok := idx.dirOwners[directoryID]
+	return ok && owner == pubKey
+}
+
+func (idx *DirectoryIndex) isModerator(directoryID, pubKey string) bool {
+	return idx.isOwner(directoryID, pubKey) || idx.dirModerators[directoryID][pubKey]
+}
+
+func (idx *DirectoryIndex) delegateModerator(directoryID, from, to string, add bool) {
+	if !idx.isOwner(directoryID, from) {
+		// only the owner can delegate
+		return
+	}
+	if add {
+		idx.dirModerators[directoryID][to] = true
+	} else {
+		delete(idx.dirModerators[directoryID], to)
+	}
+}
+
+func (idx *DirectoryIndex) moderateEntry(directoryID, from, entry, memo string) {
+	st, ok := idx.keyState[entry]
+	if !ok || st.time == 0 {
+		// not an entry
+		return
+	}
+	switch memo {
+	case TombstoneMemo:
+		if st.author == from {
+			st.tombstoned = true
+		}
+	case HideMemo:
+		if idx.isModerator(directoryID, from) {
+			st.hidden = true
+		}
+	case UnhideMemo:
+		if idx.isModerator(directoryID, from) {
+			st.hidden = false
+		}
+	}
+}
+
+// records an entry's moderation state before it's changed
+func (idx *DirectoryIndex) appendEntryUndo(undo []directoryUndo, entry string) []directoryUndo {
+	st, ok := idx.keyState[entry]
+	if !ok {
+		return undo
+	}
+	return append(undo, directoryUndo{Entry: entry, Tombstoned: st.tombstoned, Hidden: st.hidden})
+}
+
+// remember a connected block's label, moderation and policy changes
+func (idx *DirectoryIndex) saveUndo(id BlockID, undo []directoryUndo) {
+	if len(undo) == 0 {
+		return
+	}
+	idx.undo[id] = undo
+	idx.undoOrder = append(idx.undoOrder, id)
+	if len(idx.undoOrder) > directoryUndoDepth {
+		delete(idx.undo, idx.undoOrder[0])
+		idx.undoOrder = idx.undoOrder[1:]
+	}
+}
+
+// returns the IDs of the writes a connected block rejected
+func (idx *DirectoryIndex) rejectedInBlock(id BlockID) map[TransactionID]bool {
+	rejected := make(map[TransactionID]bool)
+	for _, u := range idx.undo[id] {
+		if u.RejectedID != nil {
+			rejected[*u.RejectedID] = true
+		}
+	}
+	return rejected
+}
+
+// revert a disconnected block's label, moderation and policy changes
+func (idx *DirectoryIndex) applyUndo(id BlockID) {
+	undo, ok := idx.undo[id]
+	if !ok {
+		// the block made no changes
+		return
+	}
+	for i := len(undo) - 1; i >= 0; i-- {
+		u := undo[i]
+		if u.Entry != "" {
+			if st, ok := idx.keyState[u.Entry]; ok {
+				st.tombstoned, st.hidden = u.Tombstoned, u.Hidden
+			}
+			continue
+		}
+		if u.RejectedID != nil {
+			rejected := idx.rejectedWrites[u.DirectoryID]
+			if n := len(rejected); n != 0 && rejected[n-1].TransactionID == *u.RejectedID {
+				idx.rejectedWrites[u.DirectoryID] = rejected[:n-1]
+			}
+			continue
+		}
+		if u.LabelKey != "" {
+			st, ok := idx.keyState[u.LabelKey]
+			if !ok {
+				continue
+			}
+			delete(idx.labelHolders[normalizeLabel(st.label)], u.LabelKey)
+			if u.NewKey {
+				delete(idx.keyState, u.LabelKey)
+				continue
+			}
+			if u.Label != "" {
+				idx.updateLabelHolders(u.LabelKey, "", u.Label)
+			}
+			st.label, st.memo, st.labels = u.Label, u.LabelMemo, st.labels[:u.LabelCount]
+			continue
+		}
+		if u.PolicyChanged {
+			if u.Policy == nil {
+				delete(idx.dirPolicies, u.DirectoryID)
+			} else {
+				idx.dirPolicies[u.DirectoryID] = u.Policy
+			}
+			continue
+		}
+		if u.Writer != "" {
+			if u.WriteHeights == nil {
+				delete(idx.writeHeights[u.DirectoryID], u.Writer)
+			} else {
+				idx.writeHeights[u.DirectoryID][u.Writer] = u.WriteHeights
+			}
+			continue
+		}
+		if moderators, ok := idx.dirModerators[u.DirectoryID]; ok {
+			if u.Delegated {
+				moderators[u.Moderator] = true
+			} else {
+				delete(moderators, u.Moderator)
+			}
+		}
+	}
+	delete(idx.undo, id)
+	for i := len(idx.undoOrder) - 1; i >= 0; i-- {
+		if idx.undoOrder[i] == id {
+			idx.undoOrder = append(idx.undoOrder[:i], idx.undoOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+func (idx *DirectoryIndex) rankGraph() {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.invalidateGraphCache()
+
+	log.Printf("Indexer ranking %d directories at height: %d\n", len(idx.dirGraphs), idx.latestHeight)
+
+	for _, cnGraph := range idx.dirGraphs {
+		cnGraph.Rank(1.0, 1e-6)
+	}
+
+	log.Printf("Finished Ranking %d directories", len(idx.dirGraphs))
+}
+
+// GetGraph returns a page of the rendering of a public key's view of a directory graph starting at
+// the given cursor, the cursor of the next page if there is one and the ID and height of the latest
+// indexed block. The format is "dot" (the default) or "svg". An empty cursor requests the first page.
+func (idx *DirectoryIndex) GetGraph(directoryID, pubKey, format, cursor string) (string, string, BlockID, int64, error) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	return idx.getGraph(graphCacheKey{directoryID: directoryID, pubKey: pubKey, format: format}, cursor)
+}
+
+// GetMergedGraph returns a page of a public key's graphs in several directories merged into one
+// along with the entry links between them. Public keys and entries appear once. Other nodes such
+// as path components and dates are kept separate for each directory and labelled with the
+// directory's label. Paging is the same as for GetGraph.
+func (idx *DirectoryIndex) GetMergedGraph(directoryIDs []string, pubKey, format, cursor string) (
+	string, string, BlockID, int64, error) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	key, err := idx.mergedGraphKey(directoryIDs, pubKey, format)
+	if err != nil {
+		return "", "", idx.latestBlockID, idx.latestHeight, err
+	}
+	return idx.getGraph(key, cursor)
+}
+
+// must be called with the read lock held
+func (idx *DirectoryIndex) mergedGraphKey(directoryIDs []string, pubKey, format string) (graphCacheKey, error) {
+	ids, err := idx.mergedDirectoryIDs(directoryIDs)
+	if err != nil {
+		return graphCacheKey{}, err
+	}
+	return graphCacheKey{directoryID: strings.Join(ids, ","), pubKey: pubKey, format: format, merged: true}, nil
+}
+
+// returns a page of a graph. must be called with the read lock held
+func (idx *DirectoryIndex) getGraph(key graphCacheKey, cursor string) (string, string, BlockID, int64, error) {
+	switch key.format {
+	case "":
+		key.format = "dot"
+	case "dot", "svg":
+	default:
+		return "", "", idx.latestBlockID, idx.latestHeight, fmt.Errorf("Unsupported graph format %s", key.format)
+	}
+
+	graph := idx.renderGraph(key)
+
+	var offset int
+	if len(cursor) != 0 {
+		var err error
+		if offset, err = idx.parseGraphCursor(cursor); err != nil {
+			return "", "", idx.latestBlockID, idx.latestHeight, err
+		}
+		if offset > len(graph) {
+			return "", "", idx.latestBlockID, idx.latestHeight, fmt.Errorf("Invalid cursor %s", cursor)
+		}
+	}
+
+	page, next := graphPage(graph, offset, MaxGraphPageLength)
+	var nextCursor string
+	if next < len(graph) {
+		nextCursor = fmt.Sprintf("%s:%d:%d", idx.latestBlockID, idx.graphVersion, next)
+	}
+	return page, nextCursor, idx.latestBlockID, idx.latestHeight, nil
+}
+
+// render a graph or return its cached rendering. must be called with the read lock held
+func (idx *DirectoryIndex) renderGraph(key graphCacheKey) string {
+	idx.graphCacheLock.Lock()
+	graph, ok := idx.graphCache[key]
+	idx.graphCacheLock.Unlock()
+	if ok {
+		return graph
+	}
+
+	if key.merged {
+		merged, states := idx.mergeGraphs(strings.Split(key.directoryID, ","), key.pubKey)
+		edges, includedNodes := merged.all()
+		if key.format == "svg" {
+			graph = merged.renderSVG(edges, includedNodes, key.pubKey, states)
+		} else {
+			graph = merged.renderDOT(edges, includedNodes, states)
+		}
+	} else if viewGraph, ok := idx.dirGraphs[key.directoryID]; ok {
+		if key.format == "svg" {
+			graph = viewGraph.ToSVG(key.pubKey, idx.keyState)
+		} else {
+			graph = viewGraph.ToDOT(key.pubKey, idx.keyState)
+		}
+	}
+
+	// the cache can't be invalidated while the read lock is held
+	idx.graphCacheLock.Lock()
+	defer idx.graphCacheLock.Unlock()
+	if len(idx.graphCache) >= MaxGraphCacheEntries {
+		// evict an arbitrary entry
+		for k := range idx.graphCache {
+			delete(idx.graphCache, k)
+			break
+		}
+	}
+	idx.graphCache[key] = graph
+	return graph
+}
+
+// must be called with the write lock held
+func (idx *DirectoryIndex) invalidateGraphCache() {
+	idx.graphCacheLock.Lock()
+	defer idx.graphCacheLock.Unlock()
+	idx.graphCache = make(map[graphCacheKey]string)
+	idx.graphVersion++
+}
+
+// cursors are only valid for the rendering they were issued for
+func (idx *DirectoryIndex) parseGraphCursor(cursor string) (int, error) {
+	parts := strings.Split(cursor, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("Invalid cursor %s", cursor)
+	}
+	if parts[0] != idx.latestBlockID.String() || parts[1] != strconv.FormatInt(idx.graphVersion, 10) {
+		return 0, fmt.Errorf("Graph has changed since cursor %s was issued", cursor)
+	}
+	offset, err := strconv.Atoi(parts[2])
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("Invalid cursor %s", cursor)
+	}
+	return offset, nil
+}
+
+// split a rendered graph at the last line break within maxLength bytes of the offset.
+// returns the page and the offset of the next page
+func graphPage(graph string, offset, maxLength int) (string, int) {
+	end := offset + maxLength
+	if end >= len(graph) {
+		return graph[offset:], len(graph)
+	}
+	if i := strings.LastIndexByte(graph[offset:end], '\n'); i >= 0 {
+		end = offset + i + 1
+	}
+	return graph[offset:end], end
+}
+
+// identifies the current rendering of a graph. must be called with the read lock held
+func (idx *DirectoryIndex) graphETag(key graphCacheKey) string {
+	hasher := sha3.New256()
+	fmt.Fprintf(hasher, "%s\n%s\n%s\n%t\n%s\n%d",
+		key.directoryID, key.pubKey, key.format, key.merged, idx.latestBlockID, idx.graphVersion)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// GetKeyProfile returns a public key's current and past labels, other keys currently using the
+// same label and the directories it participates in along with its balance in each.
+func (idx *DirectoryIndex) GetKeyProfile(pubKey ed25519.PublicKey) (*KeyProfile, BlockID, int64) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	pk := pubKeyToString(pubKey)
+	profile := &KeyProfile{}
+
+	if st, ok := idx.keyState[pk]; ok {
+		profile.Label = st.label
+		profile.Memo = st.memo
+		profile.LabelHistory = append([]KeyLabel{}, st.labels...)
+
+		if st.label != "" {
+			for holder := range idx.labelHolders[normalizeLabel(st.label)] {
+				if holder == pk {
+					continue
+				}
+				holderKey, err := pubKeyFromString(holder)
+				if err != nil {
+					continue
+				}
+				profile.LabelCollisions = append(profile.LabelCollisions, holderKey)
+			}
+			sort.Slice(profile.LabelCollisions, func(i, j int) bool {
+				return bytes.Compare(profile.LabelCollisions[i], profile.LabelCollisions[j]) < 0
+			})
+		}
+	}
+
+	profile.Directories = idx.keyDirectories(pk)
+	return profile, idx.latestBlockID, idx.latestHeight
+}
+
+// GetDirectoryBalance returns a public key's balance within a directory. The balance governs whether
+// the key's directory transfers are linked from itself or from the directory root.
+func (idx *DirectoryIndex) GetDirectoryBalance(directoryID string, pubKey ed25519.PublicKey) (int64, BlockID, int64, error) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	balances, ok := idx.dirBalances[directoryID]
+	if !ok {
+		return 0, idx.latestBlockID, idx.latestHeight, fmt.Errorf("Directory %s not found", directoryID)
+	}
+	return balances[pubKeyToString(pubKey)], idx.latestBlockID, idx.latestHeight, nil
+}
+
+// GetDirectoryBalances returns the public keys holding the largest balances within a directory
+// ordered by descending balance, along with the total amount issued by the directory root.
+func (idx *DirectoryIndex) GetDirectoryBalances(directoryID string, limit int) (
+	[]PublicKeyBalance, int64, BlockID, int64, error) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	balances, ok := idx.dirBalances[directoryID]
+	if !ok {
+		return nil, 0, idx.latestBlockID, idx.latestHeight, fmt.Errorf("Directory %s not found", directoryID)
+	}
+
+	var holders []PublicKeyBalance
+	for pk, balance := range balances {
+		if balance <= 0 {
+			continue
+		}
+		pubKey, err := pubKeyFromString(pk)
+		if err != nil {
+			continue
+		}
+		holders = append(holders, PublicKeyBalance{PublicKey: pubKey, Balance: balance})
+	}
+	sort.Slice(holders, func(i, j int) bool {
+		if holders[i].Balance != holders[j].Balance {
+			return holders[i].Balance > holders[j].Balance
+		}
+		return bytes.Compare(holders[i].PublicKey, holders[j].PublicKey) < 0
+	})
+	if limit > 0 && len(holders) > limit {
+		holders = holders[:limit]
+	}
+
+	return holders, idx.dirIssued[directoryID], idx.latestBlockID, idx.latestHeight, nil
+}
+
+// GetTopRanked returns the highest-ranked nodes in a directory ordered by descending ranking.
+// If contentOnly is set only directory entries are returned; synthetic temporal, revision and
+// height nodes are excluded. Entries can be further restricted to those whose key begins with
+// prefix and, if startTime or endTime are non-zero, to those posted within [startTime, endTime).
+func (idx *DirectoryIndex) GetTopRanked(directoryID, prefix string, contentOnly bool,
+	startTime, endTime int64, limit int) ([]RankedEntry, BlockID, int64, error) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	graph, ok := idx.dirGraphs[directoryID]
+	if !ok {
+		return nil, idx.latestBlockID, idx.latestHeight, fmt.Errorf("Directory %s not found", directoryID)
+	}
+
+	var entries []RankedEntry
+	for _, n := range graph.nodes {
+		if !strings.HasPrefix(n.pubkey, prefix) {
+			continue
+		}
+		st := idx.keyState[n.pubkey]
+		if contentOnly && !isContentEntry(n.pubkey, st) {
+			continue
+		}
+		if st != nil && !st.isListed() {
+			continue
+		}
+		if startTime != 0 || endTime != 0 {
+			if st == nil || st.time == 0 {
+				continue
+			}
+			if st.time < startTime || (endTime != 0 && st.time >= endTime) {
+				continue
+			}
+		}
+		entry := RankedEntry{Key: n.pubkey, Ranking: n.ranking}
+		if st != nil {
+			entry.Label = st.label
+			entry.Memo = st.memo
+			entry.Revision = st.revision
+			entry.Time = st.time
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Ranking != entries[j].Ranking {
+			return entries[i].Ranking > entries[j].Ranking
+		}
+		return entries[i].Key < entries[j].Key
+	})
+
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, idx.latestBlockID, idx.latestHeight, nil
+}
+
+// GetDirectoryTimeline returns the entries in a directory posted within the given period ("YYYY",
+// "YYYY+MM" or "YYYY+MM+DD") ordered by most recent first, along with the number of entries posted
+// in each of the period's sub-periods. An empty period counts entries per year.
+func (idx *DirectoryIndex) GetDirectoryTimeline(directoryID, period string, limit int) (
+	[]RankedEntry, []TimelineBucket, BlockID, int64, error) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	if period != "" && !periodNodeRegexp.MatchString(period) {
+		return nil, nil, idx.latestBlockID, idx.latestHeight, fmt.Errorf("Invalid period %s", period)
+	}
+
+	graph, ok := idx.dirGraphs[directoryID]
+	if !ok {
+		return nil, nil, idx.latestBlockID, idx.latestHeight, fmt.Errorf("Directory %s not found", directoryID)
+	}
+
+	// sub-periods are one level finer than the requested period
+	bucketLength := map[int]int{0: len("2006"), len("2006"): len("2006+01"), len("2006+01"): len("2006+01+02")}[len(period)]
+
+	// each entry is linked to the day node of every day it was posted
+	inPeriod := make(map[uint32]bool)
+	buckets := make(map[string]map[uint32]bool)
+	for i := range graph.nodes {
+		source := uint32(i)
+		st := idx.keyState[graph.nodes[source].pubkey]
+		if !isContentEntry(graph.nodes[source].pubkey, st) || !st.isListed() {
+			continue
+		}
+		for _, eIndex := range graph.nodes[source].out {
+			day := unpadNode(graph.nodes[graph.edges[eIndex].target].pubkey)
+			if !dayNodeRegexp.MatchString(day) || !strings.HasPrefix(day, period) {
+				continue
+			}
+			inPeriod[source] = true
+			if bucketLength == 0 {
+				continue
+			}
+			bucket := day[:bucketLength]
+			if _, ok := buckets[bucket]; !ok {
+				buckets[bucket] = make(map[uint32]bool)
+			}
+			buckets[bucket][source] = true
+		}
+	}
+
+	var entries []RankedEntry
+	for index := range inPeriod {
+		n := graph.nodes[index]
+		st := idx.keyState[n.pubkey]
+		entries = append(entries, RankedEntry{
+			Key:      n.pubkey,
+			Label:    st.label,
+			Memo:     st.memo,
+			Revision: st.revision,
+			Time:     st.time,
+			Ranking:  n.ranking,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Time != entries[j].Time {
+			return entries[i].Time > entries[j].Time
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	var timeline []TimelineBucket
+	for bucket, sources := range buckets {
+		timeline = append(timeline, TimelineBucket{Period: bucket, Count: len(sources)})
+	}
+	sort.Slice(timeline, func(i, j int) bool {
+		return timeline[i].Period < timeline[j].Period
+	})
+
+	return entries, timeline, idx.latestBlockID, idx.latestHeight, nil
+}
+
+// synthetic nodes are linked by the indexer to give entries their temporal ("2024", "2024+01",
+// "2024+01+02"), revision ("+3") and periodic (block height) dimensions
+var syntheticNodeRegexp = regexp.MustCompile(`^(\d+|\d{4}\+\d{2}(\+\d{2})?|\+\d+)$`)
+
+// temporal nodes are named by the UTC year, month and day an entry was posted
+var periodNodeRegexp = regexp.MustCompile(`^\d{4}(\+\d{2}(\+\d{2})?)?$`)
+
+var dayNodeRegexp = regexp.MustCompile(`^\d{4}\+\d{2}\+\d{2}$`)
+
+// strips the padding added by pad44 from a node's key
+func unpadNode(key string) string {
+	if len(key) != 44 || !strings.HasSuffix(key, "=") {
+		return key
+	}
+	trimmed := strings.TrimRight(key[:len(key)-1], "0")
+	if trimmed == "" {
+		return "0"
+	}
+	if strings.Count(trimmed, "/") == 1 && strings.HasSuffix(trimmed, "/") {
+		trimmed = strings.TrimSuffix(trimmed, "/")
+	}
+	return trimmed
+}
+
+func isSyntheticNode(key string) bool {
+	return syntheticNodeRegexp.MatchString(unpadNode(key))
+}
+
+// content entries are nodes which were written to as a directory path
+func isContentEntry(key string, st *KeyState) bool {
+	return st != nil && st.time != 0 && !isSyntheticNode(key)
+}
+
+// QueryTypes implements IndexModule.
+func (idx *DirectoryIndex) QueryTypes() []string {
+	return []string{
+		"get_graph",
+		"get_top_ranked",
+		"get_directory_timeline",
+		"get_key_profile",
+		"get_directory_balance",
+		"get_directory_balances",
+		"get_directory_policy",
+		"get_rejected_writes",
+		"get_key_directories",
+	}
+}
+
+// HandleQuery implements IndexModule.
+func (idx *DirectoryIndex) HandleQuery(messageType string, body json.RawMessage, outChan chan<- Message) error {
+	switch messageType {
+	case "get_graph":
+		var gn GetGraphMessage
+		if err := json.Unmarshal(body, &gn); err != nil {
+			return err
+		}
+		return idx.onGetGraph(gn.PublicKey, gn.DirectoryID, gn.DirectoryIDs, gn.Format, gn.KnownETag,
+			gn.Cursor, outChan)
+
+	case "get_top_ranked":
+		var gtr GetTopRankedMessage
+		if err := json.Unmarshal(body, &gtr); err != nil {
+			return err
+		}
+		return idx.onGetTopRanked(gtr.DirectoryID, gtr.Prefix, gtr.ContentOnly,
+			gtr.StartTime, gtr.EndTime, gtr.Limit, outChan)
+
+	case "get_directory_timeline":
+		var gdt GetDirectoryTimelineMessage
+		if err := json.Unmarshal(body, &gdt); err != nil {
+			return err
+		}
+		return idx.onGetDirectoryTimeline(gdt.DirectoryID, gdt.Period, gdt.Limit, outChan)
+
+	case "get_key_profile":
+		var gkp GetKeyProfileMessage
+		if err := json.Unmarshal(body, &gkp); err != nil {
+			return err
+		}
+		return idx.onGetKeyProfile(gkp.PublicKey, outChan)
+
+	case "get_directory_balance":
+		var gdb GetDirectoryBalanceMessage
+		if err := json.Unmarshal(body, &gdb); err != nil {
+			return err
+		}
+		return idx.onGetDirectoryBalance(gdb.DirectoryID, gdb.PublicKey, outChan)
+
+	case "get_directory_balances":
+		var gdb GetDirectoryBalancesMessage
+		if err := json.Unmarshal(body, &gdb); err != nil {
+			return err
+		}
+		return idx.onGetDirectoryBalances(gdb.DirectoryID, gdb.Limit, outChan)
+
+	case "get_directory_policy":
+		var gdp GetDirectoryPolicyMessage
+		if err := json.Unmarshal(body, &gdp); err != nil {
+			return err
+		}
+		return idx.onGetDirectoryPolicy(gdp.DirectoryID, outChan)
+
+	case "get_rejected_writes":
+		var grw GetRejectedWritesMessage
+		if err := json.Unmarshal(body, &grw); err != nil {
+			return err
+		}
+		return idx.onGetRejectedWrites(grw.DirectoryID, grw.PublicKey, grw.Limit, outChan)
+
+	case "get_key_directories":
+		var gkd GetKeyDirectoriesMessage
+		if err := json.Unmarshal(body, &gkd); err != nil {
+			return err
+		}
+		return idx.onGetKeyDirectories(gkd.PublicKey, outChan)
+	}
+
+	return fmt.Errorf("Unsupported query: %s", messageType)
+}
+
+// Handle a request for a public key's view graph
+func (idx *DirectoryIndex) onGetGraph(pubKey ed25519.PublicKey, directoryID string, directoryIDs []string,
+	format, knownETag, cursor string, outChan chan<- Message) error {
+	gm, err := idx.graphReply(pubKey, directoryID, directoryIDs, format, knownETag, cursor)
+	outChan <- Message{Type: "graph", Body: gm}
+	return err
+}
+
+// the graph and its ETag are read under the same lock so the ETag always matches the graph
+func (idx *DirectoryIndex) graphReply(pubKey ed25519.PublicKey, directoryID string, directoryIDs []string,
+	format, knownETag, cursor string) (GraphMessage, error) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	key := graphCacheKey{directoryID: directoryID, pubKey: pubKeyToString(pubKey), format: format}
+	if len(directoryIDs) != 0 {
+		var err error
+		if key, err = idx.mergedGraphKey(directoryIDs, pubKeyToString(pubKey), format); err != nil {
+			return GraphMessage{PublicKey: pubKey, Format: format, Error: err.Error()}, err
+		}
+	}
+	if len(key.format) == 0 {
+		key.format = "dot"
+	}
+
+	etag := idx.graphETag(key)
+	if len(knownETag) != 0 && knownETag == etag && len(cursor) == 0 {
+		// the requester already has the current rendering
+		return GraphMessage{
+			BlockID:     idx.latestBlockID,
+			Height:      idx.latestHeight,
+			PublicKey:   pubKey,
+			Format:      format,
+			ETag:        etag,
+			NotModified: true,
+		}, nil
+	}
+
+	graph, nextCursor, blockID, height, err := idx.getGraph(key, cursor)
+	if err != nil {
+		return GraphMessage{PublicKey: pubKey, Format: format, Error: err.Error()}, err
+	}
+	return GraphMessage{
+		BlockID:    blockID,
+		Height:     height,
+		PublicKey:  pubKey,
+		Format:     format,
+		Graph:      graph,
+		ETag:       etag,
+		NextCursor: nextCursor,
+	}, nil
+}
+
+// Handle a request for the highest-ranked nodes in a directory
+func (idx *DirectoryIndex) onGetTopRanked(directoryID, prefix string, contentOnly bool,
+	startTime, endTime int64, limit int, outChan chan<- Message) error {
+	if limit < 0 {
+		outChan <- Message{Type: "top_ranked"}
+		return nil
+	}
+
+	// enforce our limit
+	if limit > 100 || limit == 0 {
+		limit = 100
+	}
+
+	entries, blockID, height, err := idx.GetTopRanked(
+		directoryID, prefix, contentOnly, startTime, endTime, limit)
+	if err != nil {
+		outChan <- Message{Type: "top_ranked", Body: TopRankedMessage{DirectoryID: directoryID, Error: err.Error()}}
+		return err
+	}
+
+	outChan <- Message{
+		Type: "top_ranked",
+		Body: TopRankedMessage{
+			BlockID:     blockID,
+			Height:      height,
+			DirectoryID: directoryID,
+			Entries:     entries,
+		},
+	}
+	return nil
+}
+
+// Handle a request for the entries posted in a directory during a given period
+func (idx *DirectoryIndex) onGetDirectoryTimeline(directoryID, period string, limit int, outChan chan<- Message) error {
+	if limit < 0 {
+		outChan <- Message{Type: "directory_timeline"}
+		return nil
+	}
+
+	// enforce our limit
+	if limit > 100 || limit == 0 {
+		limit = 100
+	}
+
+	entries, buckets, blockID, height, err := idx.GetDirectoryTimeline(directoryID, period, limit)
+	if err != nil {
+		outChan <- Message{
+			Type: "directory_timeline",
+			Body: DirectoryTimelineMessage{DirectoryID: directoryID, Period: period, Error: err.Error()},
+		}
+		return err
+	}
+
+	outChan <- Message{
+		Type: "directory_timeline",
+		Body: DirectoryTimelineMessage{
+			BlockID:     blockID,
+			Height:      height,
+			DirectoryID: directoryID,
+			Period:      period,
+			Entries:     entries,
+			Buckets:     buckets,
+		},
+	}
+	return nil
+}
+
+// Handle a request for a public key's profile
+func (idx *DirectoryIndex) onGetKeyProfile(pubKey ed25519.PublicKey, outChan chan<- Message) error {
+	if len(pubKey) != ed25519.PublicKeySize {
+		err := fmt.Errorf("Invalid public key")
+		outChan <- Message{Type: "key_profile", Body: KeyProfileMessage{PublicKey: pubKey, Error: err.Error()}}
+		return err
+	}
+
+	profile, blockID, height := idx.GetKeyProfile(pubKey)
+
+	outChan <- Message{
+		Type: "key_profile",
+		Body: KeyProfileMessage{
+			BlockID:   blockID,
+			Height:    height,
+			PublicKey: pubKey,
+			Profile:   profile,
+		},
+	}
+	return nil
+}
+
+// Handle a request for a public key's directory balance
+func (idx *DirectoryIndex) onGetDirectoryBalance(directoryID string, pubKey ed25519.PublicKey, outChan chan<- Message) error {
+	balance, blockID, height, err := idx.GetDirectoryBalance(directoryID, pubKey)
+	if err != nil {
+		outChan <- Message{
+			Type: "directory_balance",
+			Body: DirectoryBalanceMessage{DirectoryID: directoryID, PublicKey: pubKey, Error: err.Error()},
+		}
+		return err
+	}
+
+	outChan <- Message{
+		Type: "directory_balance",
+		Body: DirectoryBalanceMessage{
+			BlockID:     blockID,
+			Height:      height,
+			DirectoryID: directoryID,
+			PublicKey:   pubKey,
+			Balance:     balance,
+		},
+	}
+	return nil
+}
+
+// Handle a request for a directory's largest balances
+func (idx *DirectoryIndex) onGetDirectoryBalances(directoryID string, limit int, outChan chan<- Message) error {
+	if limit < 0 {
+		outChan <- Message{Type: "directory_balances"}
+		return nil
+	}
+
+	// enforce our limit
+	if limit > 64 || limit == 0 {
+		limit = 64
+	}
+
+	balances, issued, blockID, height, err := idx.GetDirectoryBalances(directoryID, limit)
+	if err != nil {
+		outChan <- Message{
+			Type: "directory_balances",
+			Body: DirectoryBalancesMessage{DirectoryID: directoryID, Error: err.Error()},
+		}
+		return err
+	}
+
+	outChan <- Message{
+		Type: "directory_balances",
+		Body: DirectoryBalancesMessage{
+			BlockID:     blockID,
+			Height:      height,
+			DirectoryID: directoryID,
+			Issued:      issued,
+			Balances:    balances,
+		},
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package cruzbit
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// the saved form of the directory index
+type directoryIndexState struct {
+	LatestBlockID  BlockID                         `json:"latest_block_id"`
+	LatestHeight   int64                           `json:"latest_height"`
+	KeyState       map[string]keyStateRecord       `json:"key_state"`
+	Directories    map[string]string               `json:"directories"`
+	DirBalances    map[string]map[string]int64     `json:"dir_balances"`
+	DirGraphs      map[string]graphState           `json:"dir_graphs"`
+	DirIssued      map[string]int64                `json:"dir_issued"`
+	DirOwners      map[string]string               `json:"dir_owners"`
+	DirModerators  map[string]map[string]bool      `json:"dir_moderators"`
+	LabelHolders   map[string]map[string]bool      `json:"label_holders"`
+	DirPolicies    map[string]*DirectoryPolicy     `json:"dir_policies"`
+	WriteHeights   map[string]map[string][]int64   `json:"write_heights"`
+	RejectedWrites map[string][]RejectedWrite      `json:"rejected_writes"`
+	EntryLinks     map[string]map[string]EntryLink `json:"entry_links"`
+	Undo           []directoryUndoState            `json:"undo,omitempty"` // oldest first
+}
+
+type directoryUndoState struct {
+	BlockID BlockID         `json:"block_id"`
+	Changes []directoryUndo `json:"changes"`
+}
+
+type keyStateRecord struct {
+	Label      string     `json:"label"`
+	Memo       string     `json:"memo,omitempty"`
+	Revision   uint       `json:"revision"`
+	Time       int64      `json:"time"`
+	Author     string     `json:"author,omitempty"`
+	Tombstoned bool       `json:"tombstoned,omitempty"`
+	Hidden     bool       `json:"hidden,omitempty"`
+	Labels     []KeyLabel `json:"labels,omitempty"`
+}
+
+// SaveState implements PersistentIndexModule.
+func (idx *DirectoryIndex) SaveState(w io.Writer) error {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	state := directoryIndexState{
+		LatestBlockID:  idx.latestBlockID,
+		LatestHeight:   idx.latestHeight,
+		KeyState:       make(map[string]keyStateRecord),
+		Directories:    idx.directories,
+		DirBalances:    idx.dirBalances,
+		DirGraphs:      make(map[string]graphState),
+		DirIssued:      idx.dirIssued,
+		DirOwners:      idx.dirOwners,
+		DirModerators:  idx.dirModerators,
+		LabelHolders:   idx.labelHolders,
+		DirPolicies:    idx.dirPolicies,
+		WriteHeights:   idx.writeHeights,
+		RejectedWrites: idx.rejectedWrites,
+		EntryLinks:     idx.entryLinks,
+	}
+	for key, ks := range idx.keyState {
+		state.KeyState[key] = keyStateRecord{
+			Label:      ks.label,
+			Memo:       ks.memo,
+			Revision:   ks.revision,
+			Time:       ks.time,
+			Author:     ks.author,
+			Tombstoned: ks.tombstoned,
+			Hidden:     ks.hidden,
+			Labels:     ks.labels,
+		}
+	}
+	for directoryID, graph := range idx.dirGraphs {
+		state.DirGraphs[directoryID] = graph.state()
+	}
+	for _, id := range idx.undoOrder {
+		state.Undo = append(state.Undo, directoryUndoState{BlockID: id, Changes: idx.undo[id]})
+	}
+	return json.NewEncoder(w).Encode(state)
+}
+
+// LoadState implements PersistentIndexModule.
+func (idx *DirectoryIndex) LoadState(r io.Reader) error {
+	var state directoryIndexState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return err
+	}
+	restored := NewDirectoryIndex()
+	for key, ks := range state.KeyState {
+		restored.keyState[key] = &KeyState{
+			label:      ks.Label,
+			memo:       ks.Memo,
+			revision:   ks.Revision,
+			time:       ks.Time,
+			author:     ks.Author,
+			tombstoned: ks.Tombstoned,
+			hidden:     ks.Hidden,
+			labels:     ks.Labels,
+		}
+	}
+	for directoryID, gs := range state.DirGraphs {
+		graph, err := graphFromState(gs)
+		if err != nil {
+			return err
+		}
+		restored.dirGraphs[directoryID] = graph
+	}
+
+	if state.Directories != nil {
+		restored.directories = state.Directories
+	}
+	if state.DirBalances != nil {
+		restored.dirBalances = state.DirBalances
+	}
+	if state.DirIssued != nil {
+		restored.dirIssued = state.DirIssued
+	}
+	if state.DirOwners != nil {
+		restored.dirOwners = state.DirOwners
+	}
+	if state.DirModerators != nil {
+		restored.dirModerators = state.DirModerators
+	}
+	if state.LabelHolders != nil {
+		restored.labelHolders = state.LabelHolders
+	}
+	if state.DirPolicies != nil {
+		restored.dirPolicies = state.DirPolicies
+	}
+	if state.WriteHeights != nil {
+		restored.writeHeights = state.WriteHeights
+	}
+	if state.RejectedWrites != nil {
+		restored.rejectedWrites = state.RejectedWrites
+	}
+	if state.EntryLinks != nil {
+		restored.entryLinks = state.EntryLinks
+	}
+	for _, undoState := range state.Undo {
+		restored.undo[undoState.BlockID] = undoState.Changes
+		restored.undoOrder = append(restored.undoOrder, undoState.BlockID)
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.latestBlockID = state.LatestBlockID
+	idx.latestHeight = state.LatestHeight
+	idx.keyState = restored.keyState
+	idx.directories = restored.directories
+	idx.dirBalances = restored.dirBalances
+	idx.dirGraphs = restored.dirGraphs
+	idx.dirIssued = restored.dirIssued
+	idx.dirOwners = restored.dirOwners
+	idx.dirModerators = restored.dirModerators
+	idx.labelHolders = restored.labelHolders
+	idx.dirPolicies = restored.dirPolicies
+	idx.writeHeights = restored.writeHeights
+	idx.rejectedWrites = restored.rejectedWrites
+	idx.entryLinks = restored.entryLinks
+	idx.undo = restored.undo
+	idx.undoOrder = restored.undoOrder
+	idx.invalidateGraphCache()
+	return nil
+}
@@ -0,0 +1,672 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// decode a padded directory path or label into a public key
+func makeTestPathKey(t *testing.T, path string) ed25519.PublicKey {
+	padded := path
+	if strings.HasPrefix(path, "//") {
+		padded = path + strings.Repeat("0", 43-len(path)) + "="
+	} else {
+		padded = pad44(path)
+	}
+	pubKeyBytes, err := base64.StdEncoding.DecodeString(padded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pubKeyToString(pubKeyBytes) != padded {
+		t.Fatalf("Path %s doesn't round trip", path)
+	}
+	return ed25519.PublicKey(pubKeyBytes)
+}
+
+func makeTestKey(t *testing.T) ed25519.PublicKey {
+	pubKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pubKey
+}
+
+// index the transactions as a block at the given height
+func indexTestTransactions(idx *DirectoryIndex, height int64, txs ...*Transaction) {
+	block := &Block{Header: &BlockHeader{Height: height}, Transactions: txs}
+	idx.indexTransactions(block, BlockID{byte(height)}, true)
+}
+
+// disconnect the transactions indexed as a block at the given height
+func disconnectTestTransactions(idx *DirectoryIndex, height int64, txs ...*Transaction) {
+	block := &Block{Header: &BlockHeader{Height: height}, Transactions: txs}
+	idx.indexTransactions(block, BlockID{byte(height)}, false)
+}
+
+// create a directory and fund the given key with a directory balance
+func makeTestDirectory(t *testing.T, idx *DirectoryIndex, label string, pubKey ed25519.PublicKey,
+	amount int64) string {
+	coinbase := &Transaction{To: makeTestPathKey(t, "//"+label+"//"), Amount: 1, Series: 1}
+	dirID, err := coinbase.ID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fund := &Transaction{From: makeTestKey(t), To: pubKey, Amount: amount, Memo: dirID.String(), Series: 1}
+	indexTestTransactions(idx, 1, coinbase, fund)
+	return dirID.String()
+}
+
+func TestDirectoryIndexTopRanked(t *testing.T) {
+	idx := NewDirectoryIndex()
+	author := makeTestKey(t)
+	dirID := makeTestDirectory(t, idx, "news", author, 1000)
+
+	when := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Unix()
+	indexTestTransactions(idx, 2,
+		&Transaction{Time: when, From: author, To: makeTestPathKey(t, "news/big"), Amount: 300, Series: 1},
+		&Transaction{Time: when + 86400*40, From: author, To: makeTestPathKey(t, "news/small"), Amount: 100, Series: 1},
+	)
+	idx.rankGraph()
+
+	entries, _, height, err := idx.GetTopRanked(dirID, "", true, 0, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != 2 {
+		t.Fatalf("Expected height 2, found %d", height)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 content entries, found %d", len(entries))
+	}
+	if entries[0].Key != pad44("news/big") || entries[1].Key != pad44("news/small") {
+		t.Fatalf("Unexpected ranking order: %s, %s", entries[0].Key, entries[1].Key)
+	}
+	if entries[0].Ranking < entries[1].Ranking {
+		t.Fatal("Entries not sorted by ranking")
+	}
+
+	// synthetic nodes are included without the content filter
+	all, _, _, err := idx.GetTopRanked(dirID, "", false, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foundSynthetic := false
+	for _, entry := range all {
+		if isSyntheticNode(entry.Key) {
+			foundSynthetic = true
+		}
+	}
+	if !foundSynthetic {
+		t.Fatal("Expected synthetic nodes without the content filter")
+	}
+
+	// prefix
+	entries, _, _, err = idx.GetTopRanked(dirID, "news/sm", true, 0, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != pad44("news/small") {
+		t.Fatalf("Expected only news/small for prefix, found %v", entries)
+	}
+
+	// time window
+	entries, _, _, err = idx.GetTopRanked(dirID, "", true, when, when+86400, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != pad44("news/big") {
+		t.Fatalf("Expected only news/big for time window, found %v", entries)
+	}
+
+	// limit
+	entries, _, _, err = idx.GetTopRanked(dirID, "", true, 0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected limit of 1 entry, found %d", len(entries))
+	}
+
+	if _, _, _, err := idx.GetTopRanked("nope", "", true, 0, 0, 10); err == nil {
+		t.Fatal("Expected error for unknown directory")
+	}
+}
+
+func TestIsSyntheticNode(t *testing.T) {
+	synthetic := []string{"0", "2024", "2024+01", "2024+01+02", "+3", "145000", "2000"}
+	for _, key := range synthetic {
+		if !isSyntheticNode(pad44(key)) {
+			t.Fatalf("Expected %s to be synthetic", key)
+		}
+	}
+	content := []string{"news", "news/big", "news/2024"}
+	for _, key := range content {
+		if isSyntheticNode(pad44(key)) {
+			t.Fatalf("Expected %s not to be synthetic", key)
+		}
+	}
+}
+
+func TestDirectoryIndexDirectoryTimeline(t *testing.T) {
+	idx := NewDirectoryIndex()
+	author := makeTestKey(t)
+	dirID := makeTestDirectory(t, idx, "blog", author, 1000)
+
+	jan := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Unix()
+	feb := time.Date(2024, 2, 9, 3, 4, 5, 0, time.UTC).Unix()
+	nextYear := time.Date(2025, 2, 9, 3, 4, 5, 0, time.UTC).Unix()
+	indexTestTransactions(idx, 2,
+		&Transaction{Time: jan, From: author, To: makeTestPathKey(t, "blog/one"), Amount: 100, Series: 1},
+		&Transaction{Time: feb, From: author, To: makeTestPathKey(t, "blog/two"), Amount: 100, Series: 1},
+		&Transaction{Time: feb + 60, From: author, To: makeTestPathKey(t, "blog/three"), Amount: 100, Series: 1},
+		&Transaction{Time: nextYear, From: author, To: makeTestPathKey(t, "blog/four"), Amount: 100, Series: 1},
+	)
+
+	// years
+	_, buckets, _, _, err := idx.GetDirectoryTimeline(dirID, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 2 || buckets[0] != (TimelineBucket{"2024", 3}) || buckets[1] != (TimelineBucket{"2025", 1}) {
+		t.Fatalf("Unexpected year buckets: %v", buckets)
+	}
+
+	// months of a year
+	entries, buckets, _, _, err := idx.GetDirectoryTimeline(dirID, "2024", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries in 2024, found %d", len(entries))
+	}
+	if entries[0].Key != pad44("blog/three") {
+		t.Fatalf("Expected most recent entry first, found %s", entries[0].Key)
+	}
+	if len(buckets) != 2 || buckets[0] != (TimelineBucket{"2024+01", 1}) || buckets[1] != (TimelineBucket{"2024+02", 2}) {
+		t.Fatalf("Unexpected month buckets: %v", buckets)
+	}
+
+	// days of a month
+	entries, buckets, _, _, err = idx.GetDirectoryTimeline(dirID, "2024+02", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected limit of 1 entry, found %d", len(entries))
+	}
+	if len(buckets) != 1 || buckets[0] != (TimelineBucket{"2024+02+09", 2}) {
+		t.Fatalf("Unexpected day buckets: %v", buckets)
+	}
+
+	// a day
+	entries, buckets, _, _, err = idx.GetDirectoryTimeline(dirID, "2024+01+02", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != pad44("blog/one") || len(buckets) != 0 {
+		t.Fatalf("Unexpected entries for day: %v, %v", entries, buckets)
+	}
+
+	if _, _, _, _, err := idx.GetDirectoryTimeline(dirID, "2024-01", 0); err == nil {
+		t.Fatal("Expected error for invalid period")
+	}
+}
+
+func TestDirectoryIndexModeration(t *testing.T) {
+	idx := NewDirectoryIndex()
+	owner, author, moderator := makeTestKey(t), makeTestKey(t), makeTestKey(t)
+
+	// the owner is named in the coinbase memo
+	coinbase := &Transaction{To: makeTestPathKey(t, "//forum//"), Amount: 1, Memo: pubKeyToString(owner), Series: 1}
+	id, err := coinbase.ID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirID := id.String()
+	fund := &Transaction{From: makeTestKey(t), To: author, Amount: 1000, Memo: dirID, Series: 1}
+	indexTestTransactions(idx, 1, coinbase, fund)
+
+	when := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Unix()
+	post, spam := makeTestPathKey(t, "forum/post"), makeTestPathKey(t, "forum/spam")
+	indexTestTransactions(idx, 2,
+		&Transaction{Time: when, From: author, To: post, Amount: 100, Series: 1},
+		&Transaction{Time: when, From: author, To: spam, Amount: 100, Series: 1},
+	)
+
+	listed := func() int {
+		entries, _, _, err := idx.GetTopRanked(dirID, "", true, 0, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+	if listed() != 2 {
+		t.Fatal("Expected 2 listed entries")
+	}
+
+	// only the author can tombstone
+	indexTestTransactions(idx, 3, &Transaction{From: owner, To: post, Amount: 1, Memo: TombstoneMemo, Series: 1})
+	if listed() != 2 {
+		t.Fatal("Expected tombstone from non-author to be ignored")
+	}
+	indexTestTransactions(idx, 4, &Transaction{From: author, To: post, Amount: 1, Memo: TombstoneMemo, Series: 1})
+	if listed() != 1 {
+		t.Fatal("Expected tombstoned entry to be unlisted")
+	}
+
+	// a new revision by the author restores it
+	indexTestTransactions(idx, 5, &Transaction{Time: when, From: author, To: post, Amount: 100, Series: 1})
+	if listed() != 2 {
+		t.Fatal("Expected revised entry to be listed")
+	}
+
+	// moderators must be delegated by the owner
+	indexTestTransactions(idx, 6, &Transaction{From: moderator, To: spam, Amount: 1, Memo: HideMemo, Series: 1})
+	if listed() != 2 {
+		t.Fatal("Expected hide from non-moderator to be ignored")
+	}
+	indexTestTransactions(idx, 7,
+		&Transaction{From: owner, To: moderator, Amount: 1, Memo: ModeratorMemoPrefix + dirID, Series: 1},
+		&Transaction{From: moderator, To: spam, Amount: 1, Memo: HideMemo, Series: 1},
+	)
+	if listed() != 1 {
+		t.Fatal("Expected hidden entry to be unlisted")
+	}
+	entries, _, _, _, err := idx.GetDirectoryTimeline(dirID, "2024", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != pad44("forum/post") {
+		t.Fatalf("Expected hidden entry to be excluded from the timeline, found %v", entries)
+	}
+
+	// history is retained
+	if _, ok := idx.dirGraphs[dirID].index[pad44("forum/spam")]; !ok {
+		t.Fatal("Expected hidden entry to remain in the graph")
+	}
+
+	// revoked moderators can't unhide
+	indexTestTransactions(idx, 8,
+		&Transaction{From: owner, To: moderator, Amount: 1, Memo: UnmoderatorMemoPrefix + dirID, Series: 1},
+		&Transaction{From: moderator, To: spam, Amount: 1, Memo: UnhideMemo, Series: 1},
+	)
+	if listed() != 1 {
+		t.Fatal("Expected unhide from revoked moderator to be ignored")
+	}
+	indexTestTransactions(idx, 9, &Transaction{From: owner, To: spam, Amount: 1, Memo: UnhideMemo, Series: 1})
+	if listed() != 2 {
+		t.Fatal("Expected owner to unhide entry")
+	}
+}
+
+func TestDirectoryIndexModerationDisconnect(t *testing.T) {
+	idx := NewDirectoryIndex()
+	owner, author, moderator := makeTestKey(t), makeTestKey(t), makeTestKey(t)
+
+	coinbase := &Transaction{To: makeTestPathKey(t, "//forum//"), Amount: 1, Memo: pubKeyToString(owner), Series: 1}
+	id, err := coinbase.ID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirID := id.String()
+	fund := &Transaction{From: makeTestKey(t), To: author, Amount: 1000, Memo: dirID, Series: 1}
+	indexTestTransactions(idx, 1, coinbase, fund)
+
+	post, spam := makeTestPathKey(t, "forum/post"), makeTestPathKey(t, "forum/spam")
+	indexTestTransactions(idx, 2,
+		&Transaction{Time: 1, From: author, To: post, Amount: 100, Series: 1},
+		&Transaction{Time: 1, From: author, To: spam, Amount: 100, Series: 1},
+	)
+
+	tombstone := []*Transaction{{From: author, To: post, Amount: 1, Memo: TombstoneMemo, Series: 1}}
+	revise := []*Transaction{{Time: 2, From: author, To: post, Amount: 100, Series: 1}}
+	hide := []*Transaction{
+		{From: owner, To: moderator, Amount: 1, Memo: ModeratorMemoPrefix + dirID, Series: 1},
+		{From: moderator, To: spam, Amount: 1, Memo: HideMemo, Series: 1},
+	}
+	indexTestTransactions(idx, 3, tombstone...)
+	indexTestTransactions(idx, 4, hide...)
+	indexTestTransactions(idx, 5, revise...)
+
+	// undo information survives a restart
+	buf := new(bytes.Buffer)
+	if err := idx.SaveState(buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewDirectoryIndex()
+	if err := restored.LoadState(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, index := range []*DirectoryIndex{idx, restored} {
+		st := func(path string) *KeyState {
+			return index.keyState[pad44(path)]
+		}
+		if st("forum/post").tombstoned || !st("forum/spam").hidden {
+			t.Fatal("Expected revised entry to be listed and spam to be hidden")
+		}
+
+		disconnectTestTransactions(index, 5, revise...)
+		if !st("forum/post").tombstoned {
+			t.Fatal("Expected disconnected revision to leave the entry tombstoned")
+		}
+
+		disconnectTestTransactions(index, 4, hide...)
+		if st("forum/spam").hidden || index.isModerator(dirID, pubKeyToString(moderator)) {
+			t.Fatal("Expected disconnected hide and delegation to be reverted")
+		}
+
+		disconnectTestTransactions(index, 3, tombstone...)
+		if st("forum/post").tombstoned {
+			t.Fatal("Expected disconnected tombstone to be reverted")
+		}
+		if len(index.undo) != 0 || len(index.undoOrder) != 0 {
+			t.Fatal("Expected undo information to be consumed")
+		}
+	}
+}
+
+func TestDirectoryIndexKeyProfile(t *testing.T) {
+	idx := NewDirectoryIndex()
+	alice, mallory := makeTestKey(t), makeTestKey(t)
+	dirID := makeTestDirectory(t, idx, "wiki", alice, 1000)
+
+	indexTestTransactions(idx, 2,
+		&Transaction{Time: 100, From: alice, To: makeTestPathKey(t, "//alice//"), Amount: 1, Memo: "hi", Series: 1},
+		&Transaction{Time: 100, From: alice, To: makeTestPathKey(t, "wiki/page"), Amount: 100, Series: 1},
+	)
+	indexTestTransactions(idx, 3,
+		&Transaction{Time: 200, From: alice, To: makeTestPathKey(t, "//Alice+B//"), Amount: 1, Series: 1},
+		&Transaction{Time: 200, From: mallory, To: makeTestPathKey(t, "//alice+b//"), Amount: 1, Series: 1},
+	)
+
+	profile, _, height := idx.GetKeyProfile(alice)
+	if height != 3 {
+		t.Fatalf("Expected height 3, found %d", height)
+	}
+	if profile.Label != "Alice B" {
+		t.Fatalf("Expected label 'Alice B', found '%s'", profile.Label)
+	}
+	if len(profile.LabelHistory) != 2 {
+		t.Fatalf("Expected 2 labels in history, found %d", len(profile.LabelHistory))
+	}
+	if profile.LabelHistory[0] != (KeyLabel{Label: "alice", Memo: "hi", Height: 2, Time: 100}) {
+		t.Fatalf("Unexpected first label: %v", profile.LabelHistory[0])
+	}
+	if len(profile.LabelCollisions) != 1 || !bytes.Equal(profile.LabelCollisions[0], mallory) {
+		t.Fatalf("Expected collision with mallory, found %v", profile.LabelCollisions)
+	}
+	if len(profile.Directories) != 1 || profile.Directories[0].DirectoryID != dirID ||
+		profile.Directories[0].Label != "wiki" || profile.Directories[0].Balance != 900 {
+		t.Fatalf("Unexpected directories: %v", profile.Directories)
+	}
+
+	// relabelling resolves the collision
+	relabel := &Transaction{From: mallory, To: makeTestPathKey(t, "//mallory//"), Amount: 1, Series: 1}
+	indexTestTransactions(idx, 4, relabel)
+	profile, _, _ = idx.GetKeyProfile(alice)
+	if len(profile.LabelCollisions) != 0 {
+		t.Fatalf("Expected no collisions, found %v", profile.LabelCollisions)
+	}
+
+	// disconnecting the relabelling restores the collision
+	disconnectTestTransactions(idx, 4, relabel)
+	profile, _, _ = idx.GetKeyProfile(alice)
+	if len(profile.LabelCollisions) != 1 {
+		t.Fatalf("Expected collision with mallory, found %v", profile.LabelCollisions)
+	}
+	if profile, _, _ := idx.GetKeyProfile(mallory); profile.Label != "alice b" || len(profile.LabelHistory) != 1 {
+		t.Fatalf("Expected mallory's previous label, found %v", profile)
+	}
+	disconnectTestTransactions(idx, 3,
+		&Transaction{Time: 200, From: alice, To: makeTestPathKey(t, "//Alice+B//"), Amount: 1, Series: 1},
+		&Transaction{Time: 200, From: mallory, To: makeTestPathKey(t, "//alice+b//"), Amount: 1, Series: 1},
+	)
+	profile, _, _ = idx.GetKeyProfile(alice)
+	if profile.Label != "alice" || profile.Memo != "hi" || len(profile.LabelHistory) != 1 {
+		t.Fatalf("Expected alice's first label, found %v", profile)
+	}
+	if _, ok := idx.keyState[pubKeyToString(mallory)]; ok || len(idx.labelHolders[normalizeLabel("alice b")]) != 0 {
+		t.Fatal("Expected mallory's label to be removed")
+	}
+
+	// unknown keys have an empty profile
+	profile, _, _ = idx.GetKeyProfile(makeTestKey(t))
+	if profile.Label != "" || len(profile.Directories) != 0 {
+		t.Fatalf("Expected empty profile, found %v", profile)
+	}
+}
+
+func TestDirectoryIndexDirectoryBalances(t *testing.T) {
+	idx := NewDirectoryIndex()
+	alice, bob := makeTestKey(t), makeTestKey(t)
+	dirID := makeTestDirectory(t, idx, "club", alice, 1000)
+
+	// alice holds a balance so her transfer to bob isn't issued by the root
+	indexTestTransactions(idx, 2,
+		&Transaction{From: alice, To: bob, Amount: 400, Memo: dirID, Series: 1},
+		&Transaction{Time: 100, From: bob, To: makeTestPathKey(t, "club/hello"), Amount: 100, Series: 1},
+	)
+
+	balance, _, _, err := idx.GetDirectoryBalance(dirID, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 600 {
+		t.Fatalf("Expected alice to hold 600, found %d", balance)
+	}
+
+	holders, issued, _, _, err := idx.GetDirectoryBalances(dirID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued != 1000 {
+		t.Fatalf("Expected 1000 issued, found %d", issued)
+	}
+	if len(holders) != 2 || !bytes.Equal(holders[0].PublicKey, alice) || holders[0].Balance != 600 ||
+		!bytes.Equal(holders[1].PublicKey, bob) || holders[1].Balance != 300 {
+		t.Fatalf("Unexpected holders: %v", holders)
+	}
+
+	holders, _, _, _, err = idx.GetDirectoryBalances(dirID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(holders) != 1 {
+		t.Fatalf("Expected limit of 1 holder, found %d", len(holders))
+	}
+
+	if _, _, _, err := idx.GetDirectoryBalance("nope", alice); err == nil {
+		t.Fatal("Expected error for unknown directory")
+	}
+}
+
+func TestDirectoryIndexGraphCache(t *testing.T) {
+	idx := NewDirectoryIndex()
+	author := makeTestKey(t)
+	dirID := makeTestDirectory(t, idx, "news", author, 1000)
+	otherID := makeTestDirectory(t, idx, "other", author, 1000)
+	indexTestTransactions(idx, 2,
+		&Transaction{Time: 100, From: author, To: makeTestPathKey(t, "news/big"), Amount: 300, Series: 1})
+	idx.rankGraph()
+
+	graph, cursor, _, height, err := idx.GetGraph(dirID, pubKeyToString(author), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != 2 || len(cursor) != 0 || !strings.Contains(graph, "digraph") {
+		t.Fatalf("Unexpected graph at height %d cursor %q: %s", height, cursor, graph)
+	}
+	if len(idx.graphCache) != 1 {
+		t.Fatalf("Expected the rendering to be cached, found %d entries", len(idx.graphCache))
+	}
+
+	// formats are cached separately
+	svg, _, _, _, err := idx.GetGraph(dirID, pubKeyToString(author), "svg", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(svg, "<svg") || len(idx.graphCache) != 2 {
+		t.Fatalf("Expected a cached SVG rendering, found %d entries: %s", len(idx.graphCache), svg)
+	}
+	if _, _, _, _, err := idx.GetGraph(dirID, pubKeyToString(author), "png", ""); err == nil {
+		t.Fatal("Expected unsupported format to be rejected")
+	}
+
+	// a known ETag is answered without a graph
+	outChan := make(chan Message, 1)
+	if err := idx.onGetGraph(author, dirID, nil, "", "", "", outChan); err != nil {
+		t.Fatal(err)
+	}
+	gm := (<-outChan).Body.(GraphMessage)
+	if gm.NotModified || gm.Graph != graph || len(gm.ETag) == 0 {
+		t.Fatalf("Expected graph reply, found %v", gm)
+	}
+	etag := gm.ETag
+	notModified := func() bool {
+		if err := idx.onGetGraph(author, dirID, nil, "", etag, "", outChan); err != nil {
+			t.Fatal(err)
+		}
+		gm := (<-outChan).Body.(GraphMessage)
+		return gm.NotModified && len(gm.Graph) == 0
+	}
+	if !notModified() {
+		t.Fatal("Expected not-modified reply")
+	}
+
+	// the ETag only matches the graph it was issued for
+	other := []struct {
+		pubKey      ed25519.PublicKey
+		directoryID string
+		format      string
+	}{{author, dirID, "svg"}, {author, otherID, ""}, {makeTestKey(t), dirID, ""}}
+	for _, o := range other {
+		if err := idx.onGetGraph(o.pubKey, o.directoryID, nil, o.format, etag, "", outChan); err != nil {
+			t.Fatal(err)
+		}
+		if gm := (<-outChan).Body.(GraphMessage); gm.NotModified || gm.ETag == etag {
+			t.Fatalf("Expected graph reply for %s %s, found %v", o.directoryID, o.format, gm)
+		}
+	}
+	if err := idx.onGetGraph(author, "", []string{dirID}, "", etag, "", outChan); err != nil {
+		t.Fatal(err)
+	}
+	if gm := (<-outChan).Body.(GraphMessage); gm.NotModified {
+		t.Fatal("Expected graph reply for a merged graph")
+	}
+	if !notModified() {
+		t.Fatal("Expected not-modified reply")
+	}
+
+	// re-ranking changes the ETag
+	idx.rankGraph()
+	if notModified() {
+		t.Fatal("Expected graph reply after re-ranking")
+	}
+
+	// as does a reorganization to a block at the same height
+	if err := idx.onGetGraph(author, dirID, nil, "", "", "", outChan); err != nil {
+		t.Fatal(err)
+	}
+	etag = (<-outChan).Body.(GraphMessage).ETag
+	disconnectTestTransactions(idx, 2)
+	block := &Block{Header: &BlockHeader{Height: 2}}
+	idx.indexTransactions(block, BlockID{0xff}, true)
+	if notModified() {
+		t.Fatal("Expected graph reply after a reorganization")
+	}
+
+	// updates invalidate cached renderings and outstanding cursors
+	cursor = fmt.Sprintf("%s:%d:%d", idx.latestBlockID, idx.graphVersion, 10)
+	if page, _, _, _, err := idx.GetGraph(dirID, pubKeyToString(author), "", cursor); err != nil || page != graph[10:] {
+		t.Fatalf("Expected the rest of the graph, found %q %v", page, err)
+	}
+	indexTestTransactions(idx, 3,
+		&Transaction{Time: 200, From: author, To: makeTestPathKey(t, "news/small"), Amount: 100, Series: 1})
+	if len(idx.graphCache) != 0 {
+		t.Fatal("Expected cache to be invalidated")
+	}
+	if _, _, _, _, err := idx.GetGraph(dirID, pubKeyToString(author), "", cursor); err == nil {
+		t.Fatal("Expected stale cursor to be rejected")
+	}
+}
+
+func TestGraphPage(t *testing.T) {
+	graph := "digraph G {\n  a;\n  b;\n}\n"
+	var pages []string
+	for offset := 0; offset < len(graph); {
+		var page string
+		page, offset = graphPage(graph, offset, 8)
+		pages = append(pages, page)
+	}
+	if strings.Join(pages, "") != graph {
+		t.Fatalf("Pages don't reassemble the graph: %q", pages)
+	}
+	// pages end at line breaks unless a line is longer than a page
+	if len(pages) != 4 || pages[0] != "digraph " || pages[1] != "G {\n" {
+		t.Fatalf("Unexpected pages: %q", pages)
+	}
+}
+
+func TestDirectoryIndexState(t *testing.T) {
+	idx := NewDirectoryIndex()
+	author := makeTestKey(t)
+	dirID := makeTestDirectory(t, idx, "news", author, 1000)
+	indexTestTransactions(idx, 2,
+		&Transaction{From: author, To: makeTestPathKey(t, "news/big"), Amount: 300, Series: 1},
+		&Transaction{From: author, To: makeTestPathKey(t, "news/small"), Amount: 100, Series: 1},
+	)
+	idx.rankGraph()
+
+	buf := new(bytes.Buffer)
+	if err := idx.SaveState(buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewDirectoryIndex()
+	if err := restored.LoadState(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	compare := func() {
+		expect, _, _, err := idx.GetTopRanked(dirID, "", false, 0, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, _, height, err := restored.GetTopRanked(dirID, "", false, 0, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if height != idx.latestHeight || fmt.Sprint(found) != fmt.Sprint(expect) {
+			t.Fatalf("Expected %v at height %d, found %v at %d", expect, idx.latestHeight, found, height)
+		}
+		expectGraph, _, _, _, err := idx.GetGraph(dirID, "", "dot", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		foundGraph, _, _, _, err := restored.GetGraph(dirID, "", "dot", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if foundGraph != expectGraph {
+			t.Fatalf("Expected graph:\n%s\nfound:\n%s", expectGraph, foundGraph)
+		}
+	}
+	compare()
+
+	// both continue indexing the same way
+	for _, index := range []*DirectoryIndex{idx, restored} {
+		indexTestTransactions(index, 3,
+			&Transaction{From: author, To: makeTestPathKey(t, "news/small"), Amount: 500, Series: 1})
+		index.rankGraph()
+	}
+	compare()
+}
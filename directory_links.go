@@ -0,0 +1,236 @@
+package cruzbit
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// LinkMemoPrefix followed by a path links the entry being written to the entry at the path,
+// e.g. "//link//docs/intro". The path's root label identifies the directory it's in, which may be
+// the same directory or another one. Writing to the entry again with a different memo replaces or
+// removes its link. Links don't require the target to exist yet.
+const LinkMemoPrefix = "//link//"
+
+// parse a link memo into the ID of the target directory and the padded path of the target entry
+func (idx *DirectoryIndex) parseLinkMemo(memo string) (string, string, bool) {
+	if !strings.HasPrefix(memo, LinkMemoPrefix) {
+		return "", "", false
+	}
+	path := pad44(strings.TrimSpace(strings.TrimPrefix(memo, LinkMemoPrefix)))
+	if _, err := pubKeyFromString(path); err != nil {
+		return "", "", false
+	}
+	ok, label, _, _ := inflateNodes(path)
+	if !ok {
+		return "", "", false
+	}
+	directoryID, ok := idx.directoryByLabel(label)
+	if !ok {
+		return "", "", false
+	}
+	return directoryID, path, true
+}
+
+// set or remove an entry's link after it's written
+func (idx *DirectoryIndex) setLink(directoryID, path string, txn *Transaction, height int64) {
+	targetID, target, ok := idx.parseLinkMemo(txn.Memo)
+	if !ok || (targetID == directoryID && target == path) {
+		delete(idx.entryLinks[directoryID], path)
+		return
+	}
+	if _, ok := idx.entryLinks[directoryID]; !ok {
+		idx.entryLinks[directoryID] = make(map[string]EntryLink)
+	}
+	idx.entryLinks[directoryID][path] = EntryLink{
+		FromDirectoryID: directoryID,
+		FromPath:        path,
+		ToDirectoryID:   targetID,
+		ToPath:          target,
+		Amount:          txn.Amount,
+		Height:          height,
+		Time:            txn.Time,
+	}
+}
+
+// returns the directories a key is linked in or has a balance in. must be called with the read lock held
+func (idx *DirectoryIndex) keyDirectories(pk string) []KeyDirectory {
+	var directories []KeyDirectory
+	for directoryID, graph := range idx.dirGraphs {
+		balance, hasBalance := idx.dirBalances[directoryID][pk]
+		id, linked := graph.index[pk]
+		if !linked && !hasBalance {
+			continue
+		}
+		var ranking float64
+		if linked {
+			ranking = graph.nodes[id].ranking
+		}
+		directories = append(directories, KeyDirectory{
+			DirectoryID: directoryID,
+			Label:       idx.directories[directoryID],
+			Balance:     balance,
+			Ranking:     ranking,
+		})
+	}
+	sort.Slice(directories, func(i, j int) bool {
+		return directories[i].DirectoryID < directories[j].DirectoryID
+	})
+	return directories
+}
+
+// GetKeyDirectories returns the directories a public key or path participates in along with its
+// balance and ranking in each and the entry links to and from it. The ID and height of the latest
+// indexed block are also returned.
+func (idx *DirectoryIndex) GetKeyDirectories(pubKey ed25519.PublicKey) ([]KeyDirectory, []EntryLink, BlockID, int64) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	pk := pubKeyToString(pubKey)
+	var links []EntryLink
+	for _, dirLinks := range idx.entryLinks {
+		for _, link := range dirLinks {
+			if link.FromPath == pk || link.ToPath == pk {
+				links = append(links, link)
+			}
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].FromDirectoryID != links[j].FromDirectoryID {
+			return links[i].FromDirectoryID < links[j].FromDirectoryID
+		}
+		return links[i].FromPath < links[j].FromPath
+	})
+
+	return idx.keyDirectories(pk), links, idx.latestBlockID, idx.latestHeight
+}
+
+// validates the directories for a merged graph and returns their sorted IDs without duplicates.
+// must be called with the read lock held
+func (idx *DirectoryIndex) mergedDirectoryIDs(directoryIDs []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, directoryID := range directoryIDs {
+		if seen[directoryID] {
+			continue
+		}
+		if _, ok := idx.directories[directoryID]; !ok {
+			return nil, fmt.Errorf("Directory %s not found", directoryID)
+		}
+		seen[directoryID] = true
+		ids = append(ids, directoryID)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No directories specified")
+	}
+	if len(ids) > MaxMergedGraphDirectories {
+		return nil, fmt.Errorf("Too many directories, the maximum is %d", MaxMergedGraphDirectories)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Merges a public key's neighborhoods in each of the directories into one graph and adds the
+// entry links between them. Entries and keys with a directory balance are shared between the
+// directories while other nodes are prefixed with their directory ID. Shared nodes are given their
+// highest ranking. Returns the graph and the states to label its nodes with.
+// must be called with the read lock held
+func (idx *DirectoryIndex) mergeGraphs(directoryIDs []string, pubKey string) (*Graph, map[string]*KeyState) {
+	merged := NewGraph()
+	states := make(map[string]*KeyState)
+
+	nodeKey := func(directoryID, key string) string {
+		if st := idx.keyState[key]; isContentEntry(key, st) {
+			states[key] = st
+			return key
+		}
+		if _, ok := idx.dirBalances[directoryID][key]; ok {
+			if st, ok := idx.keyState[key]; ok {
+				states[key] = st
+			}
+			return key
+		}
+		label := unpadNode(key)
+		if key == rootNode {
+			label = "root"
+		}
+		prefixed := directoryID + ":" + key
+		states[prefixed] = &KeyState{label: idx.directories[directoryID] + " " + label}
+		return prefixed
+	}
+
+	inView := make(map[string]bool)
+	for _, directoryID := range directoryIDs {
+		graph := idx.dirGraphs[directoryID]
+		edges, _ := graph.neighborhood(pubKey)
+		for _, eIndex := range edges {
+			e := &graph.edges[eIndex]
+			ids := []uint32{e.source, e.target}
+			keys := make([]string, len(ids))
+			for i, id := range ids {
+				keys[i] = nodeKey(directoryID, graph.nodes[id].pubkey)
+			}
+			merged.Link(keys[0], keys[1], e.weight, e.height, e.time)
+
+			for i, id := range ids {
+				inView[keys[i]] = true
+				if node := &merged.nodes[merged.index[keys[i]]]; graph.nodes[id].ranking > node.ranking {
+					node.ranking = graph.nodes[id].ranking
+				}
+			}
+		}
+	}
+
+	inSet := make(map[string]bool)
+	for _, directoryID := range directoryIDs {
+		inSet[directoryID] = true
+	}
+	for _, directoryID := range directoryIDs {
+		paths := make([]string, 0, len(idx.entryLinks[directoryID]))
+		for path := range idx.entryLinks[directoryID] {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+
+		for _, path := range paths {
+			link := idx.entryLinks[directoryID][path]
+			if !inSet[link.ToDirectoryID] {
+				continue
+			}
+			source := nodeKey(link.FromDirectoryID, link.FromPath)
+			target := nodeKey(link.ToDirectoryID, link.ToPath)
+			if !inView[source] && !inView[target] {
+				// only links touching the public key's neighborhoods are shown
+				continue
+			}
+			merged.Link(source, target, float64(link.Amount), link.Height, link.Time)
+		}
+	}
+
+	return merged, states
+}
+
+// Handle a request for the directories a public key or path participates in
+func (idx *DirectoryIndex) onGetKeyDirectories(pubKey ed25519.PublicKey, outChan chan<- Message) error {
+	if len(pubKey) != ed25519.PublicKeySize {
+		err := fmt.Errorf("Invalid public key")
+		outChan <- Message{Type: "key_directories", Body: KeyDirectoriesMessage{PublicKey: pubKey, Error: err.Error()}}
+		return err
+	}
+
+	directories, links, blockID, height := idx.GetKeyDirectories(pubKey)
+
+	outChan <- Message{
+		Type: "key_directories",
+		Body: KeyDirectoriesMessage{
+			BlockID:     blockID,
+			Height:      height,
+			PublicKey:   pubKey,
+			Directories: directories,
+			Links:       links,
+		},
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDirectoryIndexLinks(t *testing.T) {
+	idx := NewDirectoryIndex()
+	author := makeTestKey(t)
+	newsID := makeTestDirectory(t, idx, "news", author, 1000)
+	docsID := makeTestDirectory(t, idx, "docs", author, 1000)
+
+	when := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Unix()
+	big, intro := makeTestPathKey(t, "news/big"), makeTestPathKey(t, "docs/intro")
+	indexTestTransactions(idx, 2,
+		&Transaction{Time: when, From: author, To: big, Amount: 100, Memo: LinkMemoPrefix + "docs/intro", Series: 1},
+		&Transaction{Time: when, From: author, To: intro, Amount: 100, Memo: "getting started", Series: 1},
+		&Transaction{Time: when, From: author, To: makeTestPathKey(t, "news/bad"), Amount: 100,
+			Memo: LinkMemoPrefix + "nowhere/intro", Series: 1},
+	)
+	idx.rankGraph()
+
+	directories, links, _, _ := idx.GetKeyDirectories(intro)
+	if len(directories) != 1 || directories[0].DirectoryID != docsID || directories[0].Ranking <= 0 {
+		t.Fatalf("Unexpected directories %v", directories)
+	}
+	if len(links) != 1 || links[0].FromDirectoryID != newsID || links[0].FromPath != pubKeyToString(big) ||
+		links[0].ToDirectoryID != docsID || links[0].ToPath != pubKeyToString(intro) || links[0].Amount != 100 {
+		t.Fatalf("Unexpected links %v", links)
+	}
+
+	directories, links, _, _ = idx.GetKeyDirectories(author)
+	if len(directories) != 2 || len(links) != 0 {
+		t.Fatalf("Expected author in 2 directories without links, found %v %v", directories, links)
+	}
+	if directories[0].Balance != 800 && directories[1].Balance != 800 {
+		t.Fatalf("Expected a balance of 800 in news, found %v", directories)
+	}
+
+	// the merged graph shares the author and entries and links them across directories
+	merged, states := idx.mergeGraphs([]string{docsID, newsID}, pubKeyToString(author))
+	source, sok := merged.index[pubKeyToString(big)]
+	target, tok := merged.index[pubKeyToString(intro)]
+	if !sok || !tok {
+		t.Fatal("Expected both entries in the merged graph")
+	}
+	if _, ok := merged.edgeIndex[uint64(source)<<32|uint64(target)]; !ok {
+		t.Fatal("Expected a link between the entries")
+	}
+	if _, ok := merged.index[pubKeyToString(author)]; !ok {
+		t.Fatal("Expected the author in the merged graph")
+	}
+	if st := states[newsID+":"+rootNode]; st == nil || st.label != "news root" {
+		t.Fatalf("Expected a labelled root for news, found %v", st)
+	}
+
+	dot, _, _, _, err := idx.GetMergedGraph([]string{newsID, docsID, newsID}, pubKeyToString(author), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dot, "news root") || !strings.Contains(dot, "docs root") {
+		t.Fatalf("Expected both roots in merged graph:\n%s", dot)
+	}
+	if _, _, _, _, err := idx.GetMergedGraph([]string{newsID, "nope"}, "", "", ""); err == nil {
+		t.Fatal("Expected unknown directory to be rejected")
+	}
+
+	// writing the entry again without a link memo removes the link
+	indexTestTransactions(idx, 3, &Transaction{Time: when, From: author, To: big, Amount: 1, Series: 1})
+	if _, links, _, _ := idx.GetKeyDirectories(intro); len(links) != 0 {
+		t.Fatalf("Expected link to be removed, found %v", links)
+	}
+}
@@ -0,0 +1,284 @@
+package cruzbit
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// PolicyMemoPrefix followed by a list of space-separated parameters sets a directory's policy
+// for writing entries when sent to any path within the directory by the directory's owner.
+// Each policy replaces the previous one and omitted parameters are unrestricted:
+//
+//	min=<cruzbits>        minimum amount per entry
+//	rate=<count>/<blocks> maximum entries per key within any span of blocks
+//	depth=<nodes>         maximum number of path nodes
+//	memo=<classes>        allowed memo characters as a "+"-separated list of alpha, digit, space and punct
+//
+// For example: "//policy//min=100000 rate=5/144 depth=3 memo=alpha+digit+space".
+// Policies apply to the transactions following them and don't consume directory balance.
+// Invalid policies from the owner are recorded as rejected writes and policy memos from
+// other keys are indexed as ordinary entries.
+const PolicyMemoPrefix = "//policy//"
+
+// the number of rejected writes kept for each directory
+const maxRejectedWrites = 1000
+
+var memoClasses = map[string]func(r rune) bool{
+	"alpha": func(r rune) bool { return unicode.IsLetter(r) },
+	"digit": func(r rune) bool { return unicode.IsDigit(r) },
+	"space": func(r rune) bool { return r == ' ' },
+	"punct": func(r rune) bool { return unicode.IsPunct(r) || unicode.IsSymbol(r) },
+}
+
+// parse a policy memo. invalid policies are rejected by all indexers
+func parsePolicyMemo(memo string) (*DirectoryPolicy, bool, error) {
+	if !strings.HasPrefix(memo, PolicyMemoPrefix) {
+		return nil, false, nil
+	}
+
+	policy := &DirectoryPolicy{}
+	for _, param := range strings.Fields(strings.TrimPrefix(memo, PolicyMemoPrefix)) {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 {
+			return nil, true, fmt.Errorf("Invalid policy parameter %s", param)
+		}
+		var err error
+		switch parts[0] {
+		case "min":
+			policy.MinAmount, err = strconv.ParseInt(parts[1], 10, 64)
+		case "rate":
+			rate := strings.SplitN(parts[1], "/", 2)
+			if len(rate) != 2 {
+				return nil, true, fmt.Errorf("Invalid rate %s", parts[1])
+			}
+			if policy.RateLimit, err = strconv.Atoi(rate[0]); err == nil {
+				policy.RateBlocks, err = strconv.ParseInt(rate[1], 10, 64)
+			}
+			if err == nil && (policy.RateLimit <= 0 || policy.RateBlocks <= 0) {
+				err = fmt.Errorf("Invalid rate %s", parts[1])
+			}
+		case "depth":
+			policy.MaxDepth, err = strconv.Atoi(parts[1])
+			if err == nil && policy.MaxDepth <= 0 {
+				err = fmt.Errorf("Invalid depth %s", parts[1])
+			}
+		case "memo":
+			for _, class := range strings.Split(parts[1], "+") {
+				if _, ok := memoClasses[class]; !ok {
+					return nil, true, fmt.Errorf("Invalid memo class %s", class)
+				}
+				policy.MemoClasses = append(policy.MemoClasses, class)
+			}
+		default:
+			return nil, true, fmt.Errorf("Unknown policy parameter %s", parts[0])
+		}
+		if err != nil {
+			return nil, true, err
+		}
+		if policy.MinAmount < 0 {
+			return nil, true, fmt.Errorf("Invalid minimum amount %d", policy.MinAmount)
+		}
+	}
+	return policy, true, nil
+}
+
+// replaces the directory's policy. the caller checks the sender is the owner
+func (idx *DirectoryIndex) setPolicy(directoryID, memo string, height int64) error {
+	policy, _, err := parsePolicyMemo(memo)
+	if err != nil {
+		return err
+	}
+	policy.Height = height
+	idx.dirPolicies[directoryID] = policy
+	return nil
+}
+
+// returns the reason a write violates the directory's policy or an empty string
+func (idx *DirectoryIndex) checkPolicy(directoryID, from string, nodes []string, txn *Transaction,
+	height int64) string {
+	policy, ok := idx.dirPolicies[directoryID]
+	if !ok {
+		return ""
+	}
+	if txn.Amount < policy.MinAmount {
+		return fmt.Sprintf("amount %d is below the minimum of %d", txn.Amount, policy.MinAmount)
+	}
+	if policy.MaxDepth != 0 && len(nodes) > policy.MaxDepth {
+		return fmt.Sprintf("path depth %d exceeds the maximum of %d", len(nodes), policy.MaxDepth)
+	}
+	if len(policy.MemoClasses) != 0 {
+		for _, r := range txn.Memo {
+			allowed := false
+			for _, class := range policy.MemoClasses {
+				if r <= unicode.MaxASCII && memoClasses[class](r) {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				return fmt.Sprintf("memo character %q is not allowed", r)
+			}
+		}
+	}
+	if policy.RateLimit != 0 {
+		count := 0
+		for _, h := range idx.writeHeights[directoryID][from] {
+			if height-h < policy.RateBlocks {
+				count++
+			}
+		}
+		if count >= policy.RateLimit {
+			return fmt.Sprintf("rate limit of %d entries per %d blocks exceeded",
+				policy.RateLimit, policy.RateBlocks)
+		}
+	}
+	return ""
+}
+
+// records a key's recent write heights before they're changed
+func (idx *DirectoryIndex) appendWriteUndo(undo []directoryUndo, directoryID, from string) []directoryUndo {
+	policy, ok := idx.dirPolicies[directoryID]
+	if !ok || policy.RateLimit == 0 {
+		return undo
+	}
+	return append(undo, directoryUndo{
+		DirectoryID:  directoryID,
+		Writer:       from,
+		WriteHeights: idx.writeHeights[directoryID][from],
+	})
+}
+
+// remember the heights of recent writes for rate limiting
+func (idx *DirectoryIndex) recordWrite(directoryID, from string, height int64) {
+	policy, ok := idx.dirPolicies[directoryID]
+	if !ok || policy.RateLimit == 0 {
+		return
+	}
+	if _, ok := idx.writeHeights[directoryID]; !ok {
+		idx.writeHeights[directoryID] = make(map[string][]int64)
+	}
+	var heights []int64
+	for _, h := range idx.writeHeights[directoryID][from] {
+		if height-h < policy.RateBlocks {
+			heights = append(heights, h)
+		}
+	}
+	idx.writeHeights[directoryID][from] = append(heights, height)
+}
+
+// records a write which wasn't indexed. returns the information needed to undo it
+func (idx *DirectoryIndex) rejectWrite(directoryID string, txid TransactionID, txn *Transaction,
+	path string, height int64, reason string) directoryUndo {
+	rejected := append(idx.rejectedWrites[directoryID], RejectedWrite{
+		TransactionID: txid,
+		PublicKey:     txn.From,
+		Path:          path,
+		Height:        height,
+		Reason:        reason,
+	})
+	if len(rejected) > maxRejectedWrites {
+		rejected = rejected[len(rejected)-maxRejectedWrites:]
+	}
+	idx.rejectedWrites[directoryID] = rejected
+	return directoryUndo{DirectoryID: directoryID, RejectedID: &txid}
+}
+
+// GetDirectoryPolicy returns a directory's current policy or nil if it has none along with
+// the ID and height of the latest indexed block.
+func (idx *DirectoryIndex) GetDirectoryPolicy(directoryID string) (*DirectoryPolicy, BlockID, int64, error) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	if _, ok := idx.directories[directoryID]; !ok {
+		return nil, idx.latestBlockID, idx.latestHeight, fmt.Errorf("Directory %s not found", directoryID)
+	}
+	return idx.dirPolicies[directoryID], idx.latestBlockID, idx.latestHeight, nil
+}
+
+// GetRejectedWrites returns the most recent writes to a directory which weren't indexed along with
+// the reason, optionally only those from the given public key. The ID and height of the latest
+// indexed block are also returned.
+func (idx *DirectoryIndex) GetRejectedWrites(directoryID string, pubKey ed25519.PublicKey, limit int) (
+	[]RejectedWrite, BlockID, int64, error) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	if _, ok := idx.directories[directoryID]; !ok {
+		return nil, idx.latestBlockID, idx.latestHeight, fmt.Errorf("Directory %s not found", directoryID)
+	}
+
+	var writes []RejectedWrite
+	rejected := idx.rejectedWrites[directoryID]
+	for i := len(rejected) - 1; i >= 0; i-- {
+		if pubKey != nil && !bytes.Equal(rejected[i].PublicKey, pubKey) {
+			continue
+		}
+		writes = append(writes, rejected[i])
+		if limit > 0 && len(writes) == limit {
+			break
+		}
+	}
+	return writes, idx.latestBlockID, idx.latestHeight, nil
+}
+
+// Handle a request for a directory's policy
+func (idx *DirectoryIndex) onGetDirectoryPolicy(directoryID string, outChan chan<- Message) error {
+	policy, blockID, height, err := idx.GetDirectoryPolicy(directoryID)
+	if err != nil {
+		outChan <- Message{
+			Type: "directory_policy",
+			Body: DirectoryPolicyMessage{DirectoryID: directoryID, Error: err.Error()},
+		}
+		return err
+	}
+
+	outChan <- Message{
+		Type: "directory_policy",
+		Body: DirectoryPolicyMessage{
+			BlockID:     blockID,
+			Height:      height,
+			DirectoryID: directoryID,
+			Policy:      policy,
+		},
+	}
+	return nil
+}
+
+// Handle a request for a directory's rejected writes
+func (idx *DirectoryIndex) onGetRejectedWrites(directoryID string, pubKey ed25519.PublicKey, limit int,
+	outChan chan<- Message) error {
+	if limit < 0 {
+		outChan <- Message{Type: "rejected_writes"}
+		return nil
+	}
+
+	// enforce our limit
+	if limit > 100 || limit == 0 {
+		limit = 100
+	}
+
+	writes, blockID, height, err := idx.GetRejectedWrites(directoryID, pubKey, limit)
+	if err != nil {
+		outChan <- Message{
+			Type: "rejected_writes",
+			Body: RejectedWritesMessage{DirectoryID: directoryID, Error: err.Error()},
+		}
+		return err
+	}
+
+	outChan <- Message{
+		Type: "rejected_writes",
+		Body: RejectedWritesMessage{
+			BlockID:     blockID,
+			Height:      height,
+			DirectoryID: directoryID,
+			Writes:      writes,
+		},
+	}
+	return nil
+}
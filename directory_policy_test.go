@@ -0,0 +1,199 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParsePolicyMemo(t *testing.T) {
+	policy, ok, err := parsePolicyMemo(PolicyMemoPrefix + "min=100 rate=5/144 depth=3 memo=alpha+digit")
+	if !ok || err != nil {
+		t.Fatalf("Expected valid policy, found %v %v", ok, err)
+	}
+	if policy.MinAmount != 100 || policy.RateLimit != 5 || policy.RateBlocks != 144 || policy.MaxDepth != 3 ||
+		len(policy.MemoClasses) != 2 {
+		t.Fatalf("Unexpected policy %v", policy)
+	}
+
+	if policy, ok, err := parsePolicyMemo(PolicyMemoPrefix); !ok || err != nil || policy.MinAmount != 0 {
+		t.Fatal("Expected empty policy to clear restrictions")
+	}
+	if _, ok, _ := parsePolicyMemo("hello"); ok {
+		t.Fatal("Expected non-policy memo")
+	}
+	for _, params := range []string{"min=-1", "rate=5", "rate=0/10", "depth=0", "memo=emoji", "size=1", "min"} {
+		if _, _, err := parsePolicyMemo(PolicyMemoPrefix + params); err == nil {
+			t.Fatalf("Expected %s to be invalid", params)
+		}
+	}
+}
+
+func TestDirectoryIndexPolicy(t *testing.T) {
+	idx := NewDirectoryIndex()
+	owner, author := makeTestKey(t), makeTestKey(t)
+
+	coinbase := &Transaction{To: makeTestPathKey(t, "//forum//"), Amount: 1, Memo: pubKeyToString(owner), Series: 1}
+	id, err := coinbase.ID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirID := id.String()
+	fund := &Transaction{From: makeTestKey(t), To: author, Amount: 10000, Memo: dirID, Series: 1}
+	indexTestTransactions(idx, 1, coinbase, fund)
+
+	// only the owner can set the policy
+	root := makeTestPathKey(t, "forum")
+	indexTestTransactions(idx, 2,
+		&Transaction{From: author, To: root, Amount: 1, Memo: PolicyMemoPrefix + "min=1", Series: 1})
+	if policy, _, _, _ := idx.GetDirectoryPolicy(dirID); policy != nil {
+		t.Fatal("Expected policy from non-owner to be ignored")
+	}
+	indexTestTransactions(idx, 3, &Transaction{From: owner, To: root, Amount: 1,
+		Memo: PolicyMemoPrefix + "min=100 rate=2/10 depth=2 memo=alpha+space", Series: 1})
+	policy, _, _, err := idx.GetDirectoryPolicy(dirID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy == nil || policy.Height != 3 || policy.RateLimit != 2 {
+		t.Fatalf("Unexpected policy %v", policy)
+	}
+
+	indexTestTransactions(idx, 4,
+		&Transaction{Time: 1, From: author, To: makeTestPathKey(t, "forum/cheap"), Amount: 99, Series: 1},
+		&Transaction{Time: 2, From: author, To: makeTestPathKey(t, "forum/a/b"), Amount: 100, Series: 1},
+		&Transaction{Time: 3, From: author, To: makeTestPathKey(t, "forum/memo"), Amount: 100, Memo: "hi!", Series: 1},
+		&Transaction{Time: 4, From: author, To: makeTestPathKey(t, "forum/one"), Amount: 100, Memo: "hi there", Series: 1},
+		&Transaction{Time: 5, From: author, To: makeTestPathKey(t, "forum/two"), Amount: 100, Series: 1},
+		&Transaction{Time: 6, From: author, To: makeTestPathKey(t, "forum/three"), Amount: 100, Series: 1},
+	)
+
+	entries, _, _, err := idx.GetTopRanked(dirID, "", true, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 accepted entries, found %d", len(entries))
+	}
+
+	writes, _, _, err := idx.GetRejectedWrites(dirID, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := []string{"rate limit", "memo character", "path depth", "below the minimum"}
+	if len(writes) != len(reasons) {
+		t.Fatalf("Expected %d rejected writes, found %v", len(reasons), writes)
+	}
+	for i, reason := range reasons {
+		if !strings.Contains(writes[i].Reason, reason) || !bytes.Equal(writes[i].PublicKey, author) {
+			t.Fatalf("Expected rejection for %s, found %v", reason, writes[i])
+		}
+	}
+
+	// the rate limit window moves on
+	indexTestTransactions(idx, 14,
+		&Transaction{Time: 7, From: author, To: makeTestPathKey(t, "forum/three"), Amount: 100, Series: 1})
+	if writes, _, _, _ := idx.GetRejectedWrites(dirID, nil, 0); len(writes) != len(reasons) {
+		t.Fatal("Expected write after the rate limit window to be accepted")
+	}
+
+	// writes without sufficient balance are also recorded
+	poor := makeTestKey(t)
+	indexTestTransactions(idx, 15,
+		&Transaction{Time: 8, From: poor, To: makeTestPathKey(t, "forum/poor"), Amount: 100, Series: 1})
+	writes, _, _, err = idx.GetRejectedWrites(dirID, poor, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(writes) != 1 || writes[0].Reason != "insufficient directory balance" {
+		t.Fatalf("Unexpected rejected writes %v", writes)
+	}
+
+	if _, _, _, err := idx.GetRejectedWrites("nope", nil, 0); err == nil {
+		t.Fatal("Expected error for unknown directory")
+	}
+}
+
+func TestDirectoryIndexPolicyDisconnect(t *testing.T) {
+	idx := NewDirectoryIndex()
+	owner, author := makeTestKey(t), makeTestKey(t)
+
+	coinbase := &Transaction{To: makeTestPathKey(t, "//forum//"), Amount: 1, Memo: pubKeyToString(owner), Series: 1}
+	id, err := coinbase.ID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirID := id.String()
+	fund := &Transaction{From: makeTestKey(t), To: author, Amount: 10000, Memo: dirID, Series: 1}
+	indexTestTransactions(idx, 1, coinbase, fund)
+
+	// policy memos from other keys are ordinary writes
+	indexTestTransactions(idx, 2, &Transaction{Time: 1, From: author, To: makeTestPathKey(t, "forum/policy"),
+		Amount: 100, Memo: PolicyMemoPrefix + "min=1", Series: 1})
+	if st, ok := idx.keyState[pad44("forum/policy")]; !ok || st.author != pubKeyToString(author) {
+		t.Fatal("Expected policy memo from non-owner to be indexed")
+	}
+
+	// invalid policies from the owner are rejected
+	root := makeTestPathKey(t, "forum")
+	indexTestTransactions(idx, 3, &Transaction{From: owner, To: root, Amount: 1,
+		Memo: PolicyMemoPrefix + "min=-1", Series: 1})
+	writes, _, _, err := idx.GetRejectedWrites(dirID, owner, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(writes) != 1 || !strings.HasPrefix(writes[0].Reason, "invalid policy") {
+		t.Fatalf("Unexpected rejected writes %v", writes)
+	}
+	if _, ok := idx.keyState[pad44("forum")]; ok {
+		t.Fatal("Expected invalid policy not to be indexed")
+	}
+
+	first := []*Transaction{{From: owner, To: root, Amount: 1, Memo: PolicyMemoPrefix + "rate=1/10", Series: 1}}
+	write := []*Transaction{{Time: 2, From: author, To: makeTestPathKey(t, "forum/one"), Amount: 100, Series: 1}}
+	second := []*Transaction{{From: owner, To: root, Amount: 1, Memo: PolicyMemoPrefix + "min=100", Series: 1}}
+	indexTestTransactions(idx, 4, first...)
+	indexTestTransactions(idx, 5, write...)
+	indexTestTransactions(idx, 6, second...)
+
+	// writes rejected by a disconnected block are forgotten and never indexed
+	cheap := []*Transaction{{Time: 3, From: author, To: makeTestPathKey(t, "forum/cheap"), Amount: 99, Series: 1}}
+	indexTestTransactions(idx, 7, cheap...)
+	if writes, _, _, _ := idx.GetRejectedWrites(dirID, author, 0); len(writes) != 1 {
+		t.Fatalf("Expected a rejected write, found %v", writes)
+	}
+	disconnectTestTransactions(idx, 7, cheap...)
+	if writes, _, _, _ := idx.GetRejectedWrites(dirID, author, 0); len(writes) != 0 {
+		t.Fatalf("Expected disconnected rejected write to be removed, found %v", writes)
+	}
+	if _, ok := idx.keyState[pad44("forum/cheap")]; ok {
+		t.Fatal("Expected rejected write not to be indexed on disconnect")
+	}
+	if _, ok := idx.dirGraphs[dirID].index[pad44("forum/cheap")]; ok {
+		t.Fatal("Expected rejected write not to be linked on disconnect")
+	}
+	if writes, _, _, _ := idx.GetRejectedWrites(dirID, owner, 0); len(writes) != 1 {
+		t.Fatal("Expected earlier rejected writes to be kept")
+	}
+
+	disconnectTestTransactions(idx, 6, second...)
+	if policy := idx.dirPolicies[dirID]; policy == nil || policy.RateLimit != 1 || policy.Height != 4 {
+		t.Fatalf("Expected previous policy to be restored, found %v", policy)
+	}
+	if len(idx.writeHeights[dirID][pubKeyToString(author)]) != 1 {
+		t.Fatal("Expected write to be counted against the rate limit")
+	}
+
+	disconnectTestTransactions(idx, 5, write...)
+	if _, ok := idx.writeHeights[dirID][pubKeyToString(author)]; ok {
+		t.Fatal("Expected disconnected write not to count against the rate limit")
+	}
+
+	disconnectTestTransactions(idx, 4, first...)
+	if _, ok := idx.dirPolicies[dirID]; ok {
+		t.Fatal("Expected disconnected policy to be removed")
+	}
+}
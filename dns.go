@@ -17,6 +17,7 @@ import (
 
 // DNSSeeder returns known peers in response to DNS queries.
 type DNSSeeder struct {
+	params    *ChainParams
 	peerStore PeerStorage
 	server    *dns.Server
 	port      int
@@ -24,8 +25,9 @@ type DNSSeeder struct {
 }
 
 // NewDNSSeeder creates a new DNS seeder given a PeerStorage interface.
-func NewDNSSeeder(peerStore PeerStorage, port int) *DNSSeeder {
+func NewDNSSeeder(params *ChainParams, peerStore PeerStorage, port int) *DNSSeeder {
 	return &DNSSeeder{
+		params:    params,
 		peerStore: peerStore,
 		port:      port,
 		server:    &dns.Server{Addr: "0.0.0.0:" + strconv.Itoa(port), Net: "udp"},
@@ -61,7 +63,7 @@ func (d *DNSSeeder) handleQuery(m *dns.Msg, externalIP string) {
 					return
 				}
 				ip, port, _ := net.SplitHostPort(addr)
-				if port != strconv.Itoa(DefaultCruzbitPort) {
+				if port != strconv.Itoa(d.params.DefaultPort) {
 					continue
 				}
 				rr, err := dns.NewRR(fmt.Sprintf("%s A %s", q.Name, ip))
@@ -123,10 +125,10 @@ var Seeders = [...]string{
 	"20.16.255.39:8831", //veripax
 }
 
-// Query DNS seeders
-func dnsQueryForPeers() ([]string, error) {
+// Query the network's DNS seeders
+func dnsQueryForPeers(params *ChainParams) ([]string, error) {
 	var peers []string
-	for _, seeder := range Seeders {
+	for _, seeder := range params.DNSSeeds {
 		c := dns.Client{}
 		m := dns.Msg{}
 		m.SetQuestion("client.cruzbit.", dns.TypeA)
@@ -140,7 +142,7 @@ func dnsQueryForPeers() ([]string, error) {
 		for _, answer := range r.Answer {
 			a := answer.(*dns.A)
 			log.Printf("Seeder returned: %s\n", a.A.String())
-			peers = append(peers, a.A.String()+":"+strconv.Itoa(DefaultCruzbitPort))
+			peers = append(peers, a.A.String()+":"+strconv.Itoa(params.DefaultPort))
 		}
 	}
 	return peers, nil
@@ -28,3 +28,53 @@ const GenesisBlockJson = `
     }
   ]
 }`
+
+// TestNetGenesisBlockJson is the first block in the test network's chain.
+const TestNetGenesisBlockJson = `
+{
+  "header": {
+    "previous": "0000000000000000000000000000000000000000000000000000000000000000",
+    "hash_list_root": "1f75fde1d70b59514b66dfd487856364814ca980d914938d24ba24777f72d858",
+    "time": 1792328230,
+    "target": "000000ffff000000000000000000000000000000000000000000000000000000",
+    "chain_work": "0000000000000000000000000000000000000000000000000000000001000100",
+    "nonce": 10644854,
+    "height": 0,
+    "transaction_count": 1
+  },
+  "transactions": [
+    {
+      "time": 1792328230,
+      "nonce": 864330145,
+      "to": "ntkSbbG+b0vo49IGd9nnH39eHIxIEqXmIL8aaJZV+jQ=",
+      "amount": 5000000000,
+      "memo": "cruzbit-tree testnet",
+      "series": 1
+    }
+  ]
+}`
+
+// RegTestGenesisBlockJson is the first block in the regression test network's chain.
+const RegTestGenesisBlockJson = `
+{
+  "header": {
+    "previous": "0000000000000000000000000000000000000000000000000000000000000000",
+    "hash_list_root": "4d467b5ff404e74daf40b3e61de8142ec4da40968dda980b6e7c19944728f040",
+    "time": 1792328294,
+    "target": "0000ffff00000000000000000000000000000000000000000000000000000000",
+    "chain_work": "0000000000000000000000000000000000000000000000000000000000010001",
+    "nonce": 8608,
+    "height": 0,
+    "transaction_count": 1
+  },
+  "transactions": [
+    {
+      "time": 1792328294,
+      "nonce": 1041767982,
+      "to": "ntkSbbG+b0vo49IGd9nnH39eHIxIEqXmIL8aaJZV+jQ=",
+      "amount": 5000000000,
+      "memo": "cruzbit-tree regtest",
+      "series": 1
+    }
+  ]
+}`
@@ -0,0 +1,432 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+)
+
+// HeaderChain is the chain of validated block headers extending our main chain's tip. During initial
+// block download headers are synced first so the block bodies can be downloaded from multiple
+// peers in parallel. Bodies which arrive before their parent has been connected are held here
+// until they can be processed in order.
+type HeaderChain struct {
+	params      *ChainParams
+	blockStore  BlockStorage
+	ledger      Ledger
+	assumeValid BlockID
+	baseID      BlockID // the main chain block the header chain extends
+	baseHeight  int64
+	ids         []BlockID
+	headers     []*BlockHeader
+	heights     map[BlockID]int64
+	bodies      map[BlockID]pendingBody
+	fork        *HeaderChain // a competing branch with less work
+	lock        sync.Mutex
+}
+
+// a downloaded block waiting for its parent to be connected
+type pendingBody struct {
+	block  *Block
+	source string
+}
+
+// the number of blocks beyond the main chain tip to download bodies for
+const headerChainWindow = 1024
+
+// NewHeaderChain returns a new, empty HeaderChain. Transaction signatures in the assume-valid block
+// and its ancestors in the header chain aren't verified. A zero assume-valid ID disables this.
+func NewHeaderChain(params *ChainParams, assumeValid BlockID, blockStore BlockStorage, ledger Ledger) *HeaderChain {
+	return &HeaderChain{
+		params:      params,
+		blockStore:  blockStore,
+		ledger:      ledger,
+		assumeValid: assumeValid,
+		heights:     make(map[BlockID]int64),
+		bodies:      make(map[BlockID]pendingBody),
+	}
+}
+
+// Tip returns the ID and height of the last header in the chain.
+func (h *HeaderChain) Tip() (BlockID, int64, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := h.sync(); err != nil {
+		return BlockID{}, 0, err
+	}
+	return h.tip()
+}
+
+// AddHeaders validates the headers and appends them to the chain. Headers already in the chain are
+// skipped. Headers forking from the chain are kept as a competing branch and the chain switches to
+// the branch once it has more work. Returns the number of headers added and false if the headers
+// don't extend the chain or the competing branch, in which case the peer is likely on a fork of the
+// main chain. An error is returned if a header is invalid.
+func (h *HeaderChain) AddHeaders(headers []*BlockHeader, now int64) (int, bool, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := h.sync(); err != nil {
+		return 0, false, err
+	}
+
+	var added int
+	c := h
+	for _, header := range headers {
+		if header == nil {
+			return added, false, fmt.Errorf("Received nil block header")
+		}
+		id, err := header.ID()
+		if err != nil {
+			return added, false, err
+		}
+
+		if c == h && h.fork != nil {
+			if _, ok := h.fork.heights[id]; ok {
+				// already on the competing branch
+				c = h.fork
+				continue
+			}
+			if forkTipID, _, _ := h.fork.tip(); header.Previous == forkTipID {
+				c = h.fork
+			}
+		}
+
+		tipID, tipHeight, err := c.tip()
+		if err != nil {
+			return added, false, err
+		}
+		if header.Height <= tipHeight {
+			// do we have it already?
+			knownID, err := c.idForHeight(header.Height)
+			if err != nil {
+				return added, false, err
+			}
+			if knownID != nil && *knownID == id {
+				continue
+			}
+			if c != h || (header.Previous != h.baseID && !h.contains(header.Previous)) {
+				return added, false, nil
+			}
+			// the header forks from the chain
+			c = h.branch(header.Previous)
+			tipID = header.Previous
+		} else if header.Previous != tipID {
+			return added, false, nil
+		}
+
+		prevHeader, err := c.header(tipID)
+		if err != nil {
+			return added, false, err
+		}
+		if err := c.checkHeader(id, header, prevHeader, now); err != nil {
+			return added, true, err
+		}
+
+		c.ids = append(c.ids, id)
+		c.headers = append(c.headers, header)
+		c.heights[id] = header.Height
+		added++
+	}
+
+	if c != h {
+		if c.tipWork().Cmp(h.tipWork()) > 0 {
+			// switch to the branch with more work
+			h.ids, h.headers, h.heights, c.ids, c.headers, c.heights =
+				c.ids, c.headers, c.heights, h.ids, h.headers, h.heights
+			for id := range h.bodies {
+				if _, ok := h.heights[id]; !ok {
+					delete(h.bodies, id)
+				}
+			}
+		}
+		h.fork = c
+	}
+	return added, true, nil
+}
+
+// returns a branch of the chain ending with the given block. Must be called with the lock held
+func (h *HeaderChain) branch(id BlockID) *HeaderChain {
+	n := 0
+	if height, ok := h.heights[id]; ok {
+		n = int(height - h.baseHeight)
+	}
+	branch := &HeaderChain{
+		params:     h.params,
+		blockStore: h.blockStore,
+		ledger:     h.ledger,
+		baseID:     h.baseID,
+		baseHeight: h.baseHeight,
+		ids:        append([]BlockID(nil), h.ids[:n]...),
+		headers:    append([]*BlockHeader(nil), h.headers[:n]...),
+		heights:    make(map[BlockID]int64),
+	}
+	for _, id := range branch.ids {
+		branch.heights[id] = h.heights[id]
+	}
+	return branch
+}
+
+// must be called with the lock held
+func (h *HeaderChain) contains(id BlockID) bool {
+	_, ok := h.heights[id]
+	return ok
+}
+
+// must be called with the lock held
+func (h *HeaderChain) tipWork() *big.Int {
+	if len(h.headers) == 0 {
+		return new(big.Int)
+	}
+	return h.headers[len(h.headers)-1].ChainWork.GetBigInt()
+}
+
+// Contains returns true if the block is in the chain and hasn't been connected yet.
+func (h *HeaderChain) Contains(id BlockID) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	_, ok := h.heights[id]
+	return ok
+}
+
+// IsAssumedValid returns true if the block is the assume-valid block or one of its ancestors in the
+// header chain. Blocks are only assumed valid once the assume-valid block's header has been synced.
+func (h *HeaderChain) IsAssumedValid(id BlockID) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.assumeValid == (BlockID{}) {
+		return false
+	}
+	assumeValidHeight, ok := h.heights[h.assumeValid]
+	if !ok {
+		return false
+	}
+	height, ok := h.heights[id]
+	return ok && height <= assumeValidHeight
+}
+
+// HasBody returns true if the block's body has been downloaded and is waiting to be connected.
+func (h *HeaderChain) HasBody(id BlockID) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	_, ok := h.bodies[id]
+	return ok
+}
+
+// Downloads returns the IDs of the blocks from minHeight up to maxHeight and within headerChainWindow
+// of the main chain tip whose bodies haven't been downloaded yet, in height order. tipID is the last
+// header the peer sent. If it's on the competing branch only blocks before the fork are returned.
+func (h *HeaderChain) Downloads(minHeight, maxHeight int64, tipID BlockID) ([]BlockID, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := h.sync(); err != nil {
+		return nil, err
+	}
+
+	if h.fork != nil && h.fork.contains(tipID) {
+		n := 0
+		for n < len(h.ids) && n < len(h.fork.ids) && h.ids[n] == h.fork.ids[n] {
+			n++
+		}
+		if forkHeight := h.baseHeight + int64(n); forkHeight < maxHeight {
+			maxHeight = forkHeight
+		}
+	}
+
+	var ids []BlockID
+	n := int(maxHeight - h.baseHeight)
+	for i := 0; i < len(h.ids) && i < headerChainWindow && i < n; i++ {
+		if h.baseHeight+1+int64(i) < minHeight {
+			continue
+		}
+		if _, ok := h.bodies[h.ids[i]]; !ok {
+			ids = append(ids, h.ids[i])
+		}
+	}
+	return ids, nil
+}
+
+// AddBody holds a downloaded block until its parent is connected. Returns false if the block isn't
+// in the chain.
+func (h *HeaderChain) AddBody(id BlockID, block *Block, source string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.heights[id]; !ok {
+		return false
+	}
+	h.bodies[id] = pendingBody{block: block, source: source}
+	return true
+}
+
+// NextBody removes and returns the body of the block following the main chain tip if it's been
+// downloaded along with the address of the peer it came from.
+func (h *HeaderChain) NextBody() (BlockID, *Block, string, bool, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := h.sync(); err != nil {
+		return BlockID{}, nil, "", false, err
+	}
+	if len(h.ids) == 0 {
+		return BlockID{}, nil, "", false, nil
+	}
+	id := h.ids[0]
+	body, ok := h.bodies[id]
+	if !ok {
+		return BlockID{}, nil, "", false, nil
+	}
+	delete(h.bodies, id)
+	return id, body.block, body.source, true, nil
+}
+
+// Truncate removes the block and its descendants from the chain. It's called when a block fails
+// to be processed.
+func (h *HeaderChain) Truncate(id BlockID) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	height, ok := h.heights[id]
+	if !ok {
+		return
+	}
+	i := int(height - h.baseHeight - 1)
+	for _, removed := range h.ids[i:] {
+		delete(h.heights, removed)
+		delete(h.bodies, removed)
+	}
+	h.ids, h.headers = h.ids[:i], h.headers[:i]
+}
+
+// Trims headers which have been connected to the main chain. If the main chain has moved
+// elsewhere the header chain is reset to extend its new tip. Must be called with the lock held
+func (h *HeaderChain) sync() error {
+	tipID, tipHeight, err := h.ledger.GetChainTip()
+	if err != nil {
+		return err
+	}
+	if tipID == nil {
+		return fmt.Errorf("No main chain tip")
+	}
+	if *tipID == h.baseID && tipHeight == h.baseHeight {
+		return nil
+	}
+
+	if height, ok := h.heights[*tipID]; ok && height == tipHeight {
+		// connected up to the tip
+		n := int(tipHeight - h.baseHeight)
+		for _, id := range h.ids[:n] {
+			delete(h.heights, id)
+			delete(h.bodies, id)
+		}
+		h.ids, h.headers = h.ids[n:], h.headers[n:]
+	} else {
+		// start over from the new tip
+		h.ids, h.headers = nil, nil
+		h.heights = make(map[BlockID]int64)
+		h.bodies = make(map[BlockID]pendingBody)
+	}
+	h.baseID, h.baseHeight = *tipID, tipHeight
+	h.fork = nil
+	return nil
+}
+
+// must be called with the lock held
+func (h *HeaderChain) tip() (BlockID, int64, error) {
+	if len(h.ids) == 0 {
+		return h.baseID, h.baseHeight, nil
+	}
+	return h.ids[len(h.ids)-1], h.baseHeight + int64(len(h.ids)), nil
+}
+
+// must be called with the lock held
+func (h *HeaderChain) header(id BlockID) (*BlockHeader, error) {
+	header, _, err := headerChainStore{BlockStorage: h.blockStore, h: h}.GetBlockHeader(id)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return nil, fmt.Errorf("No header for block %s", id)
+	}
+	return header, nil
+}
+
+// must be called with the lock held
+func (h *HeaderChain) idForHeight(height int64) (*BlockID, error) {
+	return headerChainLedger{Ledger: h.ledger, h: h}.GetBlockIDForHeight(height)
+}
+
+// Performs the checks checkBlock and acceptBlock make which only depend on the header.
+// Must be called with the lock held
+func (h *HeaderChain) checkHeader(id BlockID, header, prevHeader *BlockHeader, now int64) error {
+	if header.Time < 0 || header.Time > MaxNumber {
+		return fmt.Errorf("Time value is invalid, block %s", id)
+	}
+	if header.Time > now+MaxFutureSeconds {
+		return fmt.Errorf("Timestamp %d too far in the future, now %d, block %s", header.Time, now, id)
+	}
+	if !(Block{Header: header}).CheckPOW(id) {
+		return fmt.Errorf("Insufficient proof-of-work for block %s", id)
+	}
+	if header.Nonce < 0 || header.Nonce > MaxNumber {
+		return fmt.Errorf("Nonce value is invalid, block %s", id)
+	}
+	if header.Height != prevHeader.Height+1 {
+		return fmt.Errorf("Expected height %d found %d for block %s", prevHeader.Height+1, header.Height, id)
+	}
+	if err := h.params.CheckpointCheck(id, header.Height); err != nil {
+		return err
+	}
+	if header.TransactionCount < 1 ||
+		int(header.TransactionCount) > computeMaxTransactionsPerBlock(header.Height) {
+		return fmt.Errorf("Invalid transaction count %d in header of block %s", header.TransactionCount, id)
+	}
+
+	store, ledger := headerChainStore{BlockStorage: h.blockStore, h: h}, headerChainLedger{Ledger: h.ledger, h: h}
+	target, err := computeTarget(h.params, prevHeader, store, ledger)
+	if err != nil {
+		return err
+	}
+	if header.Target != target {
+		return fmt.Errorf("Incorrect target %s, expected %s for block %s", header.Target, target, id)
+	}
+	chainWork := computeChainWork(header.Target, prevHeader.ChainWork)
+	if header.ChainWork != chainWork {
+		return fmt.Errorf("Incorrect chain work %s, expected %s for block %s", header.ChainWork, chainWork, id)
+	}
+	medianTimestamp, err := computeMedianTimestamp(prevHeader, store)
+	if err != nil {
+		return err
+	}
+	if header.Time <= medianTimestamp {
+		return fmt.Errorf("Timestamp is too early for block %s", id)
+	}
+	return nil
+}
+
+// headerChainStore presents the header chain's headers as if they were stored. Used to validate
+// headers before their blocks have been downloaded
+type headerChainStore struct {
+	BlockStorage
+	h *HeaderChain
+}
+
+func (s headerChainStore) GetBlockHeader(id BlockID) (*BlockHeader, int64, error) {
+	if height, ok := s.h.heights[id]; ok {
+		return s.h.headers[height-s.h.baseHeight-1], 0, nil
+	}
+	return s.BlockStorage.GetBlockHeader(id)
+}
+
+// headerChainLedger presents the header chain as if it were connected to the main chain
+type headerChainLedger struct {
+	Ledger
+	h *HeaderChain
+}
+
+func (l headerChainLedger) GetBlockIDForHeight(height int64) (*BlockID, error) {
+	if i := height - l.h.baseHeight - 1; height > l.h.baseHeight && i < int64(len(l.h.ids)) {
+		id := l.h.ids[i]
+		return &id, nil
+	}
+	return l.Ledger.GetBlockIDForHeight(height)
+}
@@ -0,0 +1,254 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// a main chain consisting of only the headers the header chain needs
+type testHeaderStore struct {
+	BlockStorage
+	headers map[BlockID]*BlockHeader
+}
+
+func (s *testHeaderStore) GetBlockHeader(id BlockID) (*BlockHeader, int64, error) {
+	return s.headers[id], 0, nil
+}
+
+type testHeaderLedger struct {
+	Ledger
+	ids []BlockID
+}
+
+func (l *testHeaderLedger) GetChainTip() (*BlockID, int64, error) {
+	id := l.ids[len(l.ids)-1]
+	return &id, int64(len(l.ids) - 1), nil
+}
+
+func (l *testHeaderLedger) GetBlockIDForHeight(height int64) (*BlockID, error) {
+	if height < 0 || height >= int64(len(l.ids)) {
+		return nil, nil
+	}
+	id := l.ids[height]
+	return &id, nil
+}
+
+// mine a header on top of the previous one
+func mineTestHeader(t *testing.T, prev *BlockHeader, prevID BlockID) (*BlockHeader, BlockID) {
+	header := &BlockHeader{
+		Previous:         prevID,
+		Time:             prev.Time + TargetSpacing,
+		Target:           prev.Target,
+		ChainWork:        computeChainWork(prev.Target, prev.ChainWork),
+		Height:           prev.Height + 1,
+		TransactionCount: 1,
+	}
+	for {
+		id, err := header.ID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (Block{Header: header}).CheckPOW(id) {
+			return header, id
+		}
+		header.Nonce++
+	}
+}
+
+func TestHeaderChain(t *testing.T) {
+	params := *RegTestParams
+	params.InitialTarget = "00ffff0000000000000000000000000000000000000000000000000000000000"
+	targetBytes, err := hex.DecodeString(params.InitialTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	genesis := &BlockHeader{Time: 1000000, TransactionCount: 1}
+	copy(genesis.Target[:], targetBytes)
+	genesis.ChainWork = computeChainWork(genesis.Target, BlockID{})
+	genesisID, err := genesis.ID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &testHeaderStore{headers: map[BlockID]*BlockHeader{genesisID: genesis}}
+	ledger := &testHeaderLedger{ids: []BlockID{genesisID}}
+
+	headers := []*BlockHeader{genesis}
+	ids := []BlockID{genesisID}
+	for i := 0; i < 5; i++ {
+		header, id := mineTestHeader(t, headers[i], ids[i])
+		headers, ids = append(headers, header), append(ids, id)
+	}
+
+	chain := NewHeaderChain(&params, ids[3], store, ledger)
+	if chain.IsAssumedValid(ids[3]) {
+		t.Fatal("Expected no blocks assumed valid before the assume-valid header is synced")
+	}
+
+	added, connected, err := chain.AddHeaders(headers[1:], genesis.Time)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 5 || !connected {
+		t.Fatalf("Expected 5 headers added, found %d %v", added, connected)
+	}
+	if !chain.IsAssumedValid(ids[1]) || !chain.IsAssumedValid(ids[3]) || chain.IsAssumedValid(ids[4]) {
+		t.Fatal("Expected only the assume-valid block and its ancestors to be assumed valid")
+	}
+
+	// overlapping headers from another peer are skipped
+	added, connected, err = chain.AddHeaders(headers[2:4], genesis.Time)
+	if err != nil || added != 0 || !connected {
+		t.Fatalf("Expected known headers to be skipped, found %d %v %v", added, connected, err)
+	}
+
+	// a fork of the main chain doesn't extend the chain
+	fork := &BlockHeader{Previous: BlockID{0xff}, Height: 3, TransactionCount: 1}
+	if _, connected, _ := chain.AddHeaders([]*BlockHeader{fork}, genesis.Time); connected {
+		t.Fatal("Expected fork not to connect")
+	}
+
+	// invalid chain work is rejected
+	bad, _ := mineTestHeader(t, headers[5], ids[5])
+	bad.ChainWork = headers[5].ChainWork
+	if _, _, err := chain.AddHeaders([]*BlockHeader{bad}, genesis.Time); err == nil {
+		t.Fatal("Expected invalid header to be rejected")
+	}
+
+	// bodies are only downloaded up to the peer's height and are connected in order
+	downloads, err := chain.Downloads(0, 3, BlockID{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(downloads) != 3 || downloads[0] != ids[1] || downloads[2] != ids[3] {
+		t.Fatalf("Unexpected downloads %v", downloads)
+	}
+
+	// a peer which has pruned the first block can only send the others
+	if downloads, _ = chain.Downloads(2, 3, BlockID{}); len(downloads) != 2 || downloads[0] != ids[2] {
+		t.Fatalf("Unexpected downloads from a pruned peer %v", downloads)
+	}
+	chain.AddBody(ids[2], &Block{Header: headers[2]}, "peer")
+	if _, _, _, ok, _ := chain.NextBody(); ok {
+		t.Fatal("Expected no body ready to connect")
+	}
+	chain.AddBody(ids[1], &Block{Header: headers[1]}, "peer")
+	if id, _, source, ok, _ := chain.NextBody(); !ok || id != ids[1] || source != "peer" {
+		t.Fatalf("Expected block %s ready to connect, found %s", ids[1], id)
+	}
+
+	// connecting blocks trims the chain
+	store.headers[ids[1]] = headers[1]
+	ledger.ids = append(ledger.ids, ids[1])
+	if downloads, _ = chain.Downloads(0, 5, BlockID{}); len(downloads) != 3 || chain.Contains(ids[1]) {
+		t.Fatalf("Expected connected block to be trimmed, found %v", downloads)
+	}
+	if id, height, _ := chain.Tip(); id != ids[5] || height != 5 {
+		t.Fatalf("Expected tip %s at 5, found %s at %d", ids[5], id, height)
+	}
+
+	// an invalid block removes it and its descendants
+	chain.Truncate(ids[3])
+	if id, height, _ := chain.Tip(); id != ids[2] || height != 2 {
+		t.Fatalf("Expected tip %s at 2, found %s at %d", ids[2], id, height)
+	}
+	if !chain.HasBody(ids[2]) {
+		t.Fatal("Expected body to be kept")
+	}
+}
+
+func TestHeaderChainFork(t *testing.T) {
+	params := *RegTestParams
+	params.InitialTarget = "00ffff0000000000000000000000000000000000000000000000000000000000"
+	targetBytes, err := hex.DecodeString(params.InitialTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	genesis := &BlockHeader{Time: 1000000, TransactionCount: 1}
+	copy(genesis.Target[:], targetBytes)
+	genesis.ChainWork = computeChainWork(genesis.Target, BlockID{})
+	genesisID, err := genesis.ID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &testHeaderStore{headers: map[BlockID]*BlockHeader{genesisID: genesis}}
+	ledger := &testHeaderLedger{ids: []BlockID{genesisID}}
+	chain := NewHeaderChain(&params, BlockID{}, store, ledger)
+
+	// two peers fork after the first block
+	mine := func(headers []*BlockHeader, ids []BlockID, n int, spacing int64) ([]*BlockHeader, []BlockID) {
+		headers, ids = append([]*BlockHeader(nil), headers...), append([]BlockID(nil), ids...)
+		for i := 0; i < n; i++ {
+			prev := *headers[len(headers)-1]
+			prev.Time += spacing - TargetSpacing
+			header, id := mineTestHeader(t, &prev, ids[len(ids)-1])
+			headers, ids = append(headers, header), append(ids, id)
+		}
+		return headers, ids
+	}
+	first, firstIDs := mine([]*BlockHeader{genesis}, []BlockID{genesisID}, 4, TargetSpacing)
+	second, secondIDs := mine(first[:2], firstIDs[:2], 2, TargetSpacing+1)
+
+	tip := func() BlockID {
+		id, _, err := chain.Tip()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	// the first peer delivers 3 headers
+	if added, connected, err := chain.AddHeaders(first[1:4], genesis.Time); err != nil || added != 3 || !connected {
+		t.Fatalf("Expected 3 headers added, found %d %v %v", added, connected, err)
+	}
+
+	// the second peer's branch has equal work so it's kept aside
+	added, connected, err := chain.AddHeaders(second[1:4], genesis.Time)
+	if err != nil || added != 2 || !connected {
+		t.Fatalf("Expected 2 headers added to the fork, found %d %v %v", added, connected, err)
+	}
+	if tip() != firstIDs[3] {
+		t.Fatal("Expected the first branch to remain the chain")
+	}
+	chain.AddBody(firstIDs[1], &Block{Header: first[1]}, "first")
+	chain.AddBody(firstIDs[2], &Block{Header: first[2]}, "first")
+
+	// the second peer's blocks are only downloaded up to the fork
+	downloads, err := chain.Downloads(0, 3, secondIDs[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(downloads) != 0 {
+		t.Fatalf("Expected no downloads from the second peer, found %v", downloads)
+	}
+
+	// the second peer extends its branch and overtakes the first
+	second, secondIDs = mine(second, secondIDs, 2, TargetSpacing+1)
+	if added, connected, err := chain.AddHeaders(second[4:], genesis.Time); err != nil || added != 2 || !connected {
+		t.Fatalf("Expected 2 headers added, found %d %v %v", added, connected, err)
+	}
+	if tip() != secondIDs[5] {
+		t.Fatal("Expected to switch to the branch with more work")
+	}
+	if !chain.HasBody(firstIDs[1]) || chain.HasBody(firstIDs[2]) {
+		t.Fatal("Expected only bodies on the branch with more work to be kept")
+	}
+	if downloads, _ = chain.Downloads(0, 5, secondIDs[5]); len(downloads) != 4 || downloads[0] != secondIDs[2] {
+		t.Fatalf("Unexpected downloads %v", downloads)
+	}
+
+	// the first peer can take it back
+	if added, _, err := chain.AddHeaders(first[4:], genesis.Time); err != nil || added != 1 || tip() != secondIDs[5] {
+		t.Fatalf("Expected the first branch to be extended aside, found %d %v", added, err)
+	}
+	first, firstIDs = mine(first, firstIDs, 2, TargetSpacing)
+	if _, _, err := chain.AddHeaders(first[3:], genesis.Time); err != nil || tip() != firstIDs[6] {
+		t.Fatalf("Expected to switch back to the first branch %v", err)
+	}
+}
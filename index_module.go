@@ -0,0 +1,85 @@
+package cruzbit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// IndexModule is an interface to an index built from the main chain. Modules are driven by the
+// Indexer which connects and disconnects blocks as the tip changes and routes protocol queries.
+type IndexModule interface {
+	// Name returns the module's unique name. It's used to enable the module.
+	Name() string
+
+	// ConnectBlock indexes a block newly connected to the main chain.
+	ConnectBlock(id BlockID, block *Block) error
+
+	// DisconnectBlock reverses the indexing of a block disconnected from the main chain.
+	DisconnectBlock(id BlockID, block *Block) error
+
+	// Persist is called once the module has caught up with the tip after one or more blocks
+	// have been connected or disconnected. Modules can flush state or compute derived data here.
+	Persist() error
+
+	// QueryTypes returns the protocol message types handled by the module.
+	QueryTypes() []string
+
+	// HandleQuery handles a protocol message of one of the types returned by QueryTypes
+	// and sends any response on outChan.
+	HandleQuery(messageType string, body json.RawMessage, outChan chan<- Message) error
+}
+
+// PersistentIndexModule is an index module which can save its state and restore it so the indexer
+// can resume without replaying the chain from the genesis block. It's required to index a chain
+// whose older block bodies have been pruned.
+type PersistentIndexModule interface {
+	IndexModule
+
+	// SaveState writes the module's current state to w.
+	SaveState(w io.Writer) error
+
+	// LoadState replaces the module's state with one written by SaveState.
+	LoadState(r io.Reader) error
+}
+
+// IndexModuleConstructor creates a new instance of an index module.
+type IndexModuleConstructor func(blockStore BlockStorage, ledger Ledger) (IndexModule, error)
+
+var indexModuleConstructors = map[string]IndexModuleConstructor{
+	"directory": func(BlockStorage, Ledger) (IndexModule, error) {
+		return NewDirectoryIndex(), nil
+	},
+	"names": func(BlockStorage, Ledger) (IndexModule, error) {
+		return NewNameIndex(), nil
+	},
+}
+
+// RegisterIndexModule makes an index module available by name. It isn't safe to call
+// concurrently and is intended to be called from an init function.
+func RegisterIndexModule(name string, constructor IndexModuleConstructor) {
+	if _, ok := indexModuleConstructors[name]; ok {
+		panic("Index module " + name + " already registered")
+	}
+	indexModuleConstructors[name] = constructor
+}
+
+// NewIndexModule creates a new instance of the named index module.
+func NewIndexModule(name string, blockStore BlockStorage, ledger Ledger) (IndexModule, error) {
+	constructor, ok := indexModuleConstructors[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown index module: %s", name)
+	}
+	return constructor(blockStore, ledger)
+}
+
+// IndexModuleNames returns the sorted names of all available index modules.
+func IndexModuleNames() []string {
+	var names []string
+	for name := range indexModuleConstructors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
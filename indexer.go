@@ -1,56 +1,96 @@
 package cruzbit
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
 	"log"
-	"regexp"
-	"strconv"
-	"strings"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 )
 
-type KeyState struct {
-	label    string
-	memo     string
-	revision uint
-	time     int64
-}
-
+// Indexer drives a set of index modules from the main chain and routes protocol queries to them.
 type Indexer struct {
+	params        *ChainParams
 	blockStore    BlockStorage
 	ledger        Ledger
 	processor     *Processor
 	latestBlockID BlockID
 	latestHeight  int64
-	keyState      map[string]*KeyState
-	directories   map[string]string
-	dirBalances   map[string]map[string]int64
-	dirGraphs     map[string]*Graph
+	modules       []IndexModule
+	queryModules  map[string]IndexModule
+	stateDir      string
+	savedHeight   int64
+	savedLock     sync.Mutex
 	shutdownChan  chan struct{}
 	wg            sync.WaitGroup
 }
 
+// the first line of a module's state file
+type indexStateHeader struct {
+	BlockID BlockID `json:"block_id"`
+	Height  int64   `json:"height"`
+}
+
+// NewIndexer returns a new Indexer with no modules. If stateDir isn't empty the modules' state is
+// saved there each time they're persisted and indexing resumes from the saved state at startup.
 func NewIndexer(
+	params *ChainParams,
 	blockStore BlockStorage,
 	ledger Ledger,
 	processor *Processor,
 	genesisBlockID BlockID,
+	stateDir string,
 ) *Indexer {
 	return &Indexer{
+		params:        params,
 		blockStore:    blockStore,
 		ledger:        ledger,
 		processor:     processor,
 		latestBlockID: genesisBlockID,
 		latestHeight:  0,
-		keyState:      make(map[string]*KeyState),
-		directories:   make(map[string]string),
-		dirBalances:   make(map[string]map[string]int64),
-		dirGraphs:     make(map[string]*Graph),
+		queryModules:  make(map[string]IndexModule),
+		stateDir:      stateDir,
+		savedHeight:   -1,
 		shutdownChan:  make(chan struct{}),
 	}
 }
 
-// Run executes the indexer's main loop in its own goroutine.
+// AddModule adds a module to the indexer. Modules must be added before the indexer is run.
+func (idx *Indexer) AddModule(module IndexModule) error {
+	for _, m := range idx.modules {
+		if m.Name() == module.Name() {
+			return fmt.Errorf("Index module %s already added", module.Name())
+		}
+	}
+	if _, ok := module.(PersistentIndexModule); !ok && len(idx.stateDir) != 0 {
+		return fmt.Errorf("Index module %s can't save its state", module.Name())
+	}
+	for _, messageType := range module.QueryTypes() {
+		if m, ok := idx.queryModules[messageType]; ok {
+			return fmt.Errorf("Index module %s query %s already handled by module %s",
+				module.Name(), messageType, m.Name())
+		}
+	}
+	for _, messageType := range module.QueryTypes() {
+		idx.queryModules[messageType] = module
+	}
+	idx.modules = append(idx.modules, module)
+	return nil
+}
+
+// Module returns the added module with the given name or nil if there isn't one.
+func (idx *Indexer) Module(name string) IndexModule {
+	for _, m := range idx.modules {
+		if m.Name() == name {
+			return m
+		}
+	}
+	return nil
+}
+
 func (idx *Indexer) Run() {
 	idx.wg.Add(1)
 	go idx.run()
@@ -63,7 +103,7 @@ func (idx *Indexer) run() {
 
 	// don't start indexing until we think we're synced.
 	// we're just wasting time and slowing down the sync otherwise
-	ibd, _, err := IsInitialBlockDownload(idx.ledger, idx.blockStore)
+	ibd, _, err := IsInitialBlockDownload(idx.params, idx.ledger, idx.blockStore)
 	if err != nil {
 		panic(err)
 	}
@@ -79,7 +119,7 @@ func (idx *Indexer) run() {
 				}
 			case <-ticker.C:
 				var err error
-				ibd, _, err = IsInitialBlockDownload(idx.ledger, idx.blockStore)
+				ibd, _, err = IsInitialBlockDownload(idx.params, idx.ledger, idx.blockStore)
 				if err != nil {
 					panic(err)
 				}
@@ -93,33 +133,73 @@ func (idx *Indexer) run() {
 
 	ticker.Stop()
 
-	header, _, err := idx.blockStore.GetBlockHeader(idx.latestBlockID)
-	if err != nil {
+	if err := idx.IndexChain(); err != nil {
 		log.Println(err)
 		return
 	}
+
+	// register for tip changes
+	tipChangeChan := make(chan TipChange, 1)
+	idx.processor.RegisterForTipChange(tipChangeChan)
+	defer idx.processor.UnregisterForTipChange(tipChangeChan)
+
+	for {
+		select {
+		case tip := <-tipChangeChan:
+			log.Printf("Indexer received notice of new tip block: %s at height: %d\n", tip.BlockID, tip.Block.Header.Height)
+			idx.onTipChange(tip)
+		case _, ok := <-idx.shutdownChan:
+			if !ok {
+				log.Printf("Indexer shutting down...\n")
+				return
+			}
+		}
+	}
+}
+
+// IndexChain synchronously indexes the main chain from the latest indexed block to the current tip
+// and persists the modules. It's used offline as well as on startup.
+func (idx *Indexer) IndexChain() error {
+	resumed, err := idx.loadState()
+	if err != nil {
+		return err
+	}
+
+	header, _, err := idx.blockStore.GetBlockHeader(idx.latestBlockID)
+	if err != nil {
+		return err
+	}
 	if header == nil {
 		// don't have it
-		log.Println(err)
-		return
+		return fmt.Errorf("No block header found for latest indexed block %s", idx.latestBlockID)
 	}
 	branchType, err := idx.ledger.GetBranchType(idx.latestBlockID)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 	if branchType != MAIN {
 		// not on the main branch
-		log.Println(err)
-		return
+		return fmt.Errorf("Latest indexed block %s is not on the main branch", idx.latestBlockID)
 	}
 
 	var height int64 = header.Height
+	if resumed {
+		// the latest indexed block has already been connected
+		height += 1
+	}
+	lowestHeight, err := LowestAvailableHeight(idx.blockStore)
+	if err != nil {
+		return err
+	}
+	if height < lowestHeight {
+		return fmt.Errorf("Blocks below height %d have been pruned, can't index from height %d without saved index state",
+			lowestHeight, height)
+	}
+
 	for {
 		nextID, err := idx.ledger.GetBlockIDForHeight(height)
 		if err != nil {
-			log.Println(err)
-			return
+			return err
 		}
 		if nextID == nil {
 			height -= 1
@@ -129,17 +209,15 @@ func (idx *Indexer) run() {
 		block, err := idx.blockStore.GetBlock(*nextID)
 		if err != nil {
 			// not found
-			log.Println(err)
-			return
+			return err
 		}
 
 		if block == nil {
 			// not found
-			log.Printf("No block found with ID %v", nextID)
-			return
+			return fmt.Errorf("No block found with ID %v", nextID)
 		}
 
-		idx.indexTransactions(block, *nextID, true)
+		idx.connectBlock(*nextID, block)
 
 		height += 1
 	}
@@ -147,273 +225,209 @@ func (idx *Indexer) run() {
 	log.Printf("Finished indexing at height %v", idx.latestHeight)
 	log.Printf("Latest indexed blockID: %v", idx.latestBlockID)
 
-	idx.rankGraph()
+	idx.persist()
+	return nil
+}
 
-	// register for tip changes
-	tipChangeChan := make(chan TipChange, 1)
-	idx.processor.RegisterForTipChange(tipChangeChan)
-	defer idx.processor.UnregisterForTipChange(tipChangeChan)
+// HandlesQuery returns true if one of the modules handles the given protocol message type.
+func (idx *Indexer) HandlesQuery(messageType string) bool {
+	_, ok := idx.queryModules[messageType]
+	return ok
+}
 
-	for {
-		select {
-		case tip := <-tipChangeChan:
-			log.Printf("Indexer received notice of new tip block: %s at height: %d\n", tip.BlockID, tip.Block.Header.Height)
-			idx.indexTransactions(tip.Block, tip.BlockID, tip.Connect) //Todo: Make sure no transaction is skipped.
-			if !tip.More {
-				idx.rankGraph()
-			}
-		case _, ok := <-idx.shutdownChan:
-			if !ok {
-				log.Printf("Indexer shutting down...\n")
-				return
+// HandleQuery routes a protocol query to the module which handles it.
+func (idx *Indexer) HandleQuery(messageType string, body json.RawMessage, outChan chan<- Message) error {
+	module, ok := idx.queryModules[messageType]
+	if !ok {
+		return fmt.Errorf("No index module handles query: %s", messageType)
+	}
+	return module.HandleQuery(messageType, body, outChan)
+}
+
+func (idx *Indexer) onTipChange(tip TipChange) {
+	if tip.Connect {
+		idx.connectBlock(tip.BlockID, tip.Block)
+	} else {
+		for _, module := range idx.modules {
+			if err := module.DisconnectBlock(tip.BlockID, tip.Block); err != nil {
+				log.Printf("Index module %s error disconnecting block %s: %s\n", module.Name(), tip.BlockID, err)
 			}
 		}
+		idx.latestBlockID = tip.Block.Header.Previous
+		idx.latestHeight = tip.Block.Header.Height - 1
+	}
+	if !tip.More {
+		idx.persist()
 	}
 }
 
-func inflateNodes(pubKey string) (bool, string, []string, uint) {
-	//omit the revision from the pubKey/instruction for validation
-	trimmed := strings.TrimRight(pubKey, "/+0=")
-	splitPK := strings.Split(trimmed, "/")
-
-	if len(splitPK) == 0 || splitPK[0] == "" {
-		return false, "", nil, 0
+func (idx *Indexer) connectBlock(id BlockID, block *Block) {
+	for _, module := range idx.modules {
+		if err := module.ConnectBlock(id, block); err != nil {
+			log.Printf("Index module %s error connecting block %s: %s\n", module.Name(), id, err)
+		}
 	}
+	idx.latestBlockID = id
+	idx.latestHeight = block.Header.Height
+}
 
-	for i := 0; i < len(splitPK); i++ {
-		if splitPK[i] == "" {
-			return false, "", append([]string{}, pubKey), 0
+func (idx *Indexer) persist() {
+	for _, module := range idx.modules {
+		if err := module.Persist(); err != nil {
+			log.Printf("Index module %s error persisting: %s\n", module.Name(), err)
 		}
 	}
+	if len(idx.stateDir) == 0 || len(idx.modules) == 0 {
+		return
+	}
+	if err := idx.saveState(); err != nil {
+		log.Printf("Error saving index state: %s\n", err)
+		return
+	}
+	idx.savedLock.Lock()
+	defer idx.savedLock.Unlock()
+	idx.savedHeight = idx.latestHeight
+}
 
-	//reset to include the revision
-	trimmed = strings.TrimRight(pubKey, "0=")
-	splitPK = strings.Split(trimmed, "/")
+// SavedHeight returns the height of the latest block reflected in the modules' saved state or -1
+// if it hasn't been saved yet. Blocks at or below this height aren't needed to resume indexing.
+func (idx *Indexer) SavedHeight() int64 {
+	idx.savedLock.Lock()
+	defer idx.savedLock.Unlock()
+	return idx.savedHeight
+}
 
-	rootdir := splitPK[0]
-	nodes := splitPK
-	revision := 0
+func (idx *Indexer) stateFilePath(module IndexModule) string {
+	return filepath.Join(idx.stateDir, module.Name()+".state")
+}
 
-	if last := nodes[len(nodes)-1]; strings.Trim(last, "+") == "" {
-		revision = len(last)
-		nodes = nodes[:len(nodes)-1] // remove the revision from the nodes
+// write each module's state to a temporary file and move it into place
+func (idx *Indexer) saveState() error {
+	if err := os.MkdirAll(idx.stateDir, 0700); err != nil {
+		return err
 	}
-
-	//append implicit revision (node/+++content/+++) to node identifier (node/+++)
-	for i := 0; i < len(nodes); i++ {
-		node := nodes[i]
-
-		if j := i + 1; j < len(nodes) {
-			next := nodes[j]
-			if strings.HasPrefix(next, "+") {
-				//get prefix
-				prefix := strings.Split(next, strings.Trim(next, "+"))[0]
-				node = node + "/" + prefix
-			}
+	for _, module := range idx.modules {
+		path := idx.stateFilePath(module)
+		f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(f)
+		header := indexStateHeader{BlockID: idx.latestBlockID, Height: idx.latestHeight}
+		if err := json.NewEncoder(w).Encode(header); err != nil {
+			f.Close()
+			return err
+		}
+		if err := module.(PersistentIndexModule).SaveState(w); err != nil {
+			f.Close()
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return err
 		}
-
-		nodes[i] = node
 	}
-
-	return true, rootdir, nodes, uint(revision)
+	return nil
 }
 
-func isLabelling(key string) (bool, string) {
-	if strings.HasPrefix(key, "//") {
-		re := regexp.MustCompile(`//([^/]+)//`)
-		trimmed := strings.TrimRight(key, "0=")
-		matches := re.FindStringSubmatch(trimmed)
-		if len(matches) > 1 {
-			return true, strings.ReplaceAll(strings.Trim(trimmed, "/"), "+", " ")
+// restore the modules' saved state. returns false if there isn't a complete saved state to resume from
+func (idx *Indexer) loadState() (bool, error) {
+	if len(idx.stateDir) == 0 || len(idx.modules) == 0 {
+		return false, nil
+	}
+	for _, module := range idx.modules {
+		if _, err := os.Stat(idx.stateFilePath(module)); os.IsNotExist(err) {
+			return false, nil
 		}
 	}
 
-	return false, ""
-}
-
-func (idx *Indexer) indexTransactions(block *Block, id BlockID, increment bool) {
-
-	idx.latestBlockID = id
-	idx.latestHeight = block.Header.Height
-
-	for t := 0; t < len(block.Transactions); t++ {
-		txn := block.Transactions[t]
-
-		txid, err := txn.ID()
+	var latest *indexStateHeader
+	for _, module := range idx.modules {
+		header, err := idx.loadModuleState(module.(PersistentIndexModule))
 		if err != nil {
-			log.Printf("Error computing transaction ID: %v", err)
-			continue
+			return false, fmt.Errorf("Error loading index module %s state: %s, remove %s to rebuild the index",
+				module.Name(), err, idx.stateFilePath(module))
 		}
-
-		txnFrom := pubKeyToString(txn.From)
-		txnTo := pubKeyToString(txn.To)
-
-		/*
-			TODO: reversal, when Block disconnected
-			When Block disconnected; reverse all applicable transactions from the graph>>>>>>>>>>>>>>>>>>>
-		*/
-		incrementBy := int64(0)
-
-		if increment {
-			incrementBy = txn.Amount
+		if latest != nil && *header != *latest {
+			return false, fmt.Errorf("Index module %s state is at block %s, expected %s, remove %s to rebuild the index",
+				module.Name(), header.BlockID, latest.BlockID, idx.stateDir)
 		}
+		latest = header
+	}
+	idx.latestBlockID, idx.latestHeight = latest.BlockID, latest.Height
+	log.Printf("Loaded index state at height %d, block: %s\n", idx.latestHeight, idx.latestBlockID)
 
-		if isLabl, label := isLabelling(txnTo); isLabl {
-
-			if txn.From == nil {
-				directoryID := txid.String()
-				idx.directories[directoryID] = label
-				idx.dirGraphs[directoryID] = NewGraph()
-				idx.dirBalances[directoryID] = make(map[string]int64)
-			} else {
-				//Capture label: "SenderKey" -> "//DirectoryLabel//0000000000000000000000000000="
-
-				if _, ok := idx.keyState[txnFrom]; !ok {
-					idx.keyState[txnFrom] = &KeyState{}
-				}
-				idx.keyState[txnFrom].label = label
-				memo := strings.TrimSpace(txn.Memo)
-				idx.keyState[txnFrom].memo = memo
-			}
-
-			continue
+	// the state may be of a block which has since been disconnected
+	for {
+		branchType, err := idx.ledger.GetBranchType(idx.latestBlockID)
+		if err != nil {
+			return false, err
 		}
-
-		trimmedSysMemo := strings.Trim(txn.Memo, "/")
-
-		if _, ok := idx.directories[trimmedSysMemo]; ok {
-
-			if balances, ok := idx.dirBalances[trimmedSysMemo]; ok {
-				if idx.dirGraphs[trimmedSysMemo].IsParentDescendant(txnTo, txnFrom) {
-					//prevent cycle
-					continue
-				}
-
-				balances[txnTo] += incrementBy
-			}
-
-			if idx.dirBalances[trimmedSysMemo][txnFrom] > 0 {
-				idx.dirGraphs[trimmedSysMemo].Link(txnFrom, txnTo, float64(incrementBy), block.Header.Height, txn.Time)
-				idx.dirBalances[trimmedSysMemo][txnFrom] -= incrementBy
-			} else {
-				idx.dirGraphs[trimmedSysMemo].Link(pad44("0"), txnTo, float64(incrementBy), block.Header.Height, txn.Time)
-			}
-
-		} else {
-
-			/*
-				Build directory graph.
-			*/
-			nodesOk, dirlbl, nodes, revision := inflateNodes(txnTo)
-			var directoryGraph *Graph
-			var dirBalances map[string]int64
-
-			for key, lbl := range idx.directories {
-				if lbl == dirlbl {
-					//TODO: handle directorylabel collisions
-					directoryGraph = idx.dirGraphs[key]
-					dirBalances = idx.dirBalances[key]
-				}
+		if branchType == MAIN {
+			break
+		}
+		block, err := idx.blockStore.GetBlock(idx.latestBlockID)
+		if err != nil {
+			return false, err
+		}
+		if block == nil {
+			// can't undo it without the block
+			header, _, err := idx.blockStore.GetBlockHeader(idx.latestBlockID)
+			if err != nil {
+				return false, err
 			}
-
-			if dirBalances[txnFrom] < incrementBy {
-				//insufficient balance; skip transaction
-				continue
+			if header != nil {
+				return false, fmt.Errorf("Indexed block %s has been pruned, remove %s to rebuild the index",
+					idx.latestBlockID, idx.stateDir)
 			}
-
-			if nodesOk && directoryGraph != nil {				
-				directoryGraph.Link(txnFrom, txnTo, float64(incrementBy), block.Header.Height, txn.Time)
-				dirBalances[txnFrom] -= incrementBy
-
-				if _, ok := idx.keyState[pad44(txnTo)]; !ok {
-					idx.keyState[pad44(txnTo)] = &KeyState{}
-				}
-
-				idx.keyState[pad44(txnTo)].time = txn.Time
-				idx.keyState[pad44(txnTo)].revision = revision
-				idx.keyState[pad44(txnTo)].label = nodes[len(nodes)-1]
-				idx.keyState[pad44(txnTo)].memo = txn.Memo
-
-				timestamp := time.Unix(txn.Time, 0)
-				YEAR := timestamp.UTC().Format("2006")
-				MONTH := timestamp.UTC().Format("2006+01")
-				DAY := timestamp.UTC().Format("2006+01+02")
-
-				DIMENSION_WEIGHT := float64(incrementBy / 4)
-
-				/*
-					1/4 temporal
-					(stagger timing: +20)
-				*/
-				directoryGraph.Link(txnTo, DAY, DIMENSION_WEIGHT, block.Header.Height, txn.Time+20)
-				directoryGraph.Link(DAY, MONTH, DIMENSION_WEIGHT, block.Header.Height, txn.Time+21)
-				directoryGraph.Link(MONTH, YEAR, DIMENSION_WEIGHT, block.Header.Height, txn.Time+22)
-				directoryGraph.Link(YEAR, "0", DIMENSION_WEIGHT, block.Header.Height, txn.Time+23)
-
-				/*
-					1/4 revision
-					(stagger timing: +30)
-				*/
-				revisionNode := "+" + strconv.Itoa(int(revision))
-				directoryGraph.Link(txnTo, revisionNode, DIMENSION_WEIGHT, block.Header.Height, txn.Time+30)
-				directoryGraph.Link(revisionNode, "0", DIMENSION_WEIGHT, block.Header.Height, txn.Time+31)
-
-				/*
-					1/4 spatial
-					(stagger timing: +40)
-				*/
-				reversedNodes := reverse(nodes)
-
-				//fractionalWeight := DIMENSION_WEIGHT / float64(len(reversedNodes))
-
-				for i := 0; i < len(reversedNodes); i++ {
-					node := reversedNodes[i]
-					additive := 40 + int64(i)
-					
-					if i == 0 {
-						directoryGraph.Link(txnTo, node, DIMENSION_WEIGHT, block.Header.Height, txn.Time+additive)
-					}
-
-					if j := i + 1; j < len(reversedNodes) {
-						next := reversedNodes[j]
-						directoryGraph.Link(node, next, DIMENSION_WEIGHT, block.Header.Height, txn.Time+additive+int64(j)) // => accumulated
-					}
-
-					if i == len(reversedNodes)-1 { //last node => root
-						directoryGraph.Link(node, "0", DIMENSION_WEIGHT, block.Header.Height, txn.Time+additive+int64(i+1)) // => total spatial accumulation
-					}
-				}
-
-				/*
-					1/4 periodic
-					(stagger timing: +10)
-				*/
-				blockHeight := strconv.FormatInt(block.Header.Height, 10)
-				directoryGraph.Link(txnTo, blockHeight, DIMENSION_WEIGHT, block.Header.Height, txn.Time+10)
-
-				orders := DiminishingOrders(block.Header.Height)
-
-				for j := 1; j < len(orders); j++ {
-					i := j - 1
-
-					source := strconv.FormatInt(orders[i], 10)
-					target := strconv.FormatInt(orders[j], 10)
-
-					directoryGraph.Link(source, target, DIMENSION_WEIGHT, block.Header.Height, txn.Time+10+int64(j))
-				}
+			return false, fmt.Errorf("Indexed block %s isn't in block storage, remove %s to rebuild the index",
+				idx.latestBlockID, idx.stateDir)
+		}
+		log.Printf("Disconnecting block %s from the index state\n", idx.latestBlockID)
+		for _, module := range idx.modules {
+			if err := module.DisconnectBlock(idx.latestBlockID, block); err != nil {
+				return false, err
 			}
 		}
+		idx.latestBlockID = block.Header.Previous
+		idx.latestHeight = block.Header.Height - 1
 	}
-}
 
-func (idx *Indexer) rankGraph() {
-	log.Printf("Indexer ranking %d directories at height: %d\n", len(idx.dirGraphs), idx.latestHeight)
+	idx.savedLock.Lock()
+	defer idx.savedLock.Unlock()
+	idx.savedHeight = idx.latestHeight
+	return true, nil
+}
 
-	for _, cnGraph := range idx.dirGraphs {
-		cnGraph.Rank(1.0, 1e-6)
+func (idx *Indexer) loadModuleState(module PersistentIndexModule) (*indexStateHeader, error) {
+	f, err := os.Open(idx.stateFilePath(module))
+	if err != nil {
+		return nil, err
 	}
-
-	log.Printf("Finished Ranking %d directories", len(idx.dirGraphs))
+	defer f.Close()
+	r := bufio.NewReader(f)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	header := new(indexStateHeader)
+	if err := json.Unmarshal(line, header); err != nil {
+		return nil, err
+	}
+	if err := module.LoadState(r); err != nil {
+		return nil, err
+	}
+	return header, nil
 }
 
 // Shutdown stops the indexer synchronously.
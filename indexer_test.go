@@ -0,0 +1,118 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// an index module which counts the blocks it has seen
+type testIndexModule struct {
+	name      string
+	queries   []string
+	height    int64
+	persisted int
+}
+
+func (m *testIndexModule) Name() string {
+	return m.name
+}
+
+func (m *testIndexModule) ConnectBlock(id BlockID, block *Block) error {
+	m.height++
+	return nil
+}
+
+func (m *testIndexModule) DisconnectBlock(id BlockID, block *Block) error {
+	m.height--
+	return nil
+}
+
+func (m *testIndexModule) Persist() error {
+	m.persisted++
+	return nil
+}
+
+func (m *testIndexModule) QueryTypes() []string {
+	return m.queries
+}
+
+func (m *testIndexModule) HandleQuery(messageType string, body json.RawMessage, outChan chan<- Message) error {
+	outChan <- Message{Type: m.name, Body: m.height}
+	return nil
+}
+
+func TestIndexerModules(t *testing.T) {
+	idx := NewIndexer(MainNetParams, nil, nil, nil, BlockID{}, "")
+	stats := &testIndexModule{name: "stats", queries: []string{"get_stats"}}
+	if err := idx.AddModule(stats); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.AddModule(&testIndexModule{name: "stats"}); err == nil {
+		t.Fatal("Expected duplicate module name to be rejected")
+	}
+	if err := idx.AddModule(&testIndexModule{name: "other", queries: []string{"get_stats"}}); err == nil {
+		t.Fatal("Expected duplicate query type to be rejected")
+	}
+	if idx.Module("other") != nil {
+		t.Fatal("Expected rejected module to not be added")
+	}
+	if err := idx.AddModule(NewDirectoryIndex()); err != nil {
+		t.Fatal(err)
+	}
+
+	// connect 2 blocks as a batch then disconnect 1
+	block1 := &Block{Header: &BlockHeader{Height: 1}}
+	block2 := &Block{Header: &BlockHeader{Height: 2, Previous: BlockID{1}}}
+	idx.onTipChange(TipChange{BlockID: BlockID{1}, Block: block1, Connect: true, More: true})
+	idx.onTipChange(TipChange{BlockID: BlockID{2}, Block: block2, Connect: true})
+	if stats.height != 2 || stats.persisted != 1 {
+		t.Fatalf("Expected height 2 persisted once, found %d %d", stats.height, stats.persisted)
+	}
+	idx.onTipChange(TipChange{BlockID: BlockID{2}, Block: block2, Connect: false})
+	if stats.height != 1 || stats.persisted != 2 {
+		t.Fatalf("Expected height 1 persisted twice, found %d %d", stats.height, stats.persisted)
+	}
+	if idx.latestBlockID != (BlockID{1}) || idx.latestHeight != 1 {
+		t.Fatalf("Expected latest block 1, found %s at %d", idx.latestBlockID, idx.latestHeight)
+	}
+
+	// queries are routed to the module which handles them
+	if !idx.HandlesQuery("get_stats") || !idx.HandlesQuery("get_graph") || idx.HandlesQuery("get_nope") {
+		t.Fatal("Unexpected query routing")
+	}
+	outChan := make(chan Message, 1)
+	if err := idx.HandleQuery("get_stats", nil, outChan); err != nil {
+		t.Fatal(err)
+	}
+	if m := <-outChan; m.Type != "stats" || m.Body.(int64) != 1 {
+		t.Fatalf("Unexpected response %v", m)
+	}
+	if err := idx.HandleQuery("get_nope", nil, outChan); err == nil {
+		t.Fatal("Expected unhandled query to fail")
+	}
+}
+
+func TestIndexModuleRegistry(t *testing.T) {
+	module, err := NewIndexModule("directory", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if module.Name() != "directory" {
+		t.Fatalf("Expected directory module, found %s", module.Name())
+	}
+	if _, err := NewIndexModule("nope", nil, nil); err == nil {
+		t.Fatal("Expected unknown module to fail")
+	}
+
+	RegisterIndexModule("test_stats", func(BlockStorage, Ledger) (IndexModule, error) {
+		return &testIndexModule{name: "test_stats"}, nil
+	})
+	defer delete(indexModuleConstructors, "test_stats")
+	names := IndexModuleNames()
+	if len(names) != 3 || names[0] != "directory" || names[1] != "names" || names[2] != "test_stats" {
+		t.Fatalf("Unexpected module names %v", names)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/logrusorgru/aurora"
 	. "github.com/necessitated/cruzbit-tree"
@@ -23,24 +24,56 @@ import (
 func main() {
 	var commands = []string{
 		"height", "balance", "balance_at", "block", "block_at", "tx", "history", "verify",
+		"timeline", "directory_balance", "graph", "checkpoints", "reorgs", "export", "snapshot", "migrate",
 	}
 
 	dataDirPtr := flag.String("datadir", "", "Path to a directory containing block chain data")
 	pubKeyPtr := flag.String("pubkey", "", "Base64 encoded public key")
 	cmdPtr := flag.String("command", "height", "Commands: "+strings.Join(commands, ", "))
-	heightPtr := flag.Int("height", 0, "Block chain height")
+	heightPtr := flag.Int("height", 0, "Block chain height (defaults to the tip for \"snapshot\")")
 	blockIDPtr := flag.String("block_id", "", "Block ID")
 	txIDPtr := flag.String("tx_id", "", "Transaction ID")
-	startHeightPtr := flag.Int("start_height", 0, "Start block height (for use with \"history\")")
+	startHeightPtr := flag.Int("start_height", 0, "Start block height (for use with \"history\" and \"export\")")
 	startIndexPtr := flag.Int("start_index", 0, "Start transaction index (for use with \"history\")")
-	endHeightPtr := flag.Int("end_height", 0, "End block height (for use with \"history\")")
-	limitPtr := flag.Int("limit", 3, "Limit (for use with \"history\")")
+	endHeightPtr := flag.Int("end_height", 0, "End block height (for use with \"history\" and \"export\", defaults to the tip for \"export\")")
+	limitPtr := flag.Int("limit", 3, "Limit (for use with \"history\", \"timeline\", \"directory_balance\" and \"reorgs\")")
+	dirIDPtr := flag.String("directory_id", "", "Directory ID (for use with \"timeline\", \"directory_balance\" and \"graph\"). "+
+		"A comma-separated list of IDs merges their graphs")
+	periodPtr := flag.String("period", "", "Year, month or day as YYYY, YYYY+MM or YYYY+MM+DD (for use with \"timeline\")")
+	formatPtr := flag.String("format", "svg", "Graph format: dot or svg (for use with \"graph\")")
+	filePtr := flag.String("file", "", "Path to write the bootstrap file or snapshot (for use with \"export\" and \"snapshot\")")
+	compressPtr := flag.Bool("compress", false,
+		"Compress the bootstrap file, snapshot or migrated blocks with lz4, or zstd with -binary (for use with \"export\", \"snapshot\" and \"migrate\")")
+	maxReorgDepthPtr := flag.Int64("maxreorgdepth", DefaultSnapshotReorgDepth,
+		"Deepest reorganization nodes started from the snapshot can handle (for use with \"snapshot\")")
+	binaryPtr := flag.Bool("binary", false, "Store migrated blocks in the binary encoding (for use with \"migrate\")")
+	networkPtr := flag.String("network", MainNetParams.Name,
+		"Network the block chain data is from (available: "+strings.Join(NetworkNames(), ", ")+")")
+	checkpointKeysPtr := flag.String("checkpointkeys", "",
+		"Comma-separated list of base64 encoded public keys allowed to sign the checkpoints file in addition to the network's")
 	flag.Parse()
 
 	if len(*dataDirPtr) == 0 {
 		log.Printf("You must specify a -datadir\n")
 		os.Exit(-1)
 	}
+	params, err := ChainParamsForNetwork(*networkPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if params != MainNetParams {
+		*dataDirPtr = filepath.Join(*dataDirPtr, params.Name)
+	}
+	var checkpointKeys []string
+	for _, key := range strings.Split(*checkpointKeysPtr, ",") {
+		if key = strings.TrimSpace(key); len(key) != 0 {
+			checkpointKeys = append(checkpointKeys, key)
+		}
+	}
+	params, loadedCheckpoints, err := params.LoadCheckpoints(*dataDirPtr, checkpointKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	var pubKey ed25519.PublicKey
 	if len(*pubKeyPtr) != 0 {
@@ -72,19 +105,20 @@ func main() {
 		copy(txID[:], txIDBytes)
 	}
 
+	if *cmdPtr == "migrate" {
+		// move blocks from a file per block to segment files
+		migrateBlocks(*dataDirPtr, *compressPtr, *binaryPtr)
+		return
+	}
+
 	// instatiate block storage (read-only)
-	blockStore, err := NewBlockStorageDisk(
-		filepath.Join(*dataDirPtr, "blocks"),
-		filepath.Join(*dataDirPtr, "headers.db"),
-		true,  // read-only
-		false, // compress (if a block is compressed storage will figure it out)
-	)
+	blockStore, err := openBlockStorage(*dataDirPtr)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	// instantiate the ledger (read-only)
-	ledger, err := NewLedgerDisk(filepath.Join(*dataDirPtr, "ledger.db"),
+	ledger, err := NewLedgerDisk(params, filepath.Join(*dataDirPtr, "ledger.db"),
 		true,  // read-only
 		false, // prune (no effect with read-only set)
 		blockStore)
@@ -184,7 +218,174 @@ func main() {
 		displayHistory(bIDs, indices, stopHeight, stopIndex, blockStore)
 
 	case "verify":
-		verify(ledger, blockStore, pubKey, currentHeight)
+		verify(params, ledger, blockStore, pubKey, currentHeight)
+
+	case "timeline":
+		if len(*dirIDPtr) == 0 {
+			log.Fatal("-directory_id required for \"timeline\" command")
+		}
+		dirIndex := indexChain(params, ledger, blockStore)
+		entries, buckets, _, _, err := dirIndex.GetDirectoryTimeline(*dirIDPtr, *periodPtr, *limitPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		displayTimeline(*dirIDPtr, *periodPtr, entries, buckets)
+
+	case "directory_balance":
+		if len(*dirIDPtr) == 0 {
+			log.Fatal("-directory_id required for \"directory_balance\" command")
+		}
+		dirIndex := indexChain(params, ledger, blockStore)
+		if pubKey != nil {
+			balance, _, _, err := dirIndex.GetDirectoryBalance(*dirIDPtr, pubKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Current directory balance: %.8f\n", aurora.Bold(float64(balance)/CruzbitsPerCruz))
+			break
+		}
+		balances, issued, _, _, err := dirIndex.GetDirectoryBalances(*dirIDPtr, *limitPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		displayDirectoryBalances(*dirIDPtr, issued, balances)
+
+	case "graph":
+		if len(*dirIDPtr) == 0 {
+			log.Fatal("-directory_id required for \"graph\" command")
+		}
+		dirIndex := indexChain(params, ledger, blockStore)
+		var cursor string
+		for {
+			// the graph is written to stdout a page at a time
+			var page, nextCursor string
+			var err error
+			if strings.Contains(*dirIDPtr, ",") {
+				page, nextCursor, _, _, err = dirIndex.GetMergedGraph(
+					strings.Split(*dirIDPtr, ","), *pubKeyPtr, *formatPtr, cursor)
+			} else {
+				page, nextCursor, _, _, err = dirIndex.GetGraph(*dirIDPtr, *pubKeyPtr, *formatPtr, cursor)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Print(page)
+			if len(nextCursor) == 0 {
+				break
+			}
+			cursor = nextCursor
+		}
+
+	case "checkpoints":
+		fromFile := make(map[int64]bool)
+		for _, checkpoint := range loadedCheckpoints {
+			fromFile[checkpoint.Height] = true
+		}
+		for _, checkpoint := range params.SortedCheckpoints() {
+			source := "built-in"
+			if fromFile[checkpoint.Height] {
+				source = CheckpointsFileName
+			}
+			status := aurora.Bold("not reached")
+			if checkpoint.Height <= currentHeight {
+				id, err := ledger.GetBlockIDForHeight(checkpoint.Height)
+				if err != nil {
+					log.Fatal(err)
+				}
+				if id != nil && *id == checkpoint.BlockID {
+					status = aurora.Bold(aurora.Green("matches"))
+				} else {
+					status = aurora.Bold(aurora.Red("MISMATCH"))
+				}
+			}
+			log.Printf("%7d %s %-16s %s\n", checkpoint.Height, checkpoint.BlockID, source, status)
+		}
+		log.Printf("Latest checkpoint height: %d\n", aurora.Bold(params.LatestCheckpointHeight))
+
+	case "reorgs":
+		reorgStore, err := NewReorgStorageDisk(filepath.Join(*dataDirPtr, "reorgs.db"), true)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reorgs, err := reorgStore.Get(*limitPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, reorg := range reorgs {
+			status := aurora.Bold(aurora.Green("accepted"))
+			if reorg.Refused {
+				status = aurora.Bold(aurora.Red("REFUSED"))
+			}
+			log.Printf("%s %s depth: %d, fork: %s at %d, old tip: %s at %d, new tip: %s at %d, from: %s\n",
+				time.Unix(reorg.Time, 0).UTC().Format(time.RFC3339), status, aurora.Bold(reorg.Depth()),
+				reorg.ForkID, reorg.ForkHeight, reorg.OldTipID, reorg.OldTipHeight,
+				reorg.NewTipID, reorg.NewTipHeight, reorg.Source)
+		}
+		if err := reorgStore.Close(); err != nil {
+			log.Println(err)
+		}
+
+	case "export":
+		if len(*filePtr) == 0 {
+			log.Fatal("-file argument required")
+		}
+		endHeight := int64(*endHeightPtr)
+		if endHeight == 0 {
+			endHeight = currentHeight
+		}
+		_, genesisID, err := params.GenesisBlock()
+		if err != nil {
+			log.Fatal(err)
+		}
+		file, err := os.Create(*filePtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		count, err := ExportBlocks(file, genesisID, ledger, blockStore,
+			int64(*startHeightPtr), endHeight, *compressPtr)
+		if err != nil {
+			file.Close()
+			log.Fatal(err)
+		}
+		if err := file.Close(); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Exported %d blocks to %s\n", aurora.Bold(count), *filePtr)
+
+	case "snapshot":
+		if len(*filePtr) == 0 {
+			log.Fatal("-file argument required")
+		}
+		height := int64(*heightPtr)
+		if height == 0 {
+			height = currentHeight
+		}
+		_, genesisID, err := params.GenesisBlock()
+		if err != nil {
+			log.Fatal(err)
+		}
+		snapshot, err := NewLedgerSnapshot(params, genesisID, ledger, blockStore, height, *maxReorgDepthPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		hash, err := snapshot.Hash()
+		if err != nil {
+			log.Fatal(err)
+		}
+		file, err := os.Create(*filePtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := snapshot.Write(file, *compressPtr); err != nil {
+			file.Close()
+			log.Fatal(err)
+		}
+		if err := file.Close(); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Wrote snapshot at height %d with %d balances to %s\n",
+			aurora.Bold(height), len(snapshot.Balances), *filePtr)
+		log.Printf("Snapshot hash: %s\n", aurora.Bold(hash))
 	}
 
 	// close storage
@@ -196,6 +397,82 @@ func main() {
 	}
 }
 
+type closableBlockStorage interface {
+	BlockStorage
+	Close() error
+}
+
+// open block storage read-only with whichever layout the data directory uses
+func openBlockStorage(dataDir string) (closableBlockStorage, error) {
+	segmentsDbPath := filepath.Join(dataDir, "segments.db")
+	if _, err := os.Stat(segmentsDbPath); err == nil {
+		return NewBlockStorageSegments(
+			filepath.Join(dataDir, "segments"),
+			segmentsDbPath,
+			true,  // read-only
+			false, // compress (no effect with read-only set)
+			false, // binary encoding (no effect with read-only set)
+		)
+	}
+	return NewBlockStorageDisk(
+		filepath.Join(dataDir, "blocks"),
+		filepath.Join(dataDir, "headers.db"),
+		true,  // read-only
+		false, // compress (if a block is compressed storage will figure it out)
+		false, // binary encoding (storage figures this out too)
+	)
+}
+
+// copy the blocks stored a file per block to segment files in the same data directory
+func migrateBlocks(dataDir string, compress, binaryEncoding bool) {
+	from, err := NewBlockStorageDisk(
+		filepath.Join(dataDir, "blocks"),
+		filepath.Join(dataDir, "headers.db"),
+		true,  // read-only
+		false, // compress (if a block is compressed storage will figure it out)
+		false, // binary encoding (storage figures this out too)
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer from.Close()
+	to, err := NewBlockStorageSegments(
+		filepath.Join(dataDir, "segments"),
+		filepath.Join(dataDir, "segments.db"),
+		false, // not read-only
+		compress,
+		binaryEncoding,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer to.Close()
+
+	count, err := MigrateBlockStorage(from, to)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Migrated %d blocks to segment files\n", aurora.Bold(count))
+	log.Println("Run the client with -blocksegments. The blocks directory and headers.db can then be removed")
+}
+
+// build the directory index offline
+func indexChain(params *ChainParams, ledger Ledger, blockStore BlockStorage) *DirectoryIndex {
+	_, genesisID, err := params.GenesisBlock()
+	if err != nil {
+		log.Fatal(err)
+	}
+	dirIndex := NewDirectoryIndex()
+	indexer := NewIndexer(params, blockStore, ledger, nil, genesisID, "")
+	if err := indexer.AddModule(dirIndex); err != nil {
+		log.Fatal(err)
+	}
+	if err := indexer.IndexChain(); err != nil {
+		log.Fatal(err)
+	}
+	return dirIndex
+}
+
 type conciseBlock struct {
 	ID           BlockID         `json:"id"`
 	Header       BlockHeader     `json:"header"`
@@ -290,22 +567,22 @@ func displayHistory(bIDs []BlockID, indices []int, stopHeight int64, stopIndex i
 	fmt.Println(string(hJson))
 }
 
-func verify(ledger Ledger, blockStore BlockStorage, pubKey ed25519.PublicKey, height int64) {
+func verify(params *ChainParams, ledger Ledger, blockStore BlockStorage, pubKey ed25519.PublicKey, height int64) {
 	var err error
 	var expect, found int64
 
 	if pubKey == nil {
 		// compute expected total balance
-		if height-CoinbaseMaturity >= 0 {
+		if height-params.CoinbaseMaturity >= 0 {
 			// sum all mature rewards per schedule
 			var i int64
-			for i = 0; i <= height-CoinbaseMaturity; i++ {
+			for i = 0; i <= height-params.CoinbaseMaturity; i++ {
 				expect += BlockCreationReward(i)
 			}
 
 			// account for fees included in immature rewards
 			var immatureFees int64
-			for i = height - CoinbaseMaturity + 1; i <= height; i++ {
+			for i = height - params.CoinbaseMaturity + 1; i <= height; i++ {
 				if i < 0 {
 					continue
 				}
@@ -362,3 +639,47 @@ func verify(ledger Ledger, blockStore BlockStorage, pubKey ed25519.PublicKey, he
 		aurora.Bold(float64(expect)/CruzbitsPerCruz),
 		aurora.Bold(float64(found)/CruzbitsPerCruz))
 }
+
+type timeline struct {
+	DirectoryID string           `json:"directory_id"`
+	Period      string           `json:"period,omitempty"`
+	Entries     []RankedEntry    `json:"entries"`
+	Buckets     []TimelineBucket `json:"buckets"`
+}
+
+func displayTimeline(directoryID, period string, entries []RankedEntry, buckets []TimelineBucket) {
+	t := timeline{
+		DirectoryID: directoryID,
+		Period:      period,
+		Entries:     entries,
+		Buckets:     buckets,
+	}
+
+	tJson, err := json.MarshalIndent(&t, "", "    ")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println(string(tJson))
+}
+
+type directoryBalances struct {
+	DirectoryID string             `json:"directory_id"`
+	Issued      int64              `json:"issued"`
+	Balances    []PublicKeyBalance `json:"balances"`
+}
+
+func displayDirectoryBalances(directoryID string, issued int64, balances []PublicKeyBalance) {
+	d := directoryBalances{
+		DirectoryID: directoryID,
+		Issued:      issued,
+		Balances:    balances,
+	}
+
+	dJson, err := json.MarshalIndent(&d, "", "    ")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println(string(dJson))
+}
@@ -6,7 +6,9 @@ package cruzbit
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
@@ -16,19 +18,21 @@ import (
 
 // LedgerDisk is an on-disk implemenation of the Ledger interface using LevelDB.
 type LedgerDisk struct {
+	params     *ChainParams
 	db         *leveldb.DB
 	blockStore BlockStorage
 	prune      bool // prune historic transaction and public key transaction indices
 }
 
 // NewLedgerDisk returns a new instance of LedgerDisk.
-func NewLedgerDisk(dbPath string, readOnly, prune bool, blockStore BlockStorage) (*LedgerDisk, error) {
+func NewLedgerDisk(params *ChainParams, dbPath string, readOnly, prune bool, blockStore BlockStorage) (
+	*LedgerDisk, error) {
 	opts := opt.Options{ReadOnly: readOnly}
 	db, err := leveldb.OpenFile(dbPath, &opts)
 	if err != nil {
 		return nil, err
 	}
-	return &LedgerDisk{db: db, blockStore: blockStore, prune: prune}, nil
+	return &LedgerDisk{params: params, db: db, blockStore: blockStore, prune: prune}, nil
 }
 
 // GetChainTip returns the ID and the height of the block at the current tip of the main chain.
@@ -170,22 +174,22 @@ func (l LedgerDisk) ConnectBlock(id BlockID, block *Block) ([]TransactionID, err
 
 		txToApply := tx
 
-		if tx.IsCoinbase() {
+		if tx.IsCoinbase() && l.params.CoinbaseMaturity != 0 {
 			// don't apply a coinbase to a balance until it's 100 blocks deep.
 			// during honest reorgs normal transactions usually get into the new most-work branch
 			// but coinbases vanish. this mitigates the impact on UX when reorgs occur and transactions
 			// depend on coinbases.
 			txToApply = nil
 
-			if block.Header.Height-CoinbaseMaturity >= 0 {
+			if block.Header.Height-l.params.CoinbaseMaturity >= 0 {
 				// mature the coinbase from 100 blocks ago now
-				oldID, err := l.GetBlockIDForHeight(block.Header.Height - CoinbaseMaturity)
+				oldID, err := l.GetBlockIDForHeight(block.Header.Height - l.params.CoinbaseMaturity)
 				if err != nil {
 					return nil, err
 				}
 				if oldID == nil {
 					return nil, fmt.Errorf("Missing block at height %d\n",
-						block.Header.Height-CoinbaseMaturity)
+						block.Header.Height-l.params.CoinbaseMaturity)
 				}
 
 				// we could store the last 100 coinbases on our own in memory if we end up needing to
@@ -328,19 +332,19 @@ func (l LedgerDisk) DisconnectBlock(id BlockID, block *Block) ([]TransactionID,
 		batch.Delete(key)
 
 		txToUndo := tx
-		if tx.IsCoinbase() {
+		if tx.IsCoinbase() && l.params.CoinbaseMaturity != 0 {
 			// coinbase doesn't affect recipient balance for 100 more blocks
 			txToUndo = nil
 
-			if block.Header.Height-CoinbaseMaturity >= 0 {
+			if block.Header.Height-l.params.CoinbaseMaturity >= 0 {
 				// undo the effect of the coinbase from 100 blocks ago now
-				oldID, err := l.GetBlockIDForHeight(block.Header.Height - CoinbaseMaturity)
+				oldID, err := l.GetBlockIDForHeight(block.Header.Height - l.params.CoinbaseMaturity)
 				if err != nil {
 					return nil, err
 				}
 				if oldID == nil {
 					return nil, fmt.Errorf("Missing block at height %d\n",
-						block.Header.Height-CoinbaseMaturity)
+						block.Header.Height-l.params.CoinbaseMaturity)
 				}
 				oldTx, _, err := l.blockStore.GetTransaction(*oldID, 0)
 				if err != nil {
@@ -824,6 +828,188 @@ func (l LedgerDisk) Balance() (int64, error) {
 	return total, nil
 }
 
+// Calls fn with every non-zero public key balance in public key order
+func (l LedgerDisk) forEachPublicKeyBalance(fn func(pubKey ed25519.PublicKey, balance int64) error) error {
+	key, err := computePubKeyBalanceKey(nil)
+	if err != nil {
+		return err
+	}
+	iter := l.db.NewIterator(util.BytesPrefix(key), nil)
+	defer iter.Release()
+	for iter.Next() {
+		pubKey := make(ed25519.PublicKey, ed25519.PublicKeySize)
+		copy(pubKey, iter.Key()[1:])
+		var balance int64
+		if err := binary.Read(bytes.NewReader(iter.Value()), binary.BigEndian, &balance); err != nil {
+			return err
+		}
+		if err := fn(pubKey, balance); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// ImportSnapshot initializes an empty ledger from a snapshot. The snapshot's blocks are stored
+// and indexed as the main chain and its balances become the current balances.
+func (l LedgerDisk) ImportSnapshot(snapshot *LedgerSnapshot) error {
+	tipID, _, err := l.GetChainTip()
+	if err != nil {
+		return err
+	}
+	if tipID != nil {
+		return fmt.Errorf("Ledger isn't empty, tip: %s", *tipID)
+	}
+
+	hash, err := snapshot.Hash()
+	if err != nil {
+		return err
+	}
+
+	// apply all resulting writes atomically
+	batch := new(leveldb.Batch)
+
+	now := time.Now().Unix()
+	for _, block := range snapshot.Blocks {
+		id, err := block.ID()
+		if err != nil {
+			return err
+		}
+		if err := l.blockStore.Store(id, block, now); err != nil {
+			return err
+		}
+
+		// index the block by height
+		key, err := computeBlockHeightIndexKey(block.Header.Height)
+		if err != nil {
+			return err
+		}
+		batch.Put(key, id[:])
+
+		// set this block on the main chain
+		key, err = computeBranchTypeKey(id)
+		if err != nil {
+			return err
+		}
+		batch.Put(key, []byte{byte(MAIN)})
+
+		// skip indices a pruned ledger would no longer have
+		if l.prune && block.Header.Height <= snapshot.Height-2*BlocksUntilNewSeries {
+			continue
+		}
+
+		for i, tx := range block.Transactions {
+			txID, err := tx.ID()
+			if err != nil {
+				return err
+			}
+			key, err := computeTransactionIndexKey(txID)
+			if err != nil {
+				return err
+			}
+			indexBytes, err := encodeTransactionIndex(block.Header.Height, i)
+			if err != nil {
+				return err
+			}
+			batch.Put(key, indexBytes)
+
+			if !tx.IsCoinbase() {
+				key, err = computePubKeyTransactionIndexKey(tx.From, &block.Header.Height, &i)
+				if err != nil {
+					return err
+				}
+				batch.Put(key, []byte{0x1})
+			}
+			key, err = computePubKeyTransactionIndexKey(tx.To, &block.Header.Height, &i)
+			if err != nil {
+				return err
+			}
+			batch.Put(key, []byte{0x1})
+		}
+	}
+
+	// set balances
+	for _, balance := range snapshot.Balances {
+		key, err := computePubKeyBalanceKey(balance.PublicKey)
+		if err != nil {
+			return err
+		}
+		balanceBytes, err := encodeNumber(balance.Balance)
+		if err != nil {
+			return err
+		}
+		batch.Put(key, balanceBytes)
+	}
+
+	// set the tip
+	key, err := computeChainTipKey()
+	if err != nil {
+		return err
+	}
+	ctBytes, err := encodeChainTip(snapshot.TipID, snapshot.Height)
+	if err != nil {
+		return err
+	}
+	batch.Put(key, ctBytes)
+
+	// remember where the chain begins
+	baseID, err := snapshot.Blocks[0].ID()
+	if err != nil {
+		return err
+	}
+	info := SnapshotInfo{
+		BaseID:     baseID,
+		BaseHeight: snapshot.Blocks[0].Header.Height,
+		TipID:      snapshot.TipID,
+		Height:     snapshot.Height,
+		Hash:       hash,
+	}
+	infoBytes, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	batch.Put([]byte{snapshotInfoPrefix}, infoBytes)
+
+	// perform the writes
+	wo := opt.WriteOptions{Sync: true}
+	return l.db.Write(batch, &wo)
+}
+
+// GetSnapshotInfo returns information about the snapshot the ledger was started from.
+// It returns nil if the ledger wasn't started from a snapshot.
+func (l LedgerDisk) GetSnapshotInfo() (*SnapshotInfo, error) {
+	infoBytes, err := l.db.Get([]byte{snapshotInfoPrefix}, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info := new(SnapshotInfo)
+	if err := json.Unmarshal(infoBytes, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// MarkSnapshotValidated records that the history preceding the ledger's snapshot has been validated.
+func (l LedgerDisk) MarkSnapshotValidated() error {
+	info, err := l.GetSnapshotInfo()
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return fmt.Errorf("Ledger wasn't started from a snapshot")
+	}
+	info.Validated = true
+	infoBytes, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	wo := opt.WriteOptions{Sync: true}
+	return l.db.Put([]byte{snapshotInfoPrefix}, infoBytes, &wo)
+}
+
 // GetPublicKeyBalanceAt returns the public key balance at the given height.
 // It's only used offline for historical and verification purposes.
 // This is only accurate when the full block chain is indexed (pruning disabled.)
@@ -853,7 +1039,7 @@ func (l LedgerDisk) GetPublicKeyBalanceAt(pubKey ed25519.PublicKey, height int64
 			return 0, err
 		}
 
-		if index == 0 && height > currentHeight-CoinbaseMaturity {
+		if index == 0 && height > currentHeight-l.params.CoinbaseMaturity {
 			// coinbase isn't mature
 			continue
 		}
@@ -915,6 +1101,7 @@ func (l LedgerDisk) Close() error {
 // t{txid}              -> {height}{index} (prunable up to the previous series)
 // k{pk}{height}{index} -> 1 (not strictly necessary. probably should make it optional by flag)
 // b{pk}                -> {balance} (we always need all of this table)
+// S                    -> {snapshot info json} (only when started from a snapshot)
 
 const chainTipPrefix = 'T'
 
@@ -928,6 +1115,8 @@ const pubKeyTransactionIndexPrefix = 'k'
 
 const pubKeyBalancePrefix = 'b'
 
+const snapshotInfoPrefix = 'S'
+
 func computeBranchTypeKey(id BlockID) ([]byte, error) {
 	key := new(bytes.Buffer)
 	if err := key.WriteByte(branchTypePrefix); err != nil {
@@ -0,0 +1,584 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// LedgerMemory is an in-memory implementation of the Ledger interface. It's useful for tests and
+// simulations. It behaves like LedgerDisk including the ordering of public key transaction indices.
+type LedgerMemory struct {
+	params     *ChainParams
+	blockStore BlockStorage
+	prune      bool // prune historic transaction and public key transaction indices
+
+	connectLock   sync.Mutex // serializes connecting and disconnecting blocks
+	lock          sync.RWMutex
+	tipID         *BlockID
+	tipHeight     int64
+	branchTypes   map[BlockID]BranchType
+	heightIndex   map[int64]BlockID
+	txIndex       map[TransactionID]memoryTxIndex
+	pubKeyIndex   map[[ed25519.PublicKeySize]byte][]memoryTxIndex // sorted like LedgerDisk's keys
+	pubKeyBalance map[[ed25519.PublicKeySize]byte]int64
+}
+
+// where a transaction is in the main chain
+type memoryTxIndex struct {
+	height int64
+	index  int
+}
+
+// compare the way LedgerDisk's big-endian encoded keys compare
+func (t memoryTxIndex) less(other memoryTxIndex) bool {
+	if t.height != other.height {
+		return uint64(t.height) < uint64(other.height)
+	}
+	return uint32(int32(t.index)) < uint32(int32(other.index))
+}
+
+// NewLedgerMemory returns a new instance of LedgerMemory.
+func NewLedgerMemory(params *ChainParams, prune bool, blockStore BlockStorage) *LedgerMemory {
+	return &LedgerMemory{
+		params:        params,
+		blockStore:    blockStore,
+		prune:         prune,
+		branchTypes:   make(map[BlockID]BranchType),
+		heightIndex:   make(map[int64]BlockID),
+		txIndex:       make(map[TransactionID]memoryTxIndex),
+		pubKeyIndex:   make(map[[ed25519.PublicKeySize]byte][]memoryTxIndex),
+		pubKeyBalance: make(map[[ed25519.PublicKeySize]byte]int64),
+	}
+}
+
+// GetChainTip returns the ID and the height of the block at the current tip of the main chain.
+func (l *LedgerMemory) GetChainTip() (*BlockID, int64, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.tipID == nil {
+		return nil, 0, nil
+	}
+	tipID := *l.tipID
+	return &tipID, l.tipHeight, nil
+}
+
+// GetBlockIDForHeight returns the ID of the block at the given block chain height.
+func (l *LedgerMemory) GetBlockIDForHeight(height int64) (*BlockID, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	id, ok := l.heightIndex[height]
+	if !ok {
+		return nil, nil
+	}
+	return &id, nil
+}
+
+// SetBranchType sets the branch type for the given block.
+func (l *LedgerMemory) SetBranchType(id BlockID, branchType BranchType) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.branchTypes[id] = branchType
+	return nil
+}
+
+// GetBranchType returns the branch type for the given block.
+func (l *LedgerMemory) GetBranchType(id BlockID) (BranchType, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	branchType, ok := l.branchTypes[id]
+	if !ok {
+		return UNKNOWN, nil
+	}
+	return branchType, nil
+}
+
+// index changes to apply atomically
+type memoryLedgerChanges struct {
+	txIndexPut     map[TransactionID]memoryTxIndex
+	txIndexDelete  []TransactionID
+	pubKeyPut      []memoryPubKeyTxIndex
+	pubKeyDelete   []memoryPubKeyTxIndex
+	balances       map[[ed25519.PublicKeySize]byte]int64
+	heightIndexPut map[int64]BlockID
+	heightDelete   []int64
+}
+
+type memoryPubKeyTxIndex struct {
+	pubKey [ed25519.PublicKeySize]byte
+	memoryTxIndex
+}
+
+func newMemoryLedgerChanges() *memoryLedgerChanges {
+	return &memoryLedgerChanges{
+		txIndexPut:     make(map[TransactionID]memoryTxIndex),
+		heightIndexPut: make(map[int64]BlockID),
+	}
+}
+
+// add or remove the transaction and public key transaction indices of a transaction
+func (c *memoryLedgerChanges) indexTransaction(tx *Transaction, txID TransactionID, height int64, index int, put bool) {
+	txIndex := memoryTxIndex{height: height, index: index}
+	var pubKeys []ed25519.PublicKey
+	if !tx.IsCoinbase() {
+		pubKeys = append(pubKeys, tx.From)
+	}
+	pubKeys = append(pubKeys, tx.To)
+
+	if put {
+		c.txIndexPut[txID] = txIndex
+	} else {
+		c.txIndexDelete = append(c.txIndexDelete, txID)
+	}
+	for _, pubKey := range pubKeys {
+		pkIndex := memoryPubKeyTxIndex{memoryTxIndex: txIndex}
+		copy(pkIndex.pubKey[:], pubKey)
+		if put {
+			c.pubKeyPut = append(c.pubKeyPut, pkIndex)
+		} else {
+			c.pubKeyDelete = append(c.pubKeyDelete, pkIndex)
+		}
+	}
+}
+
+// apply the changes and set the new tip. must be called with the lock held
+func (l *LedgerMemory) apply(c *memoryLedgerChanges, tipID BlockID, tipHeight int64) {
+	for _, txID := range c.txIndexDelete {
+		delete(l.txIndex, txID)
+	}
+	for txID, txIndex := range c.txIndexPut {
+		l.txIndex[txID] = txIndex
+	}
+	for _, pkIndex := range c.pubKeyDelete {
+		indices := l.pubKeyIndex[pkIndex.pubKey]
+		i := sort.Search(len(indices), func(i int) bool {
+			return !indices[i].less(pkIndex.memoryTxIndex)
+		})
+		if i == len(indices) || indices[i] != pkIndex.memoryTxIndex {
+			continue
+		}
+		indices = append(indices[:i], indices[i+1:]...)
+		if len(indices) == 0 {
+			delete(l.pubKeyIndex, pkIndex.pubKey)
+		} else {
+			l.pubKeyIndex[pkIndex.pubKey] = indices
+		}
+	}
+	for _, pkIndex := range c.pubKeyPut {
+		indices := l.pubKeyIndex[pkIndex.pubKey]
+		i := sort.Search(len(indices), func(i int) bool {
+			return !indices[i].less(pkIndex.memoryTxIndex)
+		})
+		if i < len(indices) && indices[i] == pkIndex.memoryTxIndex {
+			continue
+		}
+		indices = append(indices, memoryTxIndex{})
+		copy(indices[i+1:], indices[i:])
+		indices[i] = pkIndex.memoryTxIndex
+		l.pubKeyIndex[pkIndex.pubKey] = indices
+	}
+	for pubKey, balance := range c.balances {
+		if balance == 0 {
+			delete(l.pubKeyBalance, pubKey)
+		} else {
+			l.pubKeyBalance[pubKey] = balance
+		}
+	}
+	for _, height := range c.heightDelete {
+		delete(l.heightIndex, height)
+	}
+	for height, id := range c.heightIndexPut {
+		l.heightIndex[height] = id
+	}
+	l.tipID, l.tipHeight = &tipID, tipHeight
+}
+
+// returns the coinbase maturing or un-maturing when a block at the given height is connected or disconnected
+func (l *LedgerMemory) maturingCoinbase(height int64) (*Transaction, error) {
+	oldID, err := l.GetBlockIDForHeight(height - l.params.CoinbaseMaturity)
+	if err != nil {
+		return nil, err
+	}
+	if oldID == nil {
+		return nil, fmt.Errorf("Missing block at height %d\n", height-l.params.CoinbaseMaturity)
+	}
+	oldTx, _, err := l.blockStore.GetTransaction(*oldID, 0)
+	if err != nil {
+		return nil, err
+	}
+	if oldTx == nil {
+		return nil, fmt.Errorf("Missing coinbase from block %s\n", *oldID)
+	}
+	return oldTx, nil
+}
+
+// ConnectBlock connects a block to the tip of the block chain and applies the transactions to the ledger.
+func (l *LedgerMemory) ConnectBlock(id BlockID, block *Block) ([]TransactionID, error) {
+	l.connectLock.Lock()
+	defer l.connectLock.Unlock()
+
+	// sanity check
+	tipID, _, err := l.GetChainTip()
+	if err != nil {
+		return nil, err
+	}
+	if tipID != nil && *tipID != block.Header.Previous {
+		return nil, fmt.Errorf("Being asked to connect %s but previous %s does not match tip %s",
+			id, block.Header.Previous, *tipID)
+	}
+
+	changes := newMemoryLedgerChanges()
+	balanceCache := NewBalanceCache(l, 0)
+	txIDs := make([]TransactionID, len(block.Transactions))
+
+	for i, tx := range block.Transactions {
+		txID, err := tx.ID()
+		if err != nil {
+			return nil, err
+		}
+		txIDs[i] = txID
+
+		// verify the transaction hasn't been processed already
+		l.lock.RLock()
+		_, processed := l.txIndex[txID]
+		l.lock.RUnlock()
+		if processed {
+			return nil, fmt.Errorf("Transaction %s already processed", txID)
+		}
+		changes.indexTransaction(tx, txID, block.Header.Height, i, true)
+
+		txToApply := tx
+		if tx.IsCoinbase() && l.params.CoinbaseMaturity != 0 {
+			// don't apply a coinbase to a balance until it's mature
+			txToApply = nil
+			if block.Header.Height-l.params.CoinbaseMaturity >= 0 {
+				// mature the coinbase from CoinbaseMaturity blocks ago now
+				if txToApply, err = l.maturingCoinbase(block.Header.Height); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if txToApply != nil {
+			// check sender balance and update sender and receiver balances
+			ok, err := balanceCache.Apply(txToApply)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				txID, _ := txToApply.ID()
+				return nil, fmt.Errorf("Sender has insuffcient balance in transaction %s", txID)
+			}
+		}
+	}
+	changes.balances = balanceCache.Balances()
+
+	// index the block by height
+	changes.heightIndexPut[block.Header.Height] = id
+
+	// prune historic transaction and public key transaction indices now
+	if l.prune && block.Header.Height >= 2*BlocksUntilNewSeries {
+		if err := l.indexBlockAtHeight(block.Header.Height-2*BlocksUntilNewSeries, changes, false); err != nil {
+			return nil, err
+		}
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.apply(changes, id, block.Header.Height)
+
+	// set this block on the main chain
+	l.branchTypes[id] = MAIN
+	return txIDs, nil
+}
+
+// DisconnectBlock disconnects a block from the tip of the block chain and undoes the effects of the transactions on the ledger.
+func (l *LedgerMemory) DisconnectBlock(id BlockID, block *Block) ([]TransactionID, error) {
+	l.connectLock.Lock()
+	defer l.connectLock.Unlock()
+
+	// sanity check
+	tipID, _, err := l.GetChainTip()
+	if err != nil {
+		return nil, err
+	}
+	if tipID == nil {
+		return nil, fmt.Errorf("Being asked to disconnect %s but no tip is currently set",
+			id)
+	}
+	if *tipID != id {
+		return nil, fmt.Errorf("Being asked to disconnect %s but it does not match tip %s",
+			id, *tipID)
+	}
+
+	changes := newMemoryLedgerChanges()
+	balanceCache := NewBalanceCache(l, 0)
+	txIDs := make([]TransactionID, len(block.Transactions))
+
+	// disconnect transactions in reverse order
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+		txID, err := tx.ID()
+		if err != nil {
+			return nil, err
+		}
+		txIDs[i] = txID
+		changes.indexTransaction(tx, txID, block.Header.Height, i, false)
+
+		txToUndo := tx
+		if tx.IsCoinbase() && l.params.CoinbaseMaturity != 0 {
+			// coinbase doesn't affect recipient balance until it's mature
+			txToUndo = nil
+			if block.Header.Height-l.params.CoinbaseMaturity >= 0 {
+				// undo the effect of the coinbase from CoinbaseMaturity blocks ago now
+				if txToUndo, err = l.maturingCoinbase(block.Header.Height); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if txToUndo != nil {
+			// credit sender and debit recipient
+			if err := balanceCache.Undo(txToUndo); err != nil {
+				return nil, err
+			}
+		}
+	}
+	changes.balances = balanceCache.Balances()
+
+	// remove this block's index by height
+	changes.heightDelete = append(changes.heightDelete, block.Header.Height)
+
+	// restore historic indices now
+	if l.prune && block.Header.Height >= 2*BlocksUntilNewSeries {
+		if err := l.indexBlockAtHeight(block.Header.Height-2*BlocksUntilNewSeries, changes, true); err != nil {
+			return nil, err
+		}
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.apply(changes, block.Header.Previous, block.Header.Height-1)
+
+	// set this block on a side chain
+	l.branchTypes[id] = SIDE
+	return txIDs, nil
+}
+
+// Restore or prune the transaction and public key transaction indices created by the block at the given height
+func (l *LedgerMemory) indexBlockAtHeight(height int64, changes *memoryLedgerChanges, put bool) error {
+	// get the ID
+	id, err := l.GetBlockIDForHeight(height)
+	if err != nil {
+		return err
+	}
+	if id == nil {
+		return fmt.Errorf("Missing block ID for height %d\n", height)
+	}
+
+	// fetch the block
+	block, err := l.blockStore.GetBlock(*id)
+	if err != nil {
+		return err
+	}
+	if block == nil {
+		return fmt.Errorf("Missing block %s\n", *id)
+	}
+
+	for i, tx := range block.Transactions {
+		txID, err := tx.ID()
+		if err != nil {
+			return err
+		}
+		changes.indexTransaction(tx, txID, block.Header.Height, i, put)
+	}
+	return nil
+}
+
+// GetPublicKeyBalance returns the current balance of a given public key.
+func (l *LedgerMemory) GetPublicKeyBalance(pubKey ed25519.PublicKey) (int64, error) {
+	var pk [ed25519.PublicKeySize]byte
+	copy(pk[:], pubKey)
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.pubKeyBalance[pk], nil
+}
+
+// GetPublicKeyBalances returns the current balance of the given public keys
+// along with block ID and height of the corresponding main chain tip.
+func (l *LedgerMemory) GetPublicKeyBalances(pubKeys []ed25519.PublicKey) (
+	map[[ed25519.PublicKeySize]byte]int64, *BlockID, int64, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	balances := make(map[[ed25519.PublicKeySize]byte]int64)
+	for _, pubKey := range pubKeys {
+		var pk [ed25519.PublicKeySize]byte
+		copy(pk[:], pubKey)
+		balances[pk] = l.pubKeyBalance[pk]
+	}
+
+	if l.tipID == nil {
+		return balances, nil, 0, nil
+	}
+	tipID := *l.tipID
+	return balances, &tipID, l.tipHeight, nil
+}
+
+// GetTransactionIndex returns the index of a processed transaction.
+func (l *LedgerMemory) GetTransactionIndex(id TransactionID) (*BlockID, int, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	txIndex, ok := l.txIndex[id]
+	if !ok {
+		return nil, 0, nil
+	}
+	blockID, ok := l.heightIndex[txIndex.height]
+	if !ok {
+		return nil, txIndex.index, nil
+	}
+	return &blockID, txIndex.index, nil
+}
+
+// GetPublicKeyTransactionIndicesRange returns transaction indices involving a given public key
+// over a range of heights. If startHeight > endHeight this iterates in reverse.
+func (l *LedgerMemory) GetPublicKeyTransactionIndicesRange(
+	pubKey ed25519.PublicKey, startHeight, endHeight int64, startIndex, limit int) (
+	ids []BlockID, indices []int, lastHeight int64, lastIndex int, err error) {
+	var pk [ed25519.PublicKeySize]byte
+	copy(pk[:], pubKey)
+
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	pkIndices := l.pubKeyIndex[pk]
+
+	// called for each index in range. returns false when the limit is reached
+	add := func(txIndex memoryTxIndex) (bool, error) {
+		id, ok := l.heightIndex[txIndex.height]
+		if !ok {
+			return false, fmt.Errorf("No block found at height %d", txIndex.height)
+		}
+		lastHeight, lastIndex = txIndex.height, txIndex.index
+		ids = append(ids, id)
+		indices = append(indices, txIndex.index)
+		return limit == 0 || len(indices) != limit, nil
+	}
+
+	if endHeight >= startHeight {
+		// forward from the start height and index through the end height inclusive
+		start := memoryTxIndex{height: startHeight, index: startIndex}
+		limitHeight := uint64(endHeight + 1)
+		i := sort.Search(len(pkIndices), func(i int) bool {
+			return !pkIndices[i].less(start)
+		})
+		for ; i < len(pkIndices) && uint64(pkIndices[i].height) < limitHeight; i++ {
+			more, err := add(pkIndices[i])
+			if err != nil {
+				return nil, nil, 0, 0, err
+			}
+			if !more {
+				break
+			}
+		}
+		return
+	}
+
+	// reverse from the start height and index inclusive through the end height
+	start := memoryTxIndex{height: startHeight, index: startIndex + 1}
+	i := sort.Search(len(pkIndices), func(i int) bool {
+		return !pkIndices[i].less(start)
+	}) - 1
+	for ; i >= 0 && uint64(pkIndices[i].height) >= uint64(endHeight); i-- {
+		more, err := add(pkIndices[i])
+		if err != nil {
+			return nil, nil, 0, 0, err
+		}
+		if !more {
+			break
+		}
+	}
+	return
+}
+
+// Balance returns the total current ledger balance by summing the balance of all public keys.
+// It's only used offline for verification purposes.
+func (l *LedgerMemory) Balance() (int64, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	var total int64
+	for _, balance := range l.pubKeyBalance {
+		total += balance
+	}
+	return total, nil
+}
+
+// GetPublicKeyBalanceAt returns the public key balance at the given height.
+// It's only used offline for historical and verification purposes.
+// This is only accurate when the full block chain is indexed (pruning disabled.)
+func (l *LedgerMemory) GetPublicKeyBalanceAt(pubKey ed25519.PublicKey, height int64) (int64, error) {
+	var pk [ed25519.PublicKeySize]byte
+	copy(pk[:], pubKey)
+
+	// find the transactions with the lock held
+	type txRef struct {
+		id    BlockID
+		index int
+	}
+	var refs []txRef
+	l.lock.RLock()
+	limitHeight := uint64(height + 1)
+	for _, txIndex := range l.pubKeyIndex[pk] {
+		if uint64(txIndex.height) >= limitHeight {
+			break
+		}
+		if txIndex.index == 0 && txIndex.height > l.tipHeight-l.params.CoinbaseMaturity {
+			// coinbase isn't mature
+			continue
+		}
+		id, ok := l.heightIndex[txIndex.height]
+		if !ok {
+			l.lock.RUnlock()
+			return 0, fmt.Errorf("No block found at height %d", txIndex.height)
+		}
+		refs = append(refs, txRef{id: id, index: txIndex.index})
+	}
+	l.lock.RUnlock()
+
+	var balance int64
+	for _, ref := range refs {
+		tx, _, err := l.blockStore.GetTransaction(ref.id, ref.index)
+		if err != nil {
+			return 0, err
+		}
+		if tx == nil {
+			return 0, fmt.Errorf("No transaction found in block %s at index %d",
+				ref.id, ref.index)
+		}
+
+		if bytes.Equal(pubKey, tx.To) {
+			balance += tx.Amount
+		} else if bytes.Equal(pubKey, tx.From) {
+			balance -= tx.Amount
+			balance -= tx.Fee
+			if balance < 0 {
+				txID, _ := tx.ID()
+				return 0, fmt.Errorf("Balance went negative at transaction %s", txID)
+			}
+		} else {
+			txID, _ := tx.ID()
+			return 0, fmt.Errorf("Transaction %s doesn't involve the public key", txID)
+		}
+	}
+	return balance, nil
+}
+
+// Close is a no-op. It's here so the memory ledger can stand in for the on-disk ledger.
+func (l *LedgerMemory) Close() error {
+	return nil
+}
@@ -0,0 +1,284 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// every Ledger implementation must pass this
+func TestLedgerConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	params := *RegTestParams
+	params.CoinbaseMaturity = 2
+
+	t.Run("disk", func(t *testing.T) {
+		blockStore, err := NewBlockStorageDisk(filepath.Join(dir, "blocks"), filepath.Join(dir, "headers.db"),
+			false, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer blockStore.Close()
+		ledger, err := NewLedgerDisk(&params, filepath.Join(dir, "ledger.db"), false, false, blockStore)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ledger.Close()
+		testLedger(t, &params, blockStore, ledger)
+	})
+	t.Run("memory", func(t *testing.T) {
+		blockStore := NewBlockStorageMemory()
+		testLedger(t, &params, blockStore, NewLedgerMemory(&params, false, blockStore))
+	})
+}
+
+func testLedger(t *testing.T, params *ChainParams, blockStore BlockStorage, ledger Ledger) {
+	genesis, genesisID, err := params.GenesisBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey2, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey3, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tipID, _, err := ledger.GetChainTip(); err != nil || tipID != nil {
+		t.Fatalf("Expected no tip, found %v %v", tipID, err)
+	}
+
+	// pubKey mines every block and spends a matured coinbase at height 4
+	tx := NewTransaction(pubKey, pubKey2, CruzbitsPerCruz, MinFeeCruzbits, 0, 0, 4, "")
+	if err := tx.Sign(privKey); err != nil {
+		t.Fatal(err)
+	}
+	blocks, ids := []*Block{genesis}, []BlockID{genesisID}
+	for height := int64(1); height <= 6; height++ {
+		var txs []*Transaction
+		if height == 4 {
+			txs = append(txs, tx)
+		}
+		block, id := mineTestBlock(t, blocks[height-1], ids[height-1], pubKey, txs...)
+		blocks, ids = append(blocks, block), append(ids, id)
+	}
+	for i, block := range blocks {
+		if err := blockStore.Store(ids[i], block, 0); err != nil {
+			t.Fatal(err)
+		}
+		txIDs, err := ledger.ConnectBlock(ids[i], block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(txIDs) != len(block.Transactions) {
+			t.Fatalf("Expected %d transaction IDs, found %d", len(block.Transactions), len(txIDs))
+		}
+	}
+
+	// tip and height index
+	if tipID, tipHeight, err := ledger.GetChainTip(); err != nil || *tipID != ids[6] || tipHeight != 6 {
+		t.Fatalf("Expected tip %s at 6, found %v %d %v", ids[6], tipID, tipHeight, err)
+	}
+	for height, id := range ids {
+		if found, err := ledger.GetBlockIDForHeight(int64(height)); err != nil || *found != id {
+			t.Fatalf("Expected block %s at height %d, found %v %v", id, height, found, err)
+		}
+	}
+	if found, err := ledger.GetBlockIDForHeight(7); err != nil || found != nil {
+		t.Fatalf("Expected no block at height 7, found %v %v", found, err)
+	}
+
+	// branch types
+	for _, id := range ids {
+		checkTestBranchType(t, ledger, id, MAIN)
+	}
+	var other BlockID
+	other[0] = 1
+	checkTestBranchType(t, ledger, other, UNKNOWN)
+	if err := ledger.SetBranchType(other, ORPHAN); err != nil {
+		t.Fatal(err)
+	}
+	checkTestBranchType(t, ledger, other, ORPHAN)
+	if err := ledger.SetBranchType(other, SIDE); err != nil {
+		t.Fatal(err)
+	}
+	checkTestBranchType(t, ledger, other, SIDE)
+
+	// balances. coinbases are applied once they're 2 blocks deep
+	coinbase := func(height int) int64 {
+		return blocks[height].Transactions[0].Amount
+	}
+	expect := coinbase(1) + coinbase(2) + coinbase(3) + coinbase(4) - tx.Amount - tx.Fee
+	checkTestBalance(t, ledger, pubKey, expect)
+	checkTestBalance(t, ledger, pubKey2, tx.Amount)
+	checkTestBalance(t, ledger, pubKey3, 0)
+	balances, tipID, tipHeight, err := ledger.GetPublicKeyBalances(
+		[]ed25519.PublicKey{pubKey, pubKey2, pubKey3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pk, pk2, pk3 [ed25519.PublicKeySize]byte
+	copy(pk[:], pubKey)
+	copy(pk2[:], pubKey2)
+	copy(pk3[:], pubKey3)
+	expectBalances := map[[ed25519.PublicKeySize]byte]int64{pk: expect, pk2: tx.Amount, pk3: 0}
+	if !reflect.DeepEqual(balances, expectBalances) || *tipID != ids[6] || tipHeight != 6 {
+		t.Fatalf("Unexpected balances %v at %v %d", balances, tipID, tipHeight)
+	}
+	total, err := ledger.Balance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expectTotal := coinbase(0) + coinbase(1) + coinbase(2) + coinbase(3) + coinbase(4) - tx.Fee; total != expectTotal {
+		t.Fatalf("Expected total balance %d, found %d", expectTotal, total)
+	}
+
+	// historic balances only count mature coinbases
+	for height, expect := range map[int64]int64{
+		0: 0,
+		1: coinbase(1),
+		3: coinbase(1) + coinbase(2) + coinbase(3),
+		4: coinbase(1) + coinbase(2) + coinbase(3) + coinbase(4) - tx.Amount - tx.Fee,
+		6: expect,
+	} {
+		if balance, err := ledger.GetPublicKeyBalanceAt(pubKey, height); err != nil || balance != expect {
+			t.Fatalf("Expected balance %d at height %d, found %d %v", expect, height, balance, err)
+		}
+	}
+	if balance, err := ledger.GetPublicKeyBalanceAt(pubKey2, 3); err != nil || balance != 0 {
+		t.Fatalf("Expected balance 0 at height 3, found %d %v", balance, err)
+	}
+
+	// transaction index
+	txID, err := tx.ID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blockID, index, err := ledger.GetTransactionIndex(txID); err != nil || *blockID != ids[4] || index != 1 {
+		t.Fatalf("Expected transaction at %s index 1, found %v %d %v", ids[4], blockID, index, err)
+	}
+	if blockID, _, err := ledger.GetTransactionIndex(TransactionID{}); err != nil || blockID != nil {
+		t.Fatalf("Expected no transaction, found %v %v", blockID, err)
+	}
+
+	// public key transaction index ranges
+	type txRef struct {
+		height int64
+		index  int
+	}
+	checkRange := func(pubKey ed25519.PublicKey, startHeight, endHeight int64, startIndex, limit int, expect ...txRef) {
+		foundIDs, indices, lastHeight, lastIndex, err := ledger.GetPublicKeyTransactionIndicesRange(
+			pubKey, startHeight, endHeight, startIndex, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(foundIDs) != len(expect) || len(indices) != len(expect) {
+			t.Fatalf("Expected %d transactions from %d to %d, found %d", len(expect), startHeight, endHeight, len(indices))
+		}
+		for i, ref := range expect {
+			if foundIDs[i] != ids[ref.height] || indices[i] != ref.index {
+				t.Fatalf("Expected transaction %d at %d index %d, found %s index %d",
+					i, ref.height, ref.index, foundIDs[i], indices[i])
+			}
+		}
+		var last txRef
+		if len(expect) != 0 {
+			last = expect[len(expect)-1]
+		}
+		if lastHeight != last.height || lastIndex != last.index {
+			t.Fatalf("Expected to stop at %d index %d, found %d index %d", last.height, last.index, lastHeight, lastIndex)
+		}
+	}
+	checkRange(pubKey, 0, 6, 0, 0, txRef{1, 0}, txRef{2, 0}, txRef{3, 0}, txRef{4, 0}, txRef{4, 1}, txRef{5, 0}, txRef{6, 0})
+	checkRange(pubKey, 0, 6, 0, 3, txRef{1, 0}, txRef{2, 0}, txRef{3, 0})
+	checkRange(pubKey, 4, 5, 1, 0, txRef{4, 1}, txRef{5, 0})
+	checkRange(pubKey, 6, 0, 0, 0, txRef{6, 0}, txRef{5, 0}, txRef{4, 1}, txRef{4, 0}, txRef{3, 0}, txRef{2, 0}, txRef{1, 0})
+	checkRange(pubKey, 6, 0, 0, 2, txRef{6, 0}, txRef{5, 0})
+	checkRange(pubKey, 4, 3, 0, 0, txRef{4, 0}, txRef{3, 0})
+	checkRange(pubKey2, 0, 6, 0, 0, txRef{4, 1})
+	checkRange(pubKey2, 5, 6, 0, 0)
+	checkRange(pubKey3, 0, 6, 0, 0)
+
+	// failures leave the ledger unchanged
+	if _, err := ledger.DisconnectBlock(ids[5], blocks[5]); err == nil {
+		t.Fatal("Expected an error disconnecting a block other than the tip")
+	}
+	if _, err := ledger.ConnectBlock(ids[6], blocks[6]); err == nil {
+		t.Fatal("Expected an error connecting a block which doesn't extend the tip")
+	}
+	replay, replayID := mineTestBlock(t, blocks[6], ids[6], pubKey, tx)
+	if _, err := ledger.ConnectBlock(replayID, replay); err == nil {
+		t.Fatal("Expected an error connecting a block with a processed transaction")
+	}
+	if tipID, _, err := ledger.GetChainTip(); err != nil || *tipID != ids[6] {
+		t.Fatalf("Expected tip %s, found %v %v", ids[6], tipID, err)
+	}
+	checkTestBalance(t, ledger, pubKey, expect)
+
+	// disconnect the tip
+	txIDs, err := ledger.DisconnectBlock(ids[6], blocks[6])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if coinbaseID, _ := blocks[6].Transactions[0].ID(); len(txIDs) != 1 || txIDs[0] != coinbaseID {
+		t.Fatalf("Unexpected disconnected transactions %v", txIDs)
+	}
+	if tipID, tipHeight, err := ledger.GetChainTip(); err != nil || *tipID != ids[5] || tipHeight != 5 {
+		t.Fatalf("Expected tip %s at 5, found %v %d %v", ids[5], tipID, tipHeight, err)
+	}
+	if found, err := ledger.GetBlockIDForHeight(6); err != nil || found != nil {
+		t.Fatalf("Expected no block at height 6, found %v %v", found, err)
+	}
+	checkTestBranchType(t, ledger, ids[6], SIDE)
+	checkTestBalance(t, ledger, pubKey, expect-coinbase(4))
+	if blockID, _, err := ledger.GetTransactionIndex(txIDs[0]); err != nil || blockID != nil {
+		t.Fatalf("Expected no transaction, found %v %v", blockID, err)
+	}
+	checkRange(pubKey, 6, 0, 0, 2, txRef{5, 0}, txRef{4, 1})
+
+	// and reconnect it
+	if _, err := ledger.ConnectBlock(ids[6], blocks[6]); err != nil {
+		t.Fatal(err)
+	}
+	checkTestBranchType(t, ledger, ids[6], MAIN)
+	checkTestBalance(t, ledger, pubKey, expect)
+	checkRange(pubKey, 6, 0, 0, 2, txRef{6, 0}, txRef{5, 0})
+}
+
+func checkTestBranchType(t *testing.T, ledger Ledger, id BlockID, expect BranchType) {
+	branchType, err := ledger.GetBranchType(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if branchType != expect {
+		t.Fatalf("Expected branch type %d for %s, found %d", expect, id, branchType)
+	}
+}
+
+func checkTestBalance(t *testing.T, ledger Ledger, pubKey ed25519.PublicKey, expect int64) {
+	balance, err := ledger.GetPublicKeyBalance(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != expect {
+		t.Fatalf("Expected balance %d, found %d", expect, balance)
+	}
+}
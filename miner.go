@@ -15,6 +15,7 @@ import (
 
 // Miner tries to mine a new tip block.
 type Miner struct {
+	params         *ChainParams
 	pubKeys        []ed25519.PublicKey // receipients of any block rewards we mine
 	memo           string              // memo for coinbase of any blocks we mine
 	blockStore     BlockStorage
@@ -36,11 +37,12 @@ type HashrateMonitor struct {
 }
 
 // NewMiner returns a new Miner instance.
-func NewMiner(pubKeys []ed25519.PublicKey, memo string,
+func NewMiner(params *ChainParams, pubKeys []ed25519.PublicKey, memo string,
 	blockStore BlockStorage, txQueue TransactionQueue,
 	ledger Ledger, processor *Processor,
 	hashUpdateChan chan int64, num int) *Miner {
 	return &Miner{
+		params:         params,
 		pubKeys:        pubKeys,
 		memo:           memo,
 		blockStore:     blockStore,
@@ -76,7 +78,7 @@ func (m *Miner) run() {
 
 	// don't start mining until we think we're synced.
 	// we're just wasting time and slowing down the sync otherwise
-	ibd, _, err := IsInitialBlockDownload(m.ledger, m.blockStore)
+	ibd, _, err := IsInitialBlockDownload(m.params, m.ledger, m.blockStore)
 	if err != nil {
 		panic(err)
 	}
@@ -92,7 +94,7 @@ func (m *Miner) run() {
 				}
 			case <-ticker.C:
 				var err error
-				ibd, _, err = IsInitialBlockDownload(m.ledger, m.blockStore)
+				ibd, _, err = IsInitialBlockDownload(m.params, m.ledger, m.blockStore)
 				if err != nil {
 					panic(err)
 				}
@@ -248,11 +250,11 @@ func (m *Miner) Shutdown() {
 func (m *Miner) createNextBlock(tipID BlockID, tipHeader *BlockHeader) (*Block, error) {
 	log.Printf("Miner %d mining new block from current tip %s\n", m.num, tipID)
 	pubKey := m.pubKeys[m.keyIndex]
-	return createNextBlock(tipID, tipHeader, m.txQueue, m.blockStore, m.ledger, pubKey, m.memo)
+	return createNextBlock(m.params, tipID, tipHeader, m.txQueue, m.blockStore, m.ledger, pubKey, m.memo)
 }
 
 // Called by the miner as well as the peer to support get_work.
-func createNextBlock(tipID BlockID, tipHeader *BlockHeader, txQueue TransactionQueue,
+func createNextBlock(params *ChainParams, tipID BlockID, tipHeader *BlockHeader, txQueue TransactionQueue,
 	blockStore BlockStorage, ledger Ledger, pubKey ed25519.PublicKey, memo string) (*Block, error) {
 
 	// fetch transactions to confirm from the queue
@@ -275,7 +277,7 @@ func createNextBlock(tipID BlockID, tipHeader *BlockHeader, txQueue TransactionQ
 	txs = append([]*Transaction{tx}, txs...)
 
 	// compute the next target
-	newTarget, err := computeTarget(tipHeader, blockStore, ledger)
+	newTarget, err := computeTarget(params, tipHeader, blockStore, ledger)
 	if err != nil {
 		return nil, err
 	}
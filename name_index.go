@@ -0,0 +1,299 @@
+package cruzbit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Names are registered with the same labelling transactions used to label keys, i.e. a key
+// sending a transaction to "//alice//000...=". The rules are applied in block and transaction order:
+//
+//   - The first key to label itself with an unregistered or expired name registers it.
+//   - The holder labelling itself with the name again renews it. Other keys doing so only
+//     change their own label; the name continues to resolve to the holder.
+//   - A registration expires NameExpiryBlocks after it was last renewed or transferred.
+//   - The holder transfers a name by sending a transaction to the new holder with the memo
+//     NameTransferMemoPrefix followed by the name. A transfer renews the name.
+//
+// Names are case-insensitive.
+const (
+	// NameExpiryBlocks is the number of blocks a name registration lasts without renewal.
+	NameExpiryBlocks = 52560 // 1 year in blocks
+
+	// NameTransferMemoPrefix followed by a name transfers the name to the recipient.
+	NameTransferMemoPrefix = "//name//"
+)
+
+// the number of connected blocks we can undo
+const nameUndoDepth = 1000
+
+type nameRecord struct {
+	holder      string
+	claimHeight int64
+	renewHeight int64
+}
+
+// the state of a name before a block changed it
+type nameUndo struct {
+	name   string
+	record *nameRecord
+}
+
+// NameIndex is the index module which resolves registered names to public keys.
+type NameIndex struct {
+	latestBlockID BlockID
+	latestHeight  int64
+	names         map[string]*nameRecord
+	undo          map[BlockID][]nameUndo
+	undoOrder     []BlockID
+	lock          sync.RWMutex
+}
+
+// NewNameIndex returns a new, empty NameIndex.
+func NewNameIndex() *NameIndex {
+	return &NameIndex{
+		names: make(map[string]*nameRecord),
+		undo:  make(map[BlockID][]nameUndo),
+	}
+}
+
+// Name implements IndexModule.
+func (idx *NameIndex) Name() string {
+	return "names"
+}
+
+// ConnectBlock implements IndexModule.
+func (idx *NameIndex) ConnectBlock(id BlockID, block *Block) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	height := block.Header.Height
+	var undo []nameUndo
+	update := func(name string, record *nameRecord) {
+		undo = append(undo, nameUndo{name: name, record: idx.names[name]})
+		idx.names[name] = record
+	}
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+		from := pubKeyToString(tx.From)
+
+		if ok, label := isLabelling(pubKeyToString(tx.To)); ok {
+			name := normalizeLabel(label)
+			if len(name) == 0 {
+				continue
+			}
+			record := idx.names[name]
+			if record == nil || record.expired(height) {
+				// first claim
+				update(name, &nameRecord{holder: from, claimHeight: height, renewHeight: height})
+			} else if record.holder == from {
+				// renewal
+				update(name, &nameRecord{holder: from, claimHeight: record.claimHeight, renewHeight: height})
+			}
+			continue
+		}
+
+		if strings.HasPrefix(tx.Memo, NameTransferMemoPrefix) {
+			name := normalizeLabel(strings.TrimPrefix(tx.Memo, NameTransferMemoPrefix))
+			record := idx.names[name]
+			if record != nil && !record.expired(height) && record.holder == from {
+				update(name, &nameRecord{holder: pubKeyToString(tx.To), claimHeight: height, renewHeight: height})
+			}
+		}
+	}
+
+	idx.undo[id] = undo
+	idx.undoOrder = append(idx.undoOrder, id)
+	if len(idx.undoOrder) > nameUndoDepth {
+		delete(idx.undo, idx.undoOrder[0])
+		idx.undoOrder = idx.undoOrder[1:]
+	}
+
+	idx.latestBlockID = id
+	idx.latestHeight = height
+	return nil
+}
+
+// DisconnectBlock implements IndexModule.
+func (idx *NameIndex) DisconnectBlock(id BlockID, block *Block) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	undo, ok := idx.undo[id]
+	if !ok {
+		return fmt.Errorf("No undo information for block %s", id)
+	}
+	for i := len(undo) - 1; i >= 0; i-- {
+		if undo[i].record == nil {
+			delete(idx.names, undo[i].name)
+		} else {
+			idx.names[undo[i].name] = undo[i].record
+		}
+	}
+	delete(idx.undo, id)
+	if n := len(idx.undoOrder); n != 0 && idx.undoOrder[n-1] == id {
+		idx.undoOrder = idx.undoOrder[:n-1]
+	}
+
+	idx.latestBlockID = block.Header.Previous
+	idx.latestHeight = block.Header.Height - 1
+	return nil
+}
+
+// Persist implements IndexModule. The name index is held in memory.
+func (idx *NameIndex) Persist() error {
+	return nil
+}
+
+// the saved form of the name index
+type nameIndexState struct {
+	LatestBlockID BlockID                    `json:"latest_block_id"`
+	LatestHeight  int64                      `json:"latest_height"`
+	Names         map[string]nameRecordState `json:"names"`
+	Undo          []nameUndoState            `json:"undo"` // oldest first
+}
+
+type nameRecordState struct {
+	Holder      string `json:"holder"`
+	ClaimHeight int64  `json:"claim_height"`
+	RenewHeight int64  `json:"renew_height"`
+}
+
+type nameUndoState struct {
+	BlockID BlockID            `json:"block_id"`
+	Names   []string           `json:"names"`
+	Records []*nameRecordState `json:"records"` // nil if the name wasn't registered
+}
+
+// SaveState implements PersistentIndexModule.
+func (idx *NameIndex) SaveState(w io.Writer) error {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	state := nameIndexState{
+		LatestBlockID: idx.latestBlockID,
+		LatestHeight:  idx.latestHeight,
+		Names:         make(map[string]nameRecordState),
+	}
+	for name, record := range idx.names {
+		state.Names[name] = nameRecordState{record.holder, record.claimHeight, record.renewHeight}
+	}
+	for _, id := range idx.undoOrder {
+		undoState := nameUndoState{BlockID: id}
+		for _, undo := range idx.undo[id] {
+			var record *nameRecordState
+			if undo.record != nil {
+				record = &nameRecordState{undo.record.holder, undo.record.claimHeight, undo.record.renewHeight}
+			}
+			undoState.Names = append(undoState.Names, undo.name)
+			undoState.Records = append(undoState.Records, record)
+		}
+		state.Undo = append(state.Undo, undoState)
+	}
+	return json.NewEncoder(w).Encode(state)
+}
+
+// LoadState implements PersistentIndexModule.
+func (idx *NameIndex) LoadState(r io.Reader) error {
+	var state nameIndexState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return err
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	idx.latestBlockID = state.LatestBlockID
+	idx.latestHeight = state.LatestHeight
+	idx.names = make(map[string]*nameRecord)
+	for name, record := range state.Names {
+		idx.names[name] = &nameRecord{record.Holder, record.ClaimHeight, record.RenewHeight}
+	}
+	idx.undo = make(map[BlockID][]nameUndo)
+	idx.undoOrder = nil
+	for _, undoState := range state.Undo {
+		if len(undoState.Names) != len(undoState.Records) {
+			return fmt.Errorf("Invalid undo information for block %s", undoState.BlockID)
+		}
+		var undo []nameUndo
+		for i, name := range undoState.Names {
+			var record *nameRecord
+			if r := undoState.Records[i]; r != nil {
+				record = &nameRecord{r.Holder, r.ClaimHeight, r.RenewHeight}
+			}
+			undo = append(undo, nameUndo{name: name, record: record})
+		}
+		idx.undo[undoState.BlockID] = undo
+		idx.undoOrder = append(idx.undoOrder, undoState.BlockID)
+	}
+	return nil
+}
+
+// QueryTypes implements IndexModule.
+func (idx *NameIndex) QueryTypes() []string {
+	return []string{"resolve_name"}
+}
+
+// HandleQuery implements IndexModule.
+func (idx *NameIndex) HandleQuery(messageType string, body json.RawMessage, outChan chan<- Message) error {
+	if messageType != "resolve_name" {
+		return fmt.Errorf("Unsupported query: %s", messageType)
+	}
+	var rn ResolveNameMessage
+	if err := json.Unmarshal(body, &rn); err != nil {
+		return err
+	}
+	return idx.onResolveName(rn.Name, outChan)
+}
+
+func (r *nameRecord) expired(height int64) bool {
+	return height >= r.renewHeight+NameExpiryBlocks
+}
+
+// ResolveName returns the current registration of a name along with the ID and height
+// of the latest indexed block.
+func (idx *NameIndex) ResolveName(name string) (*NameRecord, BlockID, int64, error) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	record, ok := idx.names[normalizeLabel(name)]
+	if !ok || record.expired(idx.latestHeight+1) {
+		return nil, idx.latestBlockID, idx.latestHeight, fmt.Errorf("Name %s is not registered", name)
+	}
+	pubKey, err := pubKeyFromString(record.holder)
+	if err != nil {
+		return nil, idx.latestBlockID, idx.latestHeight, err
+	}
+	return &NameRecord{
+		PublicKey:     pubKey,
+		ClaimHeight:   record.claimHeight,
+		RenewHeight:   record.renewHeight,
+		ExpiresHeight: record.renewHeight + NameExpiryBlocks,
+	}, idx.latestBlockID, idx.latestHeight, nil
+}
+
+// Handle a request to resolve a name
+func (idx *NameIndex) onResolveName(name string, outChan chan<- Message) error {
+	record, blockID, height, err := idx.ResolveName(name)
+	if err != nil {
+		outChan <- Message{Type: "resolved_name", Body: ResolvedNameMessage{Name: name, Error: err.Error()}}
+		return err
+	}
+
+	outChan <- Message{
+		Type: "resolved_name",
+		Body: ResolvedNameMessage{
+			BlockID: blockID,
+			Height:  height,
+			Name:    name,
+			Record:  record,
+		},
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// connect the transactions as a block at the given height
+func connectTestNames(t *testing.T, idx *NameIndex, height int64, txs ...*Transaction) *Block {
+	block := &Block{Header: &BlockHeader{Height: height, Previous: BlockID{byte(height - 1)}}, Transactions: txs}
+	if err := idx.ConnectBlock(BlockID{byte(height)}, block); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func checkTestName(t *testing.T, idx *NameIndex, name string, holder ed25519.PublicKey) {
+	record, _, _, err := idx.ResolveName(name)
+	if holder == nil {
+		if err == nil {
+			t.Fatalf("Expected %s to be unregistered", name)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(record.PublicKey, holder) {
+		t.Fatalf("Expected %s to resolve to %s, found %s", name,
+			pubKeyToString(holder), pubKeyToString(record.PublicKey))
+	}
+}
+
+func TestNameIndex(t *testing.T) {
+	idx := NewNameIndex()
+	alice, bob, carol := makeTestKey(t), makeTestKey(t), makeTestKey(t)
+	label := makeTestPathKey(t, "//alice//")
+
+	// first claim wins, even within the same block
+	connectTestNames(t, idx, 1,
+		&Transaction{From: alice, To: label, Amount: 1, Series: 1},
+		&Transaction{From: bob, To: label, Amount: 1, Series: 1},
+	)
+	checkTestName(t, idx, "alice", alice)
+	checkTestName(t, idx, " ALICE ", alice)
+	checkTestName(t, idx, "bob", nil)
+
+	// renewal extends the registration
+	connectTestNames(t, idx, 10, &Transaction{From: alice, To: label, Amount: 1, Series: 1})
+	record, _, _, err := idx.ResolveName("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.ClaimHeight != 1 || record.RenewHeight != 10 || record.ExpiresHeight != 10+NameExpiryBlocks {
+		t.Fatalf("Unexpected record %v", record)
+	}
+
+	// only the holder can transfer
+	transfer := connectTestNames(t, idx, 11,
+		&Transaction{From: bob, To: bob, Amount: 1, Memo: NameTransferMemoPrefix + "alice", Series: 1},
+		&Transaction{From: alice, To: carol, Amount: 1, Memo: NameTransferMemoPrefix + "Alice", Series: 1},
+	)
+	checkTestName(t, idx, "alice", carol)
+
+	// disconnecting restores the previous holder
+	if err := idx.DisconnectBlock(BlockID{11}, transfer); err != nil {
+		t.Fatal(err)
+	}
+	checkTestName(t, idx, "alice", alice)
+	if idx.latestHeight != 10 {
+		t.Fatalf("Expected height 10, found %d", idx.latestHeight)
+	}
+	if err := idx.DisconnectBlock(BlockID{11}, transfer); err == nil {
+		t.Fatal("Expected disconnecting an unknown block to fail")
+	}
+
+	// expired names can be claimed by someone else
+	expiry := 10 + NameExpiryBlocks
+	connectTestNames(t, idx, int64(expiry-2))
+	checkTestName(t, idx, "alice", alice)
+	connectTestNames(t, idx, int64(expiry-1))
+	checkTestName(t, idx, "alice", nil)
+	connectTestNames(t, idx, int64(expiry), &Transaction{From: bob, To: label, Amount: 1, Series: 1})
+	checkTestName(t, idx, "alice", bob)
+}
+
+func TestNameIndexState(t *testing.T) {
+	idx := NewNameIndex()
+	alice, carol := makeTestKey(t), makeTestKey(t)
+	connectTestNames(t, idx, 1, &Transaction{From: alice, To: makeTestPathKey(t, "//alice//"), Amount: 1, Series: 1})
+	transfer := connectTestNames(t, idx, 2,
+		&Transaction{From: alice, To: carol, Amount: 1, Memo: NameTransferMemoPrefix + "alice", Series: 1})
+
+	buf := new(bytes.Buffer)
+	if err := idx.SaveState(buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewNameIndex()
+	if err := restored.LoadState(buf); err != nil {
+		t.Fatal(err)
+	}
+	checkTestName(t, restored, "alice", carol)
+	if restored.latestBlockID != (BlockID{2}) || restored.latestHeight != 2 {
+		t.Fatalf("Expected latest block 2, found %s at %d", restored.latestBlockID, restored.latestHeight)
+	}
+
+	// undo information survives
+	if err := restored.DisconnectBlock(BlockID{2}, transfer); err != nil {
+		t.Fatal(err)
+	}
+	checkTestName(t, restored, "alice", alice)
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"sync"
@@ -24,6 +25,7 @@ import (
 // Peers could be fully validating and mining nodes or simply wallets.
 type Peer struct {
 	conn                          *websocket.Conn
+	params                        *ChainParams
 	genesisID                     BlockID
 	peerStore                     PeerStorage
 	blockStore                    BlockStorage
@@ -35,6 +37,10 @@ type Peer struct {
 	localDownloadQueue            *BlockQueue // peer-local download queue
 	localInflightQueue            *BlockQueue // peer-local inflight queue
 	globalInflightQueue           *BlockQueue // global inflight queue
+	headerChain                   *HeaderChain
+	headersHeight                 int64   // height of the last header the peer sent us while syncing
+	headersTipID                  BlockID // ID of the last header the peer sent us while syncing
+	lowestHeight                  int64   // lowest main chain height the peer can send block bodies for
 	ignoreBlocks                  map[BlockID]bool
 	continuationBlockID           BlockID
 	lastPeerAddressesReceivedTime time.Time
@@ -59,11 +65,12 @@ var PeerUpgrader = websocket.Upgrader{
 }
 
 // NewPeer returns a new instance of a peer.
-func NewPeer(conn *websocket.Conn, genesisID BlockID, peerStore PeerStorage,
+func NewPeer(conn *websocket.Conn, params *ChainParams, genesisID BlockID, peerStore PeerStorage,
 	blockStore BlockStorage, ledger Ledger, processor *Processor, indexer *Indexer,
-	txQueue TransactionQueue, blockQueue *BlockQueue, addrChan chan<- string) *Peer {
+	txQueue TransactionQueue, blockQueue *BlockQueue, headerChain *HeaderChain, addrChan chan<- string) *Peer {
 	peer := &Peer{
 		conn:                conn,
+		params:              params,
 		genesisID:           genesisID,
 		peerStore:           peerStore,
 		blockStore:          blockStore,
@@ -74,6 +81,7 @@ func NewPeer(conn *websocket.Conn, genesisID BlockID, peerStore PeerStorage,
 		localDownloadQueue:  NewBlockQueue(),
 		localInflightQueue:  NewBlockQueue(),
 		globalInflightQueue: blockQueue,
+		headerChain:         headerChain,
 		ignoreBlocks:        make(map[BlockID]bool),
 		addrChan:            addrChan,
 	}
@@ -179,6 +187,9 @@ const (
 
 	// Maximum local download queue size
 	downloadQueueMax = maxBlocksPerInv * 10
+
+	// Maximum headers per block_headers message
+	maxHeadersPerMessage = 2000
 )
 
 // Run executes the peer's main loop in its own goroutine.
@@ -362,10 +373,34 @@ func (p *Peer) run() {
 				}
 
 			case <-onConnectChan:
-				// send a new peer a request to find a common ancestor
-				if err := p.sendFindCommonAncestor(nil, true, outChan); err != nil {
+				// find out which blocks the peer can send us in case it prunes them
+				log.Printf("Sending get_block_availability to: %s\n", p.conn.RemoteAddr())
+				p.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if err := p.conn.WriteJSON(Message{Type: "get_block_availability"}); err != nil {
+					log.Printf("Error sending get_block_availability: %s, to: %s\n", err, p.conn.RemoteAddr())
+					p.conn.Close()
+					// the connection is gone, don't send anything else
+					break
+				}
+
+				// sync headers first from a new peer if we're syncing. otherwise send
+				// a request to find a common ancestor
+				ibd, _, err := IsInitialBlockDownload(p.params, p.ledger, p.blockStore)
+				if err != nil {
+					log.Printf("Error: %s\n", err)
+				}
+				if ibd {
+					var height int64
+					if _, height, err = p.headerChain.Tip(); err == nil {
+						err = p.sendGetBlockHeaders(height+1, true, outChan)
+					}
+				} else {
+					err = p.sendFindCommonAncestor(nil, true, outChan)
+				}
+				if err != nil {
 					log.Printf("Write error: %s, to: %s\n", err, p.conn.RemoteAddr())
 					p.conn.Close()
+					break
 				}
 
 				// send a get_peer_addresses to request peers
@@ -434,7 +469,7 @@ func (p *Peer) run() {
 
 	// are we syncing?
 	lastNewBlockTime := time.Now()
-	ibd, _, err := IsInitialBlockDownload(p.ledger, p.blockStore)
+	ibd, _, err := IsInitialBlockDownload(p.params, p.ledger, p.blockStore)
 	if err != nil {
 		log.Println(err)
 		return
@@ -445,7 +480,7 @@ func (p *Peer) run() {
 		if ibd {
 			// handle stalled blockchain syncs
 			var err error
-			ibd, _, err = IsInitialBlockDownload(p.ledger, p.blockStore)
+			ibd, _, err = IsInitialBlockDownload(p.params, p.ledger, p.blockStore)
 			if err != nil {
 				return err
 			}
@@ -542,6 +577,12 @@ func (p *Peer) run() {
 					log.Printf("Error: %s, from: %s\n", err, p.conn.RemoteAddr())
 					return
 				}
+				if b.Block == nil && b.BlockID != nil && len(b.Error) != 0 {
+					if err := p.onBlockUnavailable(*b.BlockID, b.Error, outChan); err != nil {
+						log.Printf("Error: %s, from: %s\n", err, p.conn.RemoteAddr())
+					}
+					break
+				}
 				if b.Block == nil {
 					log.Printf("Error: received nil block, from: %s\n", p.conn.RemoteAddr())
 					return
@@ -600,13 +641,39 @@ func (p *Peer) run() {
 					break
 				}
 
-			case "get_graph":
-				var gn GetGraphMessage
-				if err := json.Unmarshal(body, &gn); err != nil {
+			case "get_block_headers_by_height":
+				var gbhbh GetBlockHeadersByHeightMessage
+				if err := json.Unmarshal(body, &gbhbh); err != nil {
+					log.Printf("Error: %s, from: %s\n", err, p.conn.RemoteAddr())
+					return
+				}
+				if err := p.onGetBlockHeadersByHeight(gbhbh.Height, gbhbh.Count, outChan); err != nil {
+					log.Printf("Error: %s, from: %s\n", err, p.conn.RemoteAddr())
+					break
+				}
+
+			case "block_headers":
+				var bh BlockHeadersMessage
+				if err := json.Unmarshal(body, &bh); err != nil {
+					log.Printf("Error: %s, from: %s\n", err, p.conn.RemoteAddr())
+					return
+				}
+				ok, err := p.onBlockHeaders(bh.Headers, outChan)
+				if err != nil {
+					log.Printf("Error: %s, from: %s\n", err, p.conn.RemoteAddr())
+					break
+				}
+				if ok {
+					lastNewBlockTime = time.Now()
+				}
+
+			case "get_reorgs":
+				var gr GetReorgsMessage
+				if err := json.Unmarshal(body, &gr); err != nil {
 					log.Printf("Error: %s, from: %s\n", err, p.conn.RemoteAddr())
 					return
 				}
-				if err := p.onGetGraph(gn.PublicKey, gn.DirectoryID, outChan); err != nil {
+				if err := p.onGetReorgs(gr.Limit, outChan); err != nil {
 					log.Printf("Error: %s, from: %s\n", err, p.conn.RemoteAddr())
 					break
 				}
@@ -726,6 +793,22 @@ func (p *Peer) run() {
 				}
 				p.onPeerAddresses(pa.Addresses)
 
+			case "get_block_availability":
+				if err := p.onGetBlockAvailability(outChan); err != nil {
+					log.Printf("Error: %s, from: %s\n", err, p.conn.RemoteAddr())
+					break
+				}
+
+			case "block_availability":
+				var ba BlockAvailabilityMessage
+				if err := json.Unmarshal(body, &ba); err != nil {
+					log.Printf("Error: %s, from: %s\n", err, p.conn.RemoteAddr())
+					return
+				}
+				log.Printf("Received block_availability, lowest height: %d, from: %s\n",
+					ba.LowestHeight, p.conn.RemoteAddr())
+				p.lowestHeight = ba.LowestHeight
+
 			case "get_transaction_relay_policy":
 				outChan <- Message{
 					Type: "transaction_relay_policy",
@@ -757,8 +840,31 @@ func (p *Peer) run() {
 				log.Printf("Received submit_work message, from: %s\n", p.conn.RemoteAddr())
 				submitWorkChan <- sw
 
+			case "unsupported_query":
+				var uq UnsupportedQueryMessage
+				if err := json.Unmarshal(body, &uq); err != nil {
+					log.Printf("Error: %s, from: %s\n", err, p.conn.RemoteAddr())
+					return
+				}
+				log.Printf("Peer doesn't support %s, from: %s\n", uq.Type, p.conn.RemoteAddr())
+
 			default:
-				log.Printf("Unknown message: %s, from: %s\n", m.Type, p.conn.RemoteAddr())
+				if p.indexer == nil || !p.indexer.HandlesQuery(m.Type) {
+					log.Printf("Unknown message: %s, from: %s\n", m.Type, p.conn.RemoteAddr())
+					outChan <- Message{
+						Type: "unsupported_query",
+						Body: UnsupportedQueryMessage{
+							Type:  m.Type,
+							Error: fmt.Sprintf("Unsupported message: %s", m.Type),
+						},
+					}
+					break
+				}
+				log.Printf("Received %s from: %s\n", m.Type, p.conn.RemoteAddr())
+				if err := p.indexer.HandleQuery(m.Type, body, outChan); err != nil {
+					log.Printf("Error: %s, from: %s\n", err, p.conn.RemoteAddr())
+					break
+				}
 			}
 
 		case websocket.CloseMessage:
@@ -841,6 +947,33 @@ func (p *Peer) onGetBlockByHeight(height int64, outChan chan<- Message) error {
 	return p.getBlock(*id, outChan)
 }
 
+// Handle a request for the lowest height we can send block bodies for
+func (p *Peer) onGetBlockAvailability(outChan chan<- Message) error {
+	log.Printf("Received get_block_availability, from: %s\n", p.conn.RemoteAddr())
+	lowestHeight, err := LowestAvailableHeight(p.blockStore)
+	if err != nil {
+		return err
+	}
+	outChan <- Message{Type: "block_availability", Body: BlockAvailabilityMessage{LowestHeight: lowestHeight}}
+	return nil
+}
+
+// Handle a peer telling us it can't send a block we requested. Another peer may be able to
+func (p *Peer) onBlockUnavailable(id BlockID, reason string, outChan chan<- Message) error {
+	log.Printf("Block %s unavailable: %s, from: %s\n", id, reason, p.conn.RemoteAddr())
+	if !p.localInflightQueue.Remove(id, "") {
+		// we didn't ask for it
+		return nil
+	}
+	p.globalInflightQueue.Remove(id, p.conn.RemoteAddr().String())
+
+	// the peer may have pruned more blocks since it last told us
+	outChan <- Message{Type: "get_block_availability"}
+
+	// try the next ones
+	return p.processDownloadQueue(outChan)
+}
+
 func (p *Peer) getBlock(id BlockID, outChan chan<- Message) error {
 	// fetch the block
 	blockJson, err := p.blockStore.GetBlockBytes(id)
@@ -850,7 +983,17 @@ func (p *Peer) getBlock(id BlockID, outChan chan<- Message) error {
 		return err
 	}
 	if len(blockJson) == 0 {
-		// not found
+		// not found. check if it has been pruned
+		pruned, err := p.isPruned(id)
+		if err != nil {
+			outChan <- Message{Type: "block", Body: BlockMessage{BlockID: &id}}
+			return err
+		}
+		if pruned {
+			err := fmt.Errorf("Block %s has been pruned", id)
+			outChan <- Message{Type: "block", Body: BlockMessage{BlockID: &id, Error: err.Error()}}
+			return err
+		}
 		outChan <- Message{Type: "block", Body: BlockMessage{BlockID: &id}}
 		return fmt.Errorf("No block found with ID %s", id)
 	}
@@ -882,6 +1025,19 @@ func (p *Peer) getBlock(id BlockID, outChan chan<- Message) error {
 	return nil
 }
 
+// Returns true if we had the block but its body has been pruned
+func (p *Peer) isPruned(id BlockID) (bool, error) {
+	lowestHeight, err := LowestAvailableHeight(p.blockStore)
+	if err != nil || lowestHeight == 0 {
+		return false, err
+	}
+	header, _, err := p.blockStore.GetBlockHeader(id)
+	if err != nil || header == nil {
+		return false, err
+	}
+	return header.Height < lowestHeight, nil
+}
+
 // Handle receiving a block from a peer. Returns true if the block was newly processed and accepted.
 func (p *Peer) onBlock(block *Block, ibd bool, outChan chan<- Message) (bool, error) {
 	// the message has the ID in it but we can't trust that.
@@ -901,7 +1057,7 @@ func (p *Peer) onBlock(block *Block, ibd bool, outChan chan<- Message) (bool, er
 	}
 
 	// don't process low difficulty blocks
-	if ibd == false && CheckpointsEnabled && block.Header.Height < LatestCheckpointHeight {
+	if ibd == false && p.params.CheckpointsEnabled && block.Header.Height < p.params.LatestCheckpointHeight {
 		// don't disconnect them. they may need us to find out about the real chain
 		p.localInflightQueue.Remove(id, "")
 		p.globalInflightQueue.Remove(id, p.conn.RemoteAddr().String())
@@ -913,7 +1069,7 @@ func (p *Peer) onBlock(block *Block, ibd bool, outChan chan<- Message) (bool, er
 			p.conn.Close()
 		}
 		return false, fmt.Errorf("Block %s height %d less than latest checkpoint height %d",
-			id, block.Header.Height, LatestCheckpointHeight)
+			id, block.Header.Height, p.params.LatestCheckpointHeight)
 	}
 
 	var accepted bool
@@ -928,12 +1084,23 @@ func (p *Peer) onBlock(block *Block, ibd bool, outChan chan<- Message) (bool, er
 			return false, err
 		}
 
-		log.Printf("Block %s is an orphan, sending find_common_ancestor to: %s\n",
-			id, p.conn.RemoteAddr())
+		if p.headerChain.Contains(id) {
+			// we've synced its header. check it and hold it until its parent is connected
+			if err := checkBlock(p.params, id, block, time.Now().Unix()); err != nil {
+				// disconnect a peer that sends us a bad block
+				p.conn.Close()
+				return false, err
+			}
+			p.headerChain.AddBody(id, block, p.conn.RemoteAddr().String())
+			accepted = true
+		} else {
+			log.Printf("Block %s is an orphan, sending find_common_ancestor to: %s\n",
+				id, p.conn.RemoteAddr())
 
-		// send a find common ancestor request
-		if err := p.sendFindCommonAncestor(nil, false, outChan); err != nil {
-			return false, err
+			// send a find common ancestor request
+			if err := p.sendFindCommonAncestor(nil, false, outChan); err != nil {
+				return false, err
+			}
 		}
 	} else {
 		// process the block
@@ -950,7 +1117,15 @@ func (p *Peer) onBlock(block *Block, ibd bool, outChan chan<- Message) (bool, er
 		p.globalInflightQueue.Remove(id, p.conn.RemoteAddr().String())
 	}
 
+	// connect any downloaded blocks which were waiting on this one
+	if err := p.connectHeaderChainBlocks(); err != nil {
+		return false, err
+	}
+
 	// see if there are any more blocks to download right now
+	if err := p.queueHeaderChainDownloads(); err != nil {
+		return false, err
+	}
 	if err := p.processDownloadQueue(outChan); err != nil {
 		return false, err
 	}
@@ -958,6 +1133,50 @@ func (p *Peer) onBlock(block *Block, ibd bool, outChan chan<- Message) (bool, er
 	return accepted, nil
 }
 
+// Connect blocks from the header chain which were downloaded before their parent was connected
+func (p *Peer) connectHeaderChainBlocks() error {
+	for {
+		id, block, source, ok, err := p.headerChain.NextBody()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if err := p.processor.ProcessBlock(id, block, source); err != nil {
+			// the block is invalid. so are the headers which follow it
+			p.headerChain.Truncate(id)
+			if source == p.conn.RemoteAddr().String() {
+				// disconnect a peer that sends us a bad block
+				p.conn.Close()
+			}
+			return err
+		}
+	}
+}
+
+// Queue blocks from the header chain for download which the peer has sent us the headers of
+func (p *Peer) queueHeaderChainDownloads() error {
+	if p.headersHeight == 0 {
+		// not syncing headers with this peer
+		return nil
+	}
+	ids, err := p.headerChain.Downloads(p.lowestHeight, p.headersHeight, p.headersTipID)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if p.localDownloadQueue.Len() >= downloadQueueMax {
+			break
+		}
+		if p.localDownloadQueue.Exists(id) || p.localInflightQueue.Exists(id) {
+			continue
+		}
+		p.localDownloadQueue.Add(id, "")
+	}
+	return nil
+}
+
 // Try requesting blocks that are in the download queue
 func (p *Peer) processDownloadQueue(outChan chan<- Message) error {
 	// fill up as much of the inflight queue as possible
@@ -975,7 +1194,7 @@ func (p *Peer) processDownloadQueue(outChan chan<- Message) error {
 		if err != nil {
 			return err
 		}
-		if branchType != UNKNOWN {
+		if branchType != UNKNOWN || p.headerChain.HasBody(blockToDownload) {
 			// it's been processed. remove it and check the next one
 			log.Printf("Block %s has been processed, removing from download queue for: %s\n",
 				blockToDownload, p.conn.RemoteAddr().String())
@@ -985,6 +1204,12 @@ func (p *Peer) processDownloadQueue(outChan chan<- Message) error {
 
 		// add block to the global inflight queue with this peer as the owner
 		if p.globalInflightQueue.Add(blockToDownload, p.conn.RemoteAddr().String()) == false {
+			if p.headerChain.Contains(blockToDownload) {
+				// another peer is downloading it right now. we know which blocks
+				// follow it from the header chain so try the next one
+				p.localDownloadQueue.Remove(blockToDownload, "")
+				continue
+			}
 			// another peer is downloading it right now.
 			// wait to see if they succeed before trying to download any others
 			log.Printf("Block %s is being downloaded already from another peer\n", blockToDownload)
@@ -1073,6 +1298,73 @@ func (p *Peer) sendFindCommonAncestor(startID *BlockID, writeNow bool, outChan c
 	return nil
 }
 
+// Send a request for the next batch of headers to sync starting at the given height
+// Might be called from reader or writer context. writeNow means we're in the writer context
+func (p *Peer) sendGetBlockHeaders(height int64, writeNow bool, outChan chan<- Message) error {
+	log.Printf("Sending get_block_headers_by_height: %d, to: %s\n", height, p.conn.RemoteAddr())
+
+	m := Message{
+		Type: "get_block_headers_by_height",
+		Body: GetBlockHeadersByHeightMessage{Height: height, Count: maxHeadersPerMessage},
+	}
+	if writeNow {
+		p.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := p.conn.WriteJSON(m); err != nil {
+			log.Printf("Write error: %s, to: %s\n", err, p.conn.RemoteAddr())
+			return err
+		}
+		return nil
+	}
+	outChan <- m
+	return nil
+}
+
+// Handle a batch of headers from a peer while syncing. Returns true if any of them were new
+func (p *Peer) onBlockHeaders(headers []*BlockHeader, outChan chan<- Message) (bool, error) {
+	log.Printf("Received block_headers with %d header(s), from: %s\n", len(headers), p.conn.RemoteAddr())
+
+	if len(headers) > maxHeadersPerMessage {
+		p.conn.Close()
+		return false, fmt.Errorf("%d headers is more than %d maximum per block_headers",
+			len(headers), maxHeadersPerMessage)
+	}
+
+	added, connected, err := p.headerChain.AddHeaders(headers, time.Now().Unix())
+	if err != nil {
+		// disconnect a peer that sends us a bad header
+		p.conn.Close()
+		return false, err
+	}
+	if !connected {
+		// the peer is on another branch. fall back to finding a common ancestor
+		log.Printf("Block headers don't extend our header chain, sending find_common_ancestor to: %s\n",
+			p.conn.RemoteAddr())
+		return false, p.sendFindCommonAncestor(nil, false, outChan)
+	}
+
+	if len(headers) != 0 {
+		id, err := headers[len(headers)-1].ID()
+		if err != nil {
+			return false, err
+		}
+		p.headersHeight, p.headersTipID = headers[len(headers)-1].Height, id
+	}
+	if len(headers) == maxHeadersPerMessage {
+		// there may be more
+		if err := p.sendGetBlockHeaders(p.headersHeight+1, false, outChan); err != nil {
+			return false, err
+		}
+	} else {
+		log.Printf("Synced headers to height %d, with: %s\n", p.headersHeight, p.conn.RemoteAddr())
+	}
+
+	// download the blocks
+	if err := p.queueHeaderChainDownloads(); err != nil {
+		return false, err
+	}
+	return added > 0, p.processDownloadQueue(outChan)
+}
+
 // Handle a find common ancestor message from a peer
 func (p *Peer) onFindCommonAncestor(id BlockID, index, length int, outChan chan<- Message) (bool, error) {
 	log.Printf("Received find_common_ancestor: %s, index: %d, length: %d, from: %s\n",
@@ -1098,6 +1390,16 @@ func (p *Peer) onFindCommonAncestor(id BlockID, index, length int, outChan chan<
 	log.Printf("Common ancestor found: %s, height: %d, with: %s\n",
 		id, header.Height, p.conn.RemoteAddr())
 
+	lowestHeight, err := LowestAvailableHeight(p.blockStore)
+	if err != nil {
+		return false, err
+	}
+	if header.Height+1 < lowestHeight {
+		// the peer needs blocks we've pruned
+		log.Printf("Can't send blocks below pruned height %d, to: %s\n", lowestHeight, p.conn.RemoteAddr())
+		return true, nil
+	}
+
 	var ids []BlockID
 	var height int64 = header.Height + 1
 	for len(ids) < maxBlocksPerInv {
@@ -1148,6 +1450,45 @@ func (p *Peer) onGetBlockHeaderByHeight(height int64, outChan chan<- Message) er
 	return p.getBlockHeader(*id, outChan)
 }
 
+// Handle a request for consecutive block headers by height from a peer
+func (p *Peer) onGetBlockHeadersByHeight(height int64, count int, outChan chan<- Message) error {
+	log.Printf("Received get_block_headers_by_height: %d, count: %d, from: %s\n",
+		height, count, p.conn.RemoteAddr())
+
+	// enforce our limit
+	if count > maxHeadersPerMessage || count <= 0 {
+		count = maxHeadersPerMessage
+	}
+
+	var headers []*BlockHeader
+	for ; len(headers) < count; height++ {
+		id, err := p.ledger.GetBlockIDForHeight(height)
+		if err != nil {
+			outChan <- Message{Type: "block_headers"}
+			return err
+		}
+		if id == nil {
+			break
+		}
+		header, _, err := p.blockStore.GetBlockHeader(*id)
+		if err != nil {
+			outChan <- Message{Type: "block_headers"}
+			return err
+		}
+		if header == nil {
+			outChan <- Message{Type: "block_headers"}
+			return fmt.Errorf("Block header for %s not found", *id)
+		}
+		headers = append(headers, header)
+	}
+
+	outChan <- Message{
+		Type: "block_headers",
+		Body: BlockHeadersMessage{Height: height - int64(len(headers)), Headers: headers},
+	}
+	return nil
+}
+
 func (p *Peer) getBlockHeader(id BlockID, outChan chan<- Message) error {
 	header, _, err := p.blockStore.GetBlockHeader(id)
 	if err != nil {
@@ -1164,32 +1505,41 @@ func (p *Peer) getBlockHeader(id BlockID, outChan chan<- Message) error {
 	return nil
 }
 
-// Handle a request for a public key's view graph
-func (p *Peer) onGetGraph(pubKey ed25519.PublicKey, directoryID string, outChan chan<- Message) error {
-	log.Printf("Received get_graph from: %s\n", p.conn.RemoteAddr())
+// Handle a request for records of reorganizations
+func (p *Peer) onGetReorgs(limit int, outChan chan<- Message) error {
+	log.Printf("Received get_reorgs from: %s\n", p.conn.RemoteAddr())
 
-	pk := pubKeyToString(pubKey)
-	viewGraph, ok := p.indexer.dirGraphs[directoryID]
-
-	graph := ""
-
-	if ok {
-		graph = viewGraph.ToDOT(pk, p.indexer.keyState)
+	// only the node's operator gets to see these
+	if !isLoopbackAddr(p.conn.RemoteAddr()) {
+		err := fmt.Errorf("Reorganization records are only available to local peers")
+		outChan <- Message{Type: "reorgs", Body: ReorgsMessage{Error: err.Error()}}
+		return err
 	}
 
-	outChan <- Message{
-		Type: "graph",
-		Body: GraphMessage{
-			BlockID:   p.indexer.latestBlockID,
-			Height:    p.indexer.latestHeight,
-			PublicKey: pubKey,
-			Graph:     graph,
-		},
+	// enforce our limit
+	if limit > 100 || limit <= 0 {
+		limit = 100
 	}
 
+	reorgs, err := p.processor.GetReorgs(limit)
+	if err != nil {
+		outChan <- Message{Type: "reorgs", Body: ReorgsMessage{Error: err.Error()}}
+		return err
+	}
+	outChan <- Message{Type: "reorgs", Body: ReorgsMessage{Reorgs: reorgs}}
 	return nil
 }
 
+// Returns true if the address is on the loopback interface
+func isLoopbackAddr(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 // Handle a request for a public key's balance
 func (p *Peer) onGetBalance(pubKey ed25519.PublicKey, outChan chan<- Message) error {
 	log.Printf("Received get_balance from: %s\n", p.conn.RemoteAddr())
@@ -1639,7 +1989,8 @@ func (p *Peer) createNewWorkBlock(tipID BlockID, tipHeader *BlockHeader) error {
 		p.medianTimestamp = medianTimestamp
 		keyIndex := rand.Intn(len(p.pubKeys))
 		p.workID = rand.Int31()
-		p.workBlock, err = createNextBlock(tipID, tipHeader, p.txQueue, p.blockStore, p.ledger, p.pubKeys[keyIndex], p.memo)
+		p.workBlock, err = createNextBlock(p.params, tipID, tipHeader, p.txQueue, p.blockStore, p.ledger,
+			p.pubKeys[keyIndex], p.memo)
 		if err != nil {
 			log.Printf("Error creating next block: %s, for: %s\n", err, p.conn.RemoteAddr())
 		}
@@ -1697,7 +2048,7 @@ func (p *Peer) onSubmitWork(sw SubmitWorkMessage) {
 
 // Update the read limit if necessary
 func (p *Peer) updateReadLimit() {
-	ok, height, err := IsInitialBlockDownload(p.ledger, p.blockStore)
+	ok, height, err := IsInitialBlockDownload(p.params, p.ledger, p.blockStore)
 	if err != nil {
 		log.Fatal(err)
 	}
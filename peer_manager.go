@@ -20,6 +20,7 @@ import (
 // PeerManager manages incoming and outgoing peer connections on behalf of the client.
 // It also manages finding peers to connect to.
 type PeerManager struct {
+	params            *ChainParams
 	genesisID         BlockID
 	peerStore         PeerStorage
 	blockStore        BlockStorage
@@ -28,6 +29,7 @@ type PeerManager struct {
 	indexer           *Indexer
 	txQueue           TransactionQueue
 	blockQueue        *BlockQueue
+	headerChain       *HeaderChain
 	dataDir           string
 	myIP              string
 	peer              string
@@ -57,8 +59,8 @@ type PeerManager struct {
 
 // NewPeerManager returns a new PeerManager instance.
 func NewPeerManager(
-	genesisID BlockID, peerStore PeerStorage, blockStore BlockStorage,
-	ledger Ledger, processor *Processor, indexer *Indexer, txQueue TransactionQueue,
+	params *ChainParams, genesisID BlockID, peerStore PeerStorage, blockStore BlockStorage,
+	ledger Ledger, processor *Processor, headerChain *HeaderChain, indexer *Indexer, txQueue TransactionQueue,
 	dataDir, myExternalIP, peer, certPath, keyPath string,
 	port, inboundLimit int, accept, irc, dnsseed bool, banMap map[string]bool) *PeerManager {
 
@@ -86,6 +88,7 @@ func NewPeerManager(
 	}
 
 	return &PeerManager{
+		params:            params,
 		genesisID:         genesisID,
 		peerStore:         peerStore,
 		blockStore:        blockStore,
@@ -94,6 +97,7 @@ func NewPeerManager(
 		indexer:           indexer,
 		txQueue:           txQueue,
 		blockQueue:        NewBlockQueue(),
+		headerChain:       headerChain,
 		dataDir:           dataDir,
 		myIP:              myExternalIP, // set if upnp was enabled and successful
 		peer:              peer,
@@ -158,7 +162,7 @@ func (p *PeerManager) run() {
 		}
 	} else {
 		// query dns seeds for peers
-		addresses, err := dnsQueryForPeers()
+		addresses, err := dnsQueryForPeers(p.params)
 		if err != nil {
 			log.Printf("Error from DNS query: %s\n", err)
 		} else {
@@ -339,7 +343,7 @@ func (p *PeerManager) connectToPeers(ctx context.Context) error {
 	}
 
 	// are we syncing?
-	ibd, _, err := IsInitialBlockDownload(p.ledger, p.blockStore)
+	ibd, _, err := IsInitialBlockDownload(p.params, p.ledger, p.blockStore)
 	if err != nil {
 		return err
 	}
@@ -419,7 +423,7 @@ func (p *PeerManager) connectToPeers(ctx context.Context) error {
 
 // Connect to a peer
 func (p *PeerManager) connect(ctx context.Context, addr string) (int, *Peer, error) {
-	peer := NewPeer(nil, p.genesisID, p.peerStore, p.blockStore, p.ledger, p.processor, p.indexer, p.txQueue, p.blockQueue, p.addrChan)
+	peer := NewPeer(nil, p.params, p.genesisID, p.peerStore, p.blockStore, p.ledger, p.processor, p.indexer, p.txQueue, p.blockQueue, p.headerChain, p.addrChan)
 
 	if ok := p.addToOutboundSet(addr, peer); !ok {
 		return 0, nil, fmt.Errorf("Too many peer connections")
@@ -456,7 +460,7 @@ func (p *PeerManager) listenForPeers(ctx context.Context) bool {
 	}
 
 	// don't accept new connections while we're syncing
-	ibd, _, err := IsInitialBlockDownload(p.ledger, p.blockStore)
+	ibd, _, err := IsInitialBlockDownload(p.params, p.ledger, p.blockStore)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -569,7 +573,7 @@ func (p *PeerManager) acceptConnections() {
 			return
 		}
 
-		peer := NewPeer(conn, p.genesisID, p.peerStore, p.blockStore, p.ledger, p.processor, p.indexer, p.txQueue, p.blockQueue, p.addrChan)
+		peer := NewPeer(conn, p.params, p.genesisID, p.peerStore, p.blockStore, p.ledger, p.processor, p.indexer, p.txQueue, p.blockQueue, p.headerChain, p.addrChan)
 
 		if ok := p.addToInboundSet(r.RemoteAddr, peer); !ok {
 			// TODO: tell the peer why
@@ -801,7 +805,7 @@ func determineExternalIP() (string, error) {
 }
 
 // IsInitialBlockDownload returns true if it appears we're still syncing the block chain.
-func IsInitialBlockDownload(ledger Ledger, blockStore BlockStorage) (bool, int64, error) {
+func IsInitialBlockDownload(params *ChainParams, ledger Ledger, blockStore BlockStorage) (bool, int64, error) {
 	tipID, tipHeader, _, err := getChainTipHeader(ledger, blockStore)
 	if err != nil {
 		return false, 0, err
@@ -812,8 +816,11 @@ func IsInitialBlockDownload(ledger Ledger, blockStore BlockStorage) (bool, int64
 	if tipHeader == nil {
 		return true, 0, nil
 	}
-	if CheckpointsEnabled && tipHeader.Height < LatestCheckpointHeight {
+	if params.CheckpointsEnabled && tipHeader.Height < params.LatestCheckpointHeight {
 		return true, tipHeader.Height, nil
 	}
-	return tipHeader.Time < (time.Now().Unix() - MaxTipAge), tipHeader.Height, nil
+	if params.MaxTipAge == 0 {
+		return false, tipHeader.Height, nil
+	}
+	return tipHeader.Time < (time.Now().Unix() - params.MaxTipAge), tipHeader.Height, nil
 }
@@ -0,0 +1,187 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PeerStorageMemory is an in-memory implementation of the PeerStorage interface. It's useful for
+// tests and simulations. It follows the same retry and expiry rules as PeerStorageDisk.
+type PeerStorageMemory struct {
+	lock           sync.Mutex
+	peers          map[string]*peerInfo
+	connectedPeers map[string]bool
+}
+
+// NewPeerStorageMemory returns a new PeerStorageMemory instance.
+func NewPeerStorageMemory() *PeerStorageMemory {
+	return &PeerStorageMemory{
+		peers:          make(map[string]*peerInfo),
+		connectedPeers: make(map[string]bool),
+	}
+}
+
+// Store stores a peer address. Returns true if the peer was newly added to storage.
+func (p *PeerStorageMemory) Store(addr string) (bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.peers[addr]; ok {
+		// we've seen it
+		return false, nil
+	}
+
+	// insert new peers at the head of the list to try next but put them in a random position
+	// relative to other new peers
+	p.peers[addr] = &peerInfo{FirstSeen: time.Now().Unix(), LastAttempt: rand.Int63n(1 << 30)}
+	return true, nil
+}
+
+// Get returns some peers for us to attempt to connect to.
+func (p *PeerStorageMemory) Get(count int) ([]string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// least recently attempted first
+	now := time.Now().Unix()
+	addrs := p.sortedAddrs(func(info *peerInfo) (int64, bool) {
+		return info.LastAttempt, info.LastAttempt >= 0 && info.LastAttempt < now
+	})
+
+	var found []string
+	for _, addr := range addrs {
+		if p.connectedPeers[addr] {
+			// already connected
+			continue
+		}
+
+		// is it time to retry this address?
+		if !p.peers[addr].shouldRetry() {
+			continue
+		}
+
+		// add it to the list
+		found = append(found, addr)
+		if len(found) == count {
+			break
+		}
+	}
+	return found, nil
+}
+
+// GetSince returns some peers to tell others about last active less than "when" ago.
+func (p *PeerStorageMemory) GetSince(count int, when int64) ([]string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// most recently connected first
+	now := time.Now().Unix()
+	addrs := p.sortedAddrs(func(info *peerInfo) (int64, bool) {
+		return info.LastSuccess, info.LastSuccess != 0 && info.LastSuccess >= when && info.LastSuccess < now
+	})
+
+	var found []string
+	for i := len(addrs) - 1; i >= 0; i-- {
+		found = append(found, addrs[i])
+		if len(found) == count {
+			break
+		}
+	}
+	return found, nil
+}
+
+// returns the addresses of the peers for which fn returns true ordered by the time fn returns
+// and then by address. must be called with the lock held
+func (p *PeerStorageMemory) sortedAddrs(fn func(info *peerInfo) (int64, bool)) []string {
+	type timedAddr struct {
+		when int64
+		addr string
+	}
+	var timed []timedAddr
+	for addr, info := range p.peers {
+		if when, ok := fn(info); ok {
+			timed = append(timed, timedAddr{when: when, addr: addr})
+		}
+	}
+	sort.Slice(timed, func(i, j int) bool {
+		if timed[i].when != timed[j].when {
+			return timed[i].when < timed[j].when
+		}
+		return timed[i].addr < timed[j].addr
+	})
+	addrs := make([]string, len(timed))
+	for i, t := range timed {
+		addrs[i] = t.addr
+	}
+	return addrs
+}
+
+// Delete is called to explicitly remove a peer address from storage.
+func (p *PeerStorageMemory) Delete(addr string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.peers[addr]; !ok {
+		return fmt.Errorf("Peer info not found for: %s", addr)
+	}
+	delete(p.peers, addr)
+	return nil
+}
+
+// OnConnectAttempt is called prior to attempting to connect to the peer.
+func (p *PeerStorageMemory) OnConnectAttempt(addr string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	info, ok := p.peers[addr]
+	if !ok {
+		return fmt.Errorf("Peer info not found for: %s", addr)
+	}
+	info.LastAttempt = time.Now().Unix()
+	return nil
+}
+
+// OnConnectFailure is called upon connection failure.
+func (p *PeerStorageMemory) OnConnectFailure(addr string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	info, ok := p.peers[addr]
+	if !ok {
+		return fmt.Errorf("Peer info not found for: %s", addr)
+	}
+	if info.shouldDelete() {
+		delete(p.peers, addr)
+	}
+	return nil
+}
+
+// OnConnectSuccess is called upon successful handshake with the peer.
+func (p *PeerStorageMemory) OnConnectSuccess(addr string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	info, ok := p.peers[addr]
+	if !ok {
+		return fmt.Errorf("Peer info not found for: %s", addr)
+	}
+	info.LastSuccess = time.Now().Unix()
+
+	// save the connected status
+	p.connectedPeers[addr] = true
+	return nil
+}
+
+// OnDisconnect is called upon disconnection.
+func (p *PeerStorageMemory) OnDisconnect(addr string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.connectedPeers, addr)
+	return nil
+}
+
+// Close is a no-op. It's here so memory storage can stand in for on-disk storage.
+func (p *PeerStorageMemory) Close() error {
+	return nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// every PeerStorage implementation must pass this
+func TestPeerStorageConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peer_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("disk", func(t *testing.T) {
+		peerStore, err := NewPeerStorageDisk(filepath.Join(dir, "peers.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peerStore.Close()
+		testPeerStorage(t, peerStore)
+	})
+	t.Run("memory", func(t *testing.T) {
+		testPeerStorage(t, NewPeerStorageMemory())
+	})
+}
+
+func testPeerStorage(t *testing.T, peerStore PeerStorage) {
+	addrs := []string{"10.0.0.1:8831", "10.0.0.2:8831", "10.0.0.3:8831", "10.0.0.4:8831"}
+	for _, addr := range addrs {
+		if added, err := peerStore.Store(addr); err != nil || !added {
+			t.Fatalf("Expected %s to be added, found %v", addr, err)
+		}
+	}
+	if added, err := peerStore.Store(addrs[0]); err != nil || added {
+		t.Fatalf("Expected %s to be known, found %v", addrs[0], err)
+	}
+
+	// new peers are all worth trying
+	checkTestPeers(t, peerStore, 0, addrs...)
+	if found, err := peerStore.Get(2); err != nil || len(found) != 2 {
+		t.Fatalf("Expected 2 peers, found %v %v", found, err)
+	}
+
+	// recently attempted peers aren't tried again
+	for _, addr := range addrs[:3] {
+		if err := peerStore.OnConnectAttempt(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkTestPeers(t, peerStore, 0, addrs[3])
+
+	// only peers we've connected to are shared. they're shared once a second has passed
+	if err := peerStore.OnConnectSuccess(addrs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := peerStore.OnConnectSuccess(addrs[1]); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	found, err := peerStore.GetSince(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(found)
+	if len(found) != 2 || found[0] != addrs[0] || found[1] != addrs[1] {
+		t.Fatalf("Expected peers %v, found %v", addrs[:2], found)
+	}
+	if found, err := peerStore.GetSince(1, 0); err != nil || len(found) != 1 {
+		t.Fatalf("Expected 1 peer, found %v %v", found, err)
+	}
+	if found, err := peerStore.GetSince(10, time.Now().Unix()+1); err != nil || len(found) != 0 {
+		t.Fatalf("Expected no peers, found %v %v", found, err)
+	}
+
+	// a failure deletes a peer we've never connected to but not one we have
+	if err := peerStore.OnDisconnect(addrs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := peerStore.OnConnectFailure(addrs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := peerStore.OnConnectFailure(addrs[2]); err != nil {
+		t.Fatal(err)
+	}
+	if added, err := peerStore.Store(addrs[1]); err != nil || added {
+		t.Fatalf("Expected %s to be kept, found %v", addrs[1], err)
+	}
+	if err := peerStore.OnConnectAttempt(addrs[2]); err == nil {
+		t.Fatalf("Expected %s to be deleted", addrs[2])
+	}
+
+	// explicit deletion
+	if err := peerStore.Delete(addrs[3]); err != nil {
+		t.Fatal(err)
+	}
+	if err := peerStore.Delete(addrs[3]); err == nil {
+		t.Fatalf("Expected an error deleting %s again", addrs[3])
+	}
+	checkTestPeers(t, peerStore, 0)
+	if added, err := peerStore.Store(addrs[3]); err != nil || !added {
+		t.Fatalf("Expected %s to be added again, found %v", addrs[3], err)
+	}
+	checkTestPeers(t, peerStore, 0, addrs[3])
+
+	// unknown peers
+	for _, fn := range []func(string) error{
+		peerStore.OnConnectAttempt, peerStore.OnConnectSuccess, peerStore.OnConnectFailure,
+	} {
+		if err := fn("10.0.0.5:8831"); err == nil {
+			t.Fatal("Expected an error for an unknown peer")
+		}
+	}
+}
+
+func checkTestPeers(t *testing.T, peerStore PeerStorage, count int, expect ...string) {
+	found, err := peerStore.Get(count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(found)
+	expect = append([]string(nil), expect...)
+	sort.Strings(expect)
+	if len(found) != len(expect) {
+		t.Fatalf("Expected peers %v, found %v", expect, found)
+	}
+	for i := range expect {
+		if found[i] != expect[i] {
+			t.Fatalf("Expected peers %v, found %v", expect, found)
+		}
+	}
+}
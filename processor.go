@@ -20,10 +20,15 @@ import (
 // Processor processes blocks and transactions in order to construct the ledger.
 // It also manages the storage of all block chain data as well as inclusion of new transactions into the transaction queue.
 type Processor struct {
+	params                  *ChainParams
 	genesisID               BlockID
 	blockStore              BlockStorage                  // storage of raw block data
 	txQueue                 TransactionQueue              // queue of transactions to confirm
 	ledger                  Ledger                        // ledger built from processing blocks
+	headerChain             *HeaderChain                  // headers synced ahead of the ledger. may be nil
+	sigCache                *SignatureCache               // transaction signatures already verified
+	reorgPolicy             ReorgPolicy                   // limits, records and alerts for reorganizations
+	lastRefusedForkID       BlockID                       // fork point of the last refused reorganization
 	txChan                  chan txToProcess              // receive new transactions to process on this channel
 	blockChan               chan blockToProcess           // receive new blocks to process on this channel
 	registerNewTxChan       chan chan<- NewTx             // receive registration requests for new transaction notifications
@@ -67,12 +72,17 @@ type blockToProcess struct {
 }
 
 // NewProcessor returns a new Processor instance.
-func NewProcessor(genesisID BlockID, blockStore BlockStorage, txQueue TransactionQueue, ledger Ledger) *Processor {
+func NewProcessor(params *ChainParams, genesisID BlockID, blockStore BlockStorage, txQueue TransactionQueue,
+	ledger Ledger, headerChain *HeaderChain, reorgPolicy ReorgPolicy) *Processor {
 	return &Processor{
+		params:                  params,
 		genesisID:               genesisID,
 		blockStore:              blockStore,
 		txQueue:                 txQueue,
 		ledger:                  ledger,
+		headerChain:             headerChain,
+		sigCache:                NewSignatureCache(SignatureCacheSize),
+		reorgPolicy:             reorgPolicy,
 		txChan:                  make(chan txToProcess, 100),
 		blockChan:               make(chan blockToProcess, 10),
 		registerNewTxChan:       make(chan chan<- NewTx),
@@ -251,17 +261,20 @@ func (p *Processor) processTransaction(id TransactionID, tx *Transaction, source
 			id, tipHeight, tx.Expires)
 	}
 
-	// verify signature
-	ok, err := tx.Verify()
-	if err != nil {
-		return err
-	}
-	if !ok {
-		return fmt.Errorf("Signature verification failed for %s", id)
+	// verify signature unless we have already
+	if !p.sigCache.Exists(id, tx.Signature) {
+		ok, err := tx.Verify()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("Signature verification failed for %s", id)
+		}
+		p.sigCache.Add(id, tx.Signature)
 	}
 
 	// rejects a transaction if sender would have insufficient balance
-	ok, err = p.txQueue.Add(id, tx)
+	ok, err := p.txQueue.Add(id, tx)
 	if err != nil {
 		return err
 	}
@@ -404,7 +417,7 @@ func (p *Processor) processBlock(id BlockID, block *Block, source string) error
 	}
 
 	// sanity check the block
-	if err := checkBlock(id, block, now); err != nil {
+	if err := checkBlock(p.params, id, block, now); err != nil {
 		return err
 	}
 
@@ -435,7 +448,7 @@ func (p *Processor) processBlock(id BlockID, block *Block, source string) error
 }
 
 // Context-free block sanity checker
-func checkBlock(id BlockID, block *Block, now int64) error {
+func checkBlock(params *ChainParams, id BlockID, block *Block, now int64) error {
 	// sanity check time
 	if block.Header.Time < 0 || block.Header.Time > MaxNumber {
 		return fmt.Errorf("Time value is invalid, block %s", id)
@@ -467,7 +480,7 @@ func checkBlock(id BlockID, block *Block, now int64) error {
 	}
 
 	// check against known checkpoints
-	if err := CheckpointCheck(id, block.Header.Height); err != nil {
+	if err := params.CheckpointCheck(id, block.Header.Height); err != nil {
 		return err
 	}
 
@@ -580,7 +593,7 @@ func (p *Processor) acceptBlock(id BlockID, block *Block, now int64, source stri
 	}
 
 	// check declared proof of work is correct
-	target, err := computeTarget(prevHeader, p.blockStore, p.ledger)
+	target, err := computeTarget(p.params, prevHeader, p.blockStore, p.ledger)
 	if err != nil {
 		return err
 	}
@@ -605,13 +618,20 @@ func (p *Processor) acceptBlock(id BlockID, block *Block, now int64, source stri
 		return fmt.Errorf("Timestamp is too early for block %s", id)
 	}
 
-	// check series, maturity, expiration then verify signatures and calculate total fees
+	// signatures of the assume-valid block's ancestors don't need to be verified
+	assumedValid := p.headerChain != nil && p.headerChain.IsAssumedValid(id)
+
+	// compute IDs and verify signatures in parallel. signatures verified when
+	// the transactions entered the queue are found in the cache
+	txIDs, err := verifyTransactions(block.Transactions, p.sigCache, assumedValid)
+	if err != nil {
+		return err
+	}
+
+	// check series, maturity, expiration and calculate total fees
 	var fees int64
-	for _, tx := range block.Transactions {
-		txID, err := tx.ID()
-		if err != nil {
-			return err
-		}
+	for i, tx := range block.Transactions {
+		txID := txIDs[i]
 		if !checkTransactionSeries(tx, block.Header.Height) {
 			return fmt.Errorf("Transaction %s would have invalid series", txID)
 		}
@@ -622,16 +642,6 @@ func (p *Processor) acceptBlock(id BlockID, block *Block, now int64, source stri
 			if tx.IsExpired(block.Header.Height) {
 				return fmt.Errorf("Transaction %s is expired", txID)
 			}
-			// if it's in the queue with the same signature we've verified it already
-			if !p.txQueue.ExistsSigned(txID, tx.Signature) {
-				ok, err := tx.Verify()
-				if err != nil {
-					return err
-				}
-				if !ok {
-					return fmt.Errorf("Signature verification failed, transaction: %s", txID)
-				}
-			}
 		}
 		fees += tx.Fee
 	}
@@ -655,7 +665,7 @@ func (p *Processor) acceptBlock(id BlockID, block *Block, now int64, source stri
 	}
 
 	// finish accepting the block if possible
-	if err := p.acceptBlockContinue(id, block, now, prevHeader, source); err != nil {
+	if err := p.acceptBlockContinue(id, block, now, prevHeader, p.reorgPolicy.MaxDepth, source); err != nil {
 		// we may have disconnected the old best chain and partially
 		// connected the new one before encountering a problem. re-activate it now
 		if err2 := p.reconnectTip(*tipID, source); err2 != nil {
@@ -680,29 +690,33 @@ func BlockCreationReward(height int64) int64 {
 }
 
 // Compute expected target of the current block
-func computeTarget(prevHeader *BlockHeader, blockStore BlockStorage, ledger Ledger) (BlockID, error) {
-	if prevHeader.Height >= BitcoinCashRetargetAlgorithmHeight {
-		return computeTargetBitcoinCash(prevHeader, blockStore, ledger)
+func computeTarget(params *ChainParams, prevHeader *BlockHeader, blockStore BlockStorage, ledger Ledger) (
+	BlockID, error) {
+	if params.NoRetargeting {
+		return prevHeader.Target, nil
 	}
-	return computeTargetBitcoin(prevHeader, blockStore)
+	if prevHeader.Height >= params.BitcoinCashRetargetAlgorithmHeight {
+		return computeTargetBitcoinCash(params, prevHeader, blockStore, ledger)
+	}
+	return computeTargetBitcoin(params, prevHeader, blockStore)
 }
 
 // Original target computation
-func computeTargetBitcoin(prevHeader *BlockHeader, blockStore BlockStorage) (BlockID, error) {
-	if (prevHeader.Height+1)%RetargetInterval != 0 {
+func computeTargetBitcoin(params *ChainParams, prevHeader *BlockHeader, blockStore BlockStorage) (BlockID, error) {
+	if (prevHeader.Height+1)%params.RetargetInterval != 0 {
 		// not 2016th block, use previous block's value
 		return prevHeader.Target, nil
 	}
 
 	// defend against time warp attack
-	blocksToGoBack := RetargetInterval - 1
-	if (prevHeader.Height + 1) != RetargetInterval {
-		blocksToGoBack = RetargetInterval
+	blocksToGoBack := params.RetargetInterval - 1
+	if (prevHeader.Height + 1) != params.RetargetInterval {
+		blocksToGoBack = params.RetargetInterval
 	}
 
 	// walk back to the first block of the interval
 	firstHeader := prevHeader
-	for i := 0; i < blocksToGoBack; i++ {
+	for i := int64(0); i < blocksToGoBack; i++ {
 		var err error
 		firstHeader, _, err = blockStore.GetBlockHeader(firstHeader.Previous)
 		if err != nil {
@@ -712,8 +726,8 @@ func computeTargetBitcoin(prevHeader *BlockHeader, blockStore BlockStorage) (Blo
 
 	actualTimespan := prevHeader.Time - firstHeader.Time
 
-	minTimespan := int64(RetargetTime / 4)
-	maxTimespan := int64(RetargetTime * 4)
+	minTimespan := params.RetargetTime / 4
+	maxTimespan := params.RetargetTime * 4
 
 	if actualTimespan < minTimespan {
 		actualTimespan = minTimespan
@@ -723,9 +737,9 @@ func computeTargetBitcoin(prevHeader *BlockHeader, blockStore BlockStorage) (Blo
 	}
 
 	actualTimespanInt := big.NewInt(actualTimespan)
-	retargetTimeInt := big.NewInt(RetargetTime)
+	retargetTimeInt := big.NewInt(params.RetargetTime)
 
-	initialTargetBytes, err := hex.DecodeString(InitialTarget)
+	initialTargetBytes, err := hex.DecodeString(params.InitialTarget)
 	if err != nil {
 		return BlockID{}, err
 	}
@@ -746,10 +760,10 @@ func computeTargetBitcoin(prevHeader *BlockHeader, blockStore BlockStorage) (Blo
 }
 
 // Revised target computation
-func computeTargetBitcoinCash(prevHeader *BlockHeader, blockStore BlockStorage, ledger Ledger) (
-	targetID BlockID, err error) {
+func computeTargetBitcoinCash(params *ChainParams, prevHeader *BlockHeader, blockStore BlockStorage,
+	ledger Ledger) (targetID BlockID, err error) {
 
-	firstID, err := ledger.GetBlockIDForHeight(prevHeader.Height - RetargetSmaWindow)
+	firstID, err := ledger.GetBlockIDForHeight(prevHeader.Height - params.RetargetSmaWindow)
 	if err != nil {
 		return
 	}
@@ -759,15 +773,15 @@ func computeTargetBitcoinCash(prevHeader *BlockHeader, blockStore BlockStorage,
 	}
 
 	workInt := new(big.Int).Sub(prevHeader.ChainWork.GetBigInt(), firstHeader.ChainWork.GetBigInt())
-	workInt.Mul(workInt, big.NewInt(TargetSpacing))
+	workInt.Mul(workInt, big.NewInt(params.TargetSpacing))
 
 	// "In order to avoid difficulty cliffs, we bound the amplitude of the
 	// adjustment we are going to do to a factor in [0.5, 2]." - Bitcoin-ABC
 	actualTimespan := prevHeader.Time - firstHeader.Time
-	if actualTimespan > 2*RetargetSmaWindow*TargetSpacing {
-		actualTimespan = 2 * RetargetSmaWindow * TargetSpacing
-	} else if actualTimespan < (RetargetSmaWindow/2)*TargetSpacing {
-		actualTimespan = (RetargetSmaWindow / 2) * TargetSpacing
+	if actualTimespan > 2*params.RetargetSmaWindow*params.TargetSpacing {
+		actualTimespan = 2 * params.RetargetSmaWindow * params.TargetSpacing
+	} else if actualTimespan < (params.RetargetSmaWindow/2)*params.TargetSpacing {
+		actualTimespan = (params.RetargetSmaWindow / 2) * params.TargetSpacing
 	}
 
 	workInt.Div(workInt, big.NewInt(actualTimespan))
@@ -778,7 +792,7 @@ func computeTargetBitcoinCash(prevHeader *BlockHeader, blockStore BlockStorage,
 	newTargetInt.Sub(newTargetInt, big.NewInt(1))
 
 	// don't go above the initial target
-	initialTargetBytes, err := hex.DecodeString(InitialTarget)
+	initialTargetBytes, err := hex.DecodeString(params.InitialTarget)
 	if err != nil {
 		return
 	}
@@ -813,8 +827,9 @@ func computeMedianTimestamp(prevHeader *BlockHeader, blockStore BlockStorage) (i
 }
 
 // Continue accepting the block
+// Reorganizations disconnecting more than maxReorgDepth blocks are refused unless it's zero
 func (p *Processor) acceptBlockContinue(
-	id BlockID, block *Block, blockWhen int64, prevHeader *BlockHeader, source string) error {
+	id BlockID, block *Block, blockWhen int64, prevHeader *BlockHeader, maxReorgDepth int64, source string) error {
 
 	// get the current tip
 	tipID, tipHeader, tipWhen, err := getChainTipHeader(p.ledger, p.blockStore)
@@ -881,15 +896,43 @@ func (p *Processor) acceptBlockContinue(
 		}
 	}
 
+	var reorg *Reorg
+	if len(blocksToDisconnect) != 0 {
+		reorg = &Reorg{
+			Time:               time.Now().Unix(),
+			OldTipID:           *tipID,
+			OldTipHeight:       tipHeader.Height,
+			NewTipID:           id,
+			NewTipHeight:       block.Header.Height,
+			ForkID:             tipAncestorID,
+			ForkHeight:         tipAncestor.Height,
+			DisconnectedBlocks: blocksToDisconnect,
+			Source:             source,
+		}
+
+		if maxReorgDepth != 0 && int64(len(blocksToDisconnect)) > maxReorgDepth {
+			// refuse to switch. alert once per fork
+			reorg.Refused = true
+			if tipAncestorID != p.lastRefusedForkID {
+				p.lastRefusedForkID = tipAncestorID
+				p.reorgPolicy.onReorg(reorg)
+			}
+			// flag this as a side branch block
+			return p.ledger.SetBranchType(id, SIDE)
+		}
+	}
+
 	// we're at common ancestor. disconnect any main chain blocks we need to
 	for _, id := range blocksToDisconnect {
 		blockToDisconnect, err := p.blockStore.GetBlock(id)
 		if err != nil {
 			return err
 		}
-		if err := p.disconnectBlock(id, blockToDisconnect, source); err != nil {
+		txIDs, err := p.disconnectBlock(id, blockToDisconnect, source)
+		if err != nil {
 			return err
 		}
+		reorg.DisconnectedTransactions = append(reorg.DisconnectedTransactions, txIDs[1:]...)
 	}
 
 	// connect any new chain blocks we need to
@@ -904,29 +947,45 @@ func (p *Processor) acceptBlockContinue(
 	}
 
 	// and finally connect the new block
-	return p.connectBlock(id, block, source, false)
+	if err := p.connectBlock(id, block, source, false); err != nil {
+		return err
+	}
+
+	if reorg != nil {
+		p.reorgPolicy.onReorg(reorg)
+	}
+	return nil
 }
 
-// Update the ledger and transaction queue and notify undo tip channels
-func (p *Processor) disconnectBlock(id BlockID, block *Block, source string) error {
+// GetReorgs returns up to limit of the most recent reorganization records, newest first.
+func (p *Processor) GetReorgs(limit int) ([]*Reorg, error) {
+	if p.reorgPolicy.Store == nil {
+		return nil, fmt.Errorf("Reorganizations aren't being recorded")
+	}
+	return p.reorgPolicy.Store.Get(limit)
+}
+
+// Update the ledger and transaction queue and notify undo tip channels.
+// Returns the IDs of the block's transactions
+func (p *Processor) disconnectBlock(id BlockID, block *Block, source string) ([]TransactionID, error) {
 	// Update the ledger
 	txIDs, err := p.ledger.DisconnectBlock(id, block)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	log.Printf("Block %s has been disconnected, height: %d\n", id, block.Header.Height)
 
 	// Add newly disconnected non-coinbase transactions back to the queue
 	if err := p.txQueue.AddBatch(txIDs[1:], block.Transactions[1:], block.Header.Height-1); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Notify tip change channels
 	for ch := range p.tipChangeChannels {
 		ch <- TipChange{BlockID: id, Block: block, Source: source}
 	}
-	return nil
+	return txIDs, nil
 }
 
 // Update the ledger and transaction queue and notify new tip channels
@@ -968,7 +1027,8 @@ func (p *Processor) reconnectTip(id BlockID, source string) error {
 	if err != nil {
 		return err
 	}
-	return p.acceptBlockContinue(id, block, when, prevHeader, source)
+	// always restore the old tip regardless of its depth
+	return p.acceptBlockContinue(id, block, when, prevHeader, 0, source)
 }
 
 // Convenience method to get the current main chain's tip ID, header, and storage time.
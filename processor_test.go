@@ -3,7 +3,11 @@
 
 package cruzbit
 
-import "testing"
+import (
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
 
 func TestBlockCreationReward(t *testing.T) {
 	var maxHalvings int64 = 64
@@ -82,3 +86,69 @@ func TestComputeMaxTransactionsPerBlock(t *testing.T) {
 			MaxTransactionsPerBlockExceededAtHeight-1, max)
 	}
 }
+
+func TestReorgDepthLimit(t *testing.T) {
+	params := RegTestParams
+	genesis, genesisID, err := params.GenesisBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey2, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a main chain of 3 blocks and a fork from genesis with 4 blocks and more work
+	mineChain := func(pubKey ed25519.PublicKey, length int) ([]*Block, []BlockID) {
+		blocks, ids := []*Block{genesis}, []BlockID{genesisID}
+		for i := 0; i < length; i++ {
+			block, id := mineTestBlock(t, blocks[i], ids[i], pubKey)
+			blocks, ids = append(blocks, block), append(ids, id)
+		}
+		return blocks[1:], ids[1:]
+	}
+	mainBlocks, mainIDs := mineChain(pubKey, 3)
+	forkBlocks, forkIDs := mineChain(pubKey2, 4)
+
+	for _, maxDepth := range []int64{2, 0} {
+		blockStore := NewBlockStorageMemory()
+		ledger := NewLedgerMemory(params, false, blockStore)
+		processor := NewProcessor(params, genesisID, blockStore, NewTransactionQueueMemory(ledger),
+			ledger, nil, ReorgPolicy{MaxDepth: maxDepth})
+		process := func(ids []BlockID, blocks []*Block) {
+			for i, block := range blocks {
+				if err := processor.processBlock(ids[i], block, "test"); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		process([]BlockID{genesisID}, []*Block{genesis})
+		process(mainIDs, mainBlocks)
+		process(forkIDs, forkBlocks)
+
+		// switching to the fork disconnects 3 blocks
+		expectTipID, expectBranchType := mainIDs[2], BranchType(SIDE)
+		if maxDepth == 0 {
+			expectTipID, expectBranchType = forkIDs[3], MAIN
+		}
+		tipID, _, err := ledger.GetChainTip()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *tipID != expectTipID {
+			t.Fatalf("Expected tip %s with max depth %d, found %s", expectTipID, maxDepth, *tipID)
+		}
+		branchType, err := ledger.GetBranchType(forkIDs[3])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if branchType != expectBranchType {
+			t.Fatalf("Expected fork tip branch type %d with max depth %d, found %d",
+				expectBranchType, maxDepth, branchType)
+		}
+	}
+}
@@ -33,10 +33,11 @@ type GetBlockByHeightMessage struct {
 }
 
 // BlockMessage is used to send a peer a complete block.
-// Type: "block".
+// Type: "block". Error is set if the block can't be sent, e.g. its body has been pruned.
 type BlockMessage struct {
 	BlockID *BlockID `json:"block_id,omitempty"`
 	Block   *Block   `json:"block,omitempty"`
+	Error   string   `json:"error,omitempty"`
 }
 
 // GetBlockHeaderMessage is used to request a block header.
@@ -58,26 +59,285 @@ type BlockHeaderMessage struct {
 	BlockHeader *BlockHeader `json:"header,omitempty"`
 }
 
+// GetBlockHeadersByHeightMessage is used to request up to Count consecutive main chain block headers
+// starting at the given height. It's used to sync headers first during initial block download.
+// Type: "get_block_headers_by_height".
+type GetBlockHeadersByHeightMessage struct {
+	Height int64 `json:"height"`
+	Count  int   `json:"count"`
+}
+
+// BlockHeadersMessage is used to send a peer consecutive main chain block headers.
+// Fewer headers than requested means the peer's main chain ends with the last one.
+// Type: "block_headers".
+type BlockHeadersMessage struct {
+	Height  int64          `json:"height"`
+	Headers []*BlockHeader `json:"headers,omitempty"`
+}
+
+// GetReorgsMessage requests the peer's records of its most recent main chain reorganizations,
+// including those it refused for being too deep. They're operator data so only peers connecting
+// from the loopback interface are served.
+// Type: "get_reorgs".
+type GetReorgsMessage struct {
+	Limit int `json:"limit"`
+}
+
+// ReorgsMessage is used to send a peer records of main chain reorganizations, newest first.
+// Type: "reorgs".
+type ReorgsMessage struct {
+	Reorgs []*Reorg `json:"reorgs,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
 // FindCommonAncestorMessage is used to find a common ancestor with a peer.
 // Type: "find_common_ancestor".
 type FindCommonAncestorMessage struct {
 	BlockIDs []BlockID `json:"block_ids"`
 }
 
-// GetGraph requests a public key's directory graph
+// GetGraph requests a public key's directory graph.
+// Format is "dot" (the default) or "svg".
+// If KnownETag is the ETag of the peer's current rendering a not-modified reply is sent.
+// Graphs too large for one message are sent in pages. Cursor requests the page following the
+// one which returned it.
+// If DirectoryIDs is set the key's graphs in each of the listed directories are merged into
+// one graph linked by the entry links between them and DirectoryID is ignored.
 // Type: "get_graph".
 type GetGraphMessage struct {
-	PublicKey   ed25519.PublicKey `json:"public_key"`
-	DirectoryID string            `json:"directory_id"`
+	PublicKey    ed25519.PublicKey `json:"public_key"`
+	DirectoryID  string            `json:"directory_id"`
+	DirectoryIDs []string          `json:"directory_ids,omitempty"`
+	Format       string            `json:"format,omitempty"`
+	KnownETag    string            `json:"known_etag,omitempty"`
+	Cursor       string            `json:"cursor,omitempty"`
 }
 
 // GraphMessage is used to send a public key's graph to a peer.
+// NextCursor is set if there are more pages. ETag identifies the rendering of the requested graph
+// and format and changes whenever the index is updated or re-ranked.
 // Type: "graph".
 type GraphMessage struct {
+	BlockID     BlockID           `json:"block_id,omitempty"`
+	Height      int64             `json:"height,omitempty"`
+	PublicKey   ed25519.PublicKey `json:"public_key"`
+	Format      string            `json:"format,omitempty"`
+	Graph       string            `json:"graph"`
+	ETag        string            `json:"etag,omitempty"`
+	NotModified bool              `json:"not_modified,omitempty"`
+	NextCursor  string            `json:"next_cursor,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// GetTopRankedMessage requests the highest-ranked nodes in a directory.
+// Type: "get_top_ranked".
+type GetTopRankedMessage struct {
+	DirectoryID string `json:"directory_id"`
+	Prefix      string `json:"prefix,omitempty"`
+	ContentOnly bool   `json:"content_only,omitempty"`
+	StartTime   int64  `json:"start_time,omitempty"`
+	EndTime     int64  `json:"end_time,omitempty"`
+	Limit       int    `json:"limit"`
+}
+
+// TopRankedMessage is used to send a peer the highest-ranked nodes in a directory.
+// Type: "top_ranked".
+type TopRankedMessage struct {
+	BlockID     BlockID       `json:"block_id,omitempty"`
+	Height      int64         `json:"height,omitempty"`
+	DirectoryID string        `json:"directory_id"`
+	Entries     []RankedEntry `json:"entries,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// RankedEntry is an entry in the TopRankedMessage's Entries field.
+type RankedEntry struct {
+	Key      string  `json:"key"`
+	Label    string  `json:"label,omitempty"`
+	Memo     string  `json:"memo,omitempty"`
+	Revision uint    `json:"revision,omitempty"`
+	Time     int64   `json:"time,omitempty"`
+	Ranking  float64 `json:"ranking"`
+}
+
+// GetDirectoryTimelineMessage requests the entries posted in a directory during a given day, month or year.
+// Period is of the form "YYYY", "YYYY+MM" or "YYYY+MM+DD". If empty only the per-year counts are meaningful.
+// Type: "get_directory_timeline".
+type GetDirectoryTimelineMessage struct {
+	DirectoryID string `json:"directory_id"`
+	Period      string `json:"period,omitempty"`
+	Limit       int    `json:"limit"`
+}
+
+// DirectoryTimelineMessage is used to send a peer the entries posted in a directory during a given period
+// along with the number of entries posted in each of the period's months or days.
+// Type: "directory_timeline".
+type DirectoryTimelineMessage struct {
+	BlockID     BlockID          `json:"block_id,omitempty"`
+	Height      int64            `json:"height,omitempty"`
+	DirectoryID string           `json:"directory_id"`
+	Period      string           `json:"period,omitempty"`
+	Entries     []RankedEntry    `json:"entries,omitempty"`
+	Buckets     []TimelineBucket `json:"buckets,omitempty"`
+	Error       string           `json:"error,omitempty"`
+}
+
+// TimelineBucket is an entry in the DirectoryTimelineMessage's Buckets field.
+type TimelineBucket struct {
+	Period string `json:"period"`
+	Count  int    `json:"count"`
+}
+
+// GetKeyProfileMessage requests a public key's labels and directory participation.
+// Type: "get_key_profile".
+type GetKeyProfileMessage struct {
+	PublicKey ed25519.PublicKey `json:"public_key"`
+}
+
+// KeyProfileMessage is used to send a peer a public key's profile.
+// Type: "key_profile".
+type KeyProfileMessage struct {
 	BlockID   BlockID           `json:"block_id,omitempty"`
 	Height    int64             `json:"height,omitempty"`
 	PublicKey ed25519.PublicKey `json:"public_key"`
-	Graph     string            `json:"graph"`
+	Profile   *KeyProfile       `json:"profile,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// KeyProfile is a public key's current and past labels and the directories it participates in.
+// LabelCollisions lists other public keys currently using the same label (compared case-insensitively.)
+type KeyProfile struct {
+	Label           string              `json:"label,omitempty"`
+	Memo            string              `json:"memo,omitempty"`
+	LabelHistory    []KeyLabel          `json:"label_history,omitempty"`
+	LabelCollisions []ed25519.PublicKey `json:"label_collisions,omitempty"`
+	Directories     []KeyDirectory      `json:"directories,omitempty"`
+}
+
+// KeyLabel is an entry in the KeyProfile's LabelHistory field.
+type KeyLabel struct {
+	Label  string `json:"label"`
+	Memo   string `json:"memo,omitempty"`
+	Height int64  `json:"height"`
+	Time   int64  `json:"time"`
+}
+
+// KeyDirectory is a directory a public key participates in along with its balance and
+// ranking within the directory.
+type KeyDirectory struct {
+	DirectoryID string  `json:"directory_id"`
+	Label       string  `json:"label"`
+	Balance     int64   `json:"balance"`
+	Ranking     float64 `json:"ranking"`
+}
+
+// GetKeyDirectoriesMessage requests the directories a public key or path participates in
+// and the entry links to and from it.
+// Type: "get_key_directories".
+type GetKeyDirectoriesMessage struct {
+	PublicKey ed25519.PublicKey `json:"public_key"`
+}
+
+// KeyDirectoriesMessage is used to send a peer the directories a public key or path participates in.
+// Type: "key_directories".
+type KeyDirectoriesMessage struct {
+	BlockID     BlockID           `json:"block_id,omitempty"`
+	Height      int64             `json:"height,omitempty"`
+	PublicKey   ed25519.PublicKey `json:"public_key"`
+	Directories []KeyDirectory    `json:"directories,omitempty"`
+	Links       []EntryLink       `json:"links,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// EntryLink is a reference from a directory entry to an entry in the same or another directory.
+// Paths are the padded public keys the entries are written to.
+type EntryLink struct {
+	FromDirectoryID string `json:"from_directory_id"`
+	FromPath        string `json:"from_path"`
+	ToDirectoryID   string `json:"to_directory_id"`
+	ToPath          string `json:"to_path"`
+	Amount          int64  `json:"amount"`
+	Height          int64  `json:"height"`
+	Time            int64  `json:"time"`
+}
+
+// GetDirectoryPolicyMessage requests a directory's policy for writing entries.
+// Type: "get_directory_policy".
+type GetDirectoryPolicyMessage struct {
+	DirectoryID string `json:"directory_id"`
+}
+
+// DirectoryPolicyMessage is used to send a directory's policy to a peer.
+// Policy is omitted if the directory's owner hasn't set one.
+// Type: "directory_policy".
+type DirectoryPolicyMessage struct {
+	BlockID     BlockID          `json:"block_id,omitempty"`
+	Height      int64            `json:"height,omitempty"`
+	DirectoryID string           `json:"directory_id"`
+	Policy      *DirectoryPolicy `json:"policy,omitempty"`
+	Error       string           `json:"error,omitempty"`
+}
+
+// DirectoryPolicy restricts the entries written to a directory. Zero values are unrestricted.
+type DirectoryPolicy struct {
+	MinAmount   int64    `json:"min_amount,omitempty"`
+	RateLimit   int      `json:"rate_limit,omitempty"`
+	RateBlocks  int64    `json:"rate_blocks,omitempty"`
+	MaxDepth    int      `json:"max_depth,omitempty"`
+	MemoClasses []string `json:"memo_classes,omitempty"`
+	Height      int64    `json:"height"`
+}
+
+// GetRejectedWritesMessage requests the most recent writes to a directory which weren't indexed.
+// If PublicKey is set only writes from the key are returned.
+// Type: "get_rejected_writes".
+type GetRejectedWritesMessage struct {
+	DirectoryID string            `json:"directory_id"`
+	PublicKey   ed25519.PublicKey `json:"public_key,omitempty"`
+	Limit       int               `json:"limit"`
+}
+
+// RejectedWritesMessage is used to send a directory's rejected writes to a peer.
+// Type: "rejected_writes".
+type RejectedWritesMessage struct {
+	BlockID     BlockID         `json:"block_id,omitempty"`
+	Height      int64           `json:"height,omitempty"`
+	DirectoryID string          `json:"directory_id"`
+	Writes      []RejectedWrite `json:"writes,omitempty"`
+	Error       string          `json:"error,omitempty"`
+}
+
+// RejectedWrite is a write to a directory which wasn't indexed and the reason why.
+type RejectedWrite struct {
+	TransactionID TransactionID     `json:"transaction_id"`
+	PublicKey     ed25519.PublicKey `json:"public_key"`
+	Path          string            `json:"path"`
+	Height        int64             `json:"height"`
+	Reason        string            `json:"reason"`
+}
+
+// ResolveNameMessage requests the public key a name is registered to.
+// Type: "resolve_name".
+type ResolveNameMessage struct {
+	Name string `json:"name"`
+}
+
+// ResolvedNameMessage is used to send a name's registration to a peer.
+// Type: "resolved_name".
+type ResolvedNameMessage struct {
+	BlockID BlockID     `json:"block_id,omitempty"`
+	Height  int64       `json:"height,omitempty"`
+	Name    string      `json:"name"`
+	Record  *NameRecord `json:"record,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// NameRecord is a name's current registration.
+type NameRecord struct {
+	PublicKey     ed25519.PublicKey `json:"public_key"`
+	ClaimHeight   int64             `json:"claim_height"`
+	RenewHeight   int64             `json:"renew_height"`
+	ExpiresHeight int64             `json:"expires_height"`
 }
 
 // GetBalanceMessage requests a public key's balance.
@@ -117,6 +377,42 @@ type PublicKeyBalance struct {
 	Balance   int64             `json:"balance"`
 }
 
+// GetDirectoryBalanceMessage requests a public key's balance within a directory.
+// Type: "get_directory_balance".
+type GetDirectoryBalanceMessage struct {
+	DirectoryID string            `json:"directory_id"`
+	PublicKey   ed25519.PublicKey `json:"public_key"`
+}
+
+// DirectoryBalanceMessage is used to send a public key's directory balance to a peer.
+// Type: "directory_balance".
+type DirectoryBalanceMessage struct {
+	BlockID     BlockID           `json:"block_id,omitempty"`
+	Height      int64             `json:"height,omitempty"`
+	DirectoryID string            `json:"directory_id"`
+	PublicKey   ed25519.PublicKey `json:"public_key"`
+	Balance     int64             `json:"balance"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// GetDirectoryBalancesMessage requests the public keys holding the largest balances within a directory.
+// Type: "get_directory_balances".
+type GetDirectoryBalancesMessage struct {
+	DirectoryID string `json:"directory_id"`
+	Limit       int    `json:"limit"`
+}
+
+// DirectoryBalancesMessage is used to send a directory's top balances and total issued amount to a peer.
+// Type: "directory_balances".
+type DirectoryBalancesMessage struct {
+	BlockID     BlockID            `json:"block_id,omitempty"`
+	Height      int64              `json:"height,omitempty"`
+	DirectoryID string             `json:"directory_id"`
+	Issued      int64              `json:"issued"`
+	Balances    []PublicKeyBalance `json:"balances,omitempty"`
+	Error       string             `json:"error,omitempty"`
+}
+
 // GetTransactionMessage is used to request a confirmed transaction.
 // Type: "get_transaction".
 type GetTransactionMessage struct {
@@ -219,6 +515,13 @@ type PeerAddressesMessage struct {
 	Addresses []string `json:"addresses"`
 }
 
+// BlockAvailabilityMessage is used to communicate the lowest main chain height this node can send
+// block bodies for. It's non-zero for nodes which prune block bodies. Headers remain available.
+// Type: "block_availability". Sent in response to the empty "get_block_availability" message type.
+type BlockAvailabilityMessage struct {
+	LowestHeight int64 `json:"lowest_height"`
+}
+
 // TransactionRelayPolicyMessage is used to communicate this node's current settings for min fee and min amount.
 // Type: "transaction_relay_policy". Sent in response to the empty "get_transaction_relay_policy" message type.
 type TransactionRelayPolicyMessage struct {
@@ -258,3 +561,11 @@ type SubmitWorkResultMessage struct {
 	WorkID int32  `json:"work_id"`
 	Error  string `json:"error,omitempty"`
 }
+
+// UnsupportedQueryMessage is sent in reply to a message the peer doesn't handle, e.g. a query for
+// an index module it hasn't enabled. It lets clients fail fast instead of waiting for a reply.
+// Type: "unsupported_query"
+type UnsupportedQueryMessage struct {
+	Type  string `json:"type"`
+	Error string `json:"error"`
+}
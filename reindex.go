@@ -0,0 +1,405 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// HeaderIterableBlockStorage is block storage which can enumerate every stored block header.
+type HeaderIterableBlockStorage interface {
+	BlockStorage
+
+	// ForEachBlockHeader calls fn with every stored block header in no particular order.
+	ForEachBlockHeader(fn func(id BlockID, header *BlockHeader, when int64) error) error
+}
+
+// written beside the ledger while a reindex is in progress
+const reindexMarkerSuffix = ".reindex"
+
+// log progress every this many blocks
+const reindexProgressInterval = 1000
+
+// log progress of the consistency check every this many heights
+const checkLedgerProgressInterval = 50000
+
+// CheckLedgerDepth is the number of blocks below the tip CheckLedger looks at by default.
+const CheckLedgerDepth = 1000
+
+// records the chain being reindexed so an interrupted reindex can resume
+type reindexMarker struct {
+	TipID     BlockID   `json:"tip_id"`
+	TipHeight int64     `json:"tip_height"`
+	Invalid   []BlockID `json:"invalid,omitempty"` // blocks the ledger refused to connect
+}
+
+// ReindexInProgress returns true if a reindex of the ledger at ledgerPath was interrupted.
+func ReindexInProgress(ledgerPath string) (bool, error) {
+	_, err := os.Stat(ledgerPath + reindexMarkerSuffix)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Reindex rebuilds the ledger at ledgerPath, including branch types, the height index and public key
+// transaction indices, from the blocks in block storage. The new main chain is the most-work stored
+// chain descending from the genesis block which the ledger accepts. Blocks passed the processor's
+// context-free and header checks before they were stored so only the ledger's own checks are repeated.
+// Side branch blocks were never connected to a ledger so they may fail those. When a block fails
+// its branch is abandoned for the next best chain. Progress is recorded beside the ledger and an
+// interrupted reindex resumes from the ledger's tip when this is called again.
+func Reindex(params *ChainParams, genesisID BlockID, blockStore HeaderIterableBlockStorage,
+	ledgerPath string, prune bool) error {
+	lowestHeight, err := LowestAvailableHeight(blockStore)
+	if err != nil {
+		return err
+	}
+	if lowestHeight != 0 {
+		return fmt.Errorf("Block storage has been pruned below height %d, the ledger can't be rebuilt from it",
+			lowestHeight)
+	}
+
+	markerPath := ledgerPath + reindexMarkerSuffix
+	marker, err := readReindexMarker(markerPath)
+	if err != nil {
+		return err
+	}
+
+	if marker == nil {
+		// choose the chain and start over
+		log.Println("Finding the most-work chain in block storage...")
+		tipID, tipHeight, err := findBestStoredChain(genesisID, blockStore, nil)
+		if err != nil {
+			return err
+		}
+		marker = &reindexMarker{TipID: tipID, TipHeight: tipHeight}
+		if err := writeReindexMarker(markerPath, marker); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(ledgerPath); err != nil {
+			return err
+		}
+		log.Printf("Reindexing to tip %s, height: %d\n", tipID, tipHeight)
+	} else {
+		log.Printf("Resuming reindex to tip %s, height: %d\n", marker.TipID, marker.TipHeight)
+	}
+
+	ledger, err := NewLedgerDisk(params, ledgerPath, false, prune, blockStore)
+	if err != nil {
+		return err
+	}
+
+	for {
+		ids, err := walkStoredChain(genesisID, marker.TipID, blockStore)
+		if err != nil {
+			ledger.Close()
+			return err
+		}
+		invalidID, height, err := reindexLedger(ledger, blockStore, ids)
+		if err != nil {
+			ledger.Close()
+			return err
+		}
+		if invalidID == nil {
+			if err := markSideBranches(ledger, blockStore, ids); err != nil {
+				ledger.Close()
+				return err
+			}
+			break
+		}
+
+		// abandon the branch for the next best chain
+		marker.Invalid = append(marker.Invalid, *invalidID)
+		invalid := make(map[BlockID]bool)
+		for _, id := range marker.Invalid {
+			invalid[id] = true
+		}
+		tipID, tipHeight, err := findBestStoredChain(genesisID, blockStore, invalid)
+		if err != nil {
+			ledger.Close()
+			return err
+		}
+		marker.TipID, marker.TipHeight = tipID, tipHeight
+		if err := writeReindexMarker(markerPath, marker); err != nil {
+			ledger.Close()
+			return err
+		}
+		log.Printf("Block %s at height %d is invalid, reindexing to tip %s, height: %d\n",
+			*invalidID, height, tipID, tipHeight)
+	}
+
+	if err := ledger.Close(); err != nil {
+		return err
+	}
+	return os.Remove(markerPath)
+}
+
+// connect the chain to the ledger. blocks connected past the point where the ledger's chain forks from
+// it are disconnected first. returns the ID and height of the first block the ledger refuses, if any
+func reindexLedger(ledger Ledger, blockStore BlockStorage, ids []BlockID) (*BlockID, int64, error) {
+	tipHeight := int64(len(ids) - 1)
+
+	// resume after the ledger's tip
+	ledgerTipID, ledgerTipHeight, err := ledger.GetChainTip()
+	if err != nil {
+		return nil, 0, err
+	}
+	for ledgerTipID != nil && (ledgerTipHeight > tipHeight || ids[ledgerTipHeight] != *ledgerTipID) {
+		block, err := blockStore.GetBlock(*ledgerTipID)
+		if err != nil {
+			return nil, 0, err
+		}
+		if block == nil {
+			return nil, 0, fmt.Errorf("Block %s is missing from block storage", *ledgerTipID)
+		}
+		if _, err := ledger.DisconnectBlock(*ledgerTipID, block); err != nil {
+			return nil, 0, err
+		}
+		if ledgerTipID, ledgerTipHeight, err = ledger.GetChainTip(); err != nil {
+			return nil, 0, err
+		}
+	}
+	var startHeight int64
+	if ledgerTipID != nil {
+		startHeight = ledgerTipHeight + 1
+	}
+
+	start, connected := time.Now(), 0
+	for height := startHeight; height <= tipHeight; height++ {
+		block, err := blockStore.GetBlock(ids[height])
+		if err != nil {
+			return nil, 0, err
+		}
+		if block == nil {
+			log.Printf("Block %s at height %d is missing from block storage, stopping\n",
+				ids[height], height)
+			break
+		}
+		if _, err := ledger.ConnectBlock(ids[height], block); err != nil {
+			log.Printf("Error connecting block %s at height %d: %s\n", ids[height], height, err)
+			return &ids[height], height, nil
+		}
+		connected++
+
+		if (height+1)%reindexProgressInterval == 0 || height == tipHeight {
+			rate := float64(connected) / time.Since(start).Seconds()
+			log.Printf("Reindexed height %d of %d (%.1f%%), %.0f blocks/s\n",
+				height, tipHeight, float64(height+1)*100/float64(tipHeight+1), rate)
+		}
+	}
+	return nil, 0, nil
+}
+
+// mark every stored block not on the chain as a side branch.
+// blocks on the chain past the ledger's tip are left for the processor to reconsider
+func markSideBranches(ledger Ledger, blockStore HeaderIterableBlockStorage, ids []BlockID) error {
+	tipHeight := int64(len(ids) - 1)
+	var sideBlocks int
+	err := blockStore.ForEachBlockHeader(func(id BlockID, header *BlockHeader, when int64) error {
+		if header.Height <= tipHeight && ids[header.Height] == id {
+			return nil
+		}
+		sideBlocks++
+		return ledger.SetBranchType(id, SIDE)
+	})
+	if err != nil {
+		return err
+	}
+
+	_, height, err := ledger.GetChainTip()
+	if err != nil {
+		return err
+	}
+	log.Printf("Reindex complete, main chain blocks: %d, side branch blocks: %d\n", height+1, sideBlocks)
+	return nil
+}
+
+// CheckLedger verifies the ledger's chain tip is in block storage and its height index is contiguous
+// from the tip back to the base block. The base is the genesis block unless the ledger was started
+// from a snapshot. If depth isn't zero only that many blocks below the tip are checked.
+func CheckLedger(baseID BlockID, baseHeight, depth int64, ledger Ledger, blockStore BlockStorage) error {
+	tipID, tipHeight, err := ledger.GetChainTip()
+	if err != nil {
+		return err
+	}
+	if tipID == nil {
+		// nothing to check
+		return nil
+	}
+
+	// nothing should be indexed past the tip
+	nextID, err := ledger.GetBlockIDForHeight(tipHeight + 1)
+	if err != nil {
+		return err
+	}
+	if nextID != nil {
+		return fmt.Errorf("Height index has block %s past the tip at height %d", *nextID, tipHeight+1)
+	}
+
+	lowestHeight := baseHeight
+	if depth != 0 && tipHeight-depth+1 > baseHeight {
+		lowestHeight = tipHeight - depth + 1
+	}
+
+	expectID := *tipID
+	for height := tipHeight; height >= lowestHeight; height-- {
+		id, err := ledger.GetBlockIDForHeight(height)
+		if err != nil {
+			return err
+		}
+		if id == nil {
+			return fmt.Errorf("Height index is missing height %d", height)
+		}
+		if *id != expectID {
+			return fmt.Errorf("Height index has block %s at height %d, expected %s", *id, height, expectID)
+		}
+		header, _, err := blockStore.GetBlockHeader(*id)
+		if err != nil {
+			return err
+		}
+		if header == nil {
+			return fmt.Errorf("Block %s at height %d isn't in block storage", *id, height)
+		}
+		if header.Height != height {
+			return fmt.Errorf("Block %s is indexed at height %d but has height %d", *id, height, header.Height)
+		}
+		expectID = header.Previous
+
+		if height != lowestHeight && height%checkLedgerProgressInterval == 0 {
+			log.Printf("Checked ledger down to height %d\n", height)
+		}
+	}
+	if lowestHeight != baseHeight {
+		return nil
+	}
+
+	id, err := ledger.GetBlockIDForHeight(baseHeight)
+	if err != nil {
+		return err
+	}
+	if *id != baseID {
+		return fmt.Errorf("Height index has block %s at height %d, expected %s", *id, baseHeight, baseID)
+	}
+	return nil
+}
+
+// find the tip of the most-work stored chain which descends from the genesis block and doesn't
+// include an invalid block
+func findBestStoredChain(genesisID BlockID, blockStore HeaderIterableBlockStorage, invalid map[BlockID]bool) (
+	BlockID, int64, error) {
+	type storedHeader struct {
+		id     BlockID
+		header *BlockHeader
+		when   int64
+	}
+
+	var headers []storedHeader
+	err := blockStore.ForEachBlockHeader(func(id BlockID, header *BlockHeader, when int64) error {
+		headers = append(headers, storedHeader{id: id, header: header, when: when})
+		return nil
+	})
+	if err != nil {
+		return BlockID{}, 0, err
+	}
+
+	// best first
+	sort.Slice(headers, func(i, j int) bool {
+		return headers[i].header.Compare(headers[j].header, headers[i].when, headers[j].when)
+	})
+
+	for _, h := range headers {
+		if invalid[h.id] {
+			continue
+		}
+		ids, err := walkStoredChain(genesisID, h.id, blockStore)
+		if err != nil {
+			log.Printf("Skipping block %s: %s\n", h.id, err)
+			continue
+		}
+		if height, ok := firstInvalid(ids, invalid); ok {
+			// descendants of an invalid block are invalid
+			for _, id := range ids[height:] {
+				invalid[id] = true
+			}
+			continue
+		}
+		return h.id, h.header.Height, nil
+	}
+	return BlockID{}, 0, fmt.Errorf("No chain descending from genesis block %s in block storage", genesisID)
+}
+
+// returns the height of the first invalid block in the chain
+func firstInvalid(ids []BlockID, invalid map[BlockID]bool) (int64, bool) {
+	for height, id := range ids {
+		if invalid[id] {
+			return int64(height), true
+		}
+	}
+	return 0, false
+}
+
+// returns the IDs of the stored chain ending at the tip indexed by height
+func walkStoredChain(genesisID, tipID BlockID, blockStore BlockStorage) ([]BlockID, error) {
+	var ids []BlockID
+	id, height := tipID, int64(0)
+	for {
+		header, _, err := blockStore.GetBlockHeader(id)
+		if err != nil {
+			return nil, err
+		}
+		if header == nil {
+			return nil, fmt.Errorf("Block %s is missing from block storage", id)
+		}
+		if ids == nil {
+			if header.Height < 0 {
+				return nil, fmt.Errorf("Block %s has invalid height %d", id, header.Height)
+			}
+			height = header.Height
+			ids = make([]BlockID, height+1)
+		} else if header.Height != height {
+			return nil, fmt.Errorf("Block %s has height %d, expected %d", id, header.Height, height)
+		}
+		ids[height] = id
+		if height == 0 {
+			if id != genesisID {
+				return nil, fmt.Errorf("Chain descends from block %s instead of the genesis block", id)
+			}
+			return ids, nil
+		}
+		id, height = header.Previous, height-1
+	}
+}
+
+func readReindexMarker(markerPath string) (*reindexMarker, error) {
+	data, err := ioutil.ReadFile(markerPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	marker := new(reindexMarker)
+	if err := json.Unmarshal(data, marker); err != nil {
+		return nil, err
+	}
+	return marker, nil
+}
+
+func writeReindexMarker(markerPath string, marker *reindexMarker) error {
+	data, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(markerPath, data, 0600)
+}
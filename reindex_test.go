@@ -0,0 +1,230 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// store a block with a coinbase on top of the previous one
+func storeTestBlock(t *testing.T, blockStore BlockStorage, prev *Block, prevID BlockID, when int64, memo string) (
+	*Block, BlockID) {
+	pubKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	height := prev.Header.Height + 1
+	tx := NewTransaction(nil, pubKey, BlockCreationReward(height), 0, 0, 0, height, memo)
+	block, err := NewBlock(prevID, height, prev.Header.Target, prev.Header.ChainWork, []*Transaction{tx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := block.ID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blockStore.Store(id, block, when); err != nil {
+		t.Fatal(err)
+	}
+	return block, id
+}
+
+func TestReindex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	params := RegTestParams
+	genesis, genesisID, err := params.GenesisBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockStore, err := NewBlockStorageDisk(filepath.Join(dir, "blocks"), filepath.Join(dir, "headers.db"), false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockStore.Close()
+	if err := blockStore.Store(genesisID, genesis, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// a main chain of 5 blocks and a side branch at height 3 stored later
+	blocks, ids := []*Block{genesis}, []BlockID{genesisID}
+	for i := 0; i < 5; i++ {
+		block, id := storeTestBlock(t, blockStore, blocks[i], ids[i], int64(i+1), "main "+strconv.Itoa(i))
+		blocks, ids = append(blocks, block), append(ids, id)
+	}
+	_, sideID := storeTestBlock(t, blockStore, blocks[2], ids[2], 100, "side")
+
+	// the ledger has part of the chain when the reindex is interrupted
+	ledgerPath := filepath.Join(dir, "ledger.db")
+	if err := writeReindexMarker(ledgerPath+reindexMarkerSuffix, &reindexMarker{TipID: ids[5], TipHeight: 5}); err != nil {
+		t.Fatal(err)
+	}
+	ledger, err := NewLedgerDisk(params, ledgerPath, false, false, blockStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= 2; i++ {
+		if _, err := ledger.ConnectBlock(ids[i], blocks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ledger.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// resume
+	if inProgress, err := ReindexInProgress(ledgerPath); err != nil || !inProgress {
+		t.Fatalf("Expected reindex in progress, found %v %v", inProgress, err)
+	}
+	if err := Reindex(params, genesisID, blockStore, ledgerPath, false); err != nil {
+		t.Fatal(err)
+	}
+	if inProgress, err := ReindexInProgress(ledgerPath); err != nil || inProgress {
+		t.Fatalf("Expected reindex complete, found %v %v", inProgress, err)
+	}
+
+	ledger, err = NewLedgerDisk(params, ledgerPath, false, false, blockStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tipID, height, err := ledger.GetChainTip(); err != nil || *tipID != ids[5] || height != 5 {
+		t.Fatalf("Expected tip %s at height 5, found %v %d %v", ids[5], tipID, height, err)
+	}
+	if branchType, err := ledger.GetBranchType(sideID); err != nil || branchType != SIDE {
+		t.Fatalf("Expected side branch block, found %d %v", branchType, err)
+	}
+	if err := CheckLedger(genesisID, 0, 0, ledger, blockStore); err != nil {
+		t.Fatal(err)
+	}
+
+	// a tip missing from block storage is inconsistent
+	emptyStore, err := NewBlockStorageDisk(filepath.Join(dir, "empty"), filepath.Join(dir, "empty.db"), false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer emptyStore.Close()
+	if err := CheckLedger(genesisID, 0, 0, ledger, emptyStore); err == nil {
+		t.Fatal("Expected missing blocks to be inconsistent")
+	}
+	if err := ledger.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a fresh reindex picks the same chain
+	if err := Reindex(params, genesisID, blockStore, ledgerPath, false); err != nil {
+		t.Fatal(err)
+	}
+	ledger, err = NewLedgerDisk(params, ledgerPath, true, false, blockStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ledger.Close()
+	if tipID, _, err := ledger.GetChainTip(); err != nil || *tipID != ids[5] {
+		t.Fatalf("Expected tip %s, found %v %v", ids[5], tipID, err)
+	}
+}
+
+func TestReindexInvalidBranch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	params := RegTestParams
+	genesis, genesisID, err := params.GenesisBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockStore, err := NewBlockStorageDisk(filepath.Join(dir, "blocks"), filepath.Join(dir, "headers.db"), false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockStore.Close()
+	if err := blockStore.Store(genesisID, genesis, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// a main chain of 5 blocks
+	blocks, ids := []*Block{genesis}, []BlockID{genesisID}
+	for i := 0; i < 5; i++ {
+		block, id := storeTestBlock(t, blockStore, blocks[i], ids[i], int64(i+1), "main "+strconv.Itoa(i))
+		blocks, ids = append(blocks, block), append(ids, id)
+	}
+
+	// a side branch from height 2 with more work. its block at height 4 spends from an unfunded key
+	sideBlock, sideID := storeTestBlock(t, blockStore, blocks[2], ids[2], 10, "side")
+	sideIDs := []BlockID{sideID}
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := NewTransaction(pubKey, pubKey, 1, MinFeeCruzbits, 0, 0, 4, "")
+	if err := tx.Sign(privKey); err != nil {
+		t.Fatal(err)
+	}
+	pubKey2, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := NewTransaction(nil, pubKey2, BlockCreationReward(4)+MinFeeCruzbits, 0, 0, 0, 4, "")
+	invalidBlock, err := NewBlock(sideID, 4, sideBlock.Header.Target, sideBlock.Header.ChainWork,
+		[]*Transaction{coinbase, tx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalidID, err := invalidBlock.ID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blockStore.Store(invalidID, invalidBlock, 11); err != nil {
+		t.Fatal(err)
+	}
+	sideBlock, sideID = invalidBlock, invalidID
+	sideIDs = append(sideIDs, sideID)
+	for i := 0; i < 2; i++ {
+		sideBlock, sideID = storeTestBlock(t, blockStore, sideBlock, sideID, int64(12+i), "side "+strconv.Itoa(i))
+		sideIDs = append(sideIDs, sideID)
+	}
+
+	// the valid chain is reindexed instead
+	ledgerPath := filepath.Join(dir, "ledger.db")
+	if err := Reindex(params, genesisID, blockStore, ledgerPath, false); err != nil {
+		t.Fatal(err)
+	}
+	ledger, err := NewLedgerDisk(params, ledgerPath, true, false, blockStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ledger.Close()
+	if tipID, height, err := ledger.GetChainTip(); err != nil || *tipID != ids[5] || height != 5 {
+		t.Fatalf("Expected tip %s at height 5, found %v %d %v", ids[5], tipID, height, err)
+	}
+	for height, id := range ids {
+		if branchType, err := ledger.GetBranchType(id); err != nil || branchType != MAIN {
+			t.Fatalf("Expected main chain block at height %d, found %d %v", height, branchType, err)
+		}
+	}
+	for _, id := range sideIDs {
+		if branchType, err := ledger.GetBranchType(id); err != nil || branchType != SIDE {
+			t.Fatalf("Expected side branch block %s, found %d %v", id, branchType, err)
+		}
+	}
+	if err := CheckLedger(genesisID, 0, 0, ledger, blockStore); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckLedger(genesisID, 0, 2, ledger, blockStore); err != nil {
+		t.Fatal(err)
+	}
+}
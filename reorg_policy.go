@@ -0,0 +1,71 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ReorgPolicy configures how the processor handles main chain reorganizations.
+type ReorgPolicy struct {
+	// MaxDepth is the maximum number of main chain blocks a reorganization can disconnect.
+	// Deeper reorganizations are refused and raise an alert. Zero means there's no limit.
+	MaxDepth int64
+
+	// Store records every reorganization, including refused ones. May be nil.
+	Store ReorgStorage
+
+	// WebhookURL receives an HTTP POST of the JSON-encoded record of each refused
+	// reorganization. May be empty.
+	WebhookURL string
+}
+
+// Time allowed to deliver an alert to the webhook
+const reorgWebhookWait = 10 * time.Second
+
+// record a reorganization and raise an alert if it was refused
+func (r ReorgPolicy) onReorg(reorg *Reorg) {
+	if reorg.Refused {
+		log.Printf("ALERT: refused to reorganize %d blocks deep, maximum: %d, "+
+			"fork: %s, height: %d, tip: %s, candidate: %s, from: %s\n",
+			reorg.Depth(), r.MaxDepth, reorg.ForkID, reorg.ForkHeight,
+			reorg.OldTipID, reorg.NewTipID, reorg.Source)
+	} else {
+		log.Printf("Reorganized %d blocks deep, fork: %s, height: %d, old tip: %s, new tip: %s\n",
+			reorg.Depth(), reorg.ForkID, reorg.ForkHeight, reorg.OldTipID, reorg.NewTipID)
+	}
+
+	if r.Store != nil {
+		if err := r.Store.Store(reorg); err != nil {
+			log.Printf("Error storing reorganization record: %s\n", err)
+		}
+	}
+
+	if reorg.Refused && len(r.WebhookURL) != 0 {
+		go postReorgAlert(r.WebhookURL, reorg)
+	}
+}
+
+// deliver an alert to the webhook
+func postReorgAlert(url string, reorg *Reorg) {
+	body, err := json.Marshal(reorg)
+	if err != nil {
+		log.Printf("Error encoding reorganization alert: %s\n", err)
+		return
+	}
+	client := http.Client{Timeout: reorgWebhookWait}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error posting reorganization alert: %s\n", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("Reorganization alert webhook responded with status: %s\n", resp.Status)
+	}
+}
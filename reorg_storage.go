@@ -0,0 +1,33 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+// Reorg is a record of a main chain reorganization or of one which was refused for being too deep.
+type Reorg struct {
+	Time                     int64           `json:"time"`
+	OldTipID                 BlockID         `json:"old_tip_id"`
+	OldTipHeight             int64           `json:"old_tip_height"`
+	NewTipID                 BlockID         `json:"new_tip_id"`
+	NewTipHeight             int64           `json:"new_tip_height"`
+	ForkID                   BlockID         `json:"fork_id"`
+	ForkHeight               int64           `json:"fork_height"`
+	DisconnectedBlocks       []BlockID       `json:"disconnected_blocks"`
+	DisconnectedTransactions []TransactionID `json:"disconnected_transactions,omitempty"`
+	Refused                  bool            `json:"refused,omitempty"`
+	Source                   string          `json:"source,omitempty"`
+}
+
+// Depth returns the number of main chain blocks the reorganization disconnected.
+func (r Reorg) Depth() int {
+	return len(r.DisconnectedBlocks)
+}
+
+// ReorgStorage is an interface for storing records of main chain reorganizations.
+type ReorgStorage interface {
+	// Store stores a record of a reorganization.
+	Store(reorg *Reorg) error
+
+	// Get returns up to limit of the most recent reorganizations, newest first.
+	Get(limit int) ([]*Reorg, error)
+}
@@ -0,0 +1,81 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// ReorgStorageDisk is an on-disk implementation of the ReorgStorage interface using LevelDB.
+type ReorgStorageDisk struct {
+	db   *leveldb.DB
+	seq  uint64
+	lock sync.Mutex
+}
+
+// NewReorgStorageDisk returns a new ReorgStorageDisk instance.
+func NewReorgStorageDisk(dbPath string, readOnly bool) (*ReorgStorageDisk, error) {
+	opts := opt.Options{ReadOnly: readOnly}
+	db, err := leveldb.OpenFile(dbPath, &opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// continue the sequence after the latest record
+	var seq uint64
+	iter := db.NewIterator(nil, nil)
+	if iter.Last() {
+		seq = binary.BigEndian.Uint64(iter.Key())
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &ReorgStorageDisk{db: db, seq: seq}, nil
+}
+
+// Store implements ReorgStorage.
+func (r *ReorgStorageDisk) Store(reorg *Reorg) error {
+	value, err := json.Marshal(reorg)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, r.seq+1)
+	if err := r.db.Put(key, value, nil); err != nil {
+		return err
+	}
+	r.seq++
+	return nil
+}
+
+// Get implements ReorgStorage.
+func (r *ReorgStorageDisk) Get(limit int) ([]*Reorg, error) {
+	var reorgs []*Reorg
+	iter := r.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for ok := iter.Last(); ok && (limit <= 0 || len(reorgs) < limit); ok = iter.Prev() {
+		reorg := new(Reorg)
+		if err := json.Unmarshal(iter.Value(), reorg); err != nil {
+			return nil, err
+		}
+		reorgs = append(reorgs, reorg)
+	}
+	return reorgs, iter.Error()
+}
+
+// Close is called to close any underlying storage.
+func (r *ReorgStorageDisk) Close() error {
+	return r.db.Close()
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReorgStorageDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reorgs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbPath := filepath.Join(dir, "reorgs.db")
+
+	store, err := NewReorgStorageDisk(dbPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		reorg := &Reorg{
+			OldTipHeight:       int64(i),
+			DisconnectedBlocks: make([]BlockID, i),
+			Refused:            i == 2,
+		}
+		if err := store.Store(reorg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// records continue after reopening
+	store, err = NewReorgStorageDisk(dbPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Store(&Reorg{OldTipHeight: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	reorgs, err := store.Get(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reorgs) != 3 {
+		t.Fatalf("Expected 3 records, found %d", len(reorgs))
+	}
+	for i, reorg := range reorgs {
+		if reorg.OldTipHeight != int64(4-i) {
+			t.Fatalf("Expected newest record first, found height %d at %d", reorg.OldTipHeight, i)
+		}
+	}
+	if !reorgs[2].Refused || reorgs[2].Depth() != 2 {
+		t.Fatalf("Expected refused reorganization 2 blocks deep, found %v %d",
+			reorgs[2].Refused, reorgs[2].Depth())
+	}
+}
+
+func TestReorgPolicyAlert(t *testing.T) {
+	alerts := make(chan *Reorg, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reorg := new(Reorg)
+		if err := json.NewDecoder(r.Body).Decode(reorg); err != nil {
+			t.Error(err)
+		}
+		alerts <- reorg
+	}))
+	defer server.Close()
+
+	policy := ReorgPolicy{MaxDepth: 1, WebhookURL: server.URL}
+
+	// accepted reorganizations don't alert
+	policy.onReorg(&Reorg{DisconnectedBlocks: make([]BlockID, 1), NewTipHeight: 1})
+	policy.onReorg(&Reorg{DisconnectedBlocks: make([]BlockID, 2), NewTipHeight: 2, Refused: true})
+
+	select {
+	case reorg := <-alerts:
+		if !reorg.Refused || reorg.NewTipHeight != 2 {
+			t.Fatalf("Expected alert for the refused reorganization, found %+v", reorg)
+		}
+	case <-time.After(reorgWebhookWait):
+		t.Fatal("Timed out waiting for alert")
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
+)
+
+// SignatureCache remembers transaction signatures which have been verified so transactions
+// verified on entry to the queue aren't verified again when they're included in a block.
+// When it's full a random entry is evicted to make room.
+type SignatureCache struct {
+	max     int
+	entries map[[32]byte]struct{}
+	lock    sync.RWMutex
+}
+
+// NewSignatureCache returns a new SignatureCache holding up to max entries.
+func NewSignatureCache(max int) *SignatureCache {
+	return &SignatureCache{
+		max:     max,
+		entries: make(map[[32]byte]struct{}),
+	}
+}
+
+// the transaction ID commits to the sender so the ID and signature identify a verification
+func signatureCacheKey(id TransactionID, signature Signature) [32]byte {
+	var key [32]byte
+	hasher := sha3.New256()
+	hasher.Write(id[:])
+	hasher.Write(signature)
+	hasher.Sum(key[:0])
+	return key
+}
+
+// Exists returns true if the transaction's signature has been verified.
+func (s *SignatureCache) Exists(id TransactionID, signature Signature) bool {
+	key := signatureCacheKey(id, signature)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	_, ok := s.entries[key]
+	return ok
+}
+
+// Add records that the transaction's signature has been verified.
+func (s *SignatureCache) Add(id TransactionID, signature Signature) {
+	key := signatureCacheKey(id, signature)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.entries) >= s.max {
+		// map iteration order is random
+		for evict := range s.entries {
+			delete(s.entries, evict)
+			break
+		}
+	}
+	s.entries[key] = struct{}{}
+}
+
+// Len returns the number of entries in the cache.
+func (s *SignatureCache) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.entries)
+}
+
+// the minimum number of transactions worth handing to each verification worker
+const minTransactionsPerVerifier = 16
+
+// Computes the IDs of the transactions and verifies the signatures of those which aren't coinbases
+// across a bounded pool of workers. Signatures found in the cache aren't verified and newly verified
+// signatures are added to it. If skipSignatures is true only the IDs are computed. If any transaction
+// fails, the error for the one with the lowest index is returned.
+func verifyTransactions(txs []*Transaction, cache *SignatureCache, skipSignatures bool) (
+	[]TransactionID, error) {
+	ids := make([]TransactionID, len(txs))
+	errs := make([]error, len(txs))
+
+	verify := func(i int) {
+		tx := txs[i]
+		id, err := tx.ID()
+		if err != nil {
+			errs[i] = err
+			return
+		}
+		ids[i] = id
+		if skipSignatures || tx.IsCoinbase() {
+			return
+		}
+		if cache != nil && cache.Exists(id, tx.Signature) {
+			return
+		}
+		if !ed25519.Verify(tx.From, id[:], tx.Signature) {
+			errs[i] = fmt.Errorf("Signature verification failed, transaction: %s", id)
+			return
+		}
+		if cache != nil {
+			cache.Add(id, tx.Signature)
+		}
+	}
+
+	workers := runtime.NumCPU()
+	if n := (len(txs) + minTransactionsPerVerifier - 1) / minTransactionsPerVerifier; n < workers {
+		workers = n
+	}
+
+	if workers <= 1 {
+		for i := range txs {
+			verify(i)
+		}
+	} else {
+		// each worker takes every nth transaction
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := w; i < len(txs); i += workers {
+					verify(i)
+				}
+			}(w)
+		}
+		wg.Wait()
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
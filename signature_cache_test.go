@@ -0,0 +1,126 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// create a synthetic block's transactions: a coinbase followed by n signed transactions
+func makeTestSignedTransactions(tb testing.TB, n int) []*Transaction {
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	pubKey2, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	txs := []*Transaction{NewTransaction(nil, pubKey, InitialCoinbaseReward, 0, 0, 0, 0, "")}
+	for i := 0; i < n; i++ {
+		tx := NewTransaction(pubKey, pubKey2, CruzbitsPerCruz, MinFeeCruzbits, 0, 0, 0, "")
+		if err := tx.Sign(privKey); err != nil {
+			tb.Fatal(err)
+		}
+		txs = append(txs, tx)
+	}
+	return txs
+}
+
+func TestVerifyTransactions(t *testing.T) {
+	txs := makeTestSignedTransactions(t, 100)
+	cache := NewSignatureCache(1000)
+
+	ids, err := verifyTransactions(txs, cache, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tx := range txs {
+		id, err := tx.ID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids[i] != id {
+			t.Fatalf("Expected ID %s at index %d, found %s", id, i, ids[i])
+		}
+	}
+	if cache.Len() != 100 {
+		t.Fatalf("Expected 100 verified signatures, found %d", cache.Len())
+	}
+
+	// the first failure is reported
+	txs[40].Signature, txs[70].Signature = txs[41].Signature, txs[71].Signature
+	_, err = verifyTransactions(txs, cache, false)
+	id40, _ := txs[40].ID()
+	if err == nil || !strings.Contains(err.Error(), id40.String()) {
+		t.Fatalf("Expected failure for transaction %s, found %v", id40, err)
+	}
+
+	// unless signatures are skipped
+	if _, err := verifyTransactions(txs, cache, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignatureCacheEviction(t *testing.T) {
+	txs := makeTestSignedTransactions(t, 10)
+	cache := NewSignatureCache(5)
+	for _, tx := range txs[1:] {
+		id, err := tx.ID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.Add(id, tx.Signature)
+		if !cache.Exists(id, tx.Signature) {
+			t.Fatal("Expected signature in the cache")
+		}
+		if cache.Exists(id, txs[0].Signature) {
+			t.Fatal("Expected other signature not to be in the cache")
+		}
+	}
+	if cache.Len() != 5 {
+		t.Fatalf("Expected cache to be full at 5 entries, found %d", cache.Len())
+	}
+}
+
+func benchmarkVerifyTransactions(b *testing.B, verify func([]*Transaction) error) {
+	txs := makeTestSignedTransactions(b, InitialMaxTransactionsPerBlock-1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := verify(txs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// the original serial verification for comparison
+func BenchmarkVerifyTransactionsSerial(b *testing.B) {
+	benchmarkVerifyTransactions(b, func(txs []*Transaction) error {
+		for _, tx := range txs[1:] {
+			if ok, err := tx.Verify(); err != nil || !ok {
+				b.Fatal("Verification failed")
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkVerifyTransactionsParallel(b *testing.B) {
+	benchmarkVerifyTransactions(b, func(txs []*Transaction) error {
+		_, err := verifyTransactions(txs, nil, false)
+		return err
+	})
+}
+
+func BenchmarkVerifyTransactionsCached(b *testing.B) {
+	cache := NewSignatureCache(InitialMaxTransactionsPerBlock)
+	benchmarkVerifyTransactions(b, func(txs []*Transaction) error {
+		_, err := verifyTransactions(txs, cache, false)
+		return err
+	})
+}
@@ -0,0 +1,572 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pierrec/lz4"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
+)
+
+// LedgerSnapshot is the state of the ledger at a main chain height along with the most recent
+// blocks a node needs to continue validating the chain from there.
+type LedgerSnapshot struct {
+	GenesisID BlockID
+	Height    int64
+	TipID     BlockID
+	Blocks    []*Block           // in height order ending with the tip
+	Balances  []PublicKeyBalance // non-zero balances in public key order
+}
+
+// SnapshotHash is the commitment to the contents of a ledger snapshot.
+type SnapshotHash [32]byte
+
+// String implements the Stringer interface.
+func (h SnapshotHash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+// MarshalJSON marshals SnapshotHash as a hex string.
+func (h SnapshotHash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.String())
+}
+
+// UnmarshalJSON unmarshals a hex string to SnapshotHash.
+func (h *SnapshotHash) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return h.SetString(s)
+}
+
+// SetString sets the hash from its hex encoding.
+func (h *SnapshotHash) SetString(s string) error {
+	hashBytes, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(hashBytes) != len(h) {
+		return fmt.Errorf("Invalid snapshot hash length %d", len(hashBytes))
+	}
+	copy(h[:], hashBytes)
+	return nil
+}
+
+// SnapshotInfo describes the snapshot a ledger was started from.
+type SnapshotInfo struct {
+	BaseID     BlockID      `json:"base_id"`     // the earliest block in the ledger
+	BaseHeight int64        `json:"base_height"` // its height
+	TipID      BlockID      `json:"tip_id"`      // the tip when the snapshot was taken
+	Height     int64        `json:"height"`      // its height
+	Hash       SnapshotHash `json:"hash"`
+	Validated  bool         `json:"validated"` // true once the preceding history has been validated
+}
+
+// SnapshotMagic begins every uncompressed snapshot stream.
+const SnapshotMagic = "CRUZSNAP"
+
+// SnapshotVersion is the current version of the snapshot format.
+const SnapshotVersion = 1
+
+// DefaultSnapshotReorgDepth is the reorganization depth snapshots leave room for by default.
+const DefaultSnapshotReorgDepth = 100
+
+// SnapshotWindow returns the number of blocks preceding and including a snapshot's tip which it
+// includes. They cover target and median time computation, coinbase maturity, transaction replay
+// protection for the current and previous series and room for a reorganization of up to
+// maxReorgDepth blocks.
+func SnapshotWindow(params *ChainParams, maxReorgDepth int64) int64 {
+	window := int64(2 * BlocksUntilNewSeries)
+	for _, n := range []int64{params.RetargetInterval, params.RetargetSmaWindow,
+		params.CoinbaseMaturity, NumBlocksForMedianTmestamp} {
+		if n > window {
+			window = n
+		}
+	}
+	return window + 1 + maxReorgDepth
+}
+
+// NewLedgerSnapshot returns a snapshot of the ledger at the given main chain height. Balances at
+// heights below the tip are computed by undoing the effect of the blocks above it. It includes
+// enough blocks for nodes started from it to handle reorganizations of up to maxReorgDepth blocks.
+func NewLedgerSnapshot(params *ChainParams, genesisID BlockID, ledger *LedgerDisk, blockStore BlockStorage,
+	height, maxReorgDepth int64) (*LedgerSnapshot, error) {
+	_, tipHeight, err := ledger.GetChainTip()
+	if err != nil {
+		return nil, err
+	}
+	if height < 0 || height > tipHeight {
+		return nil, fmt.Errorf("Height %d is beyond the tip at height %d", height, tipHeight)
+	}
+
+	getBlock := func(height int64) (BlockID, *Block, error) {
+		id, err := ledger.GetBlockIDForHeight(height)
+		if err != nil {
+			return BlockID{}, nil, err
+		}
+		if id == nil {
+			return BlockID{}, nil, fmt.Errorf("No block found at height %d", height)
+		}
+		block, err := blockStore.GetBlock(*id)
+		if err != nil {
+			return BlockID{}, nil, err
+		}
+		if block == nil {
+			return BlockID{}, nil, fmt.Errorf("Block %s not found", *id)
+		}
+		return *id, block, nil
+	}
+
+	// undo the blocks above the height
+	undone := make(map[[ed25519.PublicKeySize]byte]int64)
+	adjust := func(pubKey ed25519.PublicKey, amount int64) error {
+		var pk [ed25519.PublicKeySize]byte
+		copy(pk[:], pubKey)
+		balance, ok := undone[pk]
+		if !ok {
+			var err error
+			if balance, err = ledger.GetPublicKeyBalance(pubKey); err != nil {
+				return err
+			}
+		}
+		undone[pk] = balance + amount
+		return nil
+	}
+	for h := tipHeight; h > height; h-- {
+		_, block, err := getBlock(h)
+		if err != nil {
+			return nil, err
+		}
+		for i := len(block.Transactions) - 1; i >= 0; i-- {
+			tx := block.Transactions[i]
+			if !tx.IsCoinbase() {
+				if err := adjust(tx.To, -tx.Amount); err != nil {
+					return nil, err
+				}
+				if err := adjust(tx.From, tx.Amount+tx.Fee); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if params.CoinbaseMaturity == 0 {
+				if err := adjust(tx.To, -tx.Amount); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if h-params.CoinbaseMaturity >= 0 {
+				// this block matured an earlier coinbase
+				oldID, _, err := getBlock(h - params.CoinbaseMaturity)
+				if err != nil {
+					return nil, err
+				}
+				oldTx, _, err := blockStore.GetTransaction(oldID, 0)
+				if err != nil {
+					return nil, err
+				}
+				if err := adjust(oldTx.To, -oldTx.Amount); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	snapshot := &LedgerSnapshot{GenesisID: genesisID, Height: height}
+
+	// collect balances
+	err = ledger.forEachPublicKeyBalance(func(pubKey ed25519.PublicKey, balance int64) error {
+		var pk [ed25519.PublicKeySize]byte
+		copy(pk[:], pubKey)
+		if _, ok := undone[pk]; ok {
+			return nil
+		}
+		snapshot.Balances = append(snapshot.Balances, PublicKeyBalance{PublicKey: pubKey, Balance: balance})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for pk, balance := range undone {
+		if balance < 0 {
+			return nil, fmt.Errorf("Negative balance %d for %s at height %d",
+				balance, base64.StdEncoding.EncodeToString(pk[:]), height)
+		}
+		if balance == 0 {
+			continue
+		}
+		pubKey := make(ed25519.PublicKey, ed25519.PublicKeySize)
+		copy(pubKey, pk[:])
+		snapshot.Balances = append(snapshot.Balances, PublicKeyBalance{PublicKey: pubKey, Balance: balance})
+	}
+	sort.Slice(snapshot.Balances, func(i, j int) bool {
+		return bytes.Compare(snapshot.Balances[i].PublicKey, snapshot.Balances[j].PublicKey) < 0
+	})
+
+	// collect the recent blocks
+	start := height - SnapshotWindow(params, maxReorgDepth) + 1
+	if start < 0 {
+		start = 0
+	}
+	for h := start; h <= height; h++ {
+		id, block, err := getBlock(h)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Blocks = append(snapshot.Blocks, block)
+		snapshot.TipID = id
+	}
+	return snapshot, nil
+}
+
+// Hash computes the snapshot's commitment. It commits to the genesis block, the tip, the IDs of
+// the included blocks and every balance.
+func (s *LedgerSnapshot) Hash() (SnapshotHash, error) {
+	hasher := sha3.New256()
+	hasher.Write(s.GenesisID[:])
+	binary.Write(hasher, binary.BigEndian, s.Height)
+	hasher.Write(s.TipID[:])
+	binary.Write(hasher, binary.BigEndian, int64(len(s.Blocks)))
+	for _, block := range s.Blocks {
+		id, err := block.ID()
+		if err != nil {
+			return SnapshotHash{}, err
+		}
+		hasher.Write(id[:])
+	}
+	binary.Write(hasher, binary.BigEndian, int64(len(s.Balances)))
+	for _, balance := range s.Balances {
+		hasher.Write(balance.PublicKey)
+		binary.Write(hasher, binary.BigEndian, balance.Balance)
+	}
+	var hash SnapshotHash
+	hasher.Sum(hash[:0])
+	return hash, nil
+}
+
+// Verify checks the snapshot is internally consistent and consistent with the network's
+// parameters and that it has enough blocks for reorganizations of up to maxReorgDepth blocks.
+// The balances are trusted to the extent the snapshot's hash is trusted.
+func (s *LedgerSnapshot) Verify(params *ChainParams, genesisID BlockID, maxReorgDepth int64) error {
+	if s.GenesisID != genesisID {
+		return fmt.Errorf("Snapshot is for genesis block %s, expected %s", s.GenesisID, genesisID)
+	}
+	if len(s.Blocks) == 0 {
+		return fmt.Errorf("Snapshot has no blocks")
+	}
+
+	// the blocks form a chain ending with the tip
+	var prevID BlockID
+	for i, block := range s.Blocks {
+		id, err := block.ID()
+		if err != nil {
+			return err
+		}
+		if block.Header.Height == 0 && id != genesisID {
+			return fmt.Errorf("Snapshot block %s at height 0 isn't the genesis block", id)
+		}
+		if i != 0 {
+			if block.Header.Previous != prevID {
+				return fmt.Errorf("Snapshot block %s doesn't follow block %s", id, prevID)
+			}
+			if block.Header.Height != s.Blocks[i-1].Header.Height+1 {
+				return fmt.Errorf("Snapshot block %s has unexpected height %d", id, block.Header.Height)
+			}
+		}
+		if id != genesisID && !block.CheckPOW(id) {
+			return fmt.Errorf("Snapshot block %s has insufficient proof-of-work", id)
+		}
+		if err := params.CheckpointCheck(id, block.Header.Height); err != nil {
+			return err
+		}
+		if _, err := verifyTransactions(block.Transactions, nil, false); err != nil {
+			return err
+		}
+		prevID = id
+	}
+	tip := s.Blocks[len(s.Blocks)-1]
+	if prevID != s.TipID || tip.Header.Height != s.Height {
+		return fmt.Errorf("Snapshot tip %s at height %d doesn't match its last block", s.TipID, s.Height)
+	}
+	if window := SnapshotWindow(params, maxReorgDepth); s.Blocks[0].Header.Height != 0 && int64(len(s.Blocks)) < window {
+		return fmt.Errorf("Snapshot has %d blocks, expected at least %d for a reorganization depth of %d",
+			len(s.Blocks), window, maxReorgDepth)
+	}
+
+	// balances are sorted, unique and positive
+	var total int64
+	for i, balance := range s.Balances {
+		if len(balance.PublicKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("Invalid public key length %d", len(balance.PublicKey))
+		}
+		if i != 0 && bytes.Compare(s.Balances[i-1].PublicKey, balance.PublicKey) >= 0 {
+			return fmt.Errorf("Snapshot balances aren't sorted by public key")
+		}
+		if balance.Balance <= 0 {
+			return fmt.Errorf("Invalid balance %d", balance.Balance)
+		}
+		total += balance.Balance
+	}
+
+	// the balances account for exactly the issued supply
+	var expect int64
+	if s.Height-params.CoinbaseMaturity >= 0 {
+		for h := int64(0); h <= s.Height-params.CoinbaseMaturity; h++ {
+			expect += BlockCreationReward(h)
+		}
+		// immature coinbases hold the fees paid in their blocks
+		for _, block := range s.Blocks {
+			h := block.Header.Height
+			if h > s.Height-params.CoinbaseMaturity {
+				expect -= block.Transactions[0].Amount - BlockCreationReward(h)
+			}
+		}
+	}
+	if total != expect {
+		return fmt.Errorf("Snapshot balances total %d, expected %d", total, expect)
+	}
+	return nil
+}
+
+// Write writes the snapshot to w. If compress is true it's compressed with lz4.
+//
+// format: {magic}{version}{genesis id}{height}{tip id}{block count}[{length}{block json}...]
+// {balance count}[{public key}{balance}...]{hash}
+func (s *LedgerSnapshot) Write(w io.Writer, compress bool) error {
+	var zw *lz4.Writer
+	if compress {
+		zw = lz4.NewWriter(w)
+		w = zw
+	}
+	bw := bufio.NewWriter(w)
+
+	hash, err := s.Hash()
+	if err != nil {
+		return err
+	}
+
+	bw.WriteString(SnapshotMagic)
+	bw.WriteByte(SnapshotVersion)
+	bw.Write(s.GenesisID[:])
+	binary.Write(bw, binary.BigEndian, s.Height)
+	bw.Write(s.TipID[:])
+	binary.Write(bw, binary.BigEndian, uint32(len(s.Blocks)))
+	for _, block := range s.Blocks {
+		blockJson, err := json.Marshal(block)
+		if err != nil {
+			return err
+		}
+		binary.Write(bw, binary.BigEndian, uint32(len(blockJson)))
+		bw.Write(blockJson)
+	}
+	binary.Write(bw, binary.BigEndian, uint64(len(s.Balances)))
+	for _, balance := range s.Balances {
+		bw.Write(balance.PublicKey)
+		binary.Write(bw, binary.BigEndian, balance.Balance)
+	}
+	bw.Write(hash[:])
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if zw != nil {
+		return zw.Close()
+	}
+	return nil
+}
+
+// ReadLedgerSnapshot reads a snapshot written by Write from r. Compressed snapshots are
+// detected automatically. It returns an error if the contents don't match the hash.
+func ReadLedgerSnapshot(r io.Reader) (*LedgerSnapshot, SnapshotHash, error) {
+	var hash SnapshotHash
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(lz4FrameMagic))
+	if err != nil {
+		return nil, hash, err
+	}
+	if bytes.Equal(magic, lz4FrameMagic) {
+		r = bufio.NewReader(lz4.NewReader(br))
+	} else {
+		r = br
+	}
+
+	header := make([]byte, len(SnapshotMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, hash, err
+	}
+	if string(header[:len(SnapshotMagic)]) != SnapshotMagic {
+		return nil, hash, fmt.Errorf("Not a snapshot file")
+	}
+	if version := header[len(SnapshotMagic)]; version != SnapshotVersion {
+		return nil, hash, fmt.Errorf("Unsupported snapshot version %d", version)
+	}
+
+	s := new(LedgerSnapshot)
+	if _, err := io.ReadFull(r, s.GenesisID[:]); err != nil {
+		return nil, hash, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &s.Height); err != nil {
+		return nil, hash, err
+	}
+	if _, err := io.ReadFull(r, s.TipID[:]); err != nil {
+		return nil, hash, err
+	}
+
+	var blockCount uint32
+	if err := binary.Read(r, binary.BigEndian, &blockCount); err != nil {
+		return nil, hash, err
+	}
+	for i := uint32(0); i < blockCount; i++ {
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return nil, hash, err
+		}
+		if n > maxBootstrapBlockLength {
+			return nil, hash, fmt.Errorf("Block of %d bytes exceeds maximum length %d", n, maxBootstrapBlockLength)
+		}
+		blockJson := make([]byte, n)
+		if _, err := io.ReadFull(r, blockJson); err != nil {
+			return nil, hash, err
+		}
+		block := new(Block)
+		if err := json.Unmarshal(blockJson, block); err != nil {
+			return nil, hash, err
+		}
+		s.Blocks = append(s.Blocks, block)
+	}
+
+	var balanceCount uint64
+	if err := binary.Read(r, binary.BigEndian, &balanceCount); err != nil {
+		return nil, hash, err
+	}
+	for i := uint64(0); i < balanceCount; i++ {
+		pubKey := make(ed25519.PublicKey, ed25519.PublicKeySize)
+		if _, err := io.ReadFull(r, pubKey); err != nil {
+			return nil, hash, err
+		}
+		var balance int64
+		if err := binary.Read(r, binary.BigEndian, &balance); err != nil {
+			return nil, hash, err
+		}
+		s.Balances = append(s.Balances, PublicKeyBalance{PublicKey: pubKey, Balance: balance})
+	}
+
+	if _, err := io.ReadFull(r, hash[:]); err != nil {
+		return nil, hash, err
+	}
+	computed, err := s.Hash()
+	if err != nil {
+		return nil, hash, err
+	}
+	if computed != hash {
+		return nil, hash, fmt.Errorf("Snapshot contents don't match hash %s", hash)
+	}
+	return s, hash, nil
+}
+
+// BackValidateSnapshot validates the history preceding the snapshot a ledger was started from.
+// It processes the blocks in a bootstrap stream with a separate processor and ledger in dir
+// until it reaches the snapshot's height and then compares the resulting snapshot's hash.
+// Blocks are fully validated as if they came from peers. dir is removed when it's done.
+func BackValidateSnapshot(params *ChainParams, info *SnapshotInfo, r io.Reader, dir string) error {
+	genesisBlock, genesisID, err := params.GenesisBlock()
+	if err != nil {
+		return err
+	}
+	br, err := NewBootstrapReader(r)
+	if err != nil {
+		return err
+	}
+	if br.GenesisID() != genesisID {
+		return fmt.Errorf("Bootstrap file is for genesis block %s, expected %s", br.GenesisID(), genesisID)
+	}
+
+	// start from scratch
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	blockStore, err := NewBlockStorageDisk(filepath.Join(dir, "blocks"), filepath.Join(dir, "headers.db"),
+		false, false, false)
+	if err != nil {
+		return err
+	}
+	defer blockStore.Close()
+	ledger, err := NewLedgerDisk(params, filepath.Join(dir, "ledger.db"), false, false, blockStore)
+	if err != nil {
+		return err
+	}
+	defer ledger.Close()
+
+	processor := NewProcessor(params, genesisID, blockStore, NewTransactionQueueMemory(ledger), ledger,
+		nil, ReorgPolicy{})
+	processor.Run()
+	defer processor.Shutdown()
+
+	if err := processor.ProcessBlock(genesisID, genesisBlock, ""); err != nil {
+		return err
+	}
+	for {
+		_, height, err := ledger.GetChainTip()
+		if err != nil {
+			return err
+		}
+		if height >= info.Height {
+			break
+		}
+		block, id, err := br.ReadBlock()
+		if err == io.EOF {
+			return fmt.Errorf("Bootstrap file ends at height %d before the snapshot's height %d",
+				height, info.Height)
+		}
+		if err != nil {
+			return err
+		}
+		if block.Header.Height > info.Height {
+			continue
+		}
+		if err := processor.ProcessBlock(id, block, "backvalidate"); err != nil {
+			return fmt.Errorf("Error processing block %s at height %d: %s", id, block.Header.Height, err)
+		}
+		if block.Header.Height%bootstrapProgressInterval == 0 {
+			log.Printf("Back-validated height %d of %d\n", block.Header.Height, info.Height)
+		}
+	}
+
+	// recreate the snapshot with the same number of blocks
+	maxReorgDepth := info.Height - info.BaseHeight + 1 - SnapshotWindow(params, 0)
+	if maxReorgDepth < 0 {
+		maxReorgDepth = 0
+	}
+	snapshot, err := NewLedgerSnapshot(params, genesisID, ledger, blockStore, info.Height, maxReorgDepth)
+	if err != nil {
+		return err
+	}
+	if snapshot.TipID != info.TipID {
+		return fmt.Errorf("Validated block %s at height %d, snapshot has %s",
+			snapshot.TipID, info.Height, info.TipID)
+	}
+	hash, err := snapshot.Hash()
+	if err != nil {
+		return err
+	}
+	if hash != info.Hash {
+		return fmt.Errorf("Validated history has hash %s, snapshot has %s", hash, info.Hash)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// mine a block on top of the previous one with a coinbase paying the reward and fees to pubKey
+func mineTestBlock(t *testing.T, prev *Block, prevID BlockID, pubKey ed25519.PublicKey, txs ...*Transaction) (
+	*Block, BlockID) {
+	height := prev.Header.Height + 1
+	reward := BlockCreationReward(height)
+	for _, tx := range txs {
+		reward += tx.Fee
+	}
+	coinbase := NewTransaction(nil, pubKey, reward, 0, 0, 0, height, "")
+	block, err := NewBlock(prevID, height, prev.Header.Target, prev.Header.ChainWork,
+		append([]*Transaction{coinbase}, txs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block.Header.Time = prev.Header.Time + 1
+	for {
+		id, err := block.ID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.CheckPOW(id) {
+			return block, id
+		}
+		block.Header.Nonce++
+	}
+}
+
+type testSnapshotNode struct {
+	blockStore *BlockStorageDisk
+	ledger     *LedgerDisk
+}
+
+func newTestSnapshotNode(t *testing.T, params *ChainParams, dir string) *testSnapshotNode {
+	blockStore, err := NewBlockStorageDisk(filepath.Join(dir, "blocks"), filepath.Join(dir, "headers.db"), false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledger, err := NewLedgerDisk(params, filepath.Join(dir, "ledger.db"), false, false, blockStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSnapshotNode{blockStore: blockStore, ledger: ledger}
+}
+
+func (n *testSnapshotNode) connect(t *testing.T, ids []BlockID, blocks []*Block) {
+	for i, block := range blocks {
+		if err := n.blockStore.Store(ids[i], block, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := n.ledger.ConnectBlock(ids[i], block); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (n *testSnapshotNode) close() {
+	n.ledger.Close()
+	n.blockStore.Close()
+}
+
+func TestLedgerSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	params := *RegTestParams
+	params.CoinbaseMaturity = 2
+	genesis, genesisID, err := params.GenesisBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey2, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// spend a matured coinbase at height 4
+	blocks, ids := []*Block{genesis}, []BlockID{genesisID}
+	for height := int64(1); height <= 6; height++ {
+		var txs []*Transaction
+		if height == 4 {
+			tx := NewTransaction(pubKey, pubKey2, CruzbitsPerCruz, MinFeeCruzbits, 0, 0, height, "")
+			if err := tx.Sign(privKey); err != nil {
+				t.Fatal(err)
+			}
+			txs = append(txs, tx)
+		}
+		block, id := mineTestBlock(t, blocks[height-1], ids[height-1], pubKey, txs...)
+		blocks, ids = append(blocks, block), append(ids, id)
+	}
+
+	node := newTestSnapshotNode(t, &params, filepath.Join(dir, "node"))
+	defer node.close()
+	node.connect(t, ids, blocks)
+
+	// a snapshot below the tip matches one taken from a ledger at that height.
+	// the genesis block, pubKey and pubKey2 have balances
+	partial := newTestSnapshotNode(t, &params, filepath.Join(dir, "partial"))
+	partial.connect(t, ids[:5], blocks[:5])
+	for height := int64(4); height <= 6; height++ {
+		snapshot, err := NewLedgerSnapshot(&params, genesisID, node.ledger, node.blockStore, height, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := snapshot.Verify(&params, genesisID, 0); err != nil {
+			t.Fatalf("Snapshot at height %d failed verification: %s", height, err)
+		}
+		if height != 4 {
+			continue
+		}
+		expect, err := NewLedgerSnapshot(&params, genesisID, partial.ledger, partial.blockStore, height, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, _ := snapshot.Hash()
+		expectHash, _ := expect.Hash()
+		if hash != expectHash || len(snapshot.Balances) != 3 {
+			t.Fatalf("Expected snapshot %s with 3 balances, found %s with %d", expectHash, hash, len(snapshot.Balances))
+		}
+	}
+	partial.close()
+
+	snapshot, err := NewLedgerSnapshot(&params, genesisID, node.ledger, node.blockStore, 6, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := snapshot.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// round trip
+	for _, compress := range []bool{false, true} {
+		buf := new(bytes.Buffer)
+		if err := snapshot.Write(buf, compress); err != nil {
+			t.Fatal(err)
+		}
+		read, readHash, err := ReadLedgerSnapshot(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if readHash != hash || len(read.Blocks) != 7 || read.TipID != ids[6] {
+			t.Fatalf("Expected snapshot %s, found %s", hash, readHash)
+		}
+	}
+
+	// inflated balances are rejected
+	snapshot.Balances[0].Balance++
+	if err := snapshot.Verify(&params, genesisID, 0); err == nil {
+		t.Fatal("Expected inflated snapshot to fail verification")
+	}
+	snapshot.Balances[0].Balance--
+
+	// start a new node from the snapshot
+	fresh := newTestSnapshotNode(t, &params, filepath.Join(dir, "fresh"))
+	defer fresh.close()
+	if err := fresh.ledger.ImportSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := fresh.ledger.ImportSnapshot(snapshot); err == nil {
+		t.Fatal("Expected import into a non-empty ledger to fail")
+	}
+	for _, pk := range []ed25519.PublicKey{pubKey, pubKey2} {
+		expect, _ := node.ledger.GetPublicKeyBalance(pk)
+		found, err := fresh.ledger.GetPublicKeyBalance(pk)
+		if err != nil || found != expect {
+			t.Fatalf("Expected balance %d, found %d %v", expect, found, err)
+		}
+	}
+	info, err := fresh.ledger.GetSnapshotInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || info.Hash != hash || info.BaseID != genesisID || info.Validated {
+		t.Fatalf("Unexpected snapshot info %+v", info)
+	}
+	if err := CheckLedger(info.BaseID, info.BaseHeight, 0, fresh.ledger, fresh.blockStore); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new node continues the chain
+	block, id := mineTestBlock(t, blocks[6], ids[6], pubKey2)
+	fresh.connect(t, []BlockID{id}, []*Block{block})
+}
+
+func TestBackValidateSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backvalidate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	params := RegTestParams
+	genesis, genesisID, err := params.GenesisBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks, ids := []*Block{genesis}, []BlockID{genesisID}
+	for i := 0; i < 4; i++ {
+		block, id := mineTestBlock(t, blocks[i], ids[i], pubKey)
+		blocks, ids = append(blocks, block), append(ids, id)
+	}
+	node := newTestSnapshotNode(t, params, filepath.Join(dir, "node"))
+	defer node.close()
+	node.connect(t, ids, blocks)
+
+	snapshot, err := NewLedgerSnapshot(params, genesisID, node.ledger, node.blockStore, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := snapshot.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &SnapshotInfo{TipID: ids[3], Height: 3, Hash: hash}
+
+	history := new(bytes.Buffer)
+	if _, err := ExportBlocks(history, genesisID, node.ledger, node.blockStore, 0, 4, true); err != nil {
+		t.Fatal(err)
+	}
+	data := history.Bytes()
+
+	if err := BackValidateSnapshot(params, info, bytes.NewReader(data), filepath.Join(dir, "validate")); err != nil {
+		t.Fatal(err)
+	}
+
+	info.Hash[0]++
+	if err := BackValidateSnapshot(params, info, bytes.NewReader(data), filepath.Join(dir, "validate")); err == nil {
+		t.Fatal("Expected mismatched snapshot to fail back-validation")
+	}
+}
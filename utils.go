@@ -121,6 +121,17 @@ func pubKeyToString(ppk ed25519.PublicKey) string {
 	return base64.StdEncoding.EncodeToString(ppk[:])
 }
 
+func pubKeyFromString(pk string) (ed25519.PublicKey, error) {
+	pubKeyBytes, err := base64.StdEncoding.DecodeString(pk)
+	if err != nil {
+		return nil, err
+	}
+	if len(pubKeyBytes) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Invalid public key: %s", pk)
+	}
+	return ed25519.PublicKey(pubKeyBytes), nil
+}
+
 // pads the input string to the required Base64 length for ED25519 keys
 func pad44(input string) string {
 	// ED25519 keys are 32 bytes, which in Base64 is 44 characters including padding
@@ -8,11 +8,13 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/url"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/seiflotfy/cuckoofilter"
@@ -231,7 +233,7 @@ func (w *Wallet) SetFilterBlockCallback(callback func(*FilterBlockMessage)) {
 // GetBalance returns a public key's balance as well as the current block height.
 func (w *Wallet) GetBalance(pubKey ed25519.PublicKey) (int64, int64, error) {
 	w.outChan <- Message{Type: "get_balance", Body: GetBalanceMessage{PublicKey: pubKey}}
-	result := <-w.resultChan
+	result := w.nextResult()
 	if len(result.err) != 0 {
 		return 0, 0, fmt.Errorf("%s", result.err)
 	}
@@ -245,7 +247,7 @@ func (w *Wallet) GetBalance(pubKey ed25519.PublicKey) (int64, int64, error) {
 // GetBalances returns a set of public key balances as well as the current block height.
 func (w *Wallet) GetBalances(pubKeys []ed25519.PublicKey) ([]PublicKeyBalance, int64, error) {
 	w.outChan <- Message{Type: "get_balances", Body: GetBalancesMessage{PublicKeys: pubKeys}}
-	result := <-w.resultChan
+	result := w.nextResult()
 	if len(result.err) != 0 {
 		return nil, 0, fmt.Errorf("%s", result.err)
 	}
@@ -256,10 +258,110 @@ func (w *Wallet) GetBalances(pubKeys []ed25519.PublicKey) ([]PublicKeyBalance, i
 	return b.Balances, b.Height, nil
 }
 
+// GetDirectoryBalance returns a public key's balance within a directory as well as the indexed block height.
+func (w *Wallet) GetDirectoryBalance(directoryID string, pubKey ed25519.PublicKey) (int64, int64, error) {
+	w.outChan <- Message{
+		Type: "get_directory_balance",
+		Body: GetDirectoryBalanceMessage{DirectoryID: directoryID, PublicKey: pubKey},
+	}
+	result := w.nextResult()
+	if len(result.err) != 0 {
+		return 0, 0, fmt.Errorf("%s", result.err)
+	}
+	b := new(DirectoryBalanceMessage)
+	if err := json.Unmarshal(result.message, b); err != nil {
+		return 0, 0, err
+	}
+	if len(b.Error) != 0 {
+		return 0, 0, fmt.Errorf("%s", b.Error)
+	}
+	return b.Balance, b.Height, nil
+}
+
+// GetDirectoryBalances returns the largest balances within a directory, the total amount issued
+// by the directory as well as the indexed block height.
+func (w *Wallet) GetDirectoryBalances(directoryID string, limit int) ([]PublicKeyBalance, int64, int64, error) {
+	w.outChan <- Message{
+		Type: "get_directory_balances",
+		Body: GetDirectoryBalancesMessage{DirectoryID: directoryID, Limit: limit},
+	}
+	result := w.nextResult()
+	if len(result.err) != 0 {
+		return nil, 0, 0, fmt.Errorf("%s", result.err)
+	}
+	b := new(DirectoryBalancesMessage)
+	if err := json.Unmarshal(result.message, b); err != nil {
+		return nil, 0, 0, err
+	}
+	if len(b.Error) != 0 {
+		return nil, 0, 0, fmt.Errorf("%s", b.Error)
+	}
+	return b.Balances, b.Issued, b.Height, nil
+}
+
+// ErrNameResolutionUnavailable is returned by ResolveName when the peer doesn't resolve names.
+var ErrNameResolutionUnavailable = errors.New("Peer doesn't resolve names")
+
+// how long to wait for a peer to resolve a name. older peers don't reply to unknown queries
+var resolveNameTimeout = 10 * time.Second
+
+// ResolveName returns the registration of a name as well as the indexed block height.
+func (w *Wallet) ResolveName(name string) (*NameRecord, int64, error) {
+	w.outChan <- Message{Type: "resolve_name", Body: ResolveNameMessage{Name: name}}
+	timeout := time.After(resolveNameTimeout)
+	rn := new(ResolvedNameMessage)
+	for {
+		var result walletResult
+		select {
+		case result = <-w.resultChan:
+		case <-timeout:
+			// a late reply is dropped by whichever request reads it
+			return nil, 0, ErrNameResolutionUnavailable
+		}
+		if result.unsupported && result.messageType == "resolve_name" {
+			return nil, 0, ErrNameResolutionUnavailable
+		}
+		if len(result.err) != 0 {
+			return nil, 0, fmt.Errorf("%s", result.err)
+		}
+		if result.messageType != "resolved_name" {
+			return nil, 0, fmt.Errorf("Unexpected reply %s to resolve_name", result.messageType)
+		}
+		if err := json.Unmarshal(result.message, rn); err != nil {
+			return nil, 0, err
+		}
+		if normalizeLabel(rn.Name) == normalizeLabel(name) {
+			break
+		}
+		// the reply to an earlier request which timed out
+	}
+	if len(rn.Error) != 0 {
+		return nil, 0, fmt.Errorf("%s", rn.Error)
+	}
+	return rn.Record, rn.Height, nil
+}
+
+// GetKeyProfile returns a public key's labels and directory participation as well as the indexed block height.
+func (w *Wallet) GetKeyProfile(pubKey ed25519.PublicKey) (*KeyProfile, int64, error) {
+	w.outChan <- Message{Type: "get_key_profile", Body: GetKeyProfileMessage{PublicKey: pubKey}}
+	result := w.nextResult()
+	if len(result.err) != 0 {
+		return nil, 0, fmt.Errorf("%s", result.err)
+	}
+	kp := new(KeyProfileMessage)
+	if err := json.Unmarshal(result.message, kp); err != nil {
+		return nil, 0, err
+	}
+	if len(kp.Error) != 0 {
+		return nil, 0, fmt.Errorf("%s", kp.Error)
+	}
+	return kp.Profile, kp.Height, nil
+}
+
 // GetTipHeader returns the current tip of the main chain's header.
 func (w *Wallet) GetTipHeader() (BlockID, BlockHeader, error) {
 	w.outChan <- Message{Type: "get_tip_header"}
-	result := <-w.resultChan
+	result := w.nextResult()
 	if len(result.err) != 0 {
 		return BlockID{}, BlockHeader{}, fmt.Errorf("%s", result.err)
 	}
@@ -273,7 +375,7 @@ func (w *Wallet) GetTipHeader() (BlockID, BlockHeader, error) {
 // GetTransactionRelayPolicy returns the peer's transaction relay policy.
 func (w *Wallet) GetTransactionRelayPolicy() (minFee, minAmount int64, err error) {
 	w.outChan <- Message{Type: "get_transaction_relay_policy"}
-	result := <-w.resultChan
+	result := w.nextResult()
 	if len(result.err) != 0 {
 		return 0, 0, fmt.Errorf("%s", result.err)
 	}
@@ -294,7 +396,7 @@ func (w *Wallet) SetFilter() error {
 		},
 	}
 	w.outChan <- m
-	result := <-w.resultChan
+	result := w.nextResult()
 	if len(result.err) != 0 {
 		return fmt.Errorf("%s", result.err)
 	}
@@ -310,7 +412,7 @@ func (w *Wallet) AddFilter(pubKey ed25519.PublicKey) error {
 		},
 	}
 	w.outChan <- m
-	result := <-w.resultChan
+	result := w.nextResult()
 	if len(result.err) != 0 {
 		return fmt.Errorf("%s", result.err)
 	}
@@ -359,7 +461,7 @@ func (w *Wallet) Send(from, to ed25519.PublicKey, amount, fee, matures, expires
 
 	// push it
 	w.outChan <- Message{Type: "push_transaction", Body: PushTransactionMessage{Transaction: tx}}
-	result := <-w.resultChan
+	result := w.nextResult()
 
 	// handle result
 	if len(result.err) != 0 {
@@ -378,7 +480,7 @@ func (w *Wallet) Send(from, to ed25519.PublicKey, amount, fee, matures, expires
 // GetTransaction retrieves information about a historic transaction.
 func (w *Wallet) GetTransaction(id TransactionID) (*Transaction, *BlockID, int64, error) {
 	w.outChan <- Message{Type: "get_transaction", Body: GetTransactionMessage{TransactionID: id}}
-	result := <-w.resultChan
+	result := w.nextResult()
 	if len(result.err) != 0 {
 		return nil, nil, 0, fmt.Errorf("%s", result.err)
 	}
@@ -401,7 +503,7 @@ func (w *Wallet) GetPublicKeyTransactions(
 		Limit:       limit,
 	}
 	w.outChan <- Message{Type: "get_public_key_transactions", Body: gpkt}
-	result := <-w.resultChan
+	result := w.nextResult()
 	if len(result.err) != 0 {
 		return 0, 0, 0, nil, fmt.Errorf("%s", result.err)
 	}
@@ -443,8 +545,25 @@ func (w *Wallet) VerifyKey(pubKey ed25519.PublicKey) error {
 
 // Used to hold the result of synchronous requests
 type walletResult struct {
-	err     string
-	message json.RawMessage
+	err         string
+	message     json.RawMessage
+	messageType string // the type of the reply or of the unsupported request
+	unsupported bool   // the peer doesn't handle the request
+}
+
+// is the result a reply to resolve_name
+func (r walletResult) isNameResolution() bool {
+	return r.messageType == "resolved_name" || (r.unsupported && r.messageType == "resolve_name")
+}
+
+// Waits for the result of a synchronous request. Replies to resolve_name requests which timed out
+// may arrive late and are dropped
+func (w *Wallet) nextResult() walletResult {
+	for {
+		if result := <-w.resultChan; !result.isNameResolution() {
+			return result
+		}
+	}
 }
 
 // Run executes the Wallet's main loop in its own goroutine.
@@ -498,22 +617,34 @@ func (w *Wallet) run() {
 			}
 			switch m.Type {
 			case "balance":
-				w.resultChan <- walletResult{message: body}
+				w.resultChan <- walletResult{message: body, messageType: m.Type}
 
 			case "tip_header":
-				w.resultChan <- walletResult{message: body}
+				w.resultChan <- walletResult{message: body, messageType: m.Type}
+
+			case "key_profile":
+				w.resultChan <- walletResult{message: body, messageType: m.Type}
+
+			case "directory_balance":
+				w.resultChan <- walletResult{message: body, messageType: m.Type}
+
+			case "directory_balances":
+				w.resultChan <- walletResult{message: body, messageType: m.Type}
+
+			case "resolved_name":
+				w.resultChan <- walletResult{message: body, messageType: m.Type}
 
 			case "transaction_relay_policy":
-				w.resultChan <- walletResult{message: body}
+				w.resultChan <- walletResult{message: body, messageType: m.Type}
 
 			case "push_transaction_result":
-				w.resultChan <- walletResult{message: body}
+				w.resultChan <- walletResult{message: body, messageType: m.Type}
 
 			case "transaction":
-				w.resultChan <- walletResult{message: body}
+				w.resultChan <- walletResult{message: body, messageType: m.Type}
 
 			case "public_key_transactions":
-				w.resultChan <- walletResult{message: body}
+				w.resultChan <- walletResult{message: body, messageType: m.Type}
 
 			case "filter_result":
 				if len(body) != 0 {
@@ -528,6 +659,15 @@ func (w *Wallet) run() {
 					w.resultChan <- walletResult{}
 				}
 
+			case "unsupported_query":
+				uq := new(UnsupportedQueryMessage)
+				if err := json.Unmarshal(body, uq); err != nil {
+					log.Printf("Error: %s, from: %s\n", err, w.conn.RemoteAddr())
+					w.resultChan <- walletResult{err: err.Error()}
+					break
+				}
+				w.resultChan <- walletResult{err: uq.Error, messageType: uq.Type, unsupported: true}
+
 			case "push_transaction":
 				pt := new(PushTransactionMessage)
 				if err := json.Unmarshal(body, pt); err != nil {
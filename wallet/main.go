@@ -7,7 +7,6 @@ import (
 	"bufio"
 	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -31,8 +30,9 @@ import (
 func main() {
 	rand.Seed(time.Now().UnixNano())
 
-	DefaultPeer := "127.0.0.1:" + strconv.Itoa(DefaultCruzbitPort)
-	peerPtr := flag.String("peer", DefaultPeer, "Address of a peer to connect to")
+	peerPtr := flag.String("peer", "", "Address of a peer to connect to (default 127.0.0.1 on the network's port)")
+	networkPtr := flag.String("network", MainNetParams.Name,
+		"Network to connect to (available: "+strings.Join(NetworkNames(), ", ")+")")
 	dbPathPtr := flag.String("walletdb", "", "Path to a wallet database (created if it doesn't exist)")
 	tlsVerifyPtr := flag.Bool("tlsverify", false, "Verify the TLS certificate of the peer is signed by a recognized CA and the host matches the CN")
 	recoverPtr := flag.Bool("recover", false, "Attempt to recover a corrupt walletdb")
@@ -41,26 +41,28 @@ func main() {
 	if len(*dbPathPtr) == 0 {
 		log.Fatal("Path to the wallet database required")
 	}
+
+	params, err := ChainParamsForNetwork(*networkPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if len(*peerPtr) == 0 {
-		log.Fatal("Peer address required")
+		*peerPtr = "127.0.0.1"
 	}
 	// add default port, if one was not supplied
 	i := strings.LastIndex(*peerPtr, ":")
 	if i < 0 {
-		*peerPtr = *peerPtr + ":" + strconv.Itoa(DefaultCruzbitPort)
+		*peerPtr = *peerPtr + ":" + strconv.Itoa(params.DefaultPort)
 	}
 
 	// load genesis block
-	var genesisBlock Block
-	if err := json.Unmarshal([]byte(GenesisBlockJson), &genesisBlock); err != nil {
-		log.Fatal(err)
-	}
-	genesisID, err := genesisBlock.ID()
+	_, genesisID, err := params.GenesisBlock()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	fmt.Println("Starting up...")
+	fmt.Printf("Starting up on %s...\n", params.Name)
 	fmt.Printf("Genesis block ID: %s\n", genesisID)
 
 	if *recoverPtr {
@@ -166,6 +168,7 @@ func main() {
 			{Text: "genkeys", Description: "Generate multiple keys at once"},
 			{Text: "dumpkeys", Description: "Dump all of the wallet's public keys to a text file"},
 			{Text: "balance", Description: "Retrieve the current balance of all public keys"},
+			{Text: "dirbalance", Description: "Retrieve the directory balance of all public keys and the directory's top holders"},
 			{Text: "send", Description: "Send cruzbits to someone"},
 			{Text: "show", Description: "Show new incoming transactions"},
 			{Text: "txstatus", Description: "Show confirmed transaction information given a transaction ID"},
@@ -287,6 +290,54 @@ func main() {
 			amount := roundFloat(float64(total), 8) / CruzbitsPerCruz
 			fmt.Printf("%s: %.8f\n", aurora.Bold("Total"), amount)
 
+		case "dirbalance":
+			if err := connectWallet(); err != nil {
+				fmt.Printf("Error: %s\n", err)
+				break
+			}
+			directoryID, err := promptForString("Directory ID", "", bufio.NewReader(os.Stdin))
+			if err != nil {
+				fmt.Printf("Error: %s\n", err)
+				break
+			}
+			pubKeys, err := wallet.GetKeys()
+			if err != nil {
+				fmt.Printf("Error: %s\n", err)
+				break
+			}
+			var total int64
+			for i, pubKey := range pubKeys {
+				balance, _, err := wallet.GetDirectoryBalance(directoryID, pubKey)
+				if err != nil {
+					fmt.Printf("Error: %s\n", err)
+					break
+				}
+				amount := roundFloat(float64(balance), 8) / CruzbitsPerCruz
+				fmt.Printf("%4d: %s %16.8f\n",
+					i+1,
+					base64.StdEncoding.EncodeToString(pubKey[:]),
+					amount)
+				total += balance
+			}
+			amount := roundFloat(float64(total), 8) / CruzbitsPerCruz
+			fmt.Printf("%s: %.8f\n", aurora.Bold("Total"), amount)
+
+			holders, issued, _, err := wallet.GetDirectoryBalances(directoryID, 10)
+			if err != nil {
+				fmt.Printf("Error: %s\n", err)
+				break
+			}
+			amount = roundFloat(float64(issued), 8) / CruzbitsPerCruz
+			fmt.Printf("%s: %.8f\n", aurora.Bold("Issued"), amount)
+			fmt.Printf("%s:\n", aurora.Bold("Top holders"))
+			for i, holder := range holders {
+				amount := roundFloat(float64(holder.Balance), 8) / CruzbitsPerCruz
+				fmt.Printf("%4d: %s %16.8f\n",
+					i+1,
+					base64.StdEncoding.EncodeToString(holder.PublicKey[:]),
+					amount)
+			}
+
 		case "send":
 			if err := connectWallet(); err != nil {
 				fmt.Printf("Error: %s\n", err)
@@ -403,7 +454,7 @@ func main() {
 				break
 			}
 			var total int64
-			lastHeight := tipHeader.Height - CoinbaseMaturity
+			lastHeight := tipHeader.Height - params.CoinbaseMaturity
 		gpkt:
 			for i, pubKey := range pubKeys {
 				var rewards, startHeight int64 = 0, lastHeight + 1
@@ -588,7 +639,7 @@ func sendTransaction(wallet *Wallet) (TransactionID, error) {
 	}
 
 	// prompt for to
-	to, err := promptForPublicKey("To", 6, reader)
+	to, err := promptForRecipient(wallet, "To", 6, reader)
 	if err != nil {
 		return TransactionID{}, err
 	}
@@ -652,6 +703,40 @@ func promptForPublicKey(prompt string, rightJustify int, reader *bufio.Reader) (
 	return ed25519.PublicKey(pubKeyBytes), nil
 }
 
+// accepts either a public key or a registered name
+func promptForRecipient(wallet *Wallet, prompt string, rightJustify int, reader *bufio.Reader) (
+	ed25519.PublicKey, error) {
+	fmt.Printf("%"+strconv.Itoa(rightJustify)+"v: ", aurora.Bold(prompt))
+	text, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	text = strings.TrimSpace(text)
+	pubKeyBytes, err := base64.StdEncoding.DecodeString(text)
+	if err == nil && len(pubKeyBytes) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(pubKeyBytes), nil
+	}
+
+	record, _, err := wallet.ResolveName(text)
+	if err == ErrNameResolutionUnavailable {
+		// it's more likely a mistyped key than a name
+		return nil, fmt.Errorf("Invalid public key")
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("%"+strconv.Itoa(rightJustify)+"v  %s is registered to %s (expires at height %d)\n", "",
+		text, aurora.Bold(base64.StdEncoding.EncodeToString(record.PublicKey)), record.ExpiresHeight)
+	ok, err := promptForConfirmation("Send to this key?", true, reader)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Cancelled")
+	}
+	return record.PublicKey, nil
+}
+
 func promptForValue(prompt string, rightJustify int, reader *bufio.Reader) (int64, error) {
 	fmt.Printf("%"+strconv.Itoa(rightJustify)+"v: ", aurora.Bold(prompt))
 	text, err := reader.ReadString('\n')
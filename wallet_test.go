@@ -5,8 +5,13 @@ package cruzbit
 
 import (
 	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"golang.org/x/crypto/ed25519"
 )
 
@@ -29,3 +34,74 @@ func TestPrivateKeyEncryption(t *testing.T) {
 		t.Fatal("Private key mismatch after decryption")
 	}
 }
+
+func TestWalletLateNameResolution(t *testing.T) {
+	timeout := resolveNameTimeout
+	resolveNameTimeout = 200 * time.Millisecond
+	defer func() { resolveNameTimeout = timeout }()
+
+	// a peer which is slow to resolve some names
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var body json.RawMessage
+			m := Message{Body: &body}
+			if err := conn.ReadJSON(&m); err != nil {
+				return
+			}
+			var reply Message
+			switch m.Type {
+			case "resolve_name":
+				var rn ResolveNameMessage
+				if err := json.Unmarshal(body, &rn); err != nil {
+					return
+				}
+				if rn.Name != "bob" {
+					// replies after the wallet gives up but before the following request times out
+					time.Sleep(300 * time.Millisecond)
+				}
+				reply = Message{Type: "resolved_name", Body: ResolvedNameMessage{Name: rn.Name, Height: 1}}
+			case "get_balance":
+				reply = Message{Type: "balance", Body: BalanceMessage{Balance: 42, Height: 1}}
+			}
+			if err := conn.WriteJSON(reply); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	w := &Wallet{}
+	if err := w.Connect(server.Listener.Addr().String(), BlockID{}, false); err != nil {
+		t.Fatal(err)
+	}
+	w.Run()
+	defer func() {
+		w.conn.Close()
+		w.wg.Wait()
+	}()
+
+	if _, _, err := w.ResolveName("alice"); err != ErrNameResolutionUnavailable {
+		t.Fatalf("Expected name resolution to time out, found %v", err)
+	}
+
+	// the late reply for alice isn't mistaken for bob's
+	_, height, err := w.ResolveName("bob")
+	if err != nil || height != 1 {
+		t.Fatalf("Expected bob to resolve, found %d %v", height, err)
+	}
+
+	// nor for the result of another request
+	if _, _, err := w.ResolveName("carol"); err != ErrNameResolutionUnavailable {
+		t.Fatalf("Expected name resolution to time out, found %v", err)
+	}
+	balance, _, err := w.GetBalance(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil || balance != 42 {
+		t.Fatalf("Expected balance of 42, found %d %v", balance, err)
+	}
+}